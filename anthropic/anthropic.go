@@ -0,0 +1,756 @@
+// anthropic package provides middleware for partial compatibility with the Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+)
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// MessagesRequest is a request to create a message
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	Messages      []MessageParam  `json:"messages"`
+	System        Content         `json:"system,omitempty"`
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	TopK          *int            `json:"top_k,omitempty"`
+	Tools         []Tool          `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice     `json:"tool_choice,omitempty"`
+	Thinking      *ThinkingConfig `json:"thinking,omitempty"`
+}
+
+type MessageParam struct {
+	Role    string  `json:"role"`
+	Content Content `json:"content"`
+}
+
+// Content is a list of content blocks. It can be written in JSON as a
+// string, which is a single text block.
+type Content []ContentBlock
+
+func (c *Content) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*c = Content{{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return errors.New("content must be a string or a list of content blocks")
+	}
+
+	*c = blocks
+	return nil
+}
+
+// ContentBlock is a block of text, an image, a tool call or its result, or
+// the model's thinking. The fields used depend on Type.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// Text is the text of a text block
+	Text string `json:"text,omitempty"`
+
+	// Source is the data of an image block
+	Source *ImageSource `json:"source,omitempty"`
+
+	// ID, Name and Input describe a tool_use block
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+
+	// ToolUseID, Content and IsError describe a tool_result block
+	ToolUseID string  `json:"tool_use_id,omitempty"`
+	Content   Content `json:"content,omitempty"`
+	IsError   bool    `json:"is_error,omitempty"`
+
+	// Thinking and Signature describe a thinking block
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// MarshalJSON writes only the fields of the block's type, including ones
+// that are empty, as in a text block that is about to be streamed.
+func (b ContentBlock) MarshalJSON() ([]byte, error) {
+	switch b.Type {
+	case "text":
+		return json.Marshal(struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{b.Type, b.Text})
+	case "tool_use":
+		input := b.Input
+		if input == nil {
+			input = map[string]any{}
+		}
+		return json.Marshal(struct {
+			Type  string `json:"type"`
+			ID    string `json:"id"`
+			Name  string `json:"name"`
+			Input any    `json:"input"`
+		}{b.Type, b.ID, b.Name, input})
+	case "thinking":
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			Thinking  string `json:"thinking"`
+			Signature string `json:"signature"`
+		}{b.Type, b.Thinking, b.Signature})
+	}
+
+	type block ContentBlock
+	return json.Marshal(block(b))
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+type ThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// MessagesResponse is a message created by the model
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+// Stream events
+type MessageStartEvent struct {
+	Type    string           `json:"type"`
+	Message MessagesResponse `json:"message"`
+}
+
+type ContentBlockStartEvent struct {
+	Type         string       `json:"type"`
+	Index        int          `json:"index"`
+	ContentBlock ContentBlock `json:"content_block"`
+}
+
+type ContentBlockDeltaEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Delta Delta  `json:"delta"`
+}
+
+// Delta is the next part of a content block: text for text_delta,
+// partial_json for input_json_delta or thinking for thinking_delta
+type Delta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+}
+
+type ContentBlockStopEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+}
+
+type MessageDeltaEvent struct {
+	Type  string       `json:"type"`
+	Delta MessageDelta `json:"delta"`
+	Usage Usage        `json:"usage"`
+}
+
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+type MessageStopEvent struct {
+	Type string `json:"type"`
+}
+
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		etype = "overloaded_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+func randomID(prefix string) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return prefix + string(b)
+}
+
+func fromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	if r.Model == "" {
+		return nil, errors.New("model: field required")
+	}
+
+	if r.MaxTokens <= 0 {
+		return nil, errors.New("max_tokens: field required")
+	}
+
+	if len(r.Messages) == 0 {
+		return nil, errors.New("messages: at least one message is required")
+	}
+
+	var messages []api.Message
+	if len(r.System) > 0 {
+		var system []string
+		for _, block := range r.System {
+			if block.Type != "text" {
+				return nil, fmt.Errorf("system: unsupported content block type %q", block.Type)
+			}
+			system = append(system, block.Text)
+		}
+		messages = append(messages, api.Message{Role: "system", Content: strings.Join(system, "\n\n")})
+	}
+
+	for _, m := range r.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return nil, fmt.Errorf("messages: unexpected role %q", m.Role)
+		}
+
+		msgs, err := fromMessageParam(m)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+	}
+
+	options := map[string]any{
+		"num_predict": r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.InputSchema) > 0 {
+			if err := json.Unmarshal(t.InputSchema, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("tools: invalid input_schema for %q", t.Name)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	req := api.ChatRequest{
+		Model:          r.Model,
+		Messages:       messages,
+		Tools:          tools,
+		Options:        options,
+		Stream:         &r.Stream,
+		ToolCallDeltas: r.Stream,
+	}
+
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Type {
+		case "auto":
+			req.ToolChoice = &api.ToolChoice{Mode: api.ToolChoiceAuto}
+		case "any":
+			req.ToolChoice = &api.ToolChoice{Mode: api.ToolChoiceRequired}
+		case "tool":
+			req.ToolChoice = &api.ToolChoice{Mode: api.ToolChoiceFunction, Function: r.ToolChoice.Name}
+		case "none":
+			req.ToolChoice = &api.ToolChoice{Mode: api.ToolChoiceNone}
+		default:
+			return nil, fmt.Errorf("tool_choice: unsupported type %q", r.ToolChoice.Type)
+		}
+
+		if r.ToolChoice.DisableParallelToolUse {
+			parallel := false
+			req.ParallelToolCalls = &parallel
+		}
+	}
+
+	if r.Thinking != nil {
+		think := r.Thinking.Type == "enabled"
+		req.Think = &think
+	}
+
+	return &req, nil
+}
+
+// fromMessageParam converts a message to native messages. Tool results
+// become tool messages, ahead of any other content in the message.
+func fromMessageParam(m MessageParam) ([]api.Message, error) {
+	var messages []api.Message
+	msg := api.Message{Role: m.Role}
+	var text []string
+	for _, block := range m.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "image":
+			img, err := fromImageSource(block.Source)
+			if err != nil {
+				return nil, err
+			}
+			msg.Images = append(msg.Images, img)
+		case "tool_use":
+			args, ok := block.Input.(map[string]any)
+			if !ok && block.Input != nil {
+				return nil, fmt.Errorf("invalid input for tool_use %q", block.ID)
+			}
+
+			tc := api.ToolCall{ID: block.ID}
+			tc.Function.Name = block.Name
+			tc.Function.Arguments = args
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		case "tool_result":
+			result := api.Message{Role: "tool"}
+			var content []string
+			for _, c := range block.Content {
+				switch c.Type {
+				case "text":
+					content = append(content, c.Text)
+				case "image":
+					img, err := fromImageSource(c.Source)
+					if err != nil {
+						return nil, err
+					}
+					result.Images = append(result.Images, img)
+				default:
+					return nil, fmt.Errorf("tool_result: unsupported content block type %q", c.Type)
+				}
+			}
+			result.Content = strings.Join(content, "\n\n")
+			messages = append(messages, result)
+		case "thinking":
+			msg.Thinking += block.Thinking
+		case "redacted_thinking":
+			// encrypted thinking from other models is not useful here
+		default:
+			return nil, fmt.Errorf("unsupported content block type %q", block.Type)
+		}
+	}
+
+	msg.Content = strings.Join(text, "\n\n")
+	if msg.Content != "" || msg.Thinking != "" || len(msg.Images) > 0 || len(msg.ToolCalls) > 0 || len(messages) == 0 {
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+func fromImageSource(source *ImageSource) (api.ImageData, error) {
+	if source == nil {
+		return nil, errors.New("image: source is required")
+	}
+
+	if source.Type != "base64" {
+		return nil, fmt.Errorf("image: unsupported source type %q", source.Type)
+	}
+
+	switch source.MediaType {
+	case "image/jpeg", "image/png":
+	default:
+		return nil, fmt.Errorf("image: unsupported media type %q", source.MediaType)
+	}
+
+	img, err := base64.StdEncoding.DecodeString(source.Data)
+	if err != nil {
+		return nil, errors.New("image: invalid base64 data")
+	}
+
+	return img, nil
+}
+
+func toStopReason(r api.ChatResponse, toolUse bool) *string {
+	var reason string
+	switch {
+	case toolUse:
+		reason = "tool_use"
+	case r.StopSequence != "":
+		reason = "stop_sequence"
+	case r.DoneReason == "length":
+		reason = "max_tokens"
+	case r.DoneReason != "":
+		reason = "end_turn"
+	default:
+		return nil
+	}
+	return &reason
+}
+
+// toStopSequence returns the stop sequence that ended the response, if any
+func toStopSequence(r api.ChatResponse) *string {
+	if r.StopSequence == "" {
+		return nil
+	}
+	return &r.StopSequence
+}
+
+// toolUseID returns the ID of a tool call, minting one if the model's
+// output didn't give it one
+func toolUseID(tc api.ToolCall) string {
+	if tc.ID != "" {
+		return tc.ID
+	}
+	return randomID("toolu_")
+}
+
+func toUsage(r api.ChatResponse) Usage {
+	return Usage{
+		InputTokens:  r.PromptEvalCount,
+		OutputTokens: r.EvalCount,
+	}
+}
+
+func toMessagesResponse(id string, r api.ChatResponse) MessagesResponse {
+	content := []ContentBlock{}
+	if r.Message.Thinking != "" {
+		content = append(content, ContentBlock{Type: "thinking", Thinking: r.Message.Thinking})
+	}
+
+	if r.Message.Content != "" {
+		content = append(content, ContentBlock{Type: "text", Text: r.Message.Content})
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		content = append(content, ContentBlock{
+			Type:  "tool_use",
+			ID:    toolUseID(tc),
+			Name:  tc.Function.Name,
+			Input: map[string]any(tc.Function.Arguments),
+		})
+	}
+
+	return MessagesResponse{
+		ID:           id,
+		Type:         "message",
+		Role:         "assistant",
+		Model:        r.Model,
+		Content:      content,
+		StopReason:   toStopReason(r, len(r.Message.ToolCalls) > 0),
+		StopSequence: toStopSequence(r),
+		Usage:        toUsage(r),
+	}
+}
+
+type MessagesWriter struct {
+	gin.ResponseWriter
+	stream bool
+	id     string
+
+	started bool
+	// the type of the block being streamed, if any
+	block string
+	// blocks is the number of blocks started
+	blocks int
+	// indexes of the blocks of tool calls by their native index
+	toolUses map[int]int
+}
+
+func (w *MessagesWriter) writeError(data []byte) (int, error) {
+	var serr api.StatusError
+	err := json.Unmarshal(data, &serr)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(w.ResponseWriter.Status(), serr.Error()))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) writeEvent(event string, data any) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, d)))
+	return err
+}
+
+// startBlock stops the block being streamed and starts a new one
+func (w *MessagesWriter) startBlock(block ContentBlock) error {
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+
+	w.block = block.Type
+	w.blocks++
+	return w.writeEvent("content_block_start", ContentBlockStartEvent{
+		Type:         "content_block_start",
+		Index:        w.blocks - 1,
+		ContentBlock: block,
+	})
+}
+
+func (w *MessagesWriter) stopBlock() error {
+	if w.block == "" {
+		return nil
+	}
+
+	w.block = ""
+	return w.writeEvent("content_block_stop", ContentBlockStopEvent{Type: "content_block_stop", Index: w.blocks - 1})
+}
+
+func (w *MessagesWriter) writeDelta(delta Delta) error {
+	return w.writeEvent("content_block_delta", ContentBlockDeltaEvent{
+		Type:  "content_block_delta",
+		Index: w.blocks - 1,
+		Delta: delta,
+	})
+}
+
+func (w *MessagesWriter) writeChunk(r api.ChatResponse) error {
+	if !w.started {
+		w.started = true
+		if err := w.writeEvent("message_start", MessageStartEvent{
+			Type: "message_start",
+			Message: MessagesResponse{
+				ID:      w.id,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   r.Model,
+				Content: []ContentBlock{},
+				Usage:   Usage{InputTokens: r.PromptEvalCount},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Thinking != "" {
+		if w.block != "thinking" {
+			if err := w.startBlock(ContentBlock{Type: "thinking"}); err != nil {
+				return err
+			}
+		}
+
+		if err := w.writeDelta(Delta{Type: "thinking_delta", Thinking: r.Message.Thinking}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Content != "" {
+		if w.block != "text" {
+			if err := w.startBlock(ContentBlock{Type: "text"}); err != nil {
+				return err
+			}
+		}
+
+		if err := w.writeDelta(Delta{Type: "text_delta", Text: r.Message.Content}); err != nil {
+			return err
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		arguments := tc.Function.ArgumentsDelta
+		if _, ok := w.toolUses[tc.Function.Index]; !ok {
+			if err := w.startBlock(ContentBlock{Type: "tool_use", ID: toolUseID(tc), Name: tc.Function.Name}); err != nil {
+				return err
+			}
+
+			if w.toolUses == nil {
+				w.toolUses = make(map[int]int)
+			}
+			w.toolUses[tc.Function.Index] = w.blocks - 1
+
+			// calls that were not streamed arrive with all of their arguments
+			if arguments == "" && tc.Function.Arguments != nil {
+				b, err := json.Marshal(tc.Function.Arguments)
+				if err != nil {
+					return err
+				}
+				arguments = string(b)
+			}
+		}
+
+		// fragments of arguments only follow the start of their call
+		if arguments != "" && w.block == "tool_use" && w.toolUses[tc.Function.Index] == w.blocks-1 {
+			if err := w.writeDelta(Delta{Type: "input_json_delta", PartialJSON: arguments}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.Done {
+		if err := w.stopBlock(); err != nil {
+			return err
+		}
+
+		if err := w.writeEvent("message_delta", MessageDeltaEvent{
+			Type:  "message_delta",
+			Delta: MessageDelta{StopReason: toStopReason(r, len(w.toolUses) > 0), StopSequence: toStopSequence(r)},
+			Usage: toUsage(r),
+		}); err != nil {
+			return err
+		}
+
+		return w.writeEvent("message_stop", MessageStopEvent{Type: "message_stop"})
+	}
+
+	return nil
+}
+
+func (w *MessagesWriter) writeResponse(data []byte) (int, error) {
+	var chatResponse struct {
+		api.ChatResponse
+		Error string `json:"error"`
+	}
+	err := json.Unmarshal(data, &chatResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.stream {
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+
+		// errors after the stream has started are sent as events
+		if chatResponse.Error != "" {
+			if err := w.writeEvent("error", NewError(http.StatusInternalServerError, chatResponse.Error)); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}
+
+		if err := w.writeChunk(chatResponse.ChatResponse); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(toMessagesResponse(w.id, chatResponse.ChatResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// MessagesMiddleware translates Anthropic Messages API requests to chat
+// requests and their responses back
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		chatReq, err := fromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &MessagesWriter{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			id:             randomID("msg_"),
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
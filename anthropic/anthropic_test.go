@@ -0,0 +1,461 @@
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/qompassai/rose/api"
+)
+
+const image = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNk+A8AAQUBAScY42YAAAAASUVORK5CYII=`
+
+var (
+	False = false
+	True  = true
+)
+
+func captureRequestMiddleware(capturedRequest any) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bodyBytes, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		err := json.Unmarshal(bodyBytes, capturedRequest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "failed to unmarshal request")
+		}
+		c.Next()
+	}
+}
+
+func TestMessagesMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.ChatRequest
+		err  ErrorResponse
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	img, _ := base64.StdEncoding.DecodeString(image)
+
+	weather := api.Tool{Type: "function"}
+	weather.Function.Name = "get_weather"
+	weather.Function.Description = "Get the current weather"
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["location"],
+		"properties": {
+			"location": {"type": "string", "description": "The city and state"}
+		}
+	}`), &weather.Function.Parameters); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name: "messages handler",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 1024.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "messages handler with system and options",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"system": [{"type": "text", "text": "You are a helpful assistant."}],
+				"messages": [
+					{"role": "user", "content": [{"type": "text", "text": "Hello"}]}
+				],
+				"stop_sequences": ["\n", "stop"],
+				"temperature": 0.5,
+				"top_p": 0.9,
+				"top_k": 40,
+				"stream": true,
+				"thinking": {"type": "enabled", "budget_tokens": 2048}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant."},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+					"stop":        []any{"\n", "stop"},
+					"temperature": 0.5,
+					"top_p":       0.9,
+					"top_k":       40.0,
+				},
+				Stream:         &True,
+				ToolCallDeltas: true,
+				Think:          &True,
+			},
+		},
+		{
+			name: "messages handler with image",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"messages": [
+					{
+						"role": "user",
+						"content": [
+							{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "` + image + `"}},
+							{"type": "text", "text": "What is in this image?"}
+						]
+					}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "What is in this image?", Images: []api.ImageData{img}},
+				},
+				Options: map[string]any{
+					"num_predict": 1024.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "messages handler with tools",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"tools": [
+					{
+						"name": "get_weather",
+						"description": "Get the current weather",
+						"input_schema": {
+							"type": "object",
+							"required": ["location"],
+							"properties": {
+								"location": {"type": "string", "description": "The city and state"}
+							}
+						}
+					}
+				],
+				"tool_choice": {"type": "tool", "name": "get_weather", "disable_parallel_tool_use": true},
+				"messages": [
+					{"role": "user", "content": "What's the weather like in Paris?"},
+					{
+						"role": "assistant",
+						"content": [
+							{"type": "thinking", "thinking": "I should check the weather.", "signature": ""},
+							{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"location": "Paris, France"}}
+						]
+					},
+					{
+						"role": "user",
+						"content": [
+							{"type": "tool_result", "tool_use_id": "toolu_01", "content": "Sunny, 22C"},
+							{"type": "text", "text": "Thanks!"}
+						]
+					}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather like in Paris?"},
+					{
+						Role:     "assistant",
+						Thinking: "I should check the weather.",
+						ToolCalls: []api.ToolCall{
+							{
+								ID: "toolu_01",
+								Function: api.ToolCallFunction{
+									Name:      "get_weather",
+									Arguments: api.ToolCallFunctionArguments{"location": "Paris, France"},
+								},
+							},
+						},
+					},
+					{Role: "tool", Content: "Sunny, 22C"},
+					{Role: "user", Content: "Thanks!"},
+				},
+				Tools:             []api.Tool{weather},
+				ToolChoice:        &api.ToolChoice{Mode: api.ToolChoiceFunction, Function: "get_weather"},
+				ParallelToolCalls: &False,
+				Options: map[string]any{
+					"num_predict": 1024.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "missing max_tokens",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: "max_tokens: field required",
+				},
+			},
+		},
+		{
+			name: "image url",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"messages": [
+					{"role": "user", "content": [{"type": "image", "source": {"type": "url", "url": "https://example.com/image.png"}}]}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: `image: unsupported source type "url"`,
+				},
+			},
+		},
+		{
+			name: "unsupported content block",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 1024,
+				"messages": [
+					{"role": "user", "content": [{"type": "document"}]}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: `unsupported content block type "document"`,
+				},
+			},
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MessagesMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			defer func() { capturedRequest = nil }()
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var errResp ErrorResponse
+			if resp.Code != http.StatusOK {
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+			} else if diff := cmp.Diff(&tc.req, capturedRequest); diff != "" {
+				t.Fatalf("requests did not match: %+v", diff)
+			}
+
+			if diff := cmp.Diff(tc.err, errResp); diff != "" {
+				t.Fatalf("errors did not match for %s:\n%s", tc.name, diff)
+			}
+		})
+	}
+}
+
+func TestMessagesResponse(t *testing.T) {
+	r := api.ChatResponse{
+		Model: "test-model",
+		Message: api.Message{
+			Role:     "assistant",
+			Thinking: "The user wants the weather.",
+			Content:  "Let me check.",
+			ToolCalls: []api.ToolCall{
+				{
+					Function: api.ToolCallFunction{
+						Name:      "get_weather",
+						Arguments: api.ToolCallFunctionArguments{"location": "Paris"},
+					},
+				},
+			},
+		},
+		Done:       true,
+		DoneReason: "stop",
+		Metrics:    api.Metrics{PromptEvalCount: 10, EvalCount: 5},
+	}
+
+	resp := toMessagesResponse("msg_1", r)
+	if len(resp.Content) != 3 {
+		t.Fatalf("expected 3 content blocks, got %d", len(resp.Content))
+	}
+
+	if !strings.HasPrefix(resp.Content[2].ID, "toolu_") {
+		t.Errorf("expected a tool use id, got %q", resp.Content[2].ID)
+	}
+	resp.Content[2].ID = "toolu_1"
+
+	got, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"id":"msg_1","type":"message","role":"assistant","model":"test-model","content":[` +
+		`{"type":"thinking","thinking":"The user wants the weather.","signature":""},` +
+		`{"type":"text","text":"Let me check."},` +
+		`{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"location":"Paris"}}],` +
+		`"stop_reason":"tool_use","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":5}}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("response did not match:\n%s", diff)
+	}
+
+	r.Message.ToolCalls[0].ID = "toolu_01"
+	if id := toMessagesResponse("msg_1", r).Content[2].ID; id != "toolu_01" {
+		t.Errorf("expected tool use id toolu_01, got %q", id)
+	}
+
+	r.Message = api.Message{Role: "assistant", Content: "Once upon a"}
+	r.DoneReason = "length"
+	if got := *toMessagesResponse("msg_1", r).StopReason; got != "max_tokens" {
+		t.Errorf("expected stop reason max_tokens, got %q", got)
+	}
+
+	r.DoneReason = "stop"
+	r.StopSequence = "\n\n"
+	resp = toMessagesResponse("msg_1", r)
+	if got := *resp.StopReason; got != "stop_sequence" {
+		t.Errorf("expected stop reason stop_sequence, got %q", got)
+	}
+	if resp.StopSequence == nil || *resp.StopSequence != "\n\n" {
+		t.Errorf("expected stop sequence %q, got %v", "\n\n", resp.StopSequence)
+	}
+}
+
+func TestMessagesStream(t *testing.T) {
+	chunks := []api.ChatResponse{
+		{Model: "test-model", Message: api.Message{Role: "assistant", Thinking: "Weather."}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Checking"}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{ID: "call_1", Function: api.ToolCallFunction{Name: "get_weather"}},
+		}}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{Function: api.ToolCallFunction{ArgumentsDelta: `{"location":`}},
+		}}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{ID: "call_1", Function: api.ToolCallFunction{
+				Name:           "get_weather",
+				ArgumentsDelta: `"Paris"}`,
+				Arguments:      api.ToolCallFunctionArguments{"location": "Paris"},
+			}},
+		}}},
+		{Model: "test-model", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 5}},
+	}
+
+	endpoint := func(c *gin.Context) {
+		for _, chunk := range chunks {
+			b, _ := json.Marshal(chunk)
+			c.Writer.Write(append(b, '\n'))
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MessagesMiddleware())
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{
+		"model": "test-model",
+		"max_tokens": 1024,
+		"stream": true,
+		"messages": [{"role": "user", "content": "What's the weather in Paris?"}]
+	}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if ct := resp.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected content type text/event-stream, got %q", ct)
+	}
+
+	var events []string
+	var data []map[string]any
+	for _, event := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+		name, payload, ok := strings.Cut(event, "\ndata: ")
+		if !ok {
+			t.Fatalf("malformed event %q", event)
+		}
+
+		var d map[string]any
+		if err := json.Unmarshal([]byte(payload), &d); err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, strings.TrimPrefix(name, "event: "))
+		data = append(data, d)
+	}
+
+	want := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"message_delta",
+		"message_stop",
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Fatalf("events did not match:\n%s", diff)
+	}
+
+	for i, event := range events {
+		if data[i]["type"] != event {
+			t.Errorf("expected event %s to have type %s, got %v", event, event, data[i]["type"])
+		}
+	}
+
+	if block := data[7]["content_block"].(map[string]any); block["type"] != "tool_use" || block["id"] != "call_1" || block["name"] != "get_weather" || data[7]["index"] != 2.0 {
+		t.Errorf("unexpected tool use block %v", data[7])
+	}
+
+	var arguments string
+	for _, d := range data[8:10] {
+		arguments += d["delta"].(map[string]any)["partial_json"].(string)
+	}
+	if arguments != `{"location":"Paris"}` {
+		t.Errorf("expected arguments to be streamed, got %q", arguments)
+	}
+
+	if reason := data[11]["delta"].(map[string]any)["stop_reason"]; reason != "tool_use" {
+		t.Errorf("expected stop reason tool_use, got %v", reason)
+	}
+}
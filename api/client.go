@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -35,6 +36,9 @@ import (
 type Client struct {
 	base *url.URL
 	http *http.Client
+
+	// apiKey is sent to servers that require API keys
+	apiKey string
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -46,8 +50,18 @@ func checkError(resp *http.Response, body []byte) error {
 
 	err := json.Unmarshal(body, &apiError)
 	if err != nil {
-		// Use the full body as the message if we fail to decode a response.
-		apiError.ErrorMessage = string(body)
+		// OpenAI compatible endpoints return errors as objects
+		var openaiError struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &openaiError); err == nil && openaiError.Error.Message != "" {
+			apiError.ErrorMessage = openaiError.Error.Message
+		} else {
+			// Use the full body as the message if we fail to decode a response.
+			apiError.ErrorMessage = string(body)
+		}
 	}
 
 	return apiError
@@ -61,11 +75,12 @@ func checkError(resp *http.Response, body []byte) error {
 //	<scheme>://<host>:<port>
 //
 // If the variable is not specified, a default rose host and port will be
-// used.
+// used. The API key in ROSE_API_KEY, if set, is sent with every request.
 func ClientFromEnvironment() (*Client, error) {
 	return &Client{
-		base: envconfig.Host(),
-		http: http.DefaultClient,
+		base:   envconfig.Host(),
+		http:   http.DefaultClient,
+		apiKey: envconfig.APIKey(),
 	}, nil
 }
 
@@ -96,15 +111,24 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 		reqBody = bytes.NewReader(data)
 	}
 
+	return c.send(ctx, method, path, "application/json", reqBody, respData)
+}
+
+// send makes a request with a body of the given content type. The response
+// is decoded into respData as JSON, or copied to it if it is an io.Writer.
+func (c *Client) send(ctx context.Context, method, path, contentType string, reqBody io.Reader, respData any) error {
 	requestURL := c.base.JoinPath(path)
 	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
 	if err != nil {
 		return err
 	}
 
-	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-Type", contentType)
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("rose/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
@@ -112,6 +136,11 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	}
 	defer respObj.Body.Close()
 
+	if w, ok := respData.(io.Writer); ok && respObj.StatusCode < http.StatusBadRequest {
+		_, err := io.Copy(w, respObj.Body)
+		return err
+	}
+
 	respBody, err := io.ReadAll(respObj.Body)
 	if err != nil {
 		return err
@@ -151,6 +180,9 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("rose/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	response, err := c.http.Do(request)
 	if err != nil {
@@ -324,6 +356,12 @@ func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	return nil
 }
 
+// Cancel stops a generate, chat or embed request, whether it is waiting for
+// a model or running.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/api/cancel", &CancelRequest{ID: id}, nil)
+}
+
 // Show obtains model information, including details, modelfile, license etc.
 func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
 	var resp ShowResponse
@@ -351,6 +389,37 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Rerank scores documents by how relevant they are to a query, using a
+// reranking model.
+func (c *Client) Rerank(ctx context.Context, req *RerankRequest) (*RerankResponse, error) {
+	var resp RerankResponse
+	if err := c.do(ctx, http.MethodPost, "/api/rerank", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SaveCache processes a prompt and saves the model's cache for it to disk, so
+// that later prompts starting with it can skip processing it, even after the
+// model is reloaded.
+func (c *Client) SaveCache(ctx context.Context, req *CacheRequest) (*CacheResponse, error) {
+	var resp CacheResponse
+	if err := c.do(ctx, http.MethodPost, "/api/cache/save", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RestoreCache loads the longest cache saved with [Client.SaveCache] for the
+// start of a prompt into the model's cache.
+func (c *Client) RestoreCache(ctx context.Context, req *CacheRequest) (*CacheResponse, error) {
+	var resp CacheResponse
+	if err := c.do(ctx, http.MethodPost, "/api/cache/restore", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
@@ -360,12 +429,92 @@ func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*Embedd
 	return &resp, nil
 }
 
+// Tokenize converts text into token IDs using the model's vocabulary.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize converts token IDs back into text using the model's vocabulary.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // CreateBlob creates a blob from a file on the server. digest is the
 // expected SHA256 digest of the file, and r represents the file.
 func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) error {
 	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/blobs/%s", digest), r, nil)
 }
 
+// CreateFile uploads a file for use as the input of a batch. name is the
+// file's name and r its content.
+func (c *Client) CreateFile(ctx context.Context, name string, r io.Reader) (*File, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("purpose", "batch")
+		if err == nil {
+			var part io.Writer
+			part, err = mw.CreateFormFile("file", name)
+			if err == nil {
+				_, err = io.Copy(part, r)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var resp File
+	if err := c.send(ctx, http.MethodPost, "/v1/files", mw.FormDataContentType(), pr, &resp); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FileContent writes the content of a file, such as the output of a batch,
+// to w.
+func (c *Client) FileContent(ctx context.Context, id string, w io.Writer) error {
+	return c.send(ctx, http.MethodGet, fmt.Sprintf("/v1/files/%s/content", id), "application/json", nil, w)
+}
+
+// CreateBatch starts running the requests in a file in the background.
+func (c *Client) CreateBatch(ctx context.Context, req *BatchRequest) (*Batch, error) {
+	var resp Batch
+	if err := c.do(ctx, http.MethodPost, "/v1/batches", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Batch returns the status of a batch.
+func (c *Client) Batch(ctx context.Context, id string) (*Batch, error) {
+	var resp Batch
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/v1/batches/%s", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelBatch stops a batch. Requests that have already run are kept in its
+// output.
+func (c *Client) CancelBatch(ctx context.Context, id string) (*Batch, error) {
+	var resp Batch
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/batches/%s/cancel", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Version returns the Rose server version as a string.
 func (c *Client) Version(ctx context.Context) (string, error) {
 	var version struct {
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
@@ -75,10 +76,34 @@ type GenerateRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the priority of the request when it waits for a model,
+	// either "interactive" (the default) or "batch".
+	Priority string `json:"priority,omitempty"`
+
+	// Timeout is how long the server has to complete the request, including
+	// waiting for the model to load.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// DraftModel is a smaller model to propose tokens for the model to
+	// verify, replacing the draft model in its Modelfile, if any.
+	DraftModel string `json:"draft_model,omitempty"`
+
 	// Images is an optional list of base64-encoded images accompanying this
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
 
+	// Logprobs requests the log-probability of each generated token.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely alternative tokens to return
+	// with each generated token, up to 20. Setting it implies Logprobs.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// Think controls whether a model that supports thinking reasons before
+	// it answers. Its reasoning is returned separately from the response,
+	// and by default it thinks if the model does so unprompted.
+	Think *bool `json:"think,omitempty"`
+
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
@@ -102,15 +127,119 @@ type ChatRequest struct {
 	// following the request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the priority of the request when it waits for a model,
+	// either "interactive" (the default) or "batch".
+	Priority string `json:"priority,omitempty"`
+
+	// Timeout is how long the server has to complete the request, including
+	// waiting for the model to load.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// DraftModel is a smaller model to propose tokens for the model to
+	// verify, replacing the draft model in its Modelfile, if any.
+	DraftModel string `json:"draft_model,omitempty"`
+
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// ToolChoice controls whether and which tools the model calls. The
+	// model decides when it is not set.
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
+	// ParallelToolCalls allows the model to call more than one tool in a
+	// response; true by default.
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+
+	// ToolCallDeltas streams tool calls as they are generated, with
+	// fragments of their arguments in [ToolCallFunction.ArgumentsDelta],
+	// rather than sending each call once it is complete.
+	ToolCallDeltas bool `json:"tool_call_deltas,omitempty"`
+
+	// Logprobs requests the log-probability of each generated token.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely alternative tokens to return
+	// with each generated token, as in [GenerateRequest].
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// Think controls whether the model thinks, as in [GenerateRequest].
+	Think *bool `json:"think,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
 
 type Tools []Tool
 
+const (
+	// ToolChoiceNone prevents the model from calling tools.
+	ToolChoiceNone = "none"
+	// ToolChoiceAuto lets the model decide whether to call tools.
+	ToolChoiceAuto = "auto"
+	// ToolChoiceRequired makes the model call at least one tool.
+	ToolChoiceRequired = "required"
+	// ToolChoiceFunction makes the model call the function named by
+	// [ToolChoice.Function].
+	ToolChoiceFunction = "function"
+)
+
+// ToolChoice controls whether and which tools the model calls in a
+// [ChatRequest]. It is written in JSON either as one of "none", "auto" or
+// "required", or as an object naming a function, as in
+// {"type": "function", "function": {"name": "get_weather"}}.
+type ToolChoice struct {
+	// Mode is one of [ToolChoiceNone], [ToolChoiceAuto], [ToolChoiceRequired]
+	// or [ToolChoiceFunction].
+	Mode string
+
+	// Function is the name of the function the model must call when Mode
+	// is [ToolChoiceFunction].
+	Function string
+}
+
+type toolChoiceFunction struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+	} `json:"function"`
+}
+
+func (t ToolChoice) MarshalJSON() ([]byte, error) {
+	if t.Mode != ToolChoiceFunction {
+		return json.Marshal(t.Mode)
+	}
+
+	var f toolChoiceFunction
+	f.Type = "function"
+	f.Function.Name = t.Function
+	return json.Marshal(f)
+}
+
+func (t *ToolChoice) UnmarshalJSON(b []byte) error {
+	var mode string
+	if err := json.Unmarshal(b, &mode); err == nil {
+		switch mode {
+		case ToolChoiceNone, ToolChoiceAuto, ToolChoiceRequired:
+			*t = ToolChoice{Mode: mode}
+			return nil
+		default:
+			return fmt.Errorf("invalid tool_choice %q", mode)
+		}
+	}
+
+	var f toolChoiceFunction
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("invalid tool_choice: %w", err)
+	}
+
+	if f.Type != "function" || f.Function.Name == "" {
+		return errors.New("invalid tool_choice: expected a function name")
+	}
+
+	*t = ToolChoice{Mode: ToolChoiceFunction, Function: f.Function.Name}
+	return nil
+}
+
 func (t Tools) String() string {
 	bts, _ := json.Marshal(t)
 	return string(bts)
@@ -125,8 +254,11 @@ func (t Tool) String() string {
 // role ("system", "user", or "assistant"), the content and an optional list
 // of images.
 type Message struct {
-	Role      string      `json:"role"`
-	Content   string      `json:"content"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Thinking is the model's reasoning before its answer in Content, for
+	// models that support thinking.
+	Thinking  string      `json:"thinking,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
 }
@@ -144,6 +276,8 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 }
 
 type ToolCall struct {
+	// ID identifies a tool call across the chunks of a streamed response
+	ID       string           `json:"id,omitempty"`
 	Function ToolCallFunction `json:"function"`
 }
 
@@ -151,6 +285,10 @@ type ToolCallFunction struct {
 	Index     int                       `json:"index,omitempty"`
 	Name      string                    `json:"name"`
 	Arguments ToolCallFunctionArguments `json:"arguments"`
+
+	// ArgumentsDelta is the next fragment of the call's arguments as JSON
+	// text when tool calls are streamed
+	ArgumentsDelta string `json:"arguments_delta,omitempty"`
 }
 
 type ToolCallFunctionArguments map[string]any
@@ -172,9 +310,13 @@ type ToolFunction struct {
 		Type       string   `json:"type"`
 		Required   []string `json:"required"`
 		Properties map[string]struct {
-			Type        string   `json:"type"`
-			Description string   `json:"description"`
-			Enum        []string `json:"enum,omitempty"`
+			Type        string          `json:"type"`
+			Description string          `json:"description"`
+			Enum        []string        `json:"enum,omitempty"`
+			Items       json.RawMessage `json:"items,omitempty"`
+			Properties  json.RawMessage `json:"properties,omitempty"`
+			Required    []string        `json:"required,omitempty"`
+			AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 		} `json:"properties"`
 	} `json:"parameters"`
 }
@@ -187,16 +329,41 @@ func (t *ToolFunction) String() string {
 // ChatResponse is the response returned by [Client.Chat]. Its fields are
 // similar to [GenerateResponse].
 type ChatResponse struct {
+	// RequestID identifies the request so it can be cancelled with
+	// [Client.Cancel]. It is only set on the first response of a stream.
+	RequestID string `json:"request_id,omitempty"`
+
 	Model      string    `json:"model"`
 	CreatedAt  time.Time `json:"created_at"`
 	Message    Message   `json:"message"`
 	DoneReason string    `json:"done_reason,omitempty"`
 
+	// StopSequence is the stop sequence from [Options.Stop] that ended the
+	// response, if any. It is only set on the final response.
+	StopSequence string `json:"stop_sequence,omitempty"`
+
 	Done bool `json:"done"`
 
+	// Logprobs holds the log-probabilities of the tokens in this chunk when
+	// requested with [ChatRequest.Logprobs].
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Metrics
 }
 
+// TokenLogprob is the log-probability of a single token.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// Logprob is the log-probability of a generated token together with the
+// most likely alternatives the model considered at that position.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -228,6 +395,24 @@ type Options struct {
 	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// DRY ("Don't Repeat Yourself") penalizes tokens that would extend a
+	// sequence that already appears in the context
+	DRYMultiplier       float32  `json:"dry_multiplier,omitempty"`
+	DRYBase             float32  `json:"dry_base,omitempty"`
+	DRYAllowedLength    int      `json:"dry_allowed_length,omitempty"`
+	DRYSequenceBreakers []string `json:"dry_sequence_breakers,omitempty"`
+
+	// XTC ("Exclude Top Choices") removes the most likely tokens
+	XTCThreshold   float32 `json:"xtc_threshold,omitempty"`
+	XTCProbability float32 `json:"xtc_probability,omitempty"`
+
+	// LogitBias is added to the logits of the given token ids before sampling
+	LogitBias map[int]float32 `json:"logit_bias,omitempty"`
+
+	// NumDraft is the number of tokens the draft model proposes at a time,
+	// for models with one. Zero disables speculative decoding.
+	NumDraft int `json:"num_draft,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -257,6 +442,14 @@ type EmbedRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the priority of the request when it waits for a model,
+	// either "interactive" (the default) or "batch".
+	Priority string `json:"priority,omitempty"`
+
+	// Timeout is how long the server has to complete the request, including
+	// waiting for the model to load.
+	Timeout *Duration `json:"timeout,omitempty"`
+
 	Truncate *bool `json:"truncate,omitempty"`
 
 	// Options lists model-specific options.
@@ -273,6 +466,89 @@ type EmbedResponse struct {
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
+// RerankRequest is the request passed to [Client.Rerank].
+type RerankRequest struct {
+	// Model is the model name, which must be a reranking model.
+	Model string `json:"model"`
+
+	// Query is what the documents are scored against.
+	Query string `json:"query"`
+
+	// Documents are the documents to score.
+	Documents []string `json:"documents"`
+
+	// TopN limits the response to the most relevant documents, if set.
+	TopN int `json:"top_n,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Priority is the priority of the request when it waits for a model,
+	// either "interactive" (the default) or "batch".
+	Priority string `json:"priority,omitempty"`
+
+	// Timeout is how long the server has to complete the request, including
+	// waiting for the model to load.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// RerankResponse is the response from [Client.Rerank].
+type RerankResponse struct {
+	Model string `json:"model"`
+
+	// Results are the documents sorted from most to least relevant.
+	Results []RerankResult `json:"results"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// RerankResult is the score of a document in a [RerankResponse].
+type RerankResult struct {
+	// Index is the position of the document in the request.
+	Index int `json:"index"`
+
+	// RelevanceScore is how relevant the document is to the query, from 0
+	// to 1.
+	RelevanceScore float64 `json:"relevance_score"`
+}
+
+// CacheRequest is the request passed to [Client.SaveCache] and
+// [Client.RestoreCache].
+type CacheRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the start of later prompts, exactly as the model sees them,
+	// such as a long system prompt after applying the model's template.
+	Prompt string `json:"prompt"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// CacheResponse is the response from [Client.SaveCache] and
+// [Client.RestoreCache].
+type CacheResponse struct {
+	Model string `json:"model"`
+
+	// Tokens is the number of tokens of the prompt that were saved, or that
+	// are in the cache after restoring it.
+	Tokens int `json:"tokens"`
+
+	TotalDuration time.Duration `json:"total_duration,omitempty"`
+	LoadDuration  time.Duration `json:"load_duration,omitempty"`
+}
+
 // EmbeddingRequest is the request passed to [Client.Embeddings].
 type EmbeddingRequest struct {
 	// Model is the model name.
@@ -294,6 +570,122 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Content is the text to tokenize.
+	Content string `json:"content"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens is the list of token IDs to convert back to text.
+	Tokens []int `json:"tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model   string `json:"model"`
+	Content string `json:"content"`
+}
+
+// File is a file uploaded with [Client.CreateFile] for use in batches, or
+// the output of a batch.
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+
+	// Purpose is "batch" for files uploaded as the input of a batch and
+	// "batch_output" for the outputs of batches.
+	Purpose string `json:"purpose"`
+}
+
+// BatchRequest is the request passed to [Client.CreateBatch].
+type BatchRequest struct {
+	// InputFileID is the ID of a JSONL file of requests, one per line, in
+	// the form {"custom_id": ..., "method": "POST", "url": ..., "body": ...}.
+	InputFileID string `json:"input_file_id"`
+
+	// Endpoint is the URL of every request in the file, one of
+	// "/v1/chat/completions", "/v1/completions" or "/v1/embeddings".
+	Endpoint string `json:"endpoint"`
+
+	// CompletionWindow is accepted for compatibility and must be "24h".
+	CompletionWindow string `json:"completion_window"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Batch is a batch of requests run in the background. Its status is one of
+// "validating", "in_progress", "finalizing", "completed", "failed",
+// "cancelling" or "cancelled".
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors,omitempty"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     string             `json:"output_file_id,omitempty"`
+	ErrorFileID      string             `json:"error_file_id,omitempty"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     int64              `json:"in_progress_at,omitempty"`
+	FinalizingAt     int64              `json:"finalizing_at,omitempty"`
+	CompletedAt      int64              `json:"completed_at,omitempty"`
+	FailedAt         int64              `json:"failed_at,omitempty"`
+	CancellingAt     int64              `json:"cancelling_at,omitempty"`
+	CancelledAt      int64              `json:"cancelled_at,omitempty"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata,omitempty"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchErrors are the reasons a batch failed validation.
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
 // CreateRequest is the request passed to [Client.Create].
 type CreateRequest struct {
 	Model    string `json:"model"`
@@ -303,6 +695,7 @@ type CreateRequest struct {
 	From       string            `json:"from,omitempty"`
 	Files      map[string]string `json:"files,omitempty"`
 	Adapters   map[string]string `json:"adapters,omitempty"`
+	Draft      string            `json:"draft,omitempty"`
 	Template   string            `json:"template,omitempty"`
 	License    any               `json:"license,omitempty"`
 	System     string            `json:"system,omitempty"`
@@ -323,6 +716,13 @@ type DeleteRequest struct {
 	Name string `json:"name"`
 }
 
+// CancelRequest is the request passed to [Client.Cancel].
+type CancelRequest struct {
+	// ID is the ID of the request to cancel, from its X-Request-Id header
+	// or the request_id of the first response of its stream.
+	ID string `json:"id"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -436,6 +836,10 @@ type TokenResponse struct {
 
 // GenerateResponse is the response passed into [GenerateResponseFunc].
 type GenerateResponse struct {
+	// RequestID identifies the request so it can be cancelled with
+	// [Client.Cancel]. It is only set on the first response of a stream.
+	RequestID string `json:"request_id,omitempty"`
+
 	// Model is the model name that generated the response.
 	Model string `json:"model"`
 
@@ -445,6 +849,10 @@ type GenerateResponse struct {
 	// Response is the textual response itself.
 	Response string `json:"response"`
 
+	// Thinking is the model's reasoning before its response, for models
+	// that support thinking.
+	Thinking string `json:"thinking,omitempty"`
+
 	// Done specifies if the response is complete.
 	Done bool `json:"done"`
 
@@ -455,6 +863,10 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs holds the log-probabilities of the tokens in this response when
+	// requested with [GenerateRequest.Logprobs].
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Metrics
 }
 
@@ -586,6 +998,32 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 				} else {
 					return fmt.Errorf("unknown type loading config params: %v %v", field.Kind(), field.Type())
 				}
+			case reflect.Map:
+				if field.Type() != reflect.TypeOf(map[int]float32{}) {
+					return fmt.Errorf("unknown type loading config params: %v %v", field.Kind(), field.Type())
+				}
+
+				// JSON unmarshals to map[string]interface{} with float64 values
+				val, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+
+				biases := make(map[int]float32, len(val))
+				for k, v := range val {
+					id, err := strconv.Atoi(k)
+					if err != nil {
+						return fmt.Errorf("option %q must have integer keys", key)
+					}
+
+					bias, ok := v.(float64)
+					if !ok {
+						return fmt.Errorf("option %q must have number values", key)
+					}
+
+					biases[id] = float32(bias)
+				}
+				field.Set(reflect.ValueOf(biases))
 			default:
 				return fmt.Errorf("unknown type loading config params: %v", field.Kind())
 			}
@@ -617,6 +1055,14 @@ func DefaultOptions() Options {
 		MirostatEta:      0.1,
 		Seed:             -1,
 
+		DRYMultiplier:       0.0,
+		DRYBase:             1.75,
+		DRYAllowedLength:    2,
+		DRYSequenceBreakers: []string{"\n", ":", "\"", "*"},
+		XTCThreshold:        0.1,
+		XTCProbability:      0.0,
+		NumDraft:            8,
+
 		Runner: Runner{
 			// options set when the model is loaded
 			NumCtx:    int(envconfig.ContextLength()),
@@ -732,6 +1178,29 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 					} else {
 						return nil, fmt.Errorf("unknown type %s for %s", field.Kind(), key)
 					}
+				case reflect.Map:
+					// token biases are written as <id>:<bias>
+					biases := make(map[int]float32, len(vals))
+					for _, val := range vals {
+						k, v, ok := strings.Cut(val, ":")
+						if !ok {
+							return nil, fmt.Errorf("invalid %s value %s, expected <token id>:<bias>", key, val)
+						}
+
+						id, err := strconv.Atoi(strings.TrimSpace(k))
+						if err != nil {
+							return nil, fmt.Errorf("invalid token id %s", k)
+						}
+
+						bias, err := strconv.ParseFloat(strings.TrimSpace(v), 32)
+						if err != nil {
+							return nil, fmt.Errorf("invalid float value %s", v)
+						}
+
+						biases[id] = float32(bias)
+					}
+
+					out[key] = biases
 				default:
 					return nil, fmt.Errorf("unknown type %s for %s", field.Kind(), key)
 				}
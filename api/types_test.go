@@ -209,6 +209,65 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestSamplerParams(t *testing.T) {
+	params, err := FormatParams(map[string][]string{
+		"dry_multiplier":        {"0.8"},
+		"dry_base":              {"2"},
+		"dry_allowed_length":    {"3"},
+		"dry_sequence_breakers": {"\n", "."},
+		"xtc_threshold":         {"0.2"},
+		"xtc_probability":       {"0.5"},
+	})
+	require.NoError(t, err)
+
+	// options are stored as JSON, as they are when created from a Modelfile
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(m))
+	assert.InDelta(t, 0.8, opts.DRYMultiplier, 1e-6)
+	assert.InDelta(t, 2, opts.DRYBase, 1e-6)
+	assert.Equal(t, 3, opts.DRYAllowedLength)
+	assert.Equal(t, []string{"\n", "."}, opts.DRYSequenceBreakers)
+	assert.InDelta(t, 0.2, opts.XTCThreshold, 1e-6)
+	assert.InDelta(t, 0.5, opts.XTCProbability, 1e-6)
+
+	_, err = FormatParams(map[string][]string{"dry_allowed_length": {"two"}})
+	require.Error(t, err)
+}
+
+func TestLogitBiasParams(t *testing.T) {
+	params, err := FormatParams(map[string][]string{
+		"logit_bias": {"15:-100", "42: 5.5"},
+	})
+	require.NoError(t, err)
+
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(m))
+	assert.Equal(t, map[int]float32{15: -100, 42: 5.5}, opts.LogitBias)
+
+	for _, vals := range [][]string{{"15"}, {"x:1"}, {"15:x"}} {
+		_, err := FormatParams(map[string][]string{"logit_bias": vals})
+		require.Error(t, err, "%v", vals)
+	}
+
+	err = opts.FromMap(map[string]any{"logit_bias": map[string]any{"x": 1.0}})
+	require.Error(t, err)
+
+	err = opts.FromMap(map[string]any{"logit_bias": []any{1.0}})
+	require.Error(t, err)
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -231,3 +290,32 @@ func TestMessage_UnmarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestToolChoice(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ToolChoice
+	}{
+		{`"none"`, ToolChoice{Mode: ToolChoiceNone}},
+		{`"auto"`, ToolChoice{Mode: ToolChoiceAuto}},
+		{`"required"`, ToolChoice{Mode: ToolChoiceRequired}},
+		{`{"type":"function","function":{"name":"get_weather"}}`, ToolChoice{Mode: ToolChoiceFunction, Function: "get_weather"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			var got ToolChoice
+			require.NoError(t, json.Unmarshal([]byte(test.input), &got))
+			assert.Equal(t, test.want, got)
+
+			b, err := json.Marshal(got)
+			require.NoError(t, err)
+			assert.JSONEq(t, test.input, string(b))
+		})
+	}
+
+	for _, input := range []string{`"always"`, `{"type":"function"}`, `{"type":"tool","function":{"name":"x"}}`, `1`} {
+		var got ToolChoice
+		assert.Error(t, json.Unmarshal([]byte(input), &got), input)
+	}
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	// ScopeInference allows running models, e.g. generate, chat and embed
+	ScopeInference Scope = "inference"
+	// ScopeModelRead allows listing and showing models
+	ScopeModelRead Scope = "model-read"
+	// ScopeModelWrite allows pulling, pushing, creating, copying and deleting models
+	ScopeModelWrite Scope = "model-write"
+	// ScopeAdmin allows everything, including reading server metrics
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes are the scopes a key can have
+var Scopes = []Scope{ScopeInference, ScopeModelRead, ScopeModelWrite, ScopeAdmin}
+
+// ParseScope returns the scope named s
+func ParseScope(s string) (Scope, error) {
+	if !slices.Contains(Scopes, Scope(s)) {
+		return "", fmt.Errorf("unknown scope %q", s)
+	}
+
+	return Scope(s), nil
+}
+
+// apiKeyPrefix starts every API key, so they are easy to recognize
+const apiKeyPrefix = "rose_"
+
+// ErrAPIKeyNotFound is returned when revoking a key that does not exist
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is an API key for the server. Only a hash of the key is stored.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []Scope   `json:"scopes"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Allows reports whether the key has scope, or is an admin key
+func (k APIKey) Allows(scope Scope) bool {
+	return slices.Contains(k.Scopes, ScopeAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+// APIKeysPath returns the path to the API keys file
+func APIKeysPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".rose", "api_keys.json"), nil
+}
+
+// APIKeys are the API keys in a file. The file is read again when it
+// changes, so keys created or revoked by another process take effect
+// without restarting the server.
+type APIKeys struct {
+	path string
+
+	mu   sync.Mutex
+	info os.FileInfo
+	keys []APIKey
+}
+
+// LoadAPIKeys reads the API keys in the file at path. A missing file has
+// no keys.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	k := &APIKeys{path: path}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// reload reads the keys file if it changed since it was last read. It
+// must be called with mu held.
+func (k *APIKeys) reload() error {
+	fi, err := os.Stat(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		k.keys, k.info = nil, nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the file is replaced when it is written, so a different file or
+	// modification time means it changed
+	if k.info != nil && os.SameFile(fi, k.info) && fi.ModTime().Equal(k.info.ModTime()) {
+		return nil
+	}
+
+	b, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("%s: %w", k.path, err)
+	}
+
+	k.keys, k.info = keys, fi
+	return nil
+}
+
+// save writes the keys file. It must be called with mu held.
+func (k *APIKeys) save(keys []APIKey) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".api_keys-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), k.path); err != nil {
+		return err
+	}
+
+	return k.reload()
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create creates a key with a name and scopes. It returns the key, which
+// cannot be recovered later, along with its details.
+func (k *APIKeys) Create(name string, scopes []Scope) (string, APIKey, error) {
+	if name == "" {
+		return "", APIKey{}, errors.New("name is required")
+	}
+
+	if len(scopes) == 0 {
+		return "", APIKey{}, errors.New("at least one scope is required")
+	}
+
+	for _, s := range scopes {
+		if _, err := ParseScope(string(s)); err != nil {
+			return "", APIKey{}, err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return "", APIKey{}, err
+	}
+
+	if slices.ContainsFunc(k.keys, func(key APIKey) bool { return key.Name == name }) {
+		return "", APIKey{}, fmt.Errorf("a key named %q already exists", name)
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", APIKey{}, err
+	}
+
+	secret := apiKeyPrefix + hex.EncodeToString(b[:])
+	key := APIKey{
+		// the start of a key identifies it without revealing it
+		ID:        secret[len(apiKeyPrefix) : len(apiKeyPrefix)+8],
+		Name:      name,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(scopes))),
+		Hash:      hashAPIKey(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := k.save(append(slices.Clone(k.keys), key)); err != nil {
+		return "", APIKey{}, err
+	}
+
+	return secret, key, nil
+}
+
+// List returns the keys
+func (k *APIKeys) List() ([]APIKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(k.keys), nil
+}
+
+// Revoke deletes the key with an ID or name
+func (k *APIKeys) Revoke(idOrName string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		return err
+	}
+
+	keys := slices.DeleteFunc(slices.Clone(k.keys), func(key APIKey) bool {
+		return key.ID == idOrName || key.Name == idOrName
+	})
+
+	if len(keys) == len(k.keys) {
+		return ErrAPIKeyNotFound
+	}
+
+	return k.save(keys)
+}
+
+// Verify returns the key matching secret, if there is one
+func (k *APIKeys) Verify(secret string) (APIKey, bool) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return APIKey{}, false
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		// keep using the keys last read rather than locking everyone out
+		slog.Warn("failed to read api keys", "error", err)
+	}
+
+	hash := []byte(hashAPIKey(secret))
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare(hash, []byte(key.Hash)) == 1 {
+			return key, true
+		}
+	}
+
+	return APIKey{}, false
+}
+
+type keyIDKey struct{}
+
+// WithKeyID returns a copy of ctx carrying the ID of the API key a request
+// was made with
+func WithKeyID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keyIDKey{}, id)
+}
+
+// KeyID returns the ID of the API key a request was made with, or "" if the
+// server does not require keys. Resources such as batches and stored
+// responses belong to the key that created them.
+func KeyID(ctx context.Context) string {
+	id, _ := ctx.Value(keyIDKey{}).(string)
+	return id
+}
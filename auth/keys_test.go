@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys.json")
+
+	keys, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := keys.Verify("rose_missing"); ok {
+		t.Fatal("expected no keys before any are created")
+	}
+
+	secret, key, err := keys.Create("ci", []Scope{ScopeModelRead, ScopeInference, ScopeInference})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(key.Scopes, []Scope{ScopeInference, ScopeModelRead}) {
+		t.Errorf("unexpected scopes %v", key.Scopes)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), secret) {
+		t.Fatal("expected the key not to be stored")
+	}
+
+	// keys created by another process are seen
+	other, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := other.Verify(secret)
+	if !ok {
+		t.Fatal("expected key to be valid")
+	}
+
+	if got.ID != key.ID || !got.Allows(ScopeInference) || got.Allows(ScopeModelWrite) {
+		t.Errorf("unexpected key %+v", got)
+	}
+
+	if _, ok := other.Verify(secret + "0"); ok {
+		t.Error("expected a different key to be invalid")
+	}
+
+	if _, _, err := keys.Create("ci", []Scope{ScopeAdmin}); err == nil {
+		t.Error("expected an error creating a key with the same name")
+	}
+
+	if _, _, err := keys.Create("bad", []Scope{"everything"}); err == nil {
+		t.Error("expected an error creating a key with an unknown scope")
+	}
+
+	admin, _, err := keys.Create("admin", []Scope{ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := other.Verify(admin); !got.Allows(ScopeModelWrite) {
+		t.Error("expected admin keys to have every scope")
+	}
+
+	if err := keys.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := other.Verify(secret); ok {
+		t.Error("expected revoked key to be invalid")
+	}
+
+	if err := keys.Revoke("admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Revoke("admin"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+
+	list, err := other.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 0 {
+		t.Errorf("expected no keys, got %v", list)
+	}
+}
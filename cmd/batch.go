@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/progress"
+)
+
+// batchEndpoint returns the url of the first request in a batch file
+func batchEndpoint(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(line, &req); err != nil || req.URL == "" {
+			return "", errors.New("the first request has no url, set one with --endpoint")
+		}
+		return req.URL, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("the file has no requests")
+}
+
+func batchDone(status string) bool {
+	switch status {
+	case "completed", "failed", "cancelled", "expired":
+		return true
+	default:
+		return false
+	}
+}
+
+func downloadFile(ctx context.Context, client *api.Client, id, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := client.FileContent(ctx, id, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func BatchRunHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	input := args[0]
+	base := strings.TrimSuffix(input, filepath.Ext(input))
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = base + ".output.jsonl"
+	}
+
+	errorsOutput, err := cmd.Flags().GetString("errors")
+	if err != nil {
+		return err
+	}
+	if errorsOutput == "" {
+		errorsOutput = base + ".errors.jsonl"
+	}
+
+	endpoint, err := cmd.Flags().GetString("endpoint")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if endpoint == "" {
+		if endpoint, err = batchEndpoint(f); err != nil {
+			return fmt.Errorf("%s: %w", input, err)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	spinner := progress.NewSpinner(fmt.Sprintf("uploading %s", filepath.Base(input)))
+	p.Add("upload", spinner)
+
+	file, err := client.CreateFile(cmd.Context(), filepath.Base(input), f)
+	if err != nil {
+		return err
+	}
+
+	batch, err := client.CreateBatch(cmd.Context(), &api.BatchRequest{
+		InputFileID:      file.ID,
+		Endpoint:         endpoint,
+		CompletionWindow: "24h",
+	})
+	if err != nil {
+		return err
+	}
+
+	spinner.Stop()
+	spinner = progress.NewSpinner(fmt.Sprintf("running %s", batch.ID))
+	p.Add("run", spinner)
+
+	// on ctrl+c, cancel the batch and keep the results so far
+	interrupt, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+	defer stop()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	cancelled := false
+	for !batchDone(batch.Status) {
+		if n := batch.RequestCounts; n.Total > 0 && !cancelled {
+			spinner.SetMessage(fmt.Sprintf("running %s: %d/%d requests", batch.ID, n.Completed+n.Failed, n.Total))
+		}
+
+		select {
+		case <-interrupt.Done():
+			if !cancelled {
+				cancelled = true
+				spinner.SetMessage(fmt.Sprintf("cancelling %s", batch.ID))
+				if _, err := client.CancelBatch(cmd.Context(), batch.ID); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+		}
+
+		if batch, err = client.Batch(cmd.Context(), batch.ID); err != nil {
+			return err
+		}
+	}
+
+	spinner.Stop()
+	p.StopAndClear()
+
+	if batch.Status == "failed" {
+		var msgs []string
+		if batch.Errors != nil {
+			for _, e := range batch.Errors.Data {
+				if e.Line > 0 {
+					msgs = append(msgs, fmt.Sprintf("line %d: %s", e.Line, e.Message))
+				} else {
+					msgs = append(msgs, e.Message)
+				}
+			}
+		}
+		return fmt.Errorf("batch %s failed:\n%s", batch.ID, strings.Join(msgs, "\n"))
+	}
+
+	if batch.OutputFileID != "" {
+		if err := downloadFile(cmd.Context(), client, batch.OutputFileID, output); err != nil {
+			return err
+		}
+	}
+
+	if batch.ErrorFileID != "" {
+		if err := downloadFile(cmd.Context(), client, batch.ErrorFileID, errorsOutput); err != nil {
+			return err
+		}
+	}
+
+	n := batch.RequestCounts
+	fmt.Printf("%s %s: %d of %d requests completed, %d failed\n", batch.Status, batch.ID, n.Completed, n.Total, n.Failed)
+	if batch.OutputFileID != "" {
+		fmt.Printf("output written to %s\n", output)
+	}
+	if batch.ErrorFileID != "" {
+		fmt.Printf("errors written to %s\n", errorsOutput)
+	}
+
+	return nil
+}
@@ -33,6 +33,7 @@ import (
 	"golang.org/x/term"
 
 	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
 	"github.com/qompassai/rose/envconfig"
 	"github.com/qompassai/rose/format"
 	"github.com/qompassai/rose/parser"
@@ -772,6 +773,72 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func TokenizeHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	content := strings.Join(args[1:], " ")
+	if len(args) == 1 {
+		in, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		content = string(in)
+	}
+
+	resp, err := client.Tokenize(cmd.Context(), &api.TokenizeRequest{Model: args[0], Content: content})
+	if err != nil {
+		return err
+	}
+
+	if count, _ := cmd.Flags().GetBool("count"); count {
+		fmt.Println(len(resp.Tokens))
+		return nil
+	}
+
+	tokens := make([]string, len(resp.Tokens))
+	for i, t := range resp.Tokens {
+		tokens[i] = strconv.Itoa(t)
+	}
+	fmt.Println(strings.Join(tokens, " "))
+	return nil
+}
+
+func DetokenizeHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	fields := args[1:]
+	if len(args) == 1 {
+		in, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		fields = strings.Fields(string(in))
+	}
+
+	tokens := make([]int, len(fields))
+	for i, f := range fields {
+		t, err := strconv.Atoi(f)
+		if err != nil {
+			return fmt.Errorf("invalid token %q: must be an integer", f)
+		}
+		tokens[i] = t
+	}
+
+	resp, err := client.Detokenize(cmd.Context(), &api.DetokenizeRequest{Model: args[0], Tokens: tokens})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(resp.Content)
+	return nil
+}
+
 func PullHandler(cmd *cobra.Command, args []string) error {
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
@@ -845,6 +912,37 @@ type runOptions struct {
 type displayResponseState struct {
 	lineLength int
 	wordBuffer string
+	thinking   bool
+}
+
+// displayThinking shows a model's thinking dimmed ahead of its answer
+func displayThinking(thinking string, wordWrap bool, state *displayResponseState) {
+	if thinking == "" {
+		return
+	}
+
+	if !state.thinking {
+		fmt.Print("\x1b[2m")
+		state.thinking = true
+	}
+
+	displayResponse(thinking, wordWrap, state)
+}
+
+// endThinking restores the style after thinking and separates it from
+// the answer that follows
+func endThinking(state *displayResponseState, separate bool) {
+	if !state.thinking {
+		return
+	}
+
+	fmt.Print("\x1b[0m")
+	if separate {
+		fmt.Print("\n\n")
+		state.lineLength = 0
+		state.wordBuffer = ""
+	}
+	state.thinking = false
 }
 
 func displayResponse(content string, wordWrap bool, state *displayResponseState) {
@@ -920,7 +1018,7 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 
 	var state *displayResponseState = &displayResponseState{}
 	var latest api.ChatResponse
-	var fullResponse strings.Builder
+	var fullResponse, fullThinking strings.Builder
 	var role string
 
 	fn := func(response api.ChatResponse) error {
@@ -931,7 +1029,12 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 		role = response.Message.Role
 		content := response.Message.Content
 		fullResponse.WriteString(content)
+		fullThinking.WriteString(response.Message.Thinking)
 
+		displayThinking(response.Message.Thinking, opts.WordWrap, state)
+		if content != "" {
+			endThinking(state, true)
+		}
 		displayResponse(content, opts.WordWrap, state)
 
 		return nil
@@ -952,7 +1055,9 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 		req.KeepAlive = opts.KeepAlive
 	}
 
-	if err := client.Chat(cancelCtx, req, fn); err != nil {
+	err = client.Chat(cancelCtx, req, fn)
+	endThinking(state, false)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			return nil, nil
 		}
@@ -973,7 +1078,7 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 		latest.Summary()
 	}
 
-	return &api.Message{Role: role, Content: fullResponse.String()}, nil
+	return &api.Message{Role: role, Content: fullResponse.String(), Thinking: fullThinking.String()}, nil
 }
 
 func generate(cmd *cobra.Command, opts runOptions) error {
@@ -1014,6 +1119,10 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		latest = response
 		content := response.Response
 
+		displayThinking(response.Thinking, opts.WordWrap, state)
+		if content != "" {
+			endThinking(state, true)
+		}
 		displayResponse(content, opts.WordWrap, state)
 
 		return nil
@@ -1041,7 +1150,9 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		KeepAlive: opts.KeepAlive,
 	}
 
-	if err := client.Generate(ctx, &request, fn); err != nil {
+	err = client.Generate(ctx, &request, fn)
+	endThinking(state, false)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			return nil
 		}
@@ -1322,6 +1433,74 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	tokenizeCmd := &cobra.Command{
+		Use:     "tokenize MODEL [TEXT]",
+		Short:   "Convert text to token IDs using a model's vocabulary",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    TokenizeHandler,
+	}
+
+	tokenizeCmd.Flags().Bool("count", false, "Only print the number of tokens")
+
+	detokenizeCmd := &cobra.Command{
+		Use:     "detokenize MODEL [TOKEN...]",
+		Short:   "Convert token IDs to text using a model's vocabulary",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    DetokenizeHandler,
+	}
+
+	batchCmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Run batches of requests in the background",
+	}
+
+	batchRunCmd := &cobra.Command{
+		Use:     "run FILE",
+		Short:   "Run the requests in a JSONL file and save their responses",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    BatchRunHandler,
+	}
+
+	batchRunCmd.Flags().StringP("output", "o", "", "File to write responses to (default FILE.output.jsonl)")
+	batchRunCmd.Flags().String("errors", "", "File to write failed requests to (default FILE.errors.jsonl)")
+	batchRunCmd.Flags().String("endpoint", "", "Endpoint of the requests (default the url of the first request)")
+	batchCmd.AddCommand(batchRunCmd)
+
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage API keys for the server",
+		Long:  "Manage API keys for the server. Keys are required when the server is started with ROSE_AUTH=1.",
+	}
+
+	keysCreateCmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create an API key",
+		Args:  cobra.ExactArgs(1),
+		RunE:  KeysCreateHandler,
+	}
+
+	keysCreateCmd.Flags().StringSlice("scope", []string{string(auth.ScopeInference)}, "Scopes of the key (inference, model-read, model-write, admin)")
+
+	keysListCmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List API keys",
+		Args:    cobra.NoArgs,
+		RunE:    KeysListHandler,
+	}
+
+	keysRevokeCmd := &cobra.Command{
+		Use:   "revoke ID|NAME [ID|NAME...]",
+		Short: "Revoke API keys",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  KeysRevokeHandler,
+	}
+
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+
 	runnerCmd := &cobra.Command{
 		Use:    "runner",
 		Hidden: true,
@@ -1336,7 +1515,7 @@ func NewCLI() *cobra.Command {
 
 	envVars := envconfig.AsMap()
 
-	envs := []envconfig.EnvVar{envVars["ROSE_HOST"]}
+	envs := []envconfig.EnvVar{envVars["ROSE_HOST"], envVars["ROSE_API_KEY"]}
 
 	for _, cmd := range []*cobra.Command{
 		createCmd,
@@ -1349,11 +1528,13 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		tokenizeCmd,
+		detokenizeCmd,
 		serveCmd,
 	} {
 		switch cmd {
 		case runCmd:
-			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["ROSE_HOST"], envVars["ROSE_NOHISTORY"]})
+			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["ROSE_HOST"], envVars["ROSE_API_KEY"], envVars["ROSE_NOHISTORY"]})
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["ROSE_DEBUG"],
@@ -1372,6 +1553,15 @@ func NewCLI() *cobra.Command {
 				envVars["ROSE_LLM_LIBRARY"],
 				envVars["ROSE_GPU_OVERHEAD"],
 				envVars["ROSE_LOAD_TIMEOUT"],
+				envVars["ROSE_QUEUE_TIMEOUT"],
+				envVars["ROSE_GENERATE_TIMEOUT"],
+				envVars["ROSE_AUTH"],
+				envVars["ROSE_RATE_LIMIT_RPM"],
+				envVars["ROSE_RATE_LIMIT_TPD"],
+				envVars["ROSE_RATE_LIMIT_HEADER"],
+				envVars["ROSE_OTLP_ENDPOINT"],
+				envVars["ROSE_PERSIST_CACHE"],
+				envVars["ROSE_MAX_PERSIST_CACHE"],
 			})
 		default:
 			appendEnvDocs(cmd, envs)
@@ -1390,6 +1580,10 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		tokenizeCmd,
+		detokenizeCmd,
+		batchCmd,
+		keysCmd,
 		runnerCmd,
 	)
 
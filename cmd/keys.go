@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+
+	"github.com/qompassai/rose/auth"
+	"github.com/qompassai/rose/format"
+)
+
+func loadAPIKeys() (*auth.APIKeys, error) {
+	path, err := auth.APIKeysPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.LoadAPIKeys(path)
+}
+
+func KeysCreateHandler(cmd *cobra.Command, args []string) error {
+	names, err := cmd.Flags().GetStringSlice("scope")
+	if err != nil {
+		return err
+	}
+
+	var scopes []auth.Scope
+	for _, name := range names {
+		scope, err := auth.ParseScope(name)
+		if err != nil {
+			return err
+		}
+		scopes = append(scopes, scope)
+	}
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	secret, key, err := keys.Create(args[0], scopes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Created key %s (%s) with scopes %s. It will not be shown again.\n", key.ID, key.Name, formatScopes(key.Scopes))
+	fmt.Println(secret)
+	return nil
+}
+
+func KeysListHandler(cmd *cobra.Command, args []string) error {
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	list, err := keys.List()
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+	for _, k := range list {
+		data = append(data, []string{k.ID, k.Name, formatScopes(k.Scopes), format.HumanTime(k.CreatedAt, "Never")})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"ID", "NAME", "SCOPES", "CREATED"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func KeysRevokeHandler(cmd *cobra.Command, args []string) error {
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if err := keys.Revoke(arg); errors.Is(err, auth.ErrAPIKeyNotFound) {
+			return fmt.Errorf("key %q not found", arg)
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked '%s'\n", arg)
+	}
+
+	return nil
+}
+
+func formatScopes(scopes []auth.Scope) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, ",")
+}
@@ -134,6 +134,33 @@ func LoadTimeout() (loadTimeout time.Duration) {
 	return loadTimeout
 }
 
+// QueueTimeout returns how long a request can wait in the queue before the scheduler starts on it, or for one of the parallel slots of a loaded model. QueueTimeout can be configured via the ROSE_QUEUE_TIMEOUT environment variable.
+// Zero or negative values are treated as no timeout, the default.
+func QueueTimeout() time.Duration {
+	return timeout("ROSE_QUEUE_TIMEOUT")
+}
+
+// GenerateTimeout returns how long a request can generate for once its model is loaded. GenerateTimeout can be configured via the ROSE_GENERATE_TIMEOUT environment variable.
+// Zero or negative values are treated as no timeout, the default.
+func GenerateTimeout() time.Duration {
+	return timeout("ROSE_GENERATE_TIMEOUT")
+}
+
+// timeout parses a duration or a number of seconds from an environment
+// variable, returning zero if it is not set or not positive
+func timeout(k string) (d time.Duration) {
+	if s := Var(k); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				d = time.Duration(n) * time.Second
+			}
+		}
+	}
+
+	return max(d, 0)
+}
+
 func Bool(k string) func() bool {
 	return func() bool {
 		if s := Var(k); s != "" {
@@ -164,10 +191,16 @@ var (
 	SchedSpread = Bool("ROSE_SCHED_SPREAD")
 	// IntelGPU enables experimental Intel GPU detection.
 	IntelGPU = Bool("ROSE_INTEL_GPU")
-	// MultiUserCache optimizes prompt caching for multi-user scenarios
+	// MultiUserCache optimizes prompt caching for multi-user scenarios on the llama.cpp engine.
+	//
+	// Deprecated: it has no effect on models that run on the Rose engine, which always share prompt prefixes between requests.
 	MultiUserCache = Bool("ROSE_MULTIUSER_CACHE")
+	// PersistCache saves long prompt prefixes shared between requests to disk and restores them after a model is reloaded
+	PersistCache = Bool("ROSE_PERSIST_CACHE")
 	// Enable the new Rose engine
 	NewEngine = Bool("ROSE_NEW_ENGINE")
+	// Auth requires requests to the server to use an API key created with `rose keys create`.
+	Auth = Bool("ROSE_AUTH")
 	// ContextLength sets the default context length
 	ContextLength = Uint("ROSE_CONTEXT_LENGTH", 2048)
 )
@@ -180,6 +213,12 @@ func String(s string) func() string {
 
 var (
 	LLMLibrary = String("ROSE_LLM_LIBRARY")
+	// OTLPEndpoint is the OTLP over HTTP endpoint of an OpenTelemetry collector to export traces to. Tracing is off unless it is set.
+	OTLPEndpoint = String("ROSE_OTLP_ENDPOINT")
+	// APIKey is the API key the client sends to a server that requires one.
+	APIKey = String("ROSE_API_KEY")
+	// RateLimitHeader is a request header set by a proxy identifying clients for rate limits, instead of their IP address. API keys take precedence over it.
+	RateLimitHeader = String("ROSE_RATE_LIMIT_HEADER")
 
 	CudaVisibleDevices    = String("CUDA_VISIBLE_DEVICES")
 	HipVisibleDevices     = String("HIP_VISIBLE_DEVICES")
@@ -209,6 +248,10 @@ var (
 	MaxRunners = Uint("ROSE_MAX_LOADED_MODELS", 0)
 	// MaxQueue sets the maximum number of queued requests. MaxQueue can be configured via the ROSE_MAX_QUEUE environment variable.
 	MaxQueue = Uint("ROSE_MAX_QUEUE", 512)
+	// RateLimitRPM sets the maximum number of requests per minute from each client. RateLimitRPM can be configured via the ROSE_RATE_LIMIT_RPM environment variable.
+	RateLimitRPM = Uint("ROSE_RATE_LIMIT_RPM", 0)
+	// RateLimitTPD sets the maximum number of tokens per day for each client. RateLimitTPD can be configured via the ROSE_RATE_LIMIT_TPD environment variable.
+	RateLimitTPD = Uint("ROSE_RATE_LIMIT_TPD", 0)
 	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the ROSE_MAX_VRAM environment variable.
 	MaxVRAM = Uint("ROSE_MAX_VRAM", 0)
 )
@@ -230,6 +273,9 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 // Set aside VRAM per GPU
 var GpuOverhead = Uint64("ROSE_GPU_OVERHEAD", 0)
 
+// MaxPersistCache is the most disk space in bytes that the prompts saved for each model with ROSE_PERSIST_CACHE can use. The least recently used are deleted to make room. MaxPersistCache can be configured via the ROSE_MAX_PERSIST_CACHE environment variable.
+var MaxPersistCache = Uint64("ROSE_MAX_PERSIST_CACHE", 10*1000*1000*1000)
+
 type EnvVar struct {
 	Name        string
 	Value       any
@@ -238,6 +284,8 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
+		"ROSE_API_KEY":           {"ROSE_API_KEY", APIKey() != "", "API key the client sends to a server that requires one"},
+		"ROSE_AUTH":              {"ROSE_AUTH", Auth(), "Require requests to use an API key (e.g. ROSE_AUTH=1)"},
 		"ROSE_DEBUG":             {"ROSE_DEBUG", Debug(), "Show additional debug information (e.g. ROSE_DEBUG=1)"},
 		"ROSE_FLASH_ATTENTION":   {"ROSE_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
 		"ROSE_KV_CACHE_TYPE":     {"ROSE_KV_CACHE_TYPE", KvCacheType(), "Quantization type for the K/V cache (default: f16)"},
@@ -246,6 +294,7 @@ func AsMap() map[string]EnvVar {
 		"ROSE_KEEP_ALIVE":        {"ROSE_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
 		"ROSE_LLM_LIBRARY":       {"ROSE_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
 		"ROSE_LOAD_TIMEOUT":      {"ROSE_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"ROSE_GENERATE_TIMEOUT":  {"ROSE_GENERATE_TIMEOUT", GenerateTimeout(), "How long a request can generate for before it is stopped (default: no timeout)"},
 		"ROSE_MAX_LOADED_MODELS": {"ROSE_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
 		"ROSE_MAX_QUEUE":         {"ROSE_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
 		"ROSE_MODELS":            {"ROSE_MODELS", Models(), "The path to the models directory"},
@@ -253,8 +302,15 @@ func AsMap() map[string]EnvVar {
 		"ROSE_NOPRUNE":           {"ROSE_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
 		"ROSE_NUM_PARALLEL":      {"ROSE_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
 		"ROSE_ORIGINS":           {"ROSE_ORIGINS", AllowedOrigins(), "A comma separated list of allowed origins"},
+		"ROSE_QUEUE_TIMEOUT":     {"ROSE_QUEUE_TIMEOUT", QueueTimeout(), "How long a request can wait in the queue before it is rejected (default: no timeout)"},
+		"ROSE_RATE_LIMIT_HEADER": {"ROSE_RATE_LIMIT_HEADER", RateLimitHeader(), "Request header set by a proxy identifying clients for rate limits (default: API key or client IP)"},
+		"ROSE_RATE_LIMIT_RPM":    {"ROSE_RATE_LIMIT_RPM", RateLimitRPM(), "Maximum requests per minute from each client (default: unlimited)"},
+		"ROSE_RATE_LIMIT_TPD":    {"ROSE_RATE_LIMIT_TPD", RateLimitTPD(), "Maximum prompt and generated tokens per day for each client (default: unlimited)"},
+		"ROSE_OTLP_ENDPOINT":     {"ROSE_OTLP_ENDPOINT", OTLPEndpoint(), "OpenTelemetry collector to export traces to (e.g. http://localhost:4318)"},
 		"ROSE_SCHED_SPREAD":      {"ROSE_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
-		"ROSE_MULTIUSER_CACHE":   {"ROSE_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
+		"ROSE_MULTIUSER_CACHE":   {"ROSE_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios on the llama.cpp engine (deprecated)"},
+		"ROSE_PERSIST_CACHE":     {"ROSE_PERSIST_CACHE", PersistCache(), "Save long shared prompt prefixes to disk and restore them after reloading a model"},
+		"ROSE_MAX_PERSIST_CACHE": {"ROSE_MAX_PERSIST_CACHE", MaxPersistCache(), "Maximum disk space in bytes for the prompts saved for each model (default: 10GB)"},
 		"ROSE_CONTEXT_LENGTH":    {"ROSE_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 2048)"},
 		"ROSE_NEW_ENGINE":        {"ROSE_NEW_ENGINE", NewEngine(), "Enable the new Rose engine"},
 
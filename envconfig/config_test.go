@@ -257,6 +257,35 @@ func TestLoadTimeout(t *testing.T) {
 	}
 }
 
+func TestRequestTimeouts(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":     0,
+		"30s":  30 * time.Second,
+		"1m":   time.Minute,
+		"90":   90 * time.Second,
+		"0":    0,
+		"-1":   0,
+		"-1m":  0,
+		"???":  0,
+		"1d":   0,
+		"1h2m": time.Hour + 2*time.Minute,
+	}
+
+	for k, fn := range map[string]func() time.Duration{
+		"ROSE_QUEUE_TIMEOUT":    QueueTimeout,
+		"ROSE_GENERATE_TIMEOUT": GenerateTimeout,
+	} {
+		for tt, expect := range cases {
+			t.Run(k+"/"+tt, func(t *testing.T) {
+				t.Setenv(k, tt)
+				if actual := fn(); actual != expect {
+					t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+				}
+			})
+		}
+	}
+}
+
 func TestVar(t *testing.T) {
 	cases := map[string]string{
 		"value":       "value",
@@ -2,6 +2,7 @@ package kvcache
 
 import (
 	"errors"
+	"io"
 
 	"github.com/qompassai/rose/ml"
 	"github.com/qompassai/rose/model/input"
@@ -60,6 +61,10 @@ type Cache interface {
 	StartForward(ctx ml.Context, batch input.Batch) error
 
 	// CopyPrefix copies tokens in the range [0, len) from srcSeq to dstSeq
+	//
+	// Implementations may share the underlying entries between the
+	// sequences rather than duplicating them, as long as changing one
+	// sequence doesn't affect the other.
 	CopyPrefix(srcSeq, dstSeq int, len int32)
 
 	// Remove deletes tokens in the range [beginIndex, endIndex) from seq. Set
@@ -69,3 +74,15 @@ type Cache interface {
 	// removed by calling Remove(seq, 0, math.MaxInt32)
 	Remove(seq int, beginIndex, endIndex int32) error
 }
+
+// SnapshotCache is implemented by caches that can write the contents of a
+// sequence out and read them back in later, even in another process, such as
+// to skip processing a long prompt that was seen before
+type SnapshotCache interface {
+	// Save writes the entries of seq in the range [0, end) to w
+	Save(w io.Writer, seq int, end int32) error
+
+	// Load replaces the contents of seq with the entries in r, which were
+	// written by Save from a cache with the same model and settings
+	Load(r io.Reader, seq int) error
+}
@@ -155,10 +155,10 @@ func (c *Causal) StartForward(ctx ml.Context, batch input.Batch) error {
 	c.updateSlidingWindow()
 
 	var err error
-	c.curLoc, err = c.findStartLoc()
+	c.curLoc, err = c.findStartLoc(c.curBatchSize)
 	if errors.Is(err, ErrKvCacheFull) {
 		c.defrag()
-		c.curLoc, err = c.findStartLoc()
+		c.curLoc, err = c.findStartLoc(c.curBatchSize)
 	}
 	if err != nil {
 		return err
@@ -203,13 +203,13 @@ func newRange() cellRange {
 	}
 }
 
-// Find the first contiguous block of at least curBatchSize
-func (c *Causal) findStartLoc() (int, error) {
+// Find the first contiguous block of at least size
+func (c *Causal) findStartLoc(size int) (int, error) {
 	var start, count int
 	for i := range c.cells {
 		if len(c.cells[i].sequences) == 0 {
 			count++
-			if count >= c.curBatchSize {
+			if count >= size {
 				return start, nil
 			}
 		} else {
@@ -558,6 +558,8 @@ func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 	}
 }
 
+// CopyPrefix shares the cells of srcSeq with dstSeq rather than copying
+// them. They are only copied if one of the sequences later shifts them.
 func (c *Causal) CopyPrefix(srcSeq, dstSeq int, len int32) {
 	seqRange := newRange()
 
@@ -634,10 +636,94 @@ func (c *Causal) shift(seq int, beginIndex, offset int32) error {
 	return nil
 }
 
+// unshare gives seq its own copy of its entries starting at pos that are
+// also used by other sequences, so that they can be changed without
+// affecting the others
+func (c *Causal) unshare(seq int, pos int32) error {
+	shared := func() []int {
+		var cells []int
+		for i, cell := range c.cells {
+			if cell.pos >= pos && len(cell.sequences) > 1 && slices.Contains(cell.sequences, seq) {
+				cells = append(cells, i)
+			}
+		}
+		return cells
+	}
+
+	cells := shared()
+	if len(cells) == 0 {
+		return nil
+	}
+
+	loc, err := c.findStartLoc(len(cells))
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		cells = shared()
+		loc, err = c.findStartLoc(len(cells))
+	}
+	if err != nil {
+		return err
+	}
+
+	layers := 0
+	for _, key := range c.keys {
+		if key == nil {
+			continue
+		}
+		layers++
+	}
+
+	if layers > 0 {
+		ctx := c.backend.NewContext()
+
+		maxMoves := (ctx.MaxGraphNodes() - 2*layers) / (6 * layers)
+		moves := 0
+
+		// Copy runs of adjacent cells together, since they stay adjacent
+		for start := 0; start < len(cells); {
+			end := start + 1
+			for end < len(cells) && cells[end] == cells[end-1]+1 {
+				end++
+			}
+
+			c.moveCells(ctx, cells[start], loc+start, end-start)
+			moves++
+
+			if moves >= maxMoves {
+				ctx.Compute()
+				ctx.Close()
+				ctx = c.backend.NewContext()
+
+				moves = 0
+			}
+
+			start = end
+		}
+
+		if moves > 0 {
+			ctx.Compute()
+		}
+		ctx.Close()
+	}
+
+	for i, cell := range cells {
+		c.cells[loc+i] = cacheCell{pos: c.cells[cell].pos, sequences: []int{seq}}
+		c.cells[cell].sequences = slices.DeleteFunc(c.cells[cell].sequences, func(s int) bool { return s == seq })
+	}
+
+	return nil
+}
+
 func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 	var offset int32
 	if endIndex != math.MaxInt32 {
 		offset = beginIndex - endIndex
+
+		// Entries after the removed range get shifted, so they can no
+		// longer be shared with other sequences
+		if err := c.unshare(seq, endIndex); err != nil {
+			return err
+		}
 	}
 
 	seqRange := newRange()
@@ -648,11 +734,6 @@ func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 				c.cells[i].sequences = slices.DeleteFunc(c.cells[i].sequences, func(s int) bool { return s == seq })
 			} else {
 				if c.cells[i].pos >= endIndex {
-					if slices.ContainsFunc(c.cells[i].sequences, func(s int) bool { return s != seq }) {
-						// TODO(jessegross): Need to be careful about data shared between sequences
-						return errors.New("shifting on cells shared by multiple sequences not yet implemented")
-					}
-
 					c.cells[i].pos += offset
 				}
 				if i < seqRange.min {
@@ -1,6 +1,8 @@
 package kvcache
 
 import (
+	"bytes"
+	"encoding/binary"
 	"math"
 	"slices"
 	"testing"
@@ -274,6 +276,124 @@ func TestCopy(t *testing.T) {
 	testCache(t, backend, cache, tests)
 }
 
+func TestCopyOnWrite(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewCausalCache(func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
+		return key.Add(ctx, shift), nil
+	})
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
+
+	tests := []testCase{
+		{
+			name:          "FirstBatch",
+			in:            []float32{1, 2, 3, 4},
+			inShape:       []int{1, 1, 4},
+			seqs:          []int{0, 0, 0, 0},
+			pos:           []int32{0, 1, 2, 3},
+			expected:      []float32{1, 2, 3, 4},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, 0, float32(math.Inf(-1)), 0, 0, 0, 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+
+	cache.CopyPrefix(0, 1, 4)
+
+	// Shifting sequence 1 must not change the entries still used by
+	// sequence 0
+	if err := cache.Remove(1, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	tests = []testCase{
+		{
+			name:          "Shifted",
+			in:            []float32{5, 6},
+			inShape:       []int{1, 1, 2},
+			seqs:          []int{0, 1},
+			pos:           []int32{4, 3},
+			expected:      []float32{1, 2, 3, 4, 2, 3, 5, 6},
+			expectedShape: []int{1, 1, 8},
+			expectedMask:  []float32{0, 0, 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+}
+
+func TestSnapshot(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewCausalCache(nil)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
+
+	tests := []testCase{
+		{
+			name:          "FirstBatch",
+			in:            []float32{1, 2, 3, 4},
+			inShape:       []int{1, 1, 4},
+			seqs:          []int{0, 0, 0, 0},
+			pos:           []int32{0, 1, 2, 3},
+			expected:      []float32{1, 2, 3, 4},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, 0, float32(math.Inf(-1)), 0, 0, 0, 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+
+	var b bytes.Buffer
+	if err := cache.Save(&b, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewCausalCache(nil)
+	defer restored.Close()
+
+	restored.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	// fill the start of the cache so the snapshot is restored somewhere else
+	testCache(t, backend, restored, []testCase{
+		{
+			name:          "OtherSequence",
+			in:            []float32{7, 8},
+			inShape:       []int{1, 1, 2},
+			seqs:          []int{1, 1},
+			pos:           []int32{0, 1},
+			expected:      []float32{7, 8},
+			expectedShape: []int{1, 1, 2},
+			expectedMask:  []float32{0, float32(math.Inf(-1)), 0, 0},
+		},
+	})
+
+	if err := restored.Load(bytes.NewReader(b.Bytes()), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests = []testCase{
+		{
+			name:          "Restored",
+			in:            []float32{5},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{0},
+			pos:           []int32{3},
+			expected:      []float32{1, 2, 3, 5},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, 0, 0, 0},
+		},
+	}
+
+	testCache(t, backend, restored, tests)
+
+	if err := restored.Load(bytes.NewReader(b.Bytes()[:b.Len()-1]), 0); err == nil {
+		t.Error("expected an error loading a truncated snapshot")
+	}
+}
+
 func testCache(t *testing.T, backend ml.Backend, cache Cache, tests []testCase) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -361,6 +481,18 @@ func (c *testContext) FromIntSlice(s []int32, shape ...int) (ml.Tensor, error) {
 	return out, nil
 }
 
+func (c *testContext) FromBytes(dtype ml.DType, s []byte, shape ...int) (ml.Tensor, error) {
+	f := make([]float32, len(s)/4)
+	if err := binary.Read(bytes.NewReader(s), binary.LittleEndian, f); err != nil {
+		return nil, err
+	}
+
+	out, _ := c.FromFloatSlice(f, shape...)
+	out.(*testTensor).dtype = dtype
+
+	return out, nil
+}
+
 func (c *testContext) Input() ml.Context    { return c }
 func (c *testContext) Output() ml.Context   { return c }
 func (c *testContext) Layer(int) ml.Context { return c }
@@ -404,7 +536,9 @@ func (t *testTensor) DType() ml.DType {
 }
 
 func (t *testTensor) Bytes() []byte {
-	panic("not implemented")
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, t.data)
+	return b.Bytes()
 }
 
 func (t *testTensor) Floats() []float32 {
@@ -0,0 +1,346 @@
+package kvcache
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/qompassai/rose/ml"
+)
+
+const (
+	snapshotMagic   uint32 = 0x52534b56 // "RSKV"
+	snapshotVersion uint32 = 1
+)
+
+// snapshotHeader starts a snapshot written by Causal.Save. It is followed
+// by the position of each entry and then each layer.
+type snapshotHeader struct {
+	Magic     uint32
+	Version   uint32
+	DType     uint32
+	NumCells  uint32
+	NumLayers uint32
+}
+
+// snapshotLayer is followed by the key and then value of each entry, in
+// order of position, with one row of KRowSize or VRowSize bytes per entry
+type snapshotLayer struct {
+	Layer      int32
+	KHeadDim   int32
+	VHeadDim   int32
+	NumKVHeads int32
+	KRowSize   uint32
+	VRowSize   uint32
+}
+
+func (c *Causal) Save(w io.Writer, seq int, end int32) error {
+	seqRange, ok := c.cellRanges[seq]
+	if !ok {
+		return fmt.Errorf("no cache entries for sequence %v", seq)
+	}
+
+	var cells []int
+	for i := seqRange.min; i <= seqRange.max; i++ {
+		if slices.Contains(c.cells[i].sequences, seq) && c.cells[i].pos < end {
+			cells = append(cells, i)
+		}
+	}
+
+	if len(cells) == 0 {
+		return fmt.Errorf("no cache entries for sequence %v", seq)
+	}
+
+	slices.SortFunc(cells, func(a, b int) int {
+		return cmp.Compare(c.cells[a].pos, c.cells[b].pos)
+	})
+
+	var layers []int
+	for _, layer := range slices.Sorted(maps.Keys(c.keys)) {
+		if c.keys[layer] != nil {
+			layers = append(layers, layer)
+		}
+	}
+
+	ctx := c.backend.NewContext()
+	defer ctx.Close()
+
+	// Copy out every location in the range of the sequence, which are then
+	// filtered down to the entries being saved
+	size := seqRange.max - seqRange.min + 1
+	keys := make([]ml.Tensor, len(layers))
+	values := make([]ml.Tensor, len(layers))
+	for i, layer := range layers {
+		key := c.keys[layer]
+		value := c.values[layer]
+
+		kHeadDim := key.Dim(0)
+		numKVHeads := key.Dim(1)
+		rowSize := key.Stride(2)
+
+		keys[i] = ctx.Input().Empty(c.DType, kHeadDim*numKVHeads*size)
+		ctx.Forward(key.View(ctx, rowSize*seqRange.min, kHeadDim*numKVHeads*size).Copy(ctx, keys[i]))
+
+		if c.config.PermutedV {
+			vHeadDim := value.Dim(1)
+			elemSize := value.Stride(0)
+
+			values[i] = ctx.Input().Empty(c.DType, size, vHeadDim*numKVHeads)
+			ctx.Forward(value.View(ctx, elemSize*seqRange.min, size, len(c.cells)*elemSize, vHeadDim*numKVHeads).Copy(ctx, values[i]))
+		} else {
+			vHeadDim := value.Dim(0)
+			rowSize := value.Stride(2)
+
+			values[i] = ctx.Input().Empty(c.DType, vHeadDim*numKVHeads*size)
+			ctx.Forward(value.View(ctx, rowSize*seqRange.min, vHeadDim*numKVHeads*size).Copy(ctx, values[i]))
+		}
+	}
+
+	if len(layers) > 0 {
+		ctx.Compute(append(keys, values...)...)
+	}
+
+	positions := make([]int32, len(cells))
+	for i, cell := range cells {
+		positions[i] = c.cells[cell].pos
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, snapshotHeader{
+		Magic:     snapshotMagic,
+		Version:   snapshotVersion,
+		DType:     uint32(c.DType),
+		NumCells:  uint32(len(cells)),
+		NumLayers: uint32(len(layers)),
+	}); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+
+	for i, layer := range layers {
+		key := c.keys[layer]
+		value := c.values[layer]
+
+		kHeadDim := key.Dim(0)
+		numKVHeads := key.Dim(1)
+		kRowSize := key.Stride(2)
+
+		var vHeadDim, vRowSize int
+		if c.config.PermutedV {
+			vHeadDim = value.Dim(1)
+			vRowSize = value.Stride(0) * vHeadDim * numKVHeads
+		} else {
+			vHeadDim = value.Dim(0)
+			vRowSize = value.Stride(2)
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, snapshotLayer{
+			Layer:      int32(layer),
+			KHeadDim:   int32(kHeadDim),
+			VHeadDim:   int32(vHeadDim),
+			NumKVHeads: int32(numKVHeads),
+			KRowSize:   uint32(kRowSize),
+			VRowSize:   uint32(vRowSize),
+		}); err != nil {
+			return err
+		}
+
+		kData := keys[i].Bytes()
+		for _, cell := range cells {
+			offset := (cell - seqRange.min) * kRowSize
+			if _, err := w.Write(kData[offset : offset+kRowSize]); err != nil {
+				return err
+			}
+		}
+
+		vData := values[i].Bytes()
+		if c.config.PermutedV {
+			// Values are stored transposed, so gather each entry's row
+			// one element at a time
+			elemSize := value.Stride(0)
+			row := make([]byte, vRowSize)
+			for _, cell := range cells {
+				for j := range vHeadDim * numKVHeads {
+					offset := (j*size + cell - seqRange.min) * elemSize
+					copy(row[j*elemSize:], vData[offset:offset+elemSize])
+				}
+
+				if _, err := w.Write(row); err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, cell := range cells {
+				offset := (cell - seqRange.min) * vRowSize
+				if _, err := w.Write(vData[offset : offset+vRowSize]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Causal) Load(r io.Reader, seq int) error {
+	var header snapshotHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if header.Magic != snapshotMagic {
+		return errors.New("not a kv cache snapshot")
+	}
+
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported kv cache snapshot version %v", header.Version)
+	}
+
+	if ml.DType(header.DType) != c.DType {
+		return fmt.Errorf("kv cache snapshot has a different data type (snapshot: %v cache: %v)", header.DType, c.DType)
+	}
+
+	numCells := int(header.NumCells)
+	if numCells > len(c.cells) {
+		return fmt.Errorf("kv cache snapshot is larger than the cache (snapshot: %v cache: %v)", numCells, len(c.cells))
+	}
+
+	positions := make([]int32, numCells)
+	if err := binary.Read(r, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+
+	// Read everything before touching the cache so that a bad snapshot
+	// leaves it as it was
+	type layerData struct {
+		snapshotLayer
+		keys, values []byte
+	}
+
+	layers := make([]layerData, header.NumLayers)
+	for i := range layers {
+		if err := binary.Read(r, binary.LittleEndian, &layers[i].snapshotLayer); err != nil {
+			return err
+		}
+
+		l := layers[i]
+		if key, ok := c.keys[int(l.Layer)]; ok && key != nil {
+			value := c.values[int(l.Layer)]
+
+			vHeadDim, vRowSize := value.Dim(0), value.Stride(2)
+			if c.config.PermutedV {
+				vHeadDim, vRowSize = value.Dim(1), value.Stride(0)*value.Dim(1)*value.Dim(2)
+			}
+
+			if key.Dim(0) != int(l.KHeadDim) || key.Dim(1) != int(l.NumKVHeads) || key.Stride(2) != int(l.KRowSize) ||
+				vHeadDim != int(l.VHeadDim) || vRowSize != int(l.VRowSize) {
+				return fmt.Errorf("kv cache snapshot does not match the cache (layer: %v)", l.Layer)
+			}
+		}
+
+		layers[i].keys = make([]byte, numCells*int(l.KRowSize))
+		if _, err := io.ReadFull(r, layers[i].keys); err != nil {
+			return err
+		}
+
+		layers[i].values = make([]byte, numCells*int(l.VRowSize))
+		if _, err := io.ReadFull(r, layers[i].values); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Remove(seq, 0, math.MaxInt32); err != nil {
+		return err
+	}
+
+	if numCells == 0 {
+		return nil
+	}
+
+	loc, err := c.findStartLoc(numCells)
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		loc, err = c.findStartLoc(numCells)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, pos := range positions {
+		c.cells[loc+i] = cacheCell{pos: pos, sequences: []int{seq}}
+	}
+	c.cellRanges[seq] = cellRange{min: loc, max: loc + numCells - 1}
+
+	ctx := c.backend.NewContext()
+	defer ctx.Close()
+
+	for _, l := range layers {
+		layer := int(l.Layer)
+		kHeadDim := int(l.KHeadDim)
+		vHeadDim := int(l.VHeadDim)
+		numKVHeads := int(l.NumKVHeads)
+
+		if _, ok := c.ctxs[layer]; !ok {
+			c.ctxs[layer] = c.backend.NewContextSize(2).Layer(layer)
+		}
+
+		if _, ok := c.keys[layer]; !ok {
+			c.keys[layer] = c.ctxs[layer].Zeros(c.DType, kHeadDim, numKVHeads, len(c.cells))
+		}
+
+		if _, ok := c.values[layer]; !ok {
+			if c.config.PermutedV {
+				c.values[layer] = c.ctxs[layer].Zeros(c.DType, len(c.cells), vHeadDim, numKVHeads)
+			} else {
+				c.values[layer] = c.ctxs[layer].Zeros(c.DType, vHeadDim, numKVHeads, len(c.cells))
+			}
+		}
+
+		key, err := ctx.Input().FromBytes(c.DType, l.keys, kHeadDim*numKVHeads*numCells)
+		if err != nil {
+			return err
+		}
+
+		rowSize := c.keys[layer].Stride(2)
+		ctx.Forward(key.Copy(ctx, c.keys[layer].View(ctx, rowSize*loc, kHeadDim*numKVHeads*numCells)))
+
+		if c.config.PermutedV {
+			// Transpose the rows back into the layout of the cache
+			elemSize := c.values[layer].Stride(0)
+			data := make([]byte, len(l.values))
+			for i := range numCells {
+				for j := range vHeadDim * numKVHeads {
+					copy(data[(j*numCells+i)*elemSize:], l.values[i*int(l.VRowSize)+j*elemSize:][:elemSize])
+				}
+			}
+
+			value, err := ctx.Input().FromBytes(c.DType, data, numCells, vHeadDim*numKVHeads)
+			if err != nil {
+				return err
+			}
+
+			ctx.Forward(value.Copy(ctx, c.values[layer].View(ctx, elemSize*loc, numCells, len(c.cells)*elemSize, vHeadDim*numKVHeads)))
+		} else {
+			value, err := ctx.Input().FromBytes(c.DType, l.values, vHeadDim*numKVHeads*numCells)
+			if err != nil {
+				return err
+			}
+
+			rowSize := c.values[layer].Stride(2)
+			ctx.Forward(value.Copy(ctx, c.values[layer].View(ctx, rowSize*loc, vHeadDim*numKVHeads*numCells)))
+		}
+	}
+
+	if len(layers) > 0 {
+		ctx.Compute()
+	}
+
+	return nil
+}
@@ -166,15 +166,60 @@ func (c *Context) KvCacheDefrag() {
 	C.llama_kv_cache_defrag(c.c)
 }
 
-// Get the embeddings for a sequence id
+// StateSeqSaveFile writes the KV cache of a sequence to a file, along with
+// the tokens it holds
+func (c *Context) StateSeqSaveFile(path string, seqId int, tokens []int) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	cTokens := make([]C.llama_token, len(tokens)+1)
+	for i, t := range tokens {
+		cTokens[i] = C.llama_token(t)
+	}
+
+	if C.llama_state_seq_save_file(c.c, cPath, C.llama_seq_id(seqId), &cTokens[0], C.size_t(len(tokens))) == 0 {
+		return errors.New("failed to save sequence state")
+	}
+
+	return nil
+}
+
+// StateSeqLoadFile replaces the KV cache of a sequence with one written by
+// StateSeqSaveFile, returning the tokens it holds, of which there may be up
+// to maxTokens
+func (c *Context) StateSeqLoadFile(path string, seqId int, maxTokens int) ([]int, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	cTokens := make([]C.llama_token, maxTokens+1)
+	var n C.size_t
+	if C.llama_state_seq_load_file(c.c, cPath, C.llama_seq_id(seqId), &cTokens[0], C.size_t(maxTokens), &n) == 0 {
+		return nil, errors.New("failed to load sequence state")
+	}
+
+	tokens := make([]int, n)
+	for i := range tokens {
+		tokens[i] = int(cTokens[i])
+	}
+
+	return tokens, nil
+}
+
+// Get the embeddings for a sequence id. For reranking models this is the
+// score of the sequence from the classification head.
 func (c *Context) GetEmbeddingsSeq(seqId int) []float32 {
 	e := unsafe.Pointer(C.llama_get_embeddings_seq(c.c, C.int(seqId)))
 	if e == nil {
 		return nil
 	}
 
-	embeddings := make([]float32, c.Model().NEmbd())
-	_ = copy(embeddings, unsafe.Slice((*float32)(e), c.Model().NEmbd()))
+	n := c.Model().NEmbd()
+	if C.llama_pooling_type(c.c) == C.LLAMA_POOLING_TYPE_RANK {
+		n = 1
+	}
+
+	embeddings := make([]float32, n)
+	_ = copy(embeddings, unsafe.Slice((*float32)(e), n))
 	return embeddings
 }
 
@@ -189,6 +234,18 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return embeddings
 }
 
+// GetLogitsIth returns the logits for the ith token of the last decoded batch
+func (c *Context) GetLogitsIth(i int) []float32 {
+	l := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if l == nil {
+		return nil
+	}
+
+	logits := make([]float32, c.Model().NumVocab())
+	_ = copy(logits, unsafe.Slice((*float32)(l), c.Model().NumVocab()))
+	return logits
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -287,6 +344,10 @@ func (m *Model) AddBOSToken() bool {
 	return bool(C.llama_vocab_get_add_bos(m.Vocab()))
 }
 
+func (m *Model) TokenBOS() int {
+	return int(C.llama_vocab_bos(m.Vocab()))
+}
+
 func (m *Model) ApplyLoraFromFile(context *Context, loraPath string, scale float32, threads int) error {
 	cLoraPath := C.CString(loraPath)
 	defer C.free(unsafe.Pointer(cLoraPath))
@@ -622,6 +683,13 @@ type SamplingParams struct {
 	Mirostat       int
 	MirostatTau    float32
 	MirostatEta    float32
+	DRYMultiplier  float32
+	DRYBase        float32
+	DRYAllowedLen  int
+	DRYBreakers    []string
+	XTCProbability float32
+	XTCThreshold   float32
+	LogitBias      map[int]float32
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
@@ -637,12 +705,47 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	cparams.penalty_last_n = C.int32_t(params.RepeatLastN)
 	cparams.penalty_repeat = C.float(params.PenaltyRepeat)
 	cparams.penalty_freq = C.float(params.PenaltyFreq)
-	cparams.penalty_present = C.float(params.PenaltyFreq)
+	cparams.penalty_present = C.float(params.PenaltyPresent)
 	cparams.mirostat = C.int32_t(params.Mirostat)
 	cparams.mirostat_tau = C.float(params.MirostatTau)
 	cparams.mirostat_eta = C.float(params.MirostatEta)
+	cparams.dry_multiplier = C.float(params.DRYMultiplier)
+	cparams.dry_base = C.float(params.DRYBase)
+	cparams.dry_allowed_length = C.int32_t(params.DRYAllowedLen)
+	cparams.dry_penalty_last_n = -1
+	cparams.xtc_probability = C.float(params.XTCProbability)
+	cparams.xtc_threshold = C.float(params.XTCThreshold)
 	cparams.seed = C.uint32_t(params.Seed)
 
+	if len(params.DRYBreakers) > 0 {
+		ptr := (**C.char)(C.malloc(C.size_t(len(params.DRYBreakers)) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(ptr))
+
+		breakers := unsafe.Slice(ptr, len(params.DRYBreakers))
+		for i, b := range params.DRYBreakers {
+			breakers[i] = C.CString(b)
+			defer C.free(unsafe.Pointer(breakers[i]))
+		}
+
+		cparams.dry_sequence_breakers = ptr
+		cparams.n_dry_sequence_breakers = C.size_t(len(breakers))
+	}
+
+	if len(params.LogitBias) > 0 {
+		ptr := (*C.llama_logit_bias)(C.malloc(C.size_t(len(params.LogitBias)) * C.size_t(unsafe.Sizeof(C.llama_logit_bias{}))))
+		defer C.free(unsafe.Pointer(ptr))
+
+		biases := unsafe.Slice(ptr, len(params.LogitBias))
+		i := 0
+		for token, bias := range params.LogitBias {
+			biases[i] = C.llama_logit_bias{token: C.llama_token(token), bias: C.float(bias)}
+			i++
+		}
+
+		cparams.logit_bias = ptr
+		cparams.n_logit_bias = C.size_t(len(biases))
+	}
+
 	grammar := C.CString(params.Grammar)
 	defer C.free(unsafe.Pointer(grammar))
 
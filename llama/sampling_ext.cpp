@@ -23,8 +23,14 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.mirostat_eta = params->mirostat_eta;
         sparams.seed = params->seed;
         sparams.grammar = params->grammar;
-        sparams.xtc_probability = 0.0;
-        sparams.xtc_threshold = 0.5;
+        sparams.dry_multiplier = params->dry_multiplier;
+        sparams.dry_base = params->dry_base;
+        sparams.dry_allowed_length = params->dry_allowed_length;
+        sparams.dry_penalty_last_n = params->dry_penalty_last_n;
+        sparams.dry_sequence_breakers.assign(params->dry_sequence_breakers, params->dry_sequence_breakers + params->n_dry_sequence_breakers);
+        sparams.xtc_probability = params->xtc_probability;
+        sparams.xtc_threshold = params->xtc_threshold;
+        sparams.logit_bias.assign(params->logit_bias, params->logit_bias + params->n_logit_bias);
         return common_sampler_init(model, sparams);
     } catch (const std::exception &err) {
         return nullptr;
@@ -15,12 +15,12 @@ import (
 )
 
 // This algorithm looks for a complete fit to determine if we need to unload other models
-func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, opts api.Options) (bool, uint64) {
+func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options) (bool, uint64) {
 	// Split up the GPUs by type and try them
 	var estimatedVRAM uint64
 	for _, gpus := range allGpus.ByLibrary() {
 		var layerCount int
-		estimate := EstimateGPULayers(gpus, f, projectors, opts)
+		estimate := EstimateGPULayers(gpus, f, projectors, draft, opts)
 		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize
 		if opts.NumGPU < 0 {
 			if layerCount > 0 && layerCount >= int(f.KV().BlockCount()+1) {
@@ -67,11 +67,14 @@ type MemoryEstimate struct {
 	graphPartialOffload uint64
 
 	projectorWeights, projectorGraph uint64
+
+	draftWeights, draftGraph uint64
 }
 
 // Given a model and one or more GPU targets, predict how many layers and bytes we can load, and the total size
 // The GPUs provided must all be the same Library
-func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []string, opts api.Options) MemoryEstimate {
+// A draft model, if any, is loaded whole alongside the model on the first GPU
+func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []string, draft string, opts api.Options) MemoryEstimate {
 	// Graph size for a partial offload, applies to all GPUs
 	var graphPartialOffload uint64
 
@@ -85,6 +88,10 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	var projectorWeights uint64
 	var projectorGraph uint64
 
+	// Draft model loaded into GPU0 only, including its KV cache
+	var draftWeights uint64
+	var draftGraph uint64
+
 	// Conditional output size on GPU 0
 	var memoryLayerOutput uint64
 
@@ -139,6 +146,10 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 
 	kv, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), kvct)
 
+	if draft != "" {
+		draftWeights, draftGraph = draftMemoryRequirements(draft, opts, kvct)
+	}
+
 	// KV is proportional to the number of layers
 	layerSize += kv / f.KV().BlockCount()
 
@@ -167,7 +178,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	}
 
 	// Output layer handled at the end if we have space
-	gpuZeroOverhead := projectorWeights + projectorGraph
+	gpuZeroOverhead := projectorWeights + projectorGraph + draftWeights + draftGraph
 
 	// Reduce set of GPUs to only those that have sufficient space to fit overhead and at least one layer
 	var layerCount int
@@ -323,6 +334,8 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		graphPartialOffload: graphPartialOffload,
 		projectorWeights:    projectorWeights,
 		projectorGraph:      projectorGraph,
+		draftWeights:        draftWeights,
+		draftGraph:          draftGraph,
 	}
 
 	if gpus[0].Library == "cpu" {
@@ -398,6 +411,14 @@ func (m MemoryEstimate) LogValue() slog.Value {
 		))
 	}
 
+	if m.draftWeights > 0 {
+		attrs = append(attrs, slog.Group(
+			"draft",
+			"weights", format.HumanBytes2(m.draftWeights),
+			"graph", format.HumanBytes2(m.draftGraph),
+		))
+	}
+
 	return slog.GroupValue(attrs...)
 }
 
@@ -449,3 +470,25 @@ func projectorMemoryRequirements(filename string) (weights, graphSize uint64) {
 
 	return weights, graphSize
 }
+
+// draftMemoryRequirements returns the memory for the weights of a draft model
+// and for its KV cache and graph, which are sized like the model's
+func draftMemoryRequirements(filename string, opts api.Options, kvct string) (weights, graphSize uint64) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	ggml, _, err := ggml.Decode(file, 0)
+	if err != nil {
+		return 0, 0
+	}
+
+	for _, layer := range ggml.Tensors().GroupLayers() {
+		weights += layer.Size()
+	}
+
+	kv, graphPartialOffload, graphFullOffload := ggml.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), kvct)
+	return weights, kv + max(graphPartialOffload, graphFullOffload)
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -22,8 +24,6 @@ import (
 	"sync"
 	"time"
 
-	"golang.org/x/sync/semaphore"
-
 	"github.com/qompassai/rose/api"
 	"github.com/qompassai/rose/discover"
 	"github.com/qompassai/rose/envconfig"
@@ -31,6 +31,8 @@ import (
 	"github.com/qompassai/rose/fs/ggml"
 	"github.com/qompassai/rose/llama"
 	"github.com/qompassai/rose/model"
+	"github.com/qompassai/rose/sample"
+	"github.com/qompassai/rose/tracing"
 )
 
 type LlamaServer interface {
@@ -38,6 +40,9 @@ type LlamaServer interface {
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
 	Embedding(ctx context.Context, input string) ([]float32, error)
+	Rerank(ctx context.Context, query, document string) (float32, error)
+	SaveCache(ctx context.Context, prompt string) (int, error)
+	RestoreCache(ctx context.Context, prompt string) (int, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
 	Close() error
@@ -71,8 +76,6 @@ type llmServer struct {
 	gpus         discover.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
 	loadDuration time.Duration        // Record how long it took the model to load
 	loadProgress float32
-
-	sem *semaphore.Weighted
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -95,9 +98,29 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 	return ggml, err
 }
 
+// CacheDir returns the directory that snapshots of the cache of a model with
+// adapters and projectors are saved to. Adapters and projectors change what's
+// in the cache, so each combination of them has its own directory under the
+// model's, named after the digests of their blobs.
+func CacheDir(modelPath string, adapters, projectors []string) string {
+	variant := "base"
+	if len(adapters) > 0 || len(projectors) > 0 {
+		h := sha256.New()
+		for _, adapter := range adapters {
+			fmt.Fprintln(h, "adapter", filepath.Base(adapter))
+		}
+		for _, projector := range projectors {
+			fmt.Fprintln(h, "projector", filepath.Base(projector))
+		}
+		variant = hex.EncodeToString(h.Sum(nil))[:16]
+	}
+
+	return filepath.Join(envconfig.Models(), "cache", filepath.Base(modelPath), variant)
+}
+
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (LlamaServer, error) {
 	systemInfo := discover.GetSystemInfo()
 	systemTotalMemory := systemInfo.System.TotalMemory
 	systemFreeMemory := systemInfo.System.FreeMemory
@@ -109,7 +132,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		gpus = discover.GetCPUInfo()
 	}
 
-	estimate := EstimateGPULayers(gpus, f, projectors, opts)
+	estimate := EstimateGPULayers(gpus, f, projectors, draft, opts)
 	if len(gpus) > 1 || gpus[0].Library != "cpu" {
 		switch {
 		case gpus[0].Library == "metal" && estimate.VRAMSize > systemTotalMemory:
@@ -161,6 +184,20 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		}
 	}
 
+	if draft != "" {
+		// the draft model is small, so load all of it into the GPU
+		// unless none of the model fits
+		draftGPULayers := 0
+		if estimate.Layers > 0 && gpus[0].Library != "cpu" {
+			draftGPULayers = 999
+		}
+
+		params = append(params,
+			"--draft-model", draft,
+			"--draft-n-gpu-layers", strconv.Itoa(draftGPULayers),
+		)
+	}
+
 	defaultThreads := systemInfo.GetOptimalThreadCount()
 	if opts.NumThread > 0 {
 		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
@@ -181,6 +218,9 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 
 	kvct := strings.ToLower(envconfig.KvCacheType())
 
+	// snapshots of the cache are only valid for the same type of cache
+	cacheType := "f16"
+
 	if fa {
 		slog.Info("enabling flash attention")
 		params = append(params, "--flash-attn")
@@ -189,6 +229,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		// Enable if the requested and kv cache type is supported by the model
 		if kvct != "" && f.SupportsKVCacheType(kvct) {
 			params = append(params, "--kv-cache-type", kvct)
+			cacheType = kvct
 		} else {
 			slog.Warn("kv cache type not supported by model", "type", kvct)
 		}
@@ -228,10 +269,6 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		params = append(params, "--tensor-split", estimate.TensorSplit)
 	}
 
-	if envconfig.MultiUserCache() {
-		params = append(params, "--multiuser-cache")
-	}
-
 	libs := make(map[string]string)
 	if entries, err := os.ReadDir(discover.LibRosePath); err == nil {
 		for _, entry := range entries {
@@ -289,6 +326,24 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	if envconfig.MultiUserCache() {
+		if textProcessor != nil {
+			slog.Warn("ROSE_MULTIUSER_CACHE is deprecated and has no effect, as prompt prefixes are always shared between requests")
+		} else {
+			params = append(params, "--multiuser-cache")
+		}
+	}
+
+	engine := "llama"
+	if textProcessor != nil {
+		engine = "rose"
+	}
+
+	params = append(params, "--cache-dir", filepath.Join(CacheDir(modelPath, adapters, projectors), engine+"-"+cacheType))
+	if envconfig.PersistCache() {
+		params = append(params, "--persist-cache", "--cache-size", strconv.FormatUint(envconfig.MaxPersistCache(), 10))
+	}
+
 	// iterate through compatible GPU libraries such as 'cuda_v12', 'cuda_v11', 'rocm', etc.
 	// adding each library's respective path to the LD_LIBRARY_PATH, until finally running
 	// without any LD_LIBRARY_PATH flags
@@ -358,7 +413,6 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 			textProcessor: textProcessor,
 			estimate:      estimate,
 			numParallel:   numParallel,
-			sem:           semaphore.NewWeighted(int64(numParallel)),
 			totalLayers:   f.KV().BlockCount() + 1,
 			gpus:          gpus,
 			done:          make(chan error, 1),
@@ -672,6 +726,11 @@ type CompletionRequest struct {
 	Images  []ImageData
 	Options *api.Options
 
+	// Logprobs requests the log-probability of each generated token, along
+	// with the TopLogprobs most likely alternatives
+	Logprobs    bool
+	TopLogprobs int
+
 	Grammar string // set before sending the request to the subprocess
 }
 
@@ -683,9 +742,16 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
 	EvalCount          int           `json:"eval_count"`
 	EvalDuration       time.Duration `json:"eval_duration"`
+	Logprobs           []api.Logprob `json:"logprobs,omitempty"`
+
+	// StopSequence is the stop sequence that ended the response, if any
+	StopSequence string `json:"stop_sequence,omitempty"`
 }
 
-func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) (err error) {
+	ctx, span := tracing.Start(ctx, "llmServer.Completion", tracing.Attr("images", len(req.Images)))
+	defer func() { span.End(err) }()
+
 	if len(req.Format) > 0 {
 		switch string(req.Format) {
 		case `null`, `""`:
@@ -700,11 +766,21 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			}
 
 			// User provided a JSON schema
-			g := llama.SchemaToGrammar(req.Format)
-			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
+			if s.textProcessor != nil {
+				// the new engine matches grammars in Go so the schema
+				// is converted without the llama.cpp vocabulary
+				g, err := sample.SchemaToGrammar(req.Format)
+				if err != nil {
+					return fmt.Errorf("invalid JSON schema in format: %w", err)
+				}
+				req.Grammar = string(g)
+			} else {
+				g := llama.SchemaToGrammar(req.Format)
+				if g == nil {
+					return fmt.Errorf("invalid JSON schema in format")
+				}
+				req.Grammar = string(g)
 			}
-			req.Grammar = string(g)
 		}
 	}
 
@@ -713,21 +789,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		req.Options = &opts
 	}
 
-	if err := s.sem.Acquire(ctx, 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting completion request due to client closing the connection")
-		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
-		}
-		return err
-	}
-	defer s.sem.Release(1)
-
 	// put an upper limit on num_predict to avoid the model running on forever
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
 		req.Options.NumPredict = 10 * s.options.NumCtx
 	}
 
+	if err := ctx.Err(); err != nil {
+		slog.Info("aborting completion request due to client closing the connection")
+		return err
+	}
+
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
 	if err != nil {
@@ -751,6 +822,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("error creating POST request: %v", err)
 	}
 	serverReq.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, serverReq.Header)
 
 	res, err := http.DefaultClient.Do(serverReq)
 	if err != nil {
@@ -812,7 +884,8 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 			if c.Content != "" {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content:  c.Content,
+					Logprobs: c.Logprobs,
 				})
 			}
 
@@ -850,16 +923,6 @@ type EmbeddingResponse struct {
 }
 
 func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
-	if err := s.sem.Acquire(ctx, 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting embedding request due to client closing the connection")
-		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
-		}
-		return nil, err
-	}
-	defer s.sem.Release(1)
-
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
 	if err != nil {
@@ -903,6 +966,126 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 	return e.Embedding, nil
 }
 
+type RerankRequest struct {
+	Query    string `json:"query"`
+	Document string `json:"document"`
+}
+
+type RerankResponse struct {
+	Score float32 `json:"score"`
+}
+
+// Rerank returns the score a reranking model gives document for how relevant
+// it is to query
+func (s *llmServer) Rerank(ctx context.Context, query, document string) (float32, error) {
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return 0, err
+	} else if status != ServerStatusReady {
+		return 0, fmt.Errorf("unexpected server status: %s", status)
+	}
+
+	data, err := json.Marshal(RerankRequest{Query: query, Document: document})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling rerank data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/rerank", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, fmt.Errorf("error creating rerank request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, fmt.Errorf("do rerank request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading rerank response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		log.Printf("llm rerank error: %s", body)
+		return 0, fmt.Errorf("%s", body)
+	}
+
+	var rr RerankResponse
+	if err := json.Unmarshal(body, &rr); err != nil {
+		return 0, fmt.Errorf("unmarshal rerank response: %w", err)
+	}
+
+	return rr.Score, nil
+}
+
+type CacheRequest struct {
+	Prompt string `json:"prompt"`
+}
+
+type CacheResponse struct {
+	Tokens int `json:"tokens"`
+}
+
+// SaveCache writes the KV cache for prompt, which must have just been
+// processed, to disk so that it can be restored later, even by another runner
+// for the same model. It returns the number of tokens saved.
+func (s *llmServer) SaveCache(ctx context.Context, prompt string) (int, error) {
+	return s.cacheSnapshot(ctx, "save", prompt)
+}
+
+// RestoreCache loads the longest saved KV cache for the start of prompt,
+// returning the number of tokens of prompt that are now cached
+func (s *llmServer) RestoreCache(ctx context.Context, prompt string) (int, error) {
+	return s.cacheSnapshot(ctx, "restore", prompt)
+}
+
+func (s *llmServer) cacheSnapshot(ctx context.Context, action, prompt string) (int, error) {
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return 0, err
+	} else if status != ServerStatusReady {
+		return 0, fmt.Errorf("unexpected server status: %s", status)
+	}
+
+	data, err := json.Marshal(CacheRequest{Prompt: prompt})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling cache data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/cache/%s", s.port, action), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, fmt.Errorf("error creating cache %s request: %w", action, err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, fmt.Errorf("do cache %s request: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading cache %s response: %w", action, err)
+	}
+
+	if resp.StatusCode >= 400 {
+		log.Printf("llm cache %s error: %s", action, body)
+		return 0, api.StatusError{StatusCode: resp.StatusCode, ErrorMessage: strings.TrimSpace(string(body))}
+	}
+
+	var cr CacheResponse
+	if err := json.Unmarshal(body, &cr); err != nil {
+		return 0, fmt.Errorf("unmarshal cache %s response: %w", action, err)
+	}
+
+	return cr.Tokens, nil
+}
+
 type TokenizeRequest struct {
 	Content string `json:"content"`
 }
@@ -8,7 +8,6 @@ import (
 	"testing"
 
 	"github.com/qompassai/rose/api"
-	"golang.org/x/sync/semaphore"
 )
 
 func TestLLMServerCompletionFormat(t *testing.T) {
@@ -17,9 +16,7 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	// Completion method to be more testable.
 
 	ctx, cancel := context.WithCancel(context.Background())
-	s := &llmServer{
-		sem: semaphore.NewWeighted(1), // required to prevent nil panic
-	}
+	s := &llmServer{}
 
 	checkInvalid := func(format string) {
 		t.Helper()
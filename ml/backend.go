@@ -105,6 +105,10 @@ type Context interface {
 	FromFloatSlice(s []float32, shape ...int) (Tensor, error)
 	FromIntSlice(s []int32, shape ...int) (Tensor, error)
 
+	// FromBytes creates a tensor from the raw data of a tensor of the same
+	// type and shape, such as one previously read with Bytes
+	FromBytes(dtype DType, s []byte, shape ...int) (Tensor, error)
+
 	Forward(...Tensor) Context
 	Compute(...Tensor)
 	MaxGraphNodes() int
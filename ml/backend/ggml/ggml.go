@@ -651,6 +651,19 @@ func (c Context) FromIntSlice(s []int32, shape ...int) (ml.Tensor, error) {
 	return t, nil
 }
 
+func (c Context) FromBytes(dtype ml.DType, s []byte, shape ...int) (ml.Tensor, error) {
+	t := c.newTensor(dtype, shape)
+	if n := C.ggml_nbytes(t.(*Tensor).t); C.size_t(len(s)) != n {
+		return nil, fmt.Errorf("invalid shape %v for %d bytes", shape, len(s))
+	}
+
+	if len(s) > 0 {
+		C.ggml_backend_tensor_set(t.(*Tensor).t, unsafe.Pointer(&s[0]), 0, C.ggml_nbytes(t.(*Tensor).t))
+	}
+
+	return t, nil
+}
+
 func (c *Context) Close() {
 	if c != nil {
 		C.ggml_free(c.ctx)
@@ -23,6 +23,11 @@ type Input struct {
 	// Useful for things like images that must be processed in one
 	// shot.
 	SameBatch int
+
+	// Segment is the part of its sequence the input is in, such as 0 for
+	// the query and 1 for the document that a reranking model scores.
+	// Models with token types embed it.
+	Segment int32
 }
 
 // MultimodalIndex is a multimodal element (such as an image)
@@ -52,6 +57,10 @@ type Batch struct {
 	// Sequences is the sequence for each Input. Equal in length to Inputs.
 	Sequences []int
 
+	// Segments is the segment for each Input. Equal in length to Inputs,
+	// or empty if every Input is in the first segment.
+	Segments []int32
+
 	// Outputs are the set of indicies into Inputs for which output data should
 	// be returned.
 	Outputs []int32
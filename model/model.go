@@ -33,6 +33,30 @@ type Model interface {
 	Config() config
 }
 
+// PoolingType is how the hidden states of a sequence are combined into a
+// single embedding, as stored in the pooling_type key of the model
+type PoolingType uint32
+
+const (
+	PoolingTypeNone PoolingType = iota
+	PoolingTypeMean
+	PoolingTypeCLS
+	PoolingTypeLast
+
+	// PoolingTypeRank scores a sequence with the model's classification
+	// head, which reranking models use to rate how relevant a document is
+	// to a query
+	PoolingTypeRank
+)
+
+// EmbeddingModel must be implemented by models that produce embeddings
+// rather than text. Forward returns the hidden state of each output instead
+// of logits, and the runner pools the hidden states of a sequence into its
+// embedding.
+type EmbeddingModel interface {
+	PoolingType() PoolingType
+}
+
 // MultimodalProcessor must be implemented by multimodal models.
 type MultimodalProcessor interface {
 	// EncodeMultimodal processes a single input (such as an image) and
@@ -286,6 +310,10 @@ func Forward(ctx ml.Context, m Model, inputs []int32, batch input.Batch) (ml.Ten
 		return nil, fmt.Errorf("length of positions (%v) must match length of seqs (%v)", len(batch.Positions), len(batch.Sequences))
 	}
 
+	if len(batch.Segments) > 0 && len(batch.Segments) != len(batch.Positions) {
+		return nil, fmt.Errorf("length of segments (%v) must match length of positions (%v)", len(batch.Segments), len(batch.Positions))
+	}
+
 	if len(batch.Positions) < 1 {
 		return nil, errors.New("batch size cannot be less than 1")
 	}
@@ -0,0 +1,188 @@
+package bert
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/qompassai/rose/ml"
+	"github.com/qompassai/rose/ml/nn"
+	"github.com/qompassai/rose/model"
+	"github.com/qompassai/rose/model/input"
+)
+
+type Options struct {
+	hiddenSize, numHeads int
+	eps                  float32
+	poolingType          model.PoolingType
+}
+
+// Model is a BERT-family encoder. It attends to the whole of each sequence
+// at once, so it has no cache and returns the hidden state of every output
+// for the runner to pool into an embedding. Reranking models instead return
+// the scores of their classification head.
+type Model struct {
+	model.Base
+	model.WordPiece
+
+	TokenEmbedding     *nn.Embedding `gguf:"token_embd"`
+	TypeEmbedding      *nn.Embedding `gguf:"token_types"`
+	PositionEmbedding  *nn.Embedding `gguf:"position_embd"`
+	TokenEmbeddingNorm *nn.LayerNorm `gguf:"token_embd_norm"`
+
+	Layers []Layer `gguf:"blk"`
+
+	Classifier       *nn.Linear `gguf:"cls"`
+	ClassifierOutput *nn.Linear `gguf:"cls.output"`
+
+	*Options
+}
+
+func New(c ml.Config) (model.Model, error) {
+	if tokenizer := c.String("tokenizer.ggml.model"); tokenizer != "bert" {
+		return nil, fmt.Errorf("unsupported tokenizer %q", tokenizer)
+	}
+
+	m := Model{
+		WordPiece: model.NewWordPiece(
+			&model.Vocabulary{
+				Values: c.Strings("tokenizer.ggml.tokens"),
+				Types:  c.Uints("tokenizer.ggml.token_type"),
+				BOS:    int32(c.Uint("tokenizer.ggml.cls_token_id", 101)),
+				EOS:    int32(c.Uint("tokenizer.ggml.seperator_token_id", 102)),
+				AddBOS: c.Bool("tokenizer.ggml.add_bos_token", true),
+				AddEOS: c.Bool("tokenizer.ggml.add_eos_token", true),
+			},
+			int32(c.Uint("tokenizer.ggml.unknown_token_id", 100)),
+		),
+		Layers: make([]Layer, c.Uint("block_count")),
+		Options: &Options{
+			hiddenSize:  int(c.Uint("embedding_length")),
+			numHeads:    int(c.Uint("attention.head_count")),
+			eps:         c.Float("attention.layer_norm_epsilon", 1e-12),
+			poolingType: model.PoolingType(c.Uint("pooling_type")),
+		},
+	}
+
+	return &m, nil
+}
+
+func (m *Model) PoolingType() model.PoolingType {
+	return m.poolingType
+}
+
+type SelfAttention struct {
+	Query  *nn.Linear `gguf:"attn_q"`
+	Key    *nn.Linear `gguf:"attn_k"`
+	Value  *nn.Linear `gguf:"attn_v"`
+	Output *nn.Linear `gguf:"attn_output"`
+}
+
+func (sa *SelfAttention) Forward(ctx ml.Context, hiddenState ml.Tensor, opts *Options) ml.Tensor {
+	batchSize := hiddenState.Dim(1)
+	headDim := opts.hiddenSize / opts.numHeads
+
+	q := sa.Query.Forward(ctx, hiddenState)
+	q = q.Reshape(ctx, headDim, opts.numHeads, batchSize)
+
+	k := sa.Key.Forward(ctx, hiddenState)
+	k = k.Reshape(ctx, headDim, opts.numHeads, batchSize)
+
+	v := sa.Value.Forward(ctx, hiddenState)
+	v = v.Reshape(ctx, headDim, opts.numHeads, batchSize)
+
+	// without a cache every input attends to every other input
+	kqv := nn.Attention(ctx, q, k, v, 1.0/math.Sqrt(float64(headDim)), nil)
+	kqv = kqv.Reshape(ctx, opts.hiddenSize, batchSize)
+
+	return sa.Output.Forward(ctx, kqv)
+}
+
+type MLP struct {
+	Up   *nn.Linear `gguf:"ffn_up"`
+	Down *nn.Linear `gguf:"ffn_down"`
+}
+
+func (mlp *MLP) Forward(ctx ml.Context, hiddenState ml.Tensor) ml.Tensor {
+	return mlp.Down.Forward(ctx, mlp.Up.Forward(ctx, hiddenState).GELU(ctx))
+}
+
+type Layer struct {
+	SelfAttention *SelfAttention
+	AttentionNorm *nn.LayerNorm `gguf:"attn_output_norm"`
+	MLP           *MLP
+	MLPNorm       *nn.LayerNorm `gguf:"layer_output_norm"`
+}
+
+func (l *Layer) Forward(ctx ml.Context, hiddenState, outputs ml.Tensor, opts *Options) ml.Tensor {
+	residual := hiddenState
+
+	hiddenState = l.SelfAttention.Forward(ctx, hiddenState, opts)
+
+	// In the final layer (outputs != nil), optimize by pruning to just the token positions
+	// we need hidden states for.
+	if outputs != nil {
+		hiddenState = hiddenState.Rows(ctx, outputs)
+		residual = residual.Rows(ctx, outputs)
+	}
+
+	hiddenState = l.AttentionNorm.Forward(ctx, hiddenState.Add(ctx, residual), opts.eps)
+	residual = hiddenState
+
+	hiddenState = l.MLP.Forward(ctx, hiddenState)
+	return l.MLPNorm.Forward(ctx, hiddenState.Add(ctx, residual), opts.eps)
+}
+
+func (m *Model) Forward(ctx ml.Context, batch input.Batch) (ml.Tensor, error) {
+	positions, err := ctx.Input().FromIntSlice(batch.Positions, len(batch.Positions))
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := ctx.Input().FromIntSlice(batch.Outputs, len(batch.Outputs))
+	if err != nil {
+		return nil, err
+	}
+
+	hiddenState := m.TokenEmbedding.Forward(ctx, batch.Inputs)
+	hiddenState = hiddenState.Add(ctx, m.PositionEmbedding.Forward(ctx, positions))
+	if m.TypeEmbedding != nil {
+		segments := batch.Segments
+		if len(segments) == 0 {
+			segments = make([]int32, len(batch.Positions))
+		}
+
+		types, err := ctx.Input().FromIntSlice(segments, len(segments))
+		if err != nil {
+			return nil, err
+		}
+
+		hiddenState = hiddenState.Add(ctx, m.TypeEmbedding.Forward(ctx, types))
+	}
+
+	hiddenState = m.TokenEmbeddingNorm.Forward(ctx, hiddenState, m.eps)
+
+	for i, layer := range m.Layers {
+		var lastLayerOutputs ml.Tensor
+		if i == len(m.Layers)-1 {
+			lastLayerOutputs = outputs
+		}
+
+		hiddenState = layer.Forward(ctx, hiddenState, lastLayerOutputs, m.Options)
+	}
+
+	if m.poolingType == model.PoolingTypeRank {
+		if m.Classifier != nil {
+			hiddenState = m.Classifier.Forward(ctx, hiddenState).Tanh(ctx)
+		}
+
+		if m.ClassifierOutput != nil {
+			hiddenState = m.ClassifierOutput.Forward(ctx, hiddenState)
+		}
+	}
+
+	return hiddenState, nil
+}
+
+func init() {
+	model.Register("bert", New)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	_ "github.com/qompassai/rose/model/models/bert"
 	_ "github.com/qompassai/rose/model/models/gemma2"
 	_ "github.com/qompassai/rose/model/models/gemma3"
 	_ "github.com/qompassai/rose/model/models/llama"
@@ -17,8 +17,26 @@ type Special int32
 const (
 	SpecialBOS Special = iota
 	SpecialEOS
+
+	// SpecialEOG is any token that ends generation: EOS, EOT or another
+	// token that a model's chat template uses to end a turn
+	SpecialEOG
 )
 
+// eogValues are the values of tokens that end generation for common models,
+// even if the model doesn't declare them as its EOS or EOT token
+var eogValues = []string{
+	"<|eot_id|>",
+	"<|eom_id|>",
+	"<|im_end|>",
+	"<|end|>",
+	"<end_of_turn>",
+	"<|endoftext|>",
+	"<EOT>",
+	"_<EOT>",
+	"<｜end▁of▁sentence｜>",
+}
+
 const (
 	TOKEN_TYPE_NORMAL = iota + 1
 	TOKEN_TYPE_UNKNOWN
@@ -32,6 +50,7 @@ type TextProcessor interface {
 	Encode(s string, addSpecial bool) ([]int32, error)
 	Decode([]int32) (string, error)
 	Is(int32, Special) bool
+	Vocabulary() *Vocabulary
 }
 
 type Vocabulary struct {
@@ -46,6 +65,9 @@ type Vocabulary struct {
 	specialOnce sync.Once
 	special     []string
 
+	eogOnce sync.Once
+	eog     []int32
+
 	valuesOnce sync.Once
 	values     map[string]int32
 
@@ -59,6 +81,16 @@ func (v *Vocabulary) Is(id int32, special Special) bool {
 		return id == v.BOS
 	case SpecialEOS:
 		return id == v.EOS || id == v.EOT
+	case SpecialEOG:
+		v.eogOnce.Do(func() {
+			for _, value := range eogValues {
+				if id := v.Encode(value); id >= 0 {
+					v.eog = append(v.eog, id)
+				}
+			}
+		})
+
+		return id == v.EOS || id == v.EOT || slices.Contains(v.eog, id)
 	default:
 		return false
 	}
@@ -128,6 +160,10 @@ func (bpe BytePairEncoding) Is(id int32, special Special) bool {
 	return bpe.vocab.Is(id, special)
 }
 
+func (bpe BytePairEncoding) Vocabulary() *Vocabulary {
+	return bpe.vocab
+}
+
 func (bpe *BytePairEncoding) split(s string) iter.Seq[string] {
 	return func(yield func(string) bool) {
 		for m, _ := bpe.pre.FindStringMatch(s); m != nil; m, _ = bpe.pre.FindNextMatch(m) {
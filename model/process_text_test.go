@@ -252,3 +252,33 @@ func BenchmarkBytePairEncoding(b *testing.B) {
 		})
 	}
 }
+
+func TestVocabularyIs(t *testing.T) {
+	v := &Vocabulary{
+		Values: []string{"<|begin_of_text|>", "<|end_of_text|>", "<|eot_id|>", "<|eom_id|>", "hello"},
+		BOS:    0,
+		EOS:    1,
+		EOT:    1,
+	}
+
+	cases := []struct {
+		id      int32
+		special Special
+		want    bool
+	}{
+		{0, SpecialBOS, true},
+		{1, SpecialEOS, true},
+		{2, SpecialEOS, false},
+		{1, SpecialEOG, true},
+		{2, SpecialEOG, true},
+		{3, SpecialEOG, true},
+		{4, SpecialEOG, false},
+		{0, SpecialEOG, false},
+	}
+
+	for _, tt := range cases {
+		if got := v.Is(tt.id, tt.special); got != tt.want {
+			t.Errorf("Is(%d, %v) = %v, want %v", tt.id, tt.special, got, tt.want)
+		}
+	}
+}
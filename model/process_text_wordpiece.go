@@ -0,0 +1,198 @@
+package model
+
+import (
+	"iter"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// WordPiece is the tokenizer used by BERT-family models. Text is split into
+// words which are then greedily split into the longest pieces found in the
+// vocabulary. Pieces that start a word are prefixed with spmWhitespaceSep,
+// which is how BERT vocabularies are stored once converted.
+type WordPiece struct {
+	maxTokenLen int
+	unk         int32
+	special     []string
+	vocab       *Vocabulary
+}
+
+var _ TextProcessor = (*WordPiece)(nil)
+
+// NewWordPiece returns a WordPiece tokenizer for vocab, which encodes words
+// it can't split into pieces as the token unk
+func NewWordPiece(vocab *Vocabulary, unk int32) WordPiece {
+	var maxTokenLen int
+	var special []string
+	for i, value := range vocab.Values {
+		if i < len(vocab.Types) && vocab.Types[i] == TOKEN_TYPE_CONTROL {
+			special = append(special, value)
+			continue
+		}
+
+		maxTokenLen = max(maxTokenLen, len(value))
+	}
+
+	slog.Debug("Tokens", "num tokens", len(vocab.Values), "special", len(special), "max token len", maxTokenLen)
+
+	return WordPiece{
+		maxTokenLen: maxTokenLen,
+		unk:         unk,
+		special:     special,
+		vocab:       vocab,
+	}
+}
+
+func (wp WordPiece) Is(id int32, special Special) bool {
+	return wp.vocab.Is(id, special)
+}
+
+func (wp WordPiece) Vocabulary() *Vocabulary {
+	return wp.vocab
+}
+
+// words splits s into lowercase words on whitespace, with each punctuation
+// mark and CJK character as a word of its own
+func (wp *WordPiece) words(s string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		var sb strings.Builder
+		flush := func() bool {
+			if sb.Len() == 0 {
+				return true
+			}
+
+			word := sb.String()
+			sb.Reset()
+			return yield(word)
+		}
+
+		for _, r := range norm.NFD.String(s) {
+			switch {
+			case unicode.IsSpace(r):
+				if !flush() {
+					return
+				}
+			case r == 0, r == unicode.ReplacementChar, unicode.IsControl(r):
+				continue
+			case unicode.IsPunct(r), r < 0x80 && unicode.IsSymbol(r), unicode.Is(unicode.Han, r):
+				if !flush() {
+					return
+				}
+
+				sb.WriteRune(r)
+				if !flush() {
+					return
+				}
+			default:
+				sb.WriteRune(unicode.ToLower(r))
+			}
+		}
+
+		flush()
+	}
+}
+
+// encodeWord splits word into the longest pieces in the vocabulary, or
+// returns the unknown token if some part of it isn't in the vocabulary
+func (wp *WordPiece) encodeWord(word string) []int32 {
+	word = spmWhitespaceSep + word
+
+	var ids []int32
+	for i := 0; i < len(word); {
+		j := min(len(word), i+wp.maxTokenLen)
+		for ; j > i; j-- {
+			if id := wp.vocab.Encode(word[i:j]); id >= 0 {
+				ids = append(ids, id)
+				break
+			}
+		}
+
+		if j == i {
+			slog.Debug("unknown word", "word", word)
+			return []int32{wp.unk}
+		}
+
+		i = j
+	}
+
+	return ids
+}
+
+func (wp WordPiece) Encode(s string, addSpecial bool) ([]int32, error) {
+	fragments := []fragment{{value: s}}
+	for _, special := range wp.special {
+		id := wp.vocab.Encode(special)
+		for i := 0; i < len(fragments); i++ {
+			frag := fragments[i]
+			if len(frag.ids) > 0 {
+				continue
+			}
+
+			var middle []fragment
+			switch i := strings.Index(frag.value, special); {
+			case i < 0:
+				middle = append(middle, frag)
+			case i > 0:
+				middle = append(middle, fragment{value: frag.value[:i]})
+				fallthrough
+			default:
+				middle = append(middle, fragment{value: special, ids: []int32{id}})
+				if rest := frag.value[i+len(special):]; rest != "" {
+					middle = append(middle, fragment{value: rest})
+				}
+			}
+
+			fragments = append(fragments[:i], append(middle, fragments[i+1:]...)...)
+		}
+	}
+
+	var ids []int32
+	for _, frag := range fragments {
+		if len(frag.ids) > 0 {
+			ids = append(ids, frag.ids...)
+			continue
+		}
+
+		for word := range wp.words(frag.value) {
+			ids = append(ids, wp.encodeWord(word)...)
+		}
+	}
+
+	if addSpecial {
+		if wp.vocab.AddBOS {
+			if len(ids) > 0 && ids[0] == wp.vocab.BOS {
+				slog.Warn("adding bos token to prompt which already has it", "id", wp.vocab.BOS)
+			}
+
+			slog.Debug("adding bos token to prompt", "id", wp.vocab.BOS)
+			ids = append([]int32{wp.vocab.BOS}, ids...)
+		}
+
+		if wp.vocab.AddEOS {
+			if len(ids) > 0 && ids[len(ids)-1] == wp.vocab.EOS {
+				slog.Warn("adding eos token to prompt which already has it", "id", wp.vocab.EOS)
+			}
+
+			slog.Debug("adding eos token to prompt", "id", wp.vocab.EOS)
+			ids = append(ids, wp.vocab.EOS)
+		}
+	}
+
+	return ids, nil
+}
+
+func (wp WordPiece) Decode(ids []int32) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		data := wp.vocab.Decode(id)
+		data = strings.ReplaceAll(data, spmWhitespaceSep, " ")
+		if _, err := sb.WriteString(data); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.TrimPrefix(sb.String(), " "), nil
+}
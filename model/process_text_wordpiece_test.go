@@ -0,0 +1,76 @@
+package model
+
+import (
+	"slices"
+	"testing"
+)
+
+func wordPiece(t testing.TB) WordPiece {
+	t.Helper()
+
+	values := []string{
+		"[PAD]", "[UNK]", "[CLS]", "[SEP]",
+		"▁hello", "▁world", "▁play", "ing", "▁!", "▁,", "▁中", "▁文", "▁cafe",
+	}
+
+	types := make([]uint32, len(values))
+	for i := range types {
+		types[i] = TOKEN_TYPE_NORMAL
+		if i < 4 {
+			types[i] = TOKEN_TYPE_CONTROL
+		}
+	}
+
+	return NewWordPiece(&Vocabulary{
+		Values: values,
+		Types:  types,
+		BOS:    2,
+		EOS:    3,
+		AddBOS: true,
+		AddEOS: true,
+	}, 1)
+}
+
+func TestWordPiece(t *testing.T) {
+	tokenizer := wordPiece(t)
+
+	cases := []struct {
+		in         string
+		addSpecial bool
+		want       []int32
+	}{
+		{"hello world", false, []int32{4, 5}},
+		{"Hello, World!", false, []int32{4, 9, 5, 8}},
+		{"  playing\thello\n", false, []int32{6, 7, 4}},
+		{"hello world", true, []int32{2, 4, 5, 3}},
+		{"", true, []int32{2, 3}},
+		{"[CLS]hello[SEP]", false, []int32{2, 4, 3}},
+		{"中文", false, []int32{10, 11}},
+		{"hello playingx world", false, []int32{4, 1, 5}},
+		{"hello\x00�", false, []int32{4}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.in, func(t *testing.T) {
+			ids, err := tokenizer.Encode(tt.in, tt.addSpecial)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("Encode(%q) = %v, want %v", tt.in, ids, tt.want)
+			}
+		})
+	}
+
+	t.Run("decode", func(t *testing.T) {
+		s, err := tokenizer.Decode([]int32{4, 6, 7, 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := "hello playing world"; s != want {
+			t.Errorf("Decode = %q, want %q", s, want)
+		}
+	})
+}
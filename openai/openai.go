@@ -11,6 +11,7 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,25 +37,53 @@ type ErrorResponse struct {
 type Message struct {
 	Role      string     `json:"role"`
 	Content   any        `json:"content"`
+	Reasoning string     `json:"reasoning_content,omitempty"`
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type CompleteChunkChoice struct {
-	Text         string  `json:"text"`
-	Index        int     `json:"index"`
-	FinishReason *string `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type TokenLogprob struct {
+	TopLogprob
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+// CompletionLogprobs is the legacy log-probability format used by the
+// completions endpoint
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
 }
 
 type Usage struct {
@@ -82,19 +111,24 @@ type StreamOptions struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	StreamOptions    *StreamOptions  `json:"stream_options"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model             string             `json:"model"`
+	Messages          []Message          `json:"messages"`
+	Stream            bool               `json:"stream"`
+	StreamOptions     *StreamOptions     `json:"stream_options"`
+	MaxTokens         *int               `json:"max_tokens"`
+	Seed              *int               `json:"seed"`
+	Stop              any                `json:"stop"`
+	Temperature       *float64           `json:"temperature"`
+	FrequencyPenalty  *float64           `json:"frequency_penalty"`
+	PresencePenalty   *float64           `json:"presence_penalty"`
+	TopP              *float64           `json:"top_p"`
+	ResponseFormat    *ResponseFormat    `json:"response_format"`
+	Tools             []api.Tool         `json:"tools"`
+	ToolChoice        *api.ToolChoice    `json:"tool_choice"`
+	ParallelToolCalls *bool              `json:"parallel_tool_calls"`
+	Logprobs          bool               `json:"logprobs"`
+	TopLogprobs       *int               `json:"top_logprobs"`
+	LogitBias         map[string]float64 `json:"logit_bias"`
 }
 
 type ChatCompletion struct {
@@ -118,18 +152,20 @@ type ChatCompletionChunk struct {
 }
 
 type CompletionRequest struct {
-	Model            string         `json:"model"`
-	Prompt           string         `json:"prompt"`
-	FrequencyPenalty float32        `json:"frequency_penalty"`
-	MaxTokens        *int           `json:"max_tokens"`
-	PresencePenalty  float32        `json:"presence_penalty"`
-	Seed             *int           `json:"seed"`
-	Stop             any            `json:"stop"`
-	Stream           bool           `json:"stream"`
-	StreamOptions    *StreamOptions `json:"stream_options"`
-	Temperature      *float32       `json:"temperature"`
-	TopP             float32        `json:"top_p"`
-	Suffix           string         `json:"suffix"`
+	Model            string             `json:"model"`
+	Prompt           string             `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	Suffix           string             `json:"suffix"`
+	Logprobs         *int               `json:"logprobs"`
+	LogitBias        map[string]float64 `json:"logit_bias"`
 }
 
 type Completion struct {
@@ -153,11 +189,11 @@ type CompletionChunk struct {
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
+	ID       string `json:"id,omitempty"`
 	Index    int    `json:"index"`
-	Type     string `json:"type"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
 }
@@ -199,6 +235,8 @@ func NewError(code int, message string) ErrorResponse {
 		etype = "invalid_request_error"
 	case http.StatusNotFound:
 		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_exceeded"
 	default:
 		etype = "api_error"
 	}
@@ -226,7 +264,10 @@ func toolCallId() string {
 func toToolCalls(tc []api.ToolCall) []ToolCall {
 	toolCalls := make([]ToolCall, len(tc))
 	for i, tc := range tc {
-		toolCalls[i].ID = toolCallId()
+		toolCalls[i].ID = tc.ID
+		if toolCalls[i].ID == "" {
+			toolCalls[i].ID = toolCallId()
+		}
 		toolCalls[i].Type = "function"
 		toolCalls[i].Function.Name = tc.Function.Name
 		toolCalls[i].Index = tc.Function.Index
@@ -251,8 +292,9 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_rose",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content, Reasoning: r.Message.Thinking, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -267,8 +309,47 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	}
 }
 
-func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChunk {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
+// toChunkToolCalls converts streamed tool call deltas to the OpenAI format,
+// where the first chunk for a call carries its id and name and later chunks
+// only fragments of its arguments. sent tracks the calls already started.
+func toChunkToolCalls(tcs []api.ToolCall, sent map[int]bool) []ToolCall {
+	var toolCalls []ToolCall
+	for _, tc := range tcs {
+		var toolCall ToolCall
+		toolCall.Index = tc.Function.Index
+		toolCall.Function.Arguments = tc.Function.ArgumentsDelta
+
+		if !sent[tc.Function.Index] {
+			toolCall.ID = tc.ID
+			if toolCall.ID == "" {
+				toolCall.ID = toolCallId()
+			}
+			toolCall.Type = "function"
+			toolCall.Function.Name = tc.Function.Name
+
+			// calls that were not streamed arrive with all of their arguments
+			if toolCall.Function.Arguments == "" && tc.Function.Arguments != nil {
+				args, err := json.Marshal(tc.Function.Arguments)
+				if err != nil {
+					slog.Error("could not marshall function arguments to json", "error", err)
+					continue
+				}
+				toolCall.Function.Arguments = string(args)
+			}
+
+			sent[tc.Function.Index] = true
+		} else if toolCall.Function.Arguments == "" {
+			// the completed call repeats what was already sent
+			continue
+		}
+
+		toolCalls = append(toolCalls, toolCall)
+	}
+	return toolCalls
+}
+
+func toChunk(id string, r api.ChatResponse, sent map[int]bool) ChatCompletionChunk {
+	toolCalls := toChunkToolCalls(r.Message.ToolCalls, sent)
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -276,11 +357,12 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 		Model:             r.Model,
 		SystemFingerprint: "fp_rose",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content, Reasoning: r.Message.Thinking, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
-					if toolCallSent {
+					if len(sent) > 0 {
 						return &finishReasonToolCalls
 					}
 					return &reason
@@ -291,6 +373,54 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 	}
 }
 
+func toTopLogprob(l api.TokenLogprob) TopLogprob {
+	bytes := make([]int, len(l.Token))
+	for i, b := range []byte(l.Token) {
+		bytes[i] = int(b)
+	}
+	return TopLogprob{Token: l.Token, Logprob: l.Logprob, Bytes: bytes}
+}
+
+func toChoiceLogprobs(logprobs []api.Logprob) *ChoiceLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	content := make([]TokenLogprob, len(logprobs))
+	for i, l := range logprobs {
+		content[i] = TokenLogprob{
+			TopLogprob:  toTopLogprob(l.TokenLogprob),
+			TopLogprobs: make([]TopLogprob, len(l.TopLogprobs)),
+		}
+		for j, t := range l.TopLogprobs {
+			content[i].TopLogprobs[j] = toTopLogprob(t)
+		}
+	}
+	return &ChoiceLogprobs{Content: content}
+}
+
+func toCompletionLogprobs(logprobs []api.Logprob) *CompletionLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	var offset int
+	var lp CompletionLogprobs
+	for _, l := range logprobs {
+		lp.Tokens = append(lp.Tokens, l.Token)
+		lp.TokenLogprobs = append(lp.TokenLogprobs, l.Logprob)
+		lp.TextOffset = append(lp.TextOffset, offset)
+		offset += len(l.Token)
+
+		top := make(map[string]float64, len(l.TopLogprobs))
+		for _, t := range l.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+		lp.TopLogprobs = append(lp.TopLogprobs, top)
+	}
+	return &lp
+}
+
 func toUsageGenerate(r api.GenerateResponse) Usage {
 	return Usage{
 		PromptTokens:     r.PromptEvalCount,
@@ -307,8 +437,9 @@ func toCompletion(id string, r api.GenerateResponse) Completion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_rose",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -328,8 +459,9 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_rose",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -396,7 +528,7 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	for _, msg := range r.Messages {
 		switch content := msg.Content.(type) {
 		case string:
-			messages = append(messages, api.Message{Role: msg.Role, Content: content})
+			messages = append(messages, api.Message{Role: msg.Role, Content: content, Thinking: msg.Reasoning})
 		case []any:
 			for _, c := range content {
 				data, ok := c.(map[string]any)
@@ -460,7 +592,7 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 					return nil, errors.New("invalid tool call arguments")
 				}
 			}
-			messages = append(messages, api.Message{Role: msg.Role, ToolCalls: toolCalls})
+			messages = append(messages, api.Message{Role: msg.Role, Thinking: msg.Reasoning, ToolCalls: toolCalls})
 		}
 	}
 
@@ -520,16 +652,57 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		}
 	}
 
+	if r.LogitBias != nil {
+		bias, err := toLogitBias(r.LogitBias)
+		if err != nil {
+			return nil, err
+		}
+		options["logit_bias"] = bias
+	}
+
+	var topLogprobs int
+	if r.TopLogprobs != nil {
+		if !r.Logprobs {
+			return nil, errors.New("logprobs must be true when top_logprobs is set")
+		}
+		topLogprobs = *r.TopLogprobs
+	}
+
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:             r.Model,
+		Messages:          messages,
+		Format:            format,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             r.Tools,
+		ToolChoice:        r.ToolChoice,
+		ParallelToolCalls: r.ParallelToolCalls,
+		ToolCallDeltas:    r.Stream,
+		Logprobs:          r.Logprobs,
+		TopLogprobs:       topLogprobs,
 	}, nil
 }
 
+// toLogitBias converts a logit_bias object keyed by token id strings,
+// rejecting values outside of the range OpenAI accepts
+func toLogitBias(m map[string]float64) (map[int]float64, error) {
+	bias := make(map[int]float64, len(m))
+	for k, v := range m {
+		id, err := strconv.Atoi(k)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid token id %q in logit_bias", k)
+		}
+
+		if v < -100 || v > 100 {
+			return nil, fmt.Errorf("logit_bias for token %d must be between -100 and 100", id)
+		}
+
+		bias[id] = v
+	}
+
+	return bias, nil
+}
+
 func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 	options := make(map[string]any)
 
@@ -572,13 +745,30 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	return api.GenerateRequest{
+	if r.LogitBias != nil {
+		bias, err := toLogitBias(r.LogitBias)
+		if err != nil {
+			return api.GenerateRequest{}, err
+		}
+		options["logit_bias"] = bias
+	}
+
+	req := api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
 		Options: options,
 		Stream:  &r.Stream,
 		Suffix:  r.Suffix,
-	}, nil
+	}
+
+	// the legacy logprobs field is the number of alternatives to return
+	// for each token; zero still returns the sampled token's logprob
+	if r.Logprobs != nil {
+		req.Logprobs = true
+		req.TopLogprobs = *r.Logprobs
+	}
+
+	return req, nil
 }
 
 type BaseWriter struct {
@@ -589,7 +779,8 @@ type ChatWriter struct {
 	stream        bool
 	streamOptions *StreamOptions
 	id            string
-	toolCallSent  bool
+	// indexes of the tool calls started in the stream
+	toolCalls map[int]bool
 	BaseWriter
 }
 
@@ -639,14 +830,14 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 
 	// chat chunk
 	if w.stream {
-		c := toChunk(w.id, chatResponse, w.toolCallSent)
+		if w.toolCalls == nil {
+			w.toolCalls = make(map[int]bool)
+		}
+		c := toChunk(w.id, chatResponse, w.toolCalls)
 		d, err := json.Marshal(c)
 		if err != nil {
 			return 0, err
 		}
-		if !w.toolCallSent && len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
-			w.toolCallSent = true
-		}
 
 		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
 		_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
@@ -872,6 +1063,15 @@ func RetrieveMiddleware() gin.HandlerFunc {
 	}
 }
 
+// completionID returns the ID of a completion. It is the ID the server gave
+// the request, if any, so the completion can be cancelled by its ID.
+func completionID(c *gin.Context, prefix string) string {
+	if id := c.Writer.Header().Get("X-Request-Id"); id != "" {
+		return prefix + id
+	}
+	return fmt.Sprintf("%s%d", prefix, rand.Intn(999))
+}
+
 func CompletionsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req CompletionRequest
@@ -898,7 +1098,7 @@ func CompletionsMiddleware() gin.HandlerFunc {
 		w := &CompleteWriter{
 			BaseWriter:    BaseWriter{ResponseWriter: c.Writer},
 			stream:        req.Stream,
-			id:            fmt.Sprintf("cmpl-%d", rand.Intn(999)),
+			id:            completionID(c, "cmpl-"),
 			streamOptions: req.StreamOptions,
 		}
 
@@ -981,7 +1181,7 @@ func ChatMiddleware() gin.HandlerFunc {
 		w := &ChatWriter{
 			BaseWriter:    BaseWriter{ResponseWriter: c.Writer},
 			stream:        req.Stream,
-			id:            fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			id:            completionID(c, "chatcmpl-"),
 			streamOptions: req.StreamOptions,
 		}
 
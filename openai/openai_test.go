@@ -108,8 +108,9 @@ func TestChatMiddleware(t *testing.T) {
 					"presence_penalty":  5.0,
 					"top_p":             6.0,
 				},
-				Format: json.RawMessage(`"json"`),
-				Stream: &True,
+				Format:         json.RawMessage(`"json"`),
+				Stream:         &True,
+				ToolCallDeltas: true,
 			},
 		},
 		{
@@ -147,8 +148,36 @@ func TestChatMiddleware(t *testing.T) {
 					"presence_penalty":  5.0,
 					"top_p":             6.0,
 				},
-				Format: json.RawMessage(`"json"`),
-				Stream: &True,
+				Format:         json.RawMessage(`"json"`),
+				Stream:         &True,
+				ToolCallDeltas: true,
+			},
+		},
+		{
+			name: "chat handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logprobs": true,
+				"top_logprobs": 3
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Logprobs:    true,
+				TopLogprobs: 3,
+				Stream:      &False,
 			},
 		},
 		{
@@ -283,17 +312,25 @@ func TestChatMiddleware(t *testing.T) {
 								Type       string   `json:"type"`
 								Required   []string `json:"required"`
 								Properties map[string]struct {
-									Type        string   `json:"type"`
-									Description string   `json:"description"`
-									Enum        []string `json:"enum,omitempty"`
+									Type        string          `json:"type"`
+									Description string          `json:"description"`
+									Enum        []string        `json:"enum,omitempty"`
+									Items       json.RawMessage `json:"items,omitempty"`
+									Properties  json.RawMessage `json:"properties,omitempty"`
+									Required    []string        `json:"required,omitempty"`
+									AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 								} `json:"properties"`
 							}{
 								Type:     "object",
 								Required: []string{"location"},
 								Properties: map[string]struct {
-									Type        string   `json:"type"`
-									Description string   `json:"description"`
-									Enum        []string `json:"enum,omitempty"`
+									Type        string          `json:"type"`
+									Description string          `json:"description"`
+									Enum        []string        `json:"enum,omitempty"`
+									Items       json.RawMessage `json:"items,omitempty"`
+									Properties  json.RawMessage `json:"properties,omitempty"`
+									Required    []string        `json:"required,omitempty"`
+									AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 								}{
 									"location": {
 										Type:        "string",
@@ -312,7 +349,125 @@ func TestChatMiddleware(t *testing.T) {
 					"temperature": 1.0,
 					"top_p":       1.0,
 				},
-				Stream: &True,
+				Stream:         &True,
+				ToolCallDeltas: true,
+			},
+		},
+		{
+			name: "chat handler with tool choice",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "What's the weather like in Paris Today?"}
+				],
+				"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {}}}}],
+				"tool_choice": {"type": "function", "function": {"name": "get_weather"}},
+				"parallel_tool_calls": false
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "What's the weather like in Paris Today?",
+					},
+				},
+				Tools: []api.Tool{
+					{
+						Type: "function",
+						Function: api.ToolFunction{
+							Name: "get_weather",
+							Parameters: struct {
+								Type       string   `json:"type"`
+								Required   []string `json:"required"`
+								Properties map[string]struct {
+									Type        string          `json:"type"`
+									Description string          `json:"description"`
+									Enum        []string        `json:"enum,omitempty"`
+									Items       json.RawMessage `json:"items,omitempty"`
+									Properties  json.RawMessage `json:"properties,omitempty"`
+									Required    []string        `json:"required,omitempty"`
+									AnyOf       json.RawMessage `json:"anyOf,omitempty"`
+								} `json:"properties"`
+							}{
+								Type: "object",
+								Properties: map[string]struct {
+									Type        string          `json:"type"`
+									Description string          `json:"description"`
+									Enum        []string        `json:"enum,omitempty"`
+									Items       json.RawMessage `json:"items,omitempty"`
+									Properties  json.RawMessage `json:"properties,omitempty"`
+									Required    []string        `json:"required,omitempty"`
+									AnyOf       json.RawMessage `json:"anyOf,omitempty"`
+								}{},
+							},
+						},
+					},
+				},
+				ToolChoice:        &api.ToolChoice{Mode: api.ToolChoiceFunction, Function: "get_weather"},
+				ParallelToolCalls: &False,
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with invalid tool choice",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"tool_choice": "always"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid tool_choice \"always\"",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"15": -100, "42": 5.5}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+					"logit_bias":  map[string]any{"15": -100.0, "42": 5.5},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with invalid logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"15": -101}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "logit_bias for token 15 must be between -100 and 100",
+					Type:    "invalid_request_error",
+				},
 			},
 		},
 		{
@@ -451,6 +606,61 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "completions handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logprobs": 2
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Logprobs:    true,
+				TopLogprobs: 2,
+				Stream:      &False,
+			},
+		},
+		{
+			name: "completions handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"7": 100}
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+					"logit_bias":        map[string]any{"7": 100.0},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "completions handler with invalid logit bias",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"token": 1}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid token id \"token\" in logit_bias",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "completions handler error forwarding",
 			body: `{
@@ -727,3 +937,133 @@ func TestRetrieveMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestLogprobsConversion(t *testing.T) {
+	logprobs := []api.Logprob{
+		{
+			TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.5},
+			TopLogprobs: []api.TokenLogprob{
+				{Token: "Hi", Logprob: -0.5},
+				{Token: "Hey", Logprob: -1.5},
+			},
+		},
+		{
+			TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.1},
+		},
+	}
+
+	t.Run("chat", func(t *testing.T) {
+		got := toChoiceLogprobs(logprobs)
+		want := &ChoiceLogprobs{
+			Content: []TokenLogprob{
+				{
+					TopLogprob: TopLogprob{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}},
+					TopLogprobs: []TopLogprob{
+						{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}},
+						{Token: "Hey", Logprob: -1.5, Bytes: []int{72, 101, 121}},
+					},
+				},
+				{
+					TopLogprob:  TopLogprob{Token: "!", Logprob: -0.1, Bytes: []int{33}},
+					TopLogprobs: []TopLogprob{},
+				},
+			},
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("logprobs mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("completion", func(t *testing.T) {
+		got := toCompletionLogprobs(logprobs)
+		want := &CompletionLogprobs{
+			Tokens:        []string{"Hi", "!"},
+			TokenLogprobs: []float64{-0.5, -0.1},
+			TopLogprobs: []map[string]float64{
+				{"Hi": -0.5, "Hey": -1.5},
+				{},
+			},
+			TextOffset: []int{0, 2},
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("logprobs mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		if got := toChoiceLogprobs(nil); got != nil {
+			t.Errorf("expected nil, got %v", got)
+		}
+		if got := toCompletionLogprobs(nil); got != nil {
+			t.Errorf("expected nil, got %v", got)
+		}
+	})
+}
+
+func TestChunkToolCalls(t *testing.T) {
+	responses := []api.ChatResponse{
+		{Message: api.Message{ToolCalls: []api.ToolCall{{ID: "call_1", Function: api.ToolCallFunction{Name: "get_weather", ArgumentsDelta: `{"location":`}}}}},
+		{Message: api.Message{ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{ArgumentsDelta: ` "Paris"`}}}}},
+		{Message: api.Message{ToolCalls: []api.ToolCall{
+			{ID: "call_1", Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}, ArgumentsDelta: `}`}},
+			{ID: "call_2", Function: api.ToolCallFunction{Index: 1, Name: "get_time", Arguments: api.ToolCallFunctionArguments{}}},
+		}}},
+		{Message: api.Message{ToolCalls: []api.ToolCall{{ID: "call_2", Function: api.ToolCallFunction{Index: 1, Name: "get_time", Arguments: api.ToolCallFunctionArguments{}}}}}, Done: true, DoneReason: "stop"},
+	}
+
+	want := []string{
+		`[{"id":"call_1","index":0,"type":"function","function":{"name":"get_weather","arguments":"{\"location\":"}}]`,
+		`[{"index":0,"function":{"arguments":" \"Paris\""}}]`,
+		`[{"index":0,"function":{"arguments":"}"}},{"id":"call_2","index":1,"type":"function","function":{"name":"get_time","arguments":"{}"}}]`,
+		`null`,
+	}
+
+	sent := make(map[int]bool)
+	for i, r := range responses {
+		c := toChunk("id", r, sent)
+		got, err := json.Marshal(c.Choices[0].Delta.ToolCalls)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(want[i], string(got)); diff != "" {
+			t.Errorf("chunk %d: tool calls mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+
+	if c := toChunk("id", responses[3], sent); c.Choices[0].FinishReason == nil || *c.Choices[0].FinishReason != "tool_calls" {
+		t.Errorf("expected finish reason tool_calls, got %v", c.Choices[0].FinishReason)
+	}
+}
+
+func TestReasoningContent(t *testing.T) {
+	r := api.ChatResponse{
+		Model:   "test-model",
+		Message: api.Message{Role: "assistant", Thinking: "The user greets me.", Content: "Hello!"},
+	}
+
+	if got := toChatCompletion("id", r).Choices[0].Message.Reasoning; got != "The user greets me." {
+		t.Errorf("expected reasoning_content in the completion, got %q", got)
+	}
+
+	if got := toChunk("id", r, map[int]bool{}).Choices[0].Delta.Reasoning; got != "The user greets me." {
+		t.Errorf("expected reasoning_content in the chunk, got %q", got)
+	}
+
+	req, err := fromChatRequest(ChatCompletionRequest{
+		Model: "test-model",
+		Messages: []Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello!", Reasoning: "The user greets me."},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := req.Messages[1].Thinking; got != "The user greets me." {
+		t.Errorf("expected thinking in the assistant message, got %q", got)
+	}
+}
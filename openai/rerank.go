@@ -0,0 +1,154 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+)
+
+// RerankRequest is a rerank request in the shape used by Jina and Cohere
+type RerankRequest struct {
+	Model           string           `json:"model"`
+	Query           string           `json:"query"`
+	Documents       []RerankDocument `json:"documents"`
+	TopN            int              `json:"top_n"`
+	ReturnDocuments bool             `json:"return_documents"`
+}
+
+// RerankDocument is a document to rerank, given as either a string or an
+// object with a text field
+type RerankDocument struct {
+	Text string `json:"text"`
+}
+
+func (d *RerankDocument) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Text); err == nil {
+		return nil
+	}
+
+	var doc struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return errors.New("documents must be strings or objects with a text field")
+	}
+
+	d.Text = doc.Text
+	return nil
+}
+
+type RerankResponse struct {
+	Model   string         `json:"model"`
+	Results []RerankResult `json:"results"`
+	Usage   RerankUsage    `json:"usage"`
+}
+
+type RerankResult struct {
+	Index          int             `json:"index"`
+	RelevanceScore float64         `json:"relevance_score"`
+	Document       *RerankDocument `json:"document,omitempty"`
+}
+
+type RerankUsage struct {
+	TotalTokens int `json:"total_tokens"`
+}
+
+type RerankWriter struct {
+	BaseWriter
+	model     string
+	documents []RerankDocument
+}
+
+func toRerankResponse(model string, documents []RerankDocument, r api.RerankResponse) RerankResponse {
+	results := make([]RerankResult, len(r.Results))
+	for i, result := range r.Results {
+		results[i] = RerankResult{Index: result.Index, RelevanceScore: result.RelevanceScore}
+		if documents != nil {
+			results[i].Document = &documents[result.Index]
+		}
+	}
+
+	return RerankResponse{
+		Model:   model,
+		Results: results,
+		Usage:   RerankUsage{TotalTokens: r.PromptEvalCount},
+	}
+}
+
+func (w *RerankWriter) writeResponse(data []byte) (int, error) {
+	var rerankResponse api.RerankResponse
+	err := json.Unmarshal(data, &rerankResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(toRerankResponse(w.model, w.documents, rerankResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *RerankWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+func RerankMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RerankRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if req.Query == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "query is required"))
+			return
+		}
+
+		if len(req.Documents) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "documents are required"))
+			return
+		}
+
+		documents := make([]string, len(req.Documents))
+		for i, d := range req.Documents {
+			documents[i] = d.Text
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.RerankRequest{Model: req.Model, Query: req.Query, Documents: documents, TopN: req.TopN}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &RerankWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			model:      req.Model,
+		}
+
+		if req.ReturnDocuments {
+			w.documents = req.Documents
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
@@ -0,0 +1,148 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/qompassai/rose/api"
+)
+
+func TestRerankMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.RerankRequest
+		resp RerankResponse
+		err  ErrorResponse
+	}
+
+	testCases := []testCase{
+		{
+			name: "string documents",
+			body: `{
+				"model": "test-model",
+				"query": "What is a panda?",
+				"documents": ["hi", "The giant panda is a bear"],
+				"top_n": 1
+			}`,
+			req: api.RerankRequest{
+				Model:     "test-model",
+				Query:     "What is a panda?",
+				Documents: []string{"hi", "The giant panda is a bear"},
+				TopN:      1,
+			},
+			resp: RerankResponse{
+				Model:   "test-model",
+				Results: []RerankResult{{Index: 1, RelevanceScore: 0.9}},
+				Usage:   RerankUsage{TotalTokens: 12},
+			},
+		},
+		{
+			name: "object documents returned",
+			body: `{
+				"model": "test-model",
+				"query": "What is a panda?",
+				"documents": [{"text": "hi"}, {"text": "The giant panda is a bear"}],
+				"return_documents": true
+			}`,
+			req: api.RerankRequest{
+				Model:     "test-model",
+				Query:     "What is a panda?",
+				Documents: []string{"hi", "The giant panda is a bear"},
+			},
+			resp: RerankResponse{
+				Model: "test-model",
+				Results: []RerankResult{
+					{Index: 1, RelevanceScore: 0.9, Document: &RerankDocument{Text: "The giant panda is a bear"}},
+					{Index: 0, RelevanceScore: 0.1, Document: &RerankDocument{Text: "hi"}},
+				},
+				Usage: RerankUsage{TotalTokens: 12},
+			},
+		},
+		{
+			name: "missing query",
+			body: `{
+				"model": "test-model",
+				"documents": ["hi"]
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "query is required",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "missing documents",
+			body: `{
+				"model": "test-model",
+				"query": "What is a panda?"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "documents are required",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+	}
+
+	var capturedRequest *api.RerankRequest
+
+	endpoint := func(c *gin.Context) {
+		results := []api.RerankResult{{Index: 1, RelevanceScore: 0.9}, {Index: 0, RelevanceScore: 0.1}}
+		if capturedRequest.TopN > 0 {
+			results = results[:capturedRequest.TopN]
+		}
+
+		c.JSON(http.StatusOK, api.RerankResponse{Model: capturedRequest.Model, Results: results, PromptEvalCount: 12})
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RerankMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/api/rerank", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/api/rerank", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusOK {
+				var errResp ErrorResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(tc.err, errResp); diff != "" {
+					t.Errorf("errors did not match (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(tc.req, *capturedRequest); diff != "" {
+				t.Errorf("requests did not match (-want +got):\n%s", diff)
+			}
+
+			var rerankResp RerankResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &rerankResp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.resp, rerankResp); diff != "" {
+				t.Errorf("responses did not match (-want +got):\n%s", diff)
+			}
+
+			capturedRequest = nil
+		})
+	}
+}
@@ -0,0 +1,967 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
+)
+
+// maxStoredResponses is the number of responses kept for chaining with
+// previous_response_id, after which the oldest are dropped
+const maxStoredResponses = 1000
+
+// storedResponseTTL is how long responses are kept for chaining with
+// previous_response_id
+const storedResponseTTL = 24 * time.Hour
+
+type ResponsesRequest struct {
+	Model              string              `json:"model"`
+	Input              ResponseInput       `json:"input"`
+	Instructions       string              `json:"instructions"`
+	Tools              []ResponseTool      `json:"tools"`
+	ToolChoice         *ResponseToolChoice `json:"tool_choice"`
+	ParallelToolCalls  *bool               `json:"parallel_tool_calls"`
+	PreviousResponseID string              `json:"previous_response_id"`
+	Stream             bool                `json:"stream"`
+	Store              *bool               `json:"store"`
+	MaxOutputTokens    *int                `json:"max_output_tokens"`
+	Temperature        *float64            `json:"temperature"`
+	TopP               *float64            `json:"top_p"`
+	Text               *ResponseText       `json:"text"`
+	Reasoning          *ResponseReasoning  `json:"reasoning"`
+	Metadata           map[string]string   `json:"metadata"`
+}
+
+// ResponseInput is a list of input items. It can be written in JSON as a
+// string, which is a single user message.
+type ResponseInput []ResponseInputItem
+
+func (in *ResponseInput) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*in = ResponseInput{{Type: "message", Role: "user", Content: ResponseContent{{Type: "input_text", Text: text}}}}
+		return nil
+	}
+
+	var items []ResponseInputItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return errors.New("input must be a string or a list of input items")
+	}
+
+	*in = items
+	return nil
+}
+
+// ResponseInputItem is a message, a function call or its output, or
+// reasoning from an earlier response. The fields used depend on Type.
+type ResponseInputItem struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// Role and Content describe a message
+	Role    string          `json:"role,omitempty"`
+	Content ResponseContent `json:"content,omitempty"`
+
+	// CallID, Name and Arguments describe a function_call, and CallID and
+	// Output a function_call_output
+	CallID    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    ResponseContent `json:"output,omitempty"`
+
+	// Summary describes reasoning
+	Summary []ResponseSummary `json:"summary,omitempty"`
+}
+
+// ResponseContent is a list of content parts. It can be written in JSON as
+// a string, which is a single text part.
+type ResponseContent []ResponseContentPart
+
+func (c *ResponseContent) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*c = ResponseContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+
+	var parts []ResponseContentPart
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return errors.New("content must be a string or a list of content parts")
+	}
+
+	*c = parts
+	return nil
+}
+
+type ResponseContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+type ResponseSummary struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ResponseTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ResponseToolChoice is one of "none", "auto" or "required", or an object
+// naming a function, as in {"type": "function", "name": "get_weather"}.
+type ResponseToolChoice struct {
+	api.ToolChoice
+}
+
+func (t ResponseToolChoice) MarshalJSON() ([]byte, error) {
+	if t.Mode != api.ToolChoiceFunction {
+		return json.Marshal(t.Mode)
+	}
+
+	return json.Marshal(map[string]string{"type": "function", "name": t.Function})
+}
+
+func (t *ResponseToolChoice) UnmarshalJSON(b []byte) error {
+	var mode string
+	if err := json.Unmarshal(b, &mode); err == nil {
+		return t.ToolChoice.UnmarshalJSON(b)
+	}
+
+	var f struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("invalid tool_choice: %w", err)
+	}
+
+	if f.Type != "function" || f.Name == "" {
+		return errors.New("invalid tool_choice: expected a function name")
+	}
+
+	t.ToolChoice = api.ToolChoice{Mode: api.ToolChoiceFunction, Function: f.Name}
+	return nil
+}
+
+type ResponseText struct {
+	Format *ResponseTextFormat `json:"format,omitempty"`
+}
+
+type ResponseTextFormat struct {
+	Type   string          `json:"type"`
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+	Strict *bool           `json:"strict,omitempty"`
+}
+
+type ResponseReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+type Response struct {
+	ID                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	Error              *Error               `json:"error"`
+	IncompleteDetails  *IncompleteDetails   `json:"incomplete_details"`
+	Instructions       *string              `json:"instructions"`
+	MaxOutputTokens    *int                 `json:"max_output_tokens"`
+	Model              string               `json:"model"`
+	Output             []ResponseOutputItem `json:"output"`
+	ParallelToolCalls  bool                 `json:"parallel_tool_calls"`
+	PreviousResponseID *string              `json:"previous_response_id"`
+	Reasoning          *ResponseReasoning   `json:"reasoning,omitempty"`
+	Store              bool                 `json:"store"`
+	Temperature        *float64             `json:"temperature"`
+	Text               *ResponseText        `json:"text,omitempty"`
+	ToolChoice         ResponseToolChoice   `json:"tool_choice"`
+	Tools              []ResponseTool       `json:"tools"`
+	TopP               *float64             `json:"top_p"`
+	Usage              *ResponseUsage       `json:"usage"`
+	Metadata           map[string]string    `json:"metadata"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponseUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+// ResponseOutputItem is a message, a function call or reasoning generated
+// by the model. The fields used depend on Type.
+type ResponseOutputItem struct {
+	Type   string
+	ID     string
+	Status string
+
+	// Role and Content describe a message
+	Role    string
+	Content []ResponseOutputText
+
+	// CallID, Name and Arguments describe a function_call
+	CallID    string
+	Name      string
+	Arguments string
+
+	// Summary describes reasoning
+	Summary []ResponseSummary
+}
+
+// MarshalJSON writes only the fields of the item's type, including ones
+// that are empty while the item is streamed.
+func (item ResponseOutputItem) MarshalJSON() ([]byte, error) {
+	switch item.Type {
+	case "message":
+		content := item.Content
+		if content == nil {
+			content = []ResponseOutputText{}
+		}
+		return json.Marshal(struct {
+			Type    string               `json:"type"`
+			ID      string               `json:"id"`
+			Status  string               `json:"status"`
+			Role    string               `json:"role"`
+			Content []ResponseOutputText `json:"content"`
+		}{item.Type, item.ID, item.Status, item.Role, content})
+	case "function_call":
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			ID        string `json:"id"`
+			Status    string `json:"status"`
+			CallID    string `json:"call_id"`
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		}{item.Type, item.ID, item.Status, item.CallID, item.Name, item.Arguments})
+	default:
+		summary := item.Summary
+		if summary == nil {
+			summary = []ResponseSummary{}
+		}
+		return json.Marshal(struct {
+			Type    string            `json:"type"`
+			ID      string            `json:"id"`
+			Summary []ResponseSummary `json:"summary"`
+		}{item.Type, item.ID, summary})
+	}
+}
+
+type ResponseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+// ResponseStore keeps the conversations of recent responses so requests
+// can continue them with previous_response_id. Responses belong to the API
+// key that created them, and are dropped after a day or once there are too
+// many.
+type ResponseStore struct {
+	mu        sync.Mutex
+	responses map[string]storedResponse
+	// order are the IDs of responses, the oldest first
+	order []string
+}
+
+type storedResponse struct {
+	owner     string
+	messages  []api.Message
+	createdAt time.Time
+}
+
+func NewResponseStore() *ResponseStore {
+	return &ResponseStore{responses: make(map[string]storedResponse)}
+}
+
+// Get returns the messages of a response stored for the API key owner and
+// the ones before it
+func (s *ResponseStore) Get(owner, id string) ([]api.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.responses[id]
+	if !ok || r.owner != owner || time.Since(r.createdAt) > storedResponseTTL {
+		return nil, false
+	}
+	return r.messages, true
+}
+
+// Put stores the messages of a response for the API key owner
+func (s *ResponseStore) Put(owner, id string, messages []api.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.responses[id]
+	if !ok {
+		r = storedResponse{owner: owner, createdAt: time.Now()}
+		s.order = append(s.order, id)
+	}
+	r.messages = messages
+	s.responses[id] = r
+
+	for len(s.order) > 0 {
+		oldest := s.responses[s.order[0]]
+		if len(s.order) <= maxStoredResponses && time.Since(oldest.createdAt) <= storedResponseTTL {
+			break
+		}
+
+		delete(s.responses, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func responseID(prefix string) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return prefix + string(b)
+}
+
+// fromResponseInput converts input items to messages
+func fromResponseInput(input ResponseInput) ([]api.Message, error) {
+	var messages []api.Message
+	// reasoning is kept for the assistant message that follows it
+	var thinking string
+	assistant := func() *api.Message {
+		if len(messages) == 0 || messages[len(messages)-1].Role != "assistant" || thinking != "" {
+			messages = append(messages, api.Message{Role: "assistant", Thinking: thinking})
+			thinking = ""
+		}
+		return &messages[len(messages)-1]
+	}
+
+	for _, item := range input {
+		if item.Type == "" && item.Role != "" {
+			item.Type = "message"
+		}
+
+		switch item.Type {
+		case "message":
+			msg := api.Message{Role: item.Role}
+			switch item.Role {
+			case "user", "system":
+			case "developer":
+				msg.Role = "system"
+			case "assistant":
+				msg.Thinking = thinking
+				thinking = ""
+			default:
+				return nil, fmt.Errorf("invalid role %q", item.Role)
+			}
+
+			var text []string
+			for _, part := range item.Content {
+				switch part.Type {
+				case "input_text", "output_text", "refusal":
+					text = append(text, part.Text)
+				case "input_image":
+					img, err := fromImageURL(part.ImageURL)
+					if err != nil {
+						return nil, err
+					}
+					msg.Images = append(msg.Images, img)
+				default:
+					return nil, fmt.Errorf("unsupported content type %q", part.Type)
+				}
+			}
+
+			msg.Content = strings.Join(text, "")
+			messages = append(messages, msg)
+		case "function_call":
+			var tc api.ToolCall
+			tc.ID = item.CallID
+			tc.Function.Name = item.Name
+			if item.Arguments != "" {
+				if err := json.Unmarshal([]byte(item.Arguments), &tc.Function.Arguments); err != nil {
+					return nil, errors.New("invalid function call arguments")
+				}
+			}
+
+			msg := assistant()
+			tc.Function.Index = len(msg.ToolCalls)
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		case "function_call_output":
+			var output []string
+			for _, part := range item.Output {
+				output = append(output, part.Text)
+			}
+			messages = append(messages, api.Message{Role: "tool", Content: strings.Join(output, "")})
+		case "reasoning":
+			for _, s := range item.Summary {
+				thinking += s.Text
+			}
+		default:
+			return nil, fmt.Errorf("unsupported input item type %q", item.Type)
+		}
+	}
+
+	return messages, nil
+}
+
+func fromImageURL(url string) (api.ImageData, error) {
+	for _, t := range []string{"jpeg", "jpg", "png"} {
+		prefix := "data:image/" + t + ";base64,"
+		if strings.HasPrefix(url, prefix) {
+			img, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(url, prefix))
+			if err != nil {
+				return nil, errors.New("invalid image input")
+			}
+			return img, nil
+		}
+	}
+
+	return nil, errors.New("invalid image input")
+}
+
+// fromResponsesRequest converts a request to a chat request, continuing
+// the conversation in previous
+func fromResponsesRequest(r ResponsesRequest, previous []api.Message) (*api.ChatRequest, error) {
+	input, err := fromResponseInput(r.Input)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []api.Message
+	if r.Instructions != "" {
+		messages = append(messages, api.Message{Role: "system", Content: r.Instructions})
+	}
+	messages = append(messages, previous...)
+	messages = append(messages, input...)
+
+	options := make(map[string]any)
+	if r.MaxOutputTokens != nil {
+		options["num_predict"] = *r.MaxOutputTokens
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	} else {
+		options["temperature"] = 1.0
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	} else {
+		options["top_p"] = 1.0
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		if t.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool type %q", t.Type)
+		}
+
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.Parameters) > 0 {
+			if err := json.Unmarshal(t.Parameters, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("invalid parameters for tool %q", t.Name)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	var format json.RawMessage
+	if r.Text != nil && r.Text.Format != nil {
+		switch r.Text.Format.Type {
+		case "json_object":
+			format = json.RawMessage(`"json"`)
+		case "json_schema":
+			format = r.Text.Format.Schema
+		}
+	}
+
+	req := api.ChatRequest{
+		Model:             r.Model,
+		Messages:          messages,
+		Format:            format,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             tools,
+		ParallelToolCalls: r.ParallelToolCalls,
+		ToolCallDeltas:    r.Stream,
+	}
+
+	if r.ToolChoice != nil {
+		req.ToolChoice = &r.ToolChoice.ToolChoice
+	}
+
+	// only an effort turns thinking on or off, so a reasoning object that
+	// asks for a summary leaves it to the model
+	if r.Reasoning != nil && r.Reasoning.Effort != "" {
+		think := r.Reasoning.Effort != "none"
+		req.Think = &think
+	}
+
+	return &req, nil
+}
+
+func toResponseUsage(r api.ChatResponse) *ResponseUsage {
+	return &ResponseUsage{
+		InputTokens:  r.PromptEvalCount,
+		OutputTokens: r.EvalCount,
+		TotalTokens:  r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+type ResponsesWriter struct {
+	BaseWriter
+	stream bool
+	store  *ResponseStore
+	// owner is the ID of the API key the response is stored for
+	owner string
+
+	response Response
+	// messages are the conversation before the response, without the
+	// instructions, which are not carried over to later responses
+	messages []api.Message
+
+	sequence int
+	// the item being generated, if any
+	current *ResponseOutputItem
+	// indexes of the items of function calls by their native index
+	calls map[int]int
+}
+
+// event writes a stream event. Events are only written when streaming.
+func (w *ResponsesWriter) event(name string, data map[string]any) error {
+	if !w.stream {
+		return nil
+	}
+
+	data["type"] = name
+	data["sequence_number"] = w.sequence
+	w.sequence++
+
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, d)))
+	return err
+}
+
+// startItem finishes the item being generated and starts a new one
+func (w *ResponsesWriter) startItem(item ResponseOutputItem) error {
+	if err := w.finishItem(); err != nil {
+		return err
+	}
+
+	w.response.Output = append(w.response.Output, item)
+	index := len(w.response.Output) - 1
+	w.current = &w.response.Output[index]
+	if err := w.event("response.output_item.added", map[string]any{"output_index": index, "item": item}); err != nil {
+		return err
+	}
+
+	switch item.Type {
+	case "message":
+		w.current.Content = []ResponseOutputText{{Type: "output_text", Annotations: []any{}}}
+		return w.event("response.content_part.added", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"content_index": 0,
+			"part":          w.current.Content[0],
+		})
+	case "reasoning":
+		w.current.Summary = []ResponseSummary{{Type: "summary_text"}}
+		return w.event("response.reasoning_summary_part.added", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"summary_index": 0,
+			"part":          w.current.Summary[0],
+		})
+	}
+
+	return nil
+}
+
+func (w *ResponsesWriter) finishItem() error {
+	item := w.current
+	if item == nil {
+		return nil
+	}
+
+	w.current = nil
+	index := len(w.response.Output) - 1
+	switch item.Type {
+	case "message":
+		if err := w.event("response.output_text.done", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"content_index": 0,
+			"text":          item.Content[0].Text,
+		}); err != nil {
+			return err
+		}
+
+		if err := w.event("response.content_part.done", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"content_index": 0,
+			"part":          item.Content[0],
+		}); err != nil {
+			return err
+		}
+	case "function_call":
+		if err := w.event("response.function_call_arguments.done", map[string]any{
+			"item_id":      item.ID,
+			"output_index": index,
+			"arguments":    item.Arguments,
+		}); err != nil {
+			return err
+		}
+	case "reasoning":
+		if err := w.event("response.reasoning_summary_text.done", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"summary_index": 0,
+			"text":          item.Summary[0].Text,
+		}); err != nil {
+			return err
+		}
+
+		if err := w.event("response.reasoning_summary_part.done", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"summary_index": 0,
+			"part":          item.Summary[0],
+		}); err != nil {
+			return err
+		}
+	}
+
+	item.Status = "completed"
+	return w.event("response.output_item.done", map[string]any{"output_index": index, "item": *item})
+}
+
+// add adds a chat response to the output, writing the events for it
+func (w *ResponsesWriter) add(r api.ChatResponse) error {
+	if w.sequence == 0 {
+		w.response.Model = r.Model
+		if err := w.event("response.created", map[string]any{"response": w.response}); err != nil {
+			return err
+		}
+
+		if err := w.event("response.in_progress", map[string]any{"response": w.response}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Thinking != "" {
+		if w.current == nil || w.current.Type != "reasoning" {
+			if err := w.startItem(ResponseOutputItem{Type: "reasoning", ID: responseID("rs_")}); err != nil {
+				return err
+			}
+		}
+
+		w.current.Summary[0].Text += r.Message.Thinking
+		if err := w.event("response.reasoning_summary_text.delta", map[string]any{
+			"item_id":       w.current.ID,
+			"output_index":  len(w.response.Output) - 1,
+			"summary_index": 0,
+			"delta":         r.Message.Thinking,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Content != "" {
+		if w.current == nil || w.current.Type != "message" {
+			if err := w.startItem(ResponseOutputItem{Type: "message", ID: responseID("msg_"), Status: "in_progress", Role: "assistant"}); err != nil {
+				return err
+			}
+		}
+
+		w.current.Content[0].Text += r.Message.Content
+		if err := w.event("response.output_text.delta", map[string]any{
+			"item_id":       w.current.ID,
+			"output_index":  len(w.response.Output) - 1,
+			"content_index": 0,
+			"delta":         r.Message.Content,
+		}); err != nil {
+			return err
+		}
+	}
+
+	for i, tc := range r.Message.ToolCalls {
+		// calls are streamed as deltas by their index, while a response
+		// that is not streamed has every call in full
+		key := tc.Function.Index
+		if !w.stream {
+			key = i
+		}
+
+		arguments := tc.Function.ArgumentsDelta
+		index, ok := w.calls[key]
+		if !ok {
+			callID := tc.ID
+			if callID == "" {
+				callID = toolCallId()
+			}
+
+			if err := w.startItem(ResponseOutputItem{
+				Type:   "function_call",
+				ID:     responseID("fc_"),
+				Status: "in_progress",
+				CallID: callID,
+				Name:   tc.Function.Name,
+			}); err != nil {
+				return err
+			}
+
+			index = len(w.response.Output) - 1
+			if w.calls == nil {
+				w.calls = make(map[int]int)
+			}
+			w.calls[key] = index
+
+			// calls that were not streamed arrive with all of their arguments
+			if arguments == "" && tc.Function.Arguments != nil {
+				b, err := json.Marshal(tc.Function.Arguments)
+				if err != nil {
+					return err
+				}
+				arguments = string(b)
+			}
+		}
+
+		if arguments != "" {
+			item := &w.response.Output[index]
+			item.Arguments += arguments
+			if err := w.event("response.function_call_arguments.delta", map[string]any{
+				"item_id":      item.ID,
+				"output_index": index,
+				"delta":        arguments,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !r.Done {
+		return nil
+	}
+
+	if err := w.finishItem(); err != nil {
+		return err
+	}
+
+	w.response.Status = "completed"
+	if r.DoneReason == "length" {
+		w.response.Status = "incomplete"
+		w.response.IncompleteDetails = &IncompleteDetails{Reason: "max_output_tokens"}
+	}
+	w.response.Usage = toResponseUsage(r)
+
+	if w.response.Store {
+		w.store.Put(w.owner, w.response.ID, append(w.messages, w.outputMessage()))
+	}
+
+	return w.event("response."+w.response.Status, map[string]any{"response": w.response})
+}
+
+// outputMessage returns the response's output as a message to continue
+// the conversation with
+func (w *ResponsesWriter) outputMessage() api.Message {
+	msg := api.Message{Role: "assistant"}
+	for _, item := range w.response.Output {
+		switch item.Type {
+		case "reasoning":
+			msg.Thinking += item.Summary[0].Text
+		case "message":
+			msg.Content += item.Content[0].Text
+		case "function_call":
+			var tc api.ToolCall
+			tc.ID = item.CallID
+			tc.Function.Index = len(msg.ToolCalls)
+			tc.Function.Name = item.Name
+			_ = json.Unmarshal([]byte(item.Arguments), &tc.Function.Arguments)
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		}
+	}
+	return msg
+}
+
+func (w *ResponsesWriter) writeResponse(data []byte) (int, error) {
+	var chatResponse struct {
+		api.ChatResponse
+		Error string `json:"error"`
+	}
+	err := json.Unmarshal(data, &chatResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	if chatResponse.Error != "" {
+		if !w.stream {
+			if !w.ResponseWriter.Written() {
+				w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+			}
+
+			w.ResponseWriter.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(http.StatusInternalServerError, chatResponse.Error)); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}
+
+		// errors after the stream has started are sent as events
+		if err := w.event("error", map[string]any{"code": nil, "message": chatResponse.Error, "param": nil}); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if err := w.add(chatResponse.ChatResponse); err != nil {
+		return 0, err
+	}
+
+	if !w.stream && chatResponse.Done {
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w.ResponseWriter).Encode(w.response); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (w *ResponsesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// ResponsesMiddleware translates Responses API requests to chat requests,
+// keeping responses in store so later requests can continue them
+func ResponsesMiddleware(store *ResponseStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResponsesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if len(req.Input) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "[] is too short - 'input'"))
+			return
+		}
+
+		var previous []api.Message
+		if req.PreviousResponseID != "" {
+			var ok bool
+			previous, ok = store.Get(auth.KeyID(c.Request.Context()), req.PreviousResponseID)
+			if !ok {
+				c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID)))
+				return
+			}
+		}
+
+		chatReq, err := fromResponsesRequest(req, previous)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		response := Response{
+			ID:                responseID("resp_"),
+			Object:            "response",
+			CreatedAt:         time.Now().Unix(),
+			Status:            "in_progress",
+			MaxOutputTokens:   req.MaxOutputTokens,
+			Model:             req.Model,
+			Output:            []ResponseOutputItem{},
+			ParallelToolCalls: req.ParallelToolCalls == nil || *req.ParallelToolCalls,
+			Reasoning:         req.Reasoning,
+			Store:             req.Store == nil || *req.Store,
+			Temperature:       req.Temperature,
+			Text:              req.Text,
+			ToolChoice:        ResponseToolChoice{api.ToolChoice{Mode: api.ToolChoiceAuto}},
+			Tools:             req.Tools,
+			TopP:              req.TopP,
+			Metadata:          req.Metadata,
+		}
+
+		if req.Instructions != "" {
+			response.Instructions = &req.Instructions
+		}
+
+		if req.PreviousResponseID != "" {
+			response.PreviousResponseID = &req.PreviousResponseID
+		}
+
+		if req.ToolChoice != nil {
+			response.ToolChoice = *req.ToolChoice
+		}
+
+		if response.Tools == nil {
+			response.Tools = []ResponseTool{}
+		}
+
+		// the instructions are the first message when they are set
+		messages := chatReq.Messages
+		if req.Instructions != "" {
+			messages = messages[1:]
+		}
+
+		w := &ResponsesWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			stream:     req.Stream,
+			store:      store,
+			owner:      auth.KeyID(c.Request.Context()),
+			response:   response,
+			messages:   messages,
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
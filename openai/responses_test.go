@@ -0,0 +1,573 @@
+package openai
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/qompassai/rose/api"
+)
+
+func TestResponsesMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.ChatRequest
+		err  ErrorResponse
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	img, _ := base64.StdEncoding.DecodeString(image)
+
+	store := NewResponseStore()
+	store.Put("", "resp_previous", []api.Message{
+		{Role: "user", Content: "Hi, I'm Ada."},
+		{Role: "assistant", Content: "Hello Ada!"},
+	})
+	store.Put("key-other", "resp_other", []api.Message{
+		{Role: "user", Content: "Hi, I'm Grace."},
+	})
+
+	weather := api.Tool{Type: "function"}
+	weather.Function.Name = "get_weather"
+	weather.Function.Description = "Get the current weather"
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["location"],
+		"properties": {
+			"location": {"type": "string", "description": "The city and state"}
+		}
+	}`), &weather.Function.Parameters); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name: "string input",
+			body: `{
+				"model": "test-model",
+				"input": "Hello",
+				"instructions": "Be brief.",
+				"max_output_tokens": 100
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Be brief."},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "input items",
+			body: `{
+				"model": "test-model",
+				"input": [
+					{"role": "developer", "content": "You check the weather."},
+					{
+						"type": "message",
+						"role": "user",
+						"content": [
+							{"type": "input_text", "text": "What's the weather like here?"},
+							{"type": "input_image", "image_url": "data:image/jpeg;base64,` + image + `"}
+						]
+					},
+					{"type": "reasoning", "id": "rs_1", "summary": [{"type": "summary_text", "text": "They are in Paris."}]},
+					{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"location\": \"Paris\"}"},
+					{"type": "function_call_output", "call_id": "call_1", "output": "Sunny"}
+				],
+				"tools": [
+					{
+						"type": "function",
+						"name": "get_weather",
+						"description": "Get the current weather",
+						"parameters": {
+							"type": "object",
+							"required": ["location"],
+							"properties": {
+								"location": {"type": "string", "description": "The city and state"}
+							}
+						}
+					}
+				],
+				"tool_choice": {"type": "function", "name": "get_weather"},
+				"parallel_tool_calls": false,
+				"stream": true
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "You check the weather."},
+					{Role: "user", Content: "What's the weather like here?", Images: []api.ImageData{img}},
+					{
+						Role:     "assistant",
+						Thinking: "They are in Paris.",
+						ToolCalls: []api.ToolCall{
+							{
+								ID: "call_1",
+								Function: api.ToolCallFunction{
+									Name:      "get_weather",
+									Arguments: api.ToolCallFunctionArguments{"location": "Paris"},
+								},
+							},
+						},
+					},
+					{Role: "tool", Content: "Sunny"},
+				},
+				Tools:             []api.Tool{weather},
+				ToolChoice:        &api.ToolChoice{Mode: api.ToolChoiceFunction, Function: "get_weather"},
+				ParallelToolCalls: &False,
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:         &True,
+				ToolCallDeltas: true,
+			},
+		},
+		{
+			name: "previous response",
+			body: `{
+				"model": "test-model",
+				"input": "What's my name?",
+				"instructions": "Be brief.",
+				"previous_response_id": "resp_previous",
+				"text": {"format": {"type": "json_schema", "name": "answer", "schema": {"type": "object"}}}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Be brief."},
+					{Role: "user", Content: "Hi, I'm Ada."},
+					{Role: "assistant", Content: "Hello Ada!"},
+					{Role: "user", Content: "What's my name?"},
+				},
+				Format: json.RawMessage(`{"type":"object"}`),
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "unknown previous response",
+			body: `{
+				"model": "test-model",
+				"input": "Hello",
+				"previous_response_id": "resp_unknown"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "Previous response with id 'resp_unknown' not found.",
+					Type:    "not_found_error",
+				},
+			},
+		},
+		{
+			name: "previous response of another key",
+			body: `{
+				"model": "test-model",
+				"input": "Hello",
+				"previous_response_id": "resp_other"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "Previous response with id 'resp_other' not found.",
+					Type:    "not_found_error",
+				},
+			},
+		},
+		{
+			name: "reasoning effort",
+			body: `{
+				"model": "test-model",
+				"input": "Hello",
+				"reasoning": {"effort": "low"}
+			}`,
+			req: api.ChatRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Content: "Hello"}},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				Think:  &True,
+			},
+		},
+		{
+			name: "reasoning summary",
+			body: `{
+				"model": "test-model",
+				"input": "Hello",
+				"reasoning": {"summary": "auto"}
+			}`,
+			req: api.ChatRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Content: "Hello"}},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "unsupported input item",
+			body: `{
+				"model": "test-model",
+				"input": [{"type": "file_search_call", "id": "fs_1"}]
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `unsupported input item type "file_search_call"`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "unsupported tool",
+			body: `{
+				"model": "test-model",
+				"input": "Hello",
+				"tools": [{"type": "web_search_preview"}]
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `unsupported tool type "web_search_preview"`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ResponsesMiddleware(store), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			defer func() { capturedRequest = nil }()
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var errResp ErrorResponse
+			if resp.Code != http.StatusOK {
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+			} else if diff := cmp.Diff(&tc.req, capturedRequest); diff != "" {
+				t.Fatalf("requests did not match: %+v", diff)
+			}
+
+			if diff := cmp.Diff(tc.err, errResp); diff != "" {
+				t.Fatalf("errors did not match for %s:\n%s", tc.name, diff)
+			}
+		})
+	}
+}
+
+func TestResponsesWriter(t *testing.T) {
+	chunks := []api.ChatResponse{
+		{Model: "test-model", Message: api.Message{Role: "assistant", Thinking: "Weather."}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Checking"}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{ID: "call_1", Function: api.ToolCallFunction{Name: "get_weather"}},
+		}}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{Function: api.ToolCallFunction{ArgumentsDelta: `{"location":`}},
+		}}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+			{ID: "call_1", Function: api.ToolCallFunction{
+				Name:           "get_weather",
+				ArgumentsDelta: `"Paris"}`,
+				Arguments:      api.ToolCallFunctionArguments{"location": "Paris"},
+			}},
+		}}},
+		{Model: "test-model", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 5}},
+	}
+
+	store := NewResponseStore()
+
+	endpoint := func(c *gin.Context) {
+		for _, chunk := range chunks {
+			b, _ := json.Marshal(chunk)
+			c.Writer.Write(append(b, '\n'))
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ResponsesMiddleware(store))
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{
+		"model": "test-model",
+		"input": "What's the weather in Paris?",
+		"instructions": "Be brief.",
+		"stream": true
+	}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if ct := resp.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected content type text/event-stream, got %q", ct)
+	}
+
+	var events []string
+	var data []map[string]any
+	for _, event := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+		name, payload, ok := strings.Cut(event, "\ndata: ")
+		if !ok {
+			t.Fatalf("malformed event %q", event)
+		}
+
+		var d map[string]any
+		if err := json.Unmarshal([]byte(payload), &d); err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, strings.TrimPrefix(name, "event: "))
+		data = append(data, d)
+	}
+
+	want := []string{
+		"response.created",
+		"response.in_progress",
+		"response.output_item.added",
+		"response.reasoning_summary_part.added",
+		"response.reasoning_summary_text.delta",
+		"response.reasoning_summary_text.done",
+		"response.reasoning_summary_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.done",
+		"response.output_item.done",
+		"response.completed",
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Fatalf("events did not match:\n%s", diff)
+	}
+
+	for i, event := range events {
+		if data[i]["type"] != event {
+			t.Errorf("expected event %s to have type %s, got %v", event, event, data[i]["type"])
+		}
+
+		if data[i]["sequence_number"] != float64(i) {
+			t.Errorf("expected event %s to have sequence number %d, got %v", event, i, data[i]["sequence_number"])
+		}
+	}
+
+	if arguments := data[17]["arguments"]; arguments != `{"location":"Paris"}` {
+		t.Errorf("expected streamed arguments, got %v", arguments)
+	}
+
+	completed, _ := json.Marshal(data[19]["response"])
+	var response Response
+	if err := json.Unmarshal(completed, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != "completed" || response.Usage == nil || response.Usage.TotalTokens != 15 {
+		t.Errorf("unexpected completed response %s", completed)
+	}
+
+	messages, ok := store.Get("", response.ID)
+	if !ok {
+		t.Fatalf("expected response %s to be stored", response.ID)
+	}
+
+	wantMessages := []api.Message{
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{
+			Role:     "assistant",
+			Thinking: "Weather.",
+			Content:  "Checking",
+			ToolCalls: []api.ToolCall{
+				{
+					ID: "call_1",
+					Function: api.ToolCallFunction{
+						Name:      "get_weather",
+						Arguments: api.ToolCallFunctionArguments{"location": "Paris"},
+					},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(wantMessages, messages); diff != "" {
+		t.Errorf("stored messages did not match:\n%s", diff)
+	}
+}
+
+func TestResponsesWriterNonStreaming(t *testing.T) {
+	endpoint := func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.ChatResponse{
+			Model: "test-model",
+			Message: api.Message{
+				Role:    "assistant",
+				Content: "Once upon a",
+				ToolCalls: []api.ToolCall{
+					{Function: api.ToolCallFunction{Name: "a", Arguments: api.ToolCallFunctionArguments{"x": 1.0}}},
+					{Function: api.ToolCallFunction{Name: "b", Arguments: api.ToolCallFunctionArguments{}}},
+				},
+			},
+			Done:       true,
+			DoneReason: "length",
+		})
+	}
+
+	store := NewResponseStore()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ResponsesMiddleware(store))
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "test-model", "input": "Hi", "store": false}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var response struct {
+		ID                string `json:"id"`
+		Status            string `json:"status"`
+		IncompleteDetails struct {
+			Reason string `json:"reason"`
+		} `json:"incomplete_details"`
+		Output []map[string]any `json:"output"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != "incomplete" || response.IncompleteDetails.Reason != "max_output_tokens" {
+		t.Errorf("expected an incomplete response, got %s", resp.Body.String())
+	}
+
+	if len(response.Output) != 3 {
+		t.Fatalf("expected 3 output items, got %d", len(response.Output))
+	}
+
+	for i, want := range []string{"message", "function_call", "function_call"} {
+		if response.Output[i]["type"] != want || response.Output[i]["status"] != "completed" {
+			t.Errorf("expected a completed %s, got %v", want, response.Output[i])
+		}
+	}
+
+	if response.Output[1]["arguments"] != `{"x":1}` || response.Output[2]["arguments"] != `{}` {
+		t.Errorf("unexpected function call arguments %v and %v", response.Output[1]["arguments"], response.Output[2]["arguments"])
+	}
+
+	if _, ok := store.Get("", response.ID); ok {
+		t.Error("expected the response not to be stored")
+	}
+}
+
+func TestResponsesWriterNonStreamingError(t *testing.T) {
+	endpoint := func(c *gin.Context) {
+		// an error after the handler started responding
+		c.Writer.Write([]byte(`{"error":"model runner has unexpectedly stopped"}`))
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ResponsesMiddleware(NewResponseStore()))
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "test-model", "input": "Hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+	}
+
+	var errResp ErrorResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("expected an error object, got %q: %v", resp.Body.String(), err)
+	}
+
+	want := ErrorResponse{Error: Error{Message: "model runner has unexpectedly stopped", Type: "api_error"}}
+	if diff := cmp.Diff(want, errResp); diff != "" {
+		t.Errorf("errors did not match:\n%s", diff)
+	}
+}
+
+func TestResponseStore(t *testing.T) {
+	store := NewResponseStore()
+	messages := []api.Message{{Role: "user", Content: "Hi"}}
+
+	store.Put("key-a", "resp_a", messages)
+	if _, ok := store.Get("key-b", "resp_a"); ok {
+		t.Error("expected another key to not find the response")
+	}
+
+	if got, ok := store.Get("key-a", "resp_a"); !ok || len(got) != 1 {
+		t.Errorf("expected the response's key to find it, got %v", got)
+	}
+
+	// expired responses are not returned, and are dropped when another
+	// response is stored
+	r := store.responses["resp_a"]
+	r.createdAt = time.Now().Add(-storedResponseTTL - time.Minute)
+	store.responses["resp_a"] = r
+	if _, ok := store.Get("key-a", "resp_a"); ok {
+		t.Error("expected an expired response to not be found")
+	}
+
+	store.Put("key-a", "resp_b", messages)
+	if _, ok := store.responses["resp_a"]; ok || len(store.order) != 1 {
+		t.Errorf("expected the expired response to be dropped, got %v", store.order)
+	}
+
+	for i := range maxStoredResponses + 1 {
+		store.Put("key-a", fmt.Sprintf("resp_%d", i), messages)
+	}
+
+	if len(store.responses) != maxStoredResponses || len(store.order) != maxStoredResponses {
+		t.Errorf("expected %d responses, got %d", maxStoredResponses, len(store.responses))
+	}
+
+	if _, ok := store.Get("key-a", "resp_b"); ok {
+		t.Error("expected the oldest response to be dropped")
+	}
+}
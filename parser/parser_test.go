@@ -26,6 +26,7 @@ func TestParseFileFile(t *testing.T) {
 	input := `
 FROM model1
 ADAPTER adapter1
+DRAFT draft1
 LICENSE MIT
 PARAMETER param1 value1
 PARAMETER param2 value2
@@ -46,6 +47,7 @@ TEMPLATE """{{ if .System }}<|start_header_id|>system<|end_header_id|>
 	expectedCommands := []Command{
 		{Name: "model", Args: "model1"},
 		{Name: "adapter", Args: "adapter1"},
+		{Name: "draft", Args: "draft1"},
 		{Name: "license", Args: "MIT"},
 		{Name: "param1", Args: "value1"},
 		{Name: "param2", Args: "value2"},
@@ -557,6 +559,7 @@ func TestParseFileFormatParseFile(t *testing.T) {
 		`
 FROM foo
 ADAPTER adapter1
+DRAFT draft1
 LICENSE MIT
 PARAMETER param1 value1
 PARAMETER param2 value2
@@ -690,6 +693,15 @@ func TestCreateRequest(t *testing.T) {
 		},
 		{
 			`FROM test
+DRAFT test-draft
+`,
+			&api.CreateRequest{
+				From:  "test",
+				Draft: "test-draft",
+			},
+		},
+		{
+			`FROM test
 TEMPLATE some template
 `,
 			&api.CreateRequest{
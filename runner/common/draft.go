@@ -0,0 +1,56 @@
+package common
+
+import (
+	"fmt"
+)
+
+const (
+	// draftVocabMaxSizeDifference is how many more tokens one of a model
+	// and its draft model may have than the other, such as for padding
+	draftVocabMaxSizeDifference = 128
+
+	// draftVocabCheckStart skips the first few tokens, which are often
+	// special tokens that differ between models sharing a vocabulary
+	draftVocabCheckStart = 5
+)
+
+// CheckDraftVocab checks that a draft model has the same vocabulary as the
+// model it proposes tokens for, so that its tokens can be verified without
+// translating them. decode and draftDecode convert a token id into its text
+// piece for the model and the draft model.
+func CheckDraftVocab(size int, decode func(int) string, draftSize int, draftDecode func(int) string) error {
+	if diff := size - draftSize; diff > draftVocabMaxSizeDifference || diff < -draftVocabMaxSizeDifference {
+		return fmt.Errorf("draft model vocabulary size %d is too different from the model's %d", draftSize, size)
+	}
+
+	for i := draftVocabCheckStart; i < min(size, draftSize); i++ {
+		if piece, draftPiece := decode(i), draftDecode(i); piece != draftPiece {
+			return fmt.Errorf("draft model token %d %q doesn't match the model's %q", i, draftPiece, piece)
+		}
+	}
+
+	return nil
+}
+
+// Argmax returns the most likely token of logits, which is how a draft model
+// picks the tokens it proposes
+func Argmax(logits []float32) int {
+	var best int
+	for i, l := range logits {
+		if l > logits[best] {
+			best = i
+		}
+	}
+
+	return best
+}
+
+// CommonPrefix returns how many tokens at the start of a and b are the same
+func CommonPrefix[T comparable](a, b []T) int {
+	var n int
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
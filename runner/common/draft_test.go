@@ -0,0 +1,67 @@
+package common
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCheckDraftVocab(t *testing.T) {
+	decode := func(id int) string { return strconv.Itoa(id) }
+
+	cases := []struct {
+		name        string
+		size        int
+		draftSize   int
+		draftDecode func(int) string
+		wantErr     bool
+	}{
+		{"same", 1000, 1000, decode, false},
+		{"padded", 1000, 1100, decode, false},
+		{"too different", 1000, 2000, decode, true},
+		{"special tokens differ", 1000, 1000, func(id int) string {
+			if id < 3 {
+				return "<special>"
+			}
+			return decode(id)
+		}, false},
+		{"tokens differ", 1000, 1000, func(id int) string {
+			if id == 500 {
+				return "other"
+			}
+			return decode(id)
+		}, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckDraftVocab(tt.size, decode, tt.draftSize, tt.draftDecode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestArgmax(t *testing.T) {
+	if got := Argmax([]float32{1, 4, 2, 4, 0}); got != 1 {
+		t.Errorf("expected 1, got %d", got)
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	cases := []struct {
+		a, b []int32
+		want int
+	}{
+		{nil, []int32{1}, 0},
+		{[]int32{1, 2, 3}, []int32{1, 2}, 2},
+		{[]int32{1, 2, 3}, []int32{1, 4, 3}, 1},
+		{[]int32{1, 2}, []int32{1, 2}, 2},
+	}
+
+	for _, tt := range cases {
+		if got := CommonPrefix(tt.a, tt.b); got != tt.want {
+			t.Errorf("CommonPrefix(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"math"
+	"slices"
+
+	"github.com/qompassai/rose/api"
+)
+
+// MaxTopLogprobs is the largest number of alternative tokens that can be
+// requested for each generated token
+const MaxTopLogprobs = 20
+
+// Logprobs computes the log-probability of the selected token from the raw,
+// untransformed logits produced by the model along with the topN most likely
+// tokens at that position. decode converts a token id into its text piece.
+func Logprobs(logits []float32, selected int, topN int, decode func(int) string) api.Logprob {
+	// log-softmax: logit - (max + log(sum(exp(logit - max))))
+	maxLogit := math.Inf(-1)
+	for _, l := range logits {
+		maxLogit = max(maxLogit, float64(l))
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l) - maxLogit)
+	}
+	logSum := maxLogit + math.Log(sum)
+
+	lp := api.Logprob{
+		TokenLogprob: api.TokenLogprob{
+			Token:   decode(selected),
+			Logprob: float64(logits[selected]) - logSum,
+		},
+	}
+
+	topN = min(topN, MaxTopLogprobs, len(logits))
+	if topN <= 0 {
+		return lp
+	}
+
+	// track the topN largest logits in descending order; topN is small
+	// so insertion is cheaper than sorting the whole vocabulary
+	top := make([]int, 0, topN)
+	for i, l := range logits {
+		if len(top) == topN && l <= logits[top[topN-1]] {
+			continue
+		}
+
+		j, _ := slices.BinarySearchFunc(top, l, func(id int, target float32) int {
+			if logits[id] >= target {
+				return -1
+			}
+			return 1
+		})
+
+		if len(top) < topN {
+			top = append(top, 0)
+		}
+		copy(top[j+1:], top[j:])
+		top[j] = i
+	}
+
+	lp.TopLogprobs = make([]api.TokenLogprob, len(top))
+	for i, id := range top {
+		lp.TopLogprobs[i] = api.TokenLogprob{
+			Token:   decode(id),
+			Logprob: float64(logits[id]) - logSum,
+		}
+	}
+
+	return lp
+}
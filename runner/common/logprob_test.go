@@ -0,0 +1,72 @@
+package common
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestLogprobs(t *testing.T) {
+	decode := func(id int) string { return strconv.Itoa(id) }
+
+	logits := []float32{1, 4, 2, 3, 0}
+
+	t.Run("selected only", func(t *testing.T) {
+		lp := Logprobs(logits, 1, 0, decode)
+		if lp.Token != "1" {
+			t.Errorf("expected token 1, got %q", lp.Token)
+		}
+
+		var sum float64
+		for _, l := range logits {
+			sum += math.Exp(float64(l))
+		}
+		want := 4 - math.Log(sum)
+		if math.Abs(lp.Logprob-want) > 1e-6 {
+			t.Errorf("expected logprob %f, got %f", want, lp.Logprob)
+		}
+
+		if lp.TopLogprobs != nil {
+			t.Errorf("expected no top logprobs, got %v", lp.TopLogprobs)
+		}
+	})
+
+	t.Run("top", func(t *testing.T) {
+		lp := Logprobs(logits, 2, 3, decode)
+
+		var got []string
+		for _, tl := range lp.TopLogprobs {
+			got = append(got, tl.Token)
+		}
+
+		want := []string{"1", "3", "2"}
+		if len(got) != len(want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("expected %v, got %v", want, got)
+				break
+			}
+		}
+
+		if lp.TopLogprobs[2].Logprob != lp.Logprob {
+			t.Errorf("expected selected token logprob %f to match top entry %f", lp.Logprob, lp.TopLogprobs[2].Logprob)
+		}
+	})
+
+	t.Run("more than vocab", func(t *testing.T) {
+		lp := Logprobs(logits, 0, 10, decode)
+		if len(lp.TopLogprobs) != len(logits) {
+			t.Errorf("expected %d top logprobs, got %d", len(logits), len(lp.TopLogprobs))
+		}
+
+		var total float64
+		for _, tl := range lp.TopLogprobs {
+			total += math.Exp(tl.Logprob)
+		}
+		if math.Abs(total-1) > 1e-6 {
+			t.Errorf("expected probabilities to sum to 1, got %f", total)
+		}
+	})
+}
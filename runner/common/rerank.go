@@ -0,0 +1,28 @@
+package common
+
+import "slices"
+
+// RerankTokens joins a query and document, each tokenized with the special
+// tokens the model adds to a sequence, into the single sequence a reranking
+// model scores, such as [CLS] query [SEP] document [SEP]. The document's
+// leading bos token is dropped since the pair is one sequence.
+func RerankTokens[T comparable](query, document []T, bos T) []T {
+	if len(document) > 0 && document[0] == bos {
+		document = document[1:]
+	}
+
+	return append(slices.Clip(query), document...)
+}
+
+// RerankSegments returns the segment of each token that RerankTokens joins
+// query and document into: 0 for the query, including its trailing
+// separator, and 1 for the document. Models with token types, such as BERT
+// cross-encoders, are trained with the document in the second segment.
+func RerankSegments[T comparable](query, document []T, bos T) []int32 {
+	segments := make([]int32, len(RerankTokens(query, document, bos)))
+	for i := len(query); i < len(segments); i++ {
+		segments[i] = 1
+	}
+
+	return segments
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRerankTokens(t *testing.T) {
+	cases := []struct {
+		name            string
+		query, document []int
+		want            []int
+		segments        []int32
+	}{
+		{"bert", []int{101, 1, 2, 102}, []int{101, 3, 102}, []int{101, 1, 2, 102, 3, 102}, []int32{0, 0, 0, 0, 1, 1}},
+		{"no bos", []int{1, 2, 9}, []int{3, 9}, []int{1, 2, 9, 3, 9}, []int32{0, 0, 0, 1, 1}},
+		{"empty document", []int{101, 1, 102}, nil, []int{101, 1, 102}, []int32{0, 0, 0}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			query := slices.Clone(tt.query)
+			if got := RerankTokens(query, tt.document, 101); !slices.Equal(got, tt.want) {
+				t.Errorf("RerankTokens = %v, want %v", got, tt.want)
+			}
+
+			if !slices.Equal(query, tt.query) {
+				t.Errorf("query changed to %v", query)
+			}
+
+			if got := RerankSegments(query, tt.document, 101); !slices.Equal(got, tt.segments) {
+				t.Errorf("RerankSegments = %v, want %v", got, tt.segments)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinSnapshotTokens is how long a prefix shared between prompts must be
+// before it's worth snapshotting automatically, since short prompts are
+// quicker to process than to load from disk
+const MinSnapshotTokens = 1024
+
+// SnapshotName returns the name of the file that a snapshot of the KV cache
+// for tokens is stored in. It starts with the number of tokens so that
+// snapshots can be matched to prompts without reading them.
+func SnapshotName(tokens []int32) string {
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, tokens)
+	return fmt.Sprintf("%d-%x", len(tokens), h.Sum(nil))
+}
+
+// FindSnapshot returns the path of the snapshot in dir for the longest
+// prefix of tokens and the length of that prefix, or 0 if there isn't one
+func FindSnapshot(dir string, tokens []int32) (string, int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", 0
+	}
+
+	var path string
+	var longest int
+	for _, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "-")
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n <= longest || n > len(tokens) {
+			continue
+		}
+
+		if entry.Name() == SnapshotName(tokens[:n]) {
+			path = filepath.Join(dir, entry.Name())
+			longest = n
+		}
+	}
+
+	return path, longest
+}
+
+// HasSnapshot reports whether dir has a snapshot for exactly tokens
+func HasSnapshot(dir string, tokens []int32) bool {
+	_, err := os.Stat(filepath.Join(dir, SnapshotName(tokens)))
+	return err == nil
+}
+
+// WriteSnapshot creates the snapshot for tokens in dir by calling write with
+// the path to write it to. The snapshot is only moved into place once write
+// succeeds, so a partially written snapshot is never found.
+func WriteSnapshot(dir string, tokens []int32, write func(path string) error) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, SnapshotName(tokens))
+	partial := path + ".partial"
+	if err := write(partial); err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	return os.Rename(partial, path)
+}
+
+// UseSnapshot marks the snapshot at path as used, so that it's pruned after
+// snapshots that were used less recently
+func UseSnapshot(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// PruneSnapshots deletes the least recently used snapshots in dir until the
+// rest take up at most size bytes
+func PruneSnapshots(dir string, size int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type snapshot struct {
+		path string
+		size int64
+		used time.Time
+	}
+
+	var snapshots []snapshot
+	var total int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot{filepath.Join(dir, entry.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	slices.SortFunc(snapshots, func(a, b snapshot) int {
+		return cmp.Compare(a.used.UnixNano(), b.used.UnixNano())
+	})
+
+	for _, s := range snapshots {
+		if total <= size {
+			break
+		}
+
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		total -= s.size
+	}
+
+	return nil
+}
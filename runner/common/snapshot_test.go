@@ -0,0 +1,113 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(tokens []int32) {
+		t.Helper()
+		if err := WriteSnapshot(dir, tokens, func(path string) error {
+			return os.WriteFile(path, []byte("snapshot"), 0o644)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write([]int32{1, 2})
+	write([]int32{1, 2, 3, 4})
+	write([]int32{1, 5, 6})
+
+	if err := WriteSnapshot(dir, []int32{1, 2, 3}, func(path string) error {
+		if err := os.WriteFile(path, []byte("snap"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("failed")
+	}); err == nil {
+		t.Error("expected an error")
+	}
+
+	cases := []struct {
+		name   string
+		tokens []int32
+		want   int
+	}{
+		{"longest", []int32{1, 2, 3, 4, 5}, 4},
+		{"exact", []int32{1, 2, 3, 4}, 4},
+		{"failed write", []int32{1, 2, 3}, 2},
+		{"other prefix", []int32{1, 5, 6, 7}, 3},
+		{"none", []int32{2, 1}, 0},
+		{"too short", []int32{1}, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path, n := FindSnapshot(dir, tt.tokens)
+			if n != tt.want {
+				t.Fatalf("FindSnapshot = %d, want %d", n, tt.want)
+			}
+
+			if n == 0 {
+				if path != "" {
+					t.Errorf("FindSnapshot path = %q, want none", path)
+				}
+				return
+			}
+
+			if want := filepath.Join(dir, SnapshotName(tt.tokens[:n])); path != want {
+				t.Errorf("FindSnapshot path = %q, want %q", path, want)
+			}
+
+			if !HasSnapshot(dir, tt.tokens[:n]) {
+				t.Error("HasSnapshot = false, want true")
+			}
+		})
+	}
+
+	if _, n := FindSnapshot(filepath.Join(dir, "missing"), []int32{1, 2}); n != 0 {
+		t.Errorf("FindSnapshot in a missing directory = %d, want 0", n)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	dir := t.TempDir()
+
+	start := time.Now()
+	for i, tokens := range [][]int32{{1}, {2}, {3}, {4}} {
+		if err := WriteSnapshot(dir, tokens, func(path string) error {
+			return os.WriteFile(path, make([]byte, 10), 0o644)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		used := start.Add(time.Duration(i-4) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, SnapshotName(tokens)), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest snapshot is used again, so it's kept
+	UseSnapshot(filepath.Join(dir, SnapshotName([]int32{1})))
+
+	if err := PruneSnapshots(dir, 25); err != nil {
+		t.Fatal(err)
+	}
+
+	var kept [][]int32
+	for _, tokens := range [][]int32{{1}, {2}, {3}, {4}} {
+		if HasSnapshot(dir, tokens) {
+			kept = append(kept, tokens)
+		}
+	}
+
+	if want := [][]int32{{1}, {4}}; !slices.EqualFunc(kept, want, slices.Equal) {
+		t.Errorf("kept snapshots %v, want %v", kept, want)
+	}
+}
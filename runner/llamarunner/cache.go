@@ -5,9 +5,17 @@ import (
 	"fmt"
 	"log/slog"
 	"reflect"
+	"slices"
 	"time"
 
 	"github.com/qompassai/rose/llama"
+	"github.com/qompassai/rose/runner/common"
+)
+
+var (
+	errSnapshotNotSupported = errors.New("saving the cache is not supported")
+	errNotCached            = errors.New("prompt is not in the cache")
+	errNoSnapshot           = errors.New("no saved cache for prompt")
 )
 
 type InputCache struct {
@@ -20,10 +28,21 @@ type InputCache struct {
 	// optimize cache eviction for multiple users
 	multiUserCache bool
 
+	// directory that snapshots of the cache are saved to and restored from
+	snapshotDir string
+
+	// automatically snapshot long prefixes shared between prompts and
+	// restore them for later prompts
+	autoSnapshot bool
+
+	// most bytes of snapshots kept in snapshotDir when saving them
+	// automatically, or 0 for no limit
+	maxSnapshots int64
+
 	lc *llama.Context
 }
 
-func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool) (*InputCache, error) {
+func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool, snapshotDir string, autoSnapshot bool, maxSnapshots int64) (*InputCache, error) {
 	if kvSize/numSlots < 1 {
 		return nil, fmt.Errorf("must have at least one kv cache entry per parallel sequence (kv: %v parallel: %v)", kvSize, numSlots)
 	}
@@ -41,6 +60,9 @@ func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache b
 		numCtx:         kvSize / numSlots,
 		slots:          slots,
 		multiUserCache: multiUserCache,
+		snapshotDir:    snapshotDir,
+		autoSnapshot:   autoSnapshot && snapshotDir != "",
+		maxSnapshots:   maxSnapshots,
 		lc:             lc,
 	}, nil
 }
@@ -85,6 +107,8 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 
 	if !cachePrompt {
 		numPast = 0
+	} else if c.autoSnapshot {
+		numPast = c.autoRestore(slot, prompt, numPast)
 	}
 
 	slot.InUse = true
@@ -104,6 +128,10 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	slog.Debug("loading cache slot", "id", slot.Id, "cache", len(slot.Inputs), "prompt", len(prompt),
 		"used", numPast, "remaining", len(prompt)-numPast)
 
+	if cachePrompt && c.autoSnapshot {
+		c.autoSave(slot, prompt[:numPast])
+	}
+
 	prompt = prompt[numPast:]
 	slot.Inputs = slot.Inputs[:numPast]
 
@@ -181,6 +209,178 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	return oldestSlot, longest, nil
 }
 
+// autoRestore restores the snapshot for the longest prefix of prompt into
+// slot if it has more of prompt than the slot does, returning how much of
+// prompt is now in the slot
+func (c *InputCache) autoRestore(slot *InputCacheSlot, prompt []input, numPast int) int {
+	path, n := common.FindSnapshot(c.snapshotDir, snapshotTokens(prompt))
+	if n <= numPast {
+		return numPast
+	}
+
+	if err := c.restore(slot, path, prompt[:n]); err != nil {
+		slog.Warn("failed to restore cache", "path", path, "error", err)
+		return 0
+	}
+
+	return n
+}
+
+// autoSave saves inputs, which must be the whole of slot's cache, if they're
+// long enough to be worth restoring and there isn't already a snapshot for
+// part of them
+func (c *InputCache) autoSave(slot *InputCacheSlot, inputs []input) {
+	if len(inputs) < common.MinSnapshotTokens {
+		return
+	}
+
+	tokens := snapshotTokens(inputs)
+	if len(tokens) != len(inputs) {
+		return
+	}
+
+	if _, n := common.FindSnapshot(c.snapshotDir, tokens); n > 0 {
+		return
+	}
+
+	if err := c.save(slot, tokens); err != nil {
+		slog.Warn("failed to save cache", "error", err)
+		return
+	}
+
+	if c.maxSnapshots > 0 {
+		if err := common.PruneSnapshots(c.snapshotDir, c.maxSnapshots); err != nil {
+			slog.Warn("failed to prune saved caches", "error", err)
+		}
+	}
+}
+
+// SaveSnapshot saves the cache for prompt, which must already be in a cache
+// slot, returning the number of inputs saved
+func (c *InputCache) SaveSnapshot(prompt []input) (int, error) {
+	if c.snapshotDir == "" {
+		return 0, errSnapshotNotSupported
+	}
+
+	tokens := snapshotTokens(prompt)
+	if len(tokens) != len(prompt) {
+		return 0, errors.New("prompts with images cannot be saved")
+	}
+
+	for i, s := range c.slots {
+		if s.InUse || countCommonPrefix(s.Inputs, prompt) != len(prompt) {
+			continue
+		}
+
+		// the whole sequence is saved, so drop anything after the prompt
+		if !c.lc.KvCacheSeqRm(s.Id, len(prompt), -1) {
+			continue
+		}
+		c.slots[i].Inputs = s.Inputs[:len(prompt)]
+
+		if err := c.save(&c.slots[i], tokens); err != nil {
+			return 0, err
+		}
+
+		return len(prompt), nil
+	}
+
+	return 0, errNotCached
+}
+
+// RestoreSnapshot loads the snapshot for the longest prefix of prompt into
+// the least recently used slot, unless a slot already has as much of prompt.
+// It returns the number of inputs of prompt in the cache.
+func (c *InputCache) RestoreSnapshot(prompt []input) (int, error) {
+	if c.snapshotDir == "" {
+		return 0, errSnapshotNotSupported
+	}
+
+	path, n := common.FindSnapshot(c.snapshotDir, snapshotTokens(prompt))
+	if n == 0 {
+		return 0, errNoSnapshot
+	}
+
+	var longest int
+	var oldestSlot *InputCacheSlot
+	for i, s := range c.slots {
+		longest = max(longest, countCommonPrefix(s.Inputs, prompt))
+
+		if !s.InUse && (oldestSlot == nil || s.lastUsed.Before(oldestSlot.lastUsed)) {
+			oldestSlot = &c.slots[i]
+		}
+	}
+
+	if longest >= n {
+		return longest, nil
+	}
+
+	if oldestSlot == nil {
+		return 0, errors.New("no available cache slots")
+	}
+
+	if err := c.restore(oldestSlot, path, prompt[:n]); err != nil {
+		return 0, err
+	}
+
+	oldestSlot.lastUsed = time.Now()
+	return n, nil
+}
+
+// save writes the cache of slot, which must hold exactly tokens, to the
+// snapshot directory
+func (c *InputCache) save(slot *InputCacheSlot, tokens []int32) error {
+	slog.Debug("saving cache slot", "id", slot.Id, "inputs", len(tokens))
+
+	return common.WriteSnapshot(c.snapshotDir, tokens, func(path string) error {
+		ids := make([]int, len(tokens))
+		for i, t := range tokens {
+			ids[i] = int(t)
+		}
+
+		return c.lc.StateSeqSaveFile(path, slot.Id, ids)
+	})
+}
+
+// restore replaces the contents of slot with the snapshot at path, which
+// holds inputs
+func (c *InputCache) restore(slot *InputCacheSlot, path string, inputs []input) error {
+	slog.Debug("restoring cache slot", "id", slot.Id, "inputs", len(inputs), "path", path)
+
+	c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+	slot.Inputs = slot.Inputs[:0]
+
+	tokens, err := c.lc.StateSeqLoadFile(path, slot.Id, len(inputs))
+	if err != nil {
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		return err
+	}
+
+	if len(tokens) != len(inputs) {
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		return fmt.Errorf("saved cache has %d tokens, expected %d", len(tokens), len(inputs))
+	}
+
+	slot.Inputs = slices.Clone(inputs)
+	common.UseSnapshot(path)
+	return nil
+}
+
+// snapshotTokens returns the tokens at the start of inputs, up to the first
+// image, which is as much as can be matched to a snapshot
+func snapshotTokens(inputs []input) []int32 {
+	var tokens []int32
+	for _, inp := range inputs {
+		if inp.embed != nil {
+			break
+		}
+
+		tokens = append(tokens, int32(inp.token))
+	}
+
+	return tokens
+}
+
 func countCommonPrefix(a []input, b []input) int {
 	var count int
 
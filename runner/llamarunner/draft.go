@@ -0,0 +1,105 @@
+package llamarunner
+
+import (
+	"fmt"
+
+	"github.com/qompassai/rose/llama"
+	"github.com/qompassai/rose/runner/common"
+)
+
+// draftModel is a smaller model that proposes tokens for the model to verify
+// all at once, which is faster than generating them one at a time when the
+// model agrees with most of them
+type draftModel struct {
+	model *llama.Model
+	lc    *llama.Context
+	batch *llama.Batch
+
+	// tokens stored in the draft model's KV cache for each cache slot,
+	// which it keeps in step with the model's
+	tokens [][]int
+}
+
+func newDraftModel(path string, params llama.ModelParams, target *llama.Model, ctxParams llama.ContextParams, batchSize int, parallel int) (*draftModel, error) {
+	model, err := llama.LoadModelFromFile(path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := common.CheckDraftVocab(target.NumVocab(), target.TokenToPiece, model.NumVocab(), model.TokenToPiece); err != nil {
+		llama.FreeModel(model)
+		return nil, err
+	}
+
+	lc, err := llama.NewContextWithModel(model, ctxParams)
+	if err != nil {
+		llama.FreeModel(model)
+		return nil, err
+	}
+
+	batch, err := llama.NewBatch(batchSize, 1, 0)
+	if err != nil {
+		llama.FreeModel(model)
+		return nil, err
+	}
+
+	return &draftModel{
+		model:  model,
+		lc:     lc,
+		batch:  batch,
+		tokens: make([][]int, parallel),
+	}, nil
+}
+
+// propose returns up to n tokens that the draft model predicts will follow
+// tokens in cache slot id, first catching up on any tokens it hasn't seen
+func (d *draftModel) propose(id int, tokens []int, n int) ([]int, error) {
+	numPast := common.CommonPrefix(d.tokens[id], tokens)
+	if numPast == len(tokens) {
+		// leave one token to get the logits for the first draft
+		numPast--
+	}
+
+	if !d.lc.KvCacheSeqRm(id, numPast, -1) {
+		d.lc.KvCacheSeqRm(id, 0, -1)
+		numPast = 0
+	}
+	d.tokens[id] = d.tokens[id][:numPast]
+
+	for numPast < len(tokens) {
+		d.batch.Clear()
+		for i := numPast; i < len(tokens) && i-numPast < d.batch.Size(); i++ {
+			d.batch.Add(tokens[i], nil, i, i+1 == len(tokens), id)
+		}
+
+		if err := d.lc.Decode(d.batch); err != nil {
+			return nil, fmt.Errorf("failed to decode draft batch: %w", err)
+		}
+
+		d.tokens[id] = append(d.tokens[id], tokens[numPast:numPast+d.batch.NumTokens()]...)
+		numPast += d.batch.NumTokens()
+	}
+
+	var drafts []int
+	for {
+		token := common.Argmax(d.lc.GetLogitsIth(d.batch.NumTokens() - 1))
+		if d.model.TokenIsEog(token) {
+			break
+		}
+
+		drafts = append(drafts, token)
+		if len(drafts) >= n {
+			break
+		}
+
+		d.batch.Clear()
+		d.batch.Add(token, nil, len(d.tokens[id]), true, id)
+		if err := d.lc.Decode(d.batch); err != nil {
+			return nil, fmt.Errorf("failed to decode draft batch: %w", err)
+		}
+
+		d.tokens[id] = append(d.tokens[id], token)
+	}
+
+	return drafts, nil
+}
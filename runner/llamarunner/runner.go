@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,9 +24,11 @@ import (
 	"golang.org/x/sync/semaphore"
 
 	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/envconfig"
 	"github.com/qompassai/rose/llama"
 	"github.com/qompassai/rose/llm"
 	"github.com/qompassai/rose/runner/common"
+	"github.com/qompassai/rose/tracing"
 )
 
 // input is an element of the prompt to process, either
@@ -53,6 +56,9 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log-probabilities of pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
@@ -61,7 +67,7 @@ type Sequence struct {
 	crossAttention bool
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -69,6 +75,13 @@ type Sequence struct {
 	// number of tokens to predict
 	numPredict int
 
+	// number of tokens for the draft model to propose at a time
+	numDraft int
+
+	// tokens proposed by the draft model that were added to the
+	// batch after the last input
+	drafts []int
+
 	samplingCtx *llama.SamplingContext
 
 	// channel to send back the embedding if embedding only
@@ -83,8 +96,16 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// return the log-probability of each generated token along with
+	// topLogprobs alternatives
+	logprobs    bool
+	topLogprobs int
+
 	doneReason string
 
+	// the stop sequence that ended generation, if any
+	stopSequence string
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
@@ -94,10 +115,14 @@ type Sequence struct {
 
 type NewSequenceParams struct {
 	numPredict     int
+	numDraft       int
 	stop           []string
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+
+	logprobs    bool
+	topLogprobs int
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -112,6 +137,26 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		return nil, errors.New("no input provided")
 	}
 
+	return s.newSequence(inputs, startTime, params)
+}
+
+// NewRerankSequence returns a sequence whose embedding is the score a
+// reranking model gives document for how relevant it is to query
+func (s *Server) NewRerankSequence(query, document string) (*Sequence, error) {
+	s.ready.Wait()
+
+	startTime := time.Now()
+
+	inputs, err := s.rerankInputs(query, document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process inputs: %w", err)
+	}
+
+	return s.newSequence(inputs, startTime, NewSequenceParams{embedding: true})
+}
+
+func (s *Server) newSequence(inputs []input, startTime time.Time, params NewSequenceParams) (*Sequence, error) {
+	var err error
 	if params.numKeep < 0 {
 		params.numKeep = len(inputs)
 	}
@@ -132,6 +177,11 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		inputs = newInputs
 	}
 
+	// the draft model only sees text
+	if slices.ContainsFunc(inputs, func(inp input) bool { return inp.embed != nil }) {
+		params.numDraft = 0
+	}
+
 	var sc *llama.SamplingContext
 	if params.samplingParams != nil {
 		sc, err = llama.NewSamplingContext(s.model, *params.samplingParams)
@@ -150,12 +200,15 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		numPromptInputs:     len(inputs),
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
+		numDraft:            params.numDraft,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
 		embeddingOnly:       params.embedding,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
 	}, nil
@@ -218,6 +271,27 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input, error)
 	return inputs, nil
 }
 
+// rerankInputs tokenizes a query and document into a single sequence for a
+// reranking model to score
+func (s *Server) rerankInputs(query, document string) ([]input, error) {
+	q, err := s.lc.Model().Tokenize(query, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := s.lc.Model().Tokenize(document, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []input
+	for _, t := range common.RerankTokens(q, d, s.lc.Model().TokenBOS()) {
+		inputs = append(inputs, input{token: t})
+	}
+
+	return inputs, nil
+}
+
 type Server struct {
 	// is the server ready to process requests?
 	// protects access to model and image
@@ -229,6 +303,9 @@ type Server struct {
 	// image model context for multi-modal models
 	image *ImageContext
 
+	// draft model proposing tokens for the model to verify, if any
+	draft *draftModel
+
 	// status for external health reporting - loading, ready to serve, etc.
 	status llm.ServerStatus
 
@@ -275,9 +352,17 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// response is a piece of generated text sent back to the client
+type response struct {
+	content  string
+	logprobs []api.Logprob
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -294,7 +379,7 @@ func flushPending(seq *Sequence) bool {
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -425,6 +510,20 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		}
 
 		seq.inputs = seq.inputs[len(seq.pendingInputs):]
+
+		if len(seq.inputs) == 0 && seq.numPredicted > 0 && batch == tokenBatch {
+			drafts, err := s.propose(seq, batch)
+			if err != nil {
+				return err
+			}
+
+			for _, token := range drafts {
+				batch.Add(token, nil, len(seq.cache.Inputs)+len(seq.pendingInputs), true, seq.cache.Id)
+				seq.pendingInputs = append(seq.pendingInputs, input{token: token})
+				seq.iBatch = batch.NumTokens() - 1
+			}
+			seq.drafts = drafts
+		}
 	}
 
 	if batch == nil || batch.NumTokens() == 0 {
@@ -450,12 +549,16 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
-		// After calling Decode, pending inputs are now in the cache
+		// After calling Decode, pending inputs are now in the cache. Drafts
+		// are only kept once the model agrees with them.
 		if len(seq.pendingInputs) > 0 {
-			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
+			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs[:len(seq.pendingInputs)-len(seq.drafts)]...)
 			seq.pendingInputs = []input{}
 		}
 
+		drafts := seq.drafts
+		seq.drafts = nil
+
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
 			continue
@@ -478,71 +581,160 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
-		// sample a token
-		token := seq.samplingCtx.Sample(s.lc, seq.iBatch)
-		seq.samplingCtx.Accept(token, true)
-		piece := s.model.TokenToPiece(token)
-
-		seq.numPredicted++
+		// sample a token, then another for each draft the model agrees
+		// with, up to a token after the last draft
+		for j := 0; ; j++ {
+			token, ok := s.sample(i, seq, seq.iBatch-len(drafts)+j)
+			if !ok || j == len(drafts) || token != drafts[j] {
+				break
+			}
 
-		// if it's an end of sequence token, break
-		if s.model.TokenIsEog(token) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
+			// the draft is already in the KV cache
+			seq.cache.Inputs = append(seq.cache.Inputs, input{token: token})
+			seq.inputs = nil
+			seq.numDecoded++
+		}
 
-			s.removeSequence(i, "stop")
-			continue
+		// discard the drafts the model disagreed with
+		if len(drafts) > 0 && s.seqs[i] != nil && !s.lc.KvCacheSeqRm(seq.cache.Id, len(seq.cache.Inputs), -1) {
+			// the model can't discard part of its cache, so evaluate the
+			// sequence again and stop drafting
+			slog.Warn("model does not support discarding drafts, disabling draft model")
+			s.lc.KvCacheSeqRm(seq.cache.Id, 0, -1)
+			seq.inputs = slices.Concat(seq.cache.Inputs, seq.inputs)
+			seq.cache.Inputs = []input{}
+			s.draft = nil
 		}
+	}
 
-		seq.inputs = []input{{token: token}}
-
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
-
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
-
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
-
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
-			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+	return nil
+}
 
-			s.removeSequence(i, "stop")
-			continue
-		}
+// propose returns tokens from the draft model to add to the batch after the
+// token the sequence generated last, as many as fit in the batch and the
+// context and are still left to predict
+func (s *Server) propose(seq *Sequence, batch *llama.Batch) ([]int, error) {
+	if s.draft == nil || seq.numDraft <= 0 || seq.embeddingOnly {
+		return nil, nil
+	}
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
-		}
+	n := min(seq.numDraft,
+		batch.Size()-len(seq.pendingInputs),
+		s.cache.numCtx-len(seq.cache.Inputs)-len(seq.pendingInputs))
+	if seq.numPredict > 0 {
+		n = min(n, seq.numPredict-seq.numPredicted-1)
+	}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+	if n <= 0 {
+		return nil, nil
+	}
+
+	tokens := make([]int, 0, len(seq.cache.Inputs)+len(seq.pendingInputs))
+	for _, inp := range slices.Concat(seq.cache.Inputs, seq.pendingInputs) {
+		tokens = append(tokens, inp.token)
+	}
+
+	return s.draft.propose(seq.cache.Id, tokens, n)
+}
+
+// sample samples a token for the sequence in s.seqs[i] from the logits at
+// iBatch and sends it back, returning the token and whether the sequence is
+// still generating
+func (s *Server) sample(i int, seq *Sequence, iBatch int) (int, bool) {
+	token := seq.samplingCtx.Sample(s.lc, iBatch)
+	seq.samplingCtx.Accept(token, true)
+	piece := s.model.TokenToPiece(token)
+
+	var logprob *api.Logprob
+	if seq.logprobs {
+		lp := common.Logprobs(s.lc.GetLogitsIth(iBatch), token, seq.topLogprobs, s.model.TokenToPiece)
+		logprob = &lp
+	}
+
+	seq.numPredicted++
+
+	// if it's an end of sequence token, break
+	if s.model.TokenIsEog(token) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
+
+		s.removeSequence(i, "stop")
+		return token, false
+	}
+
+	seq.inputs = []input{{token: token}}
+
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	if logprob != nil {
+		seq.pendingLogprobs = append(seq.pendingLogprobs, *logprob)
+	}
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		if len(seq.pendingLogprobs) > newLen {
+			seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
 		}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, "connection")
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		seq.stopSequence = stop
+		s.removeSequence(i, "stop")
+		return token, false
 	}
 
-	return nil
+	if common.ContainsStopSuffix(sequence, seq.stop) {
+		return token, true
+	}
+
+	if common.IncompleteUnicode(sequence) {
+		return token, true
+	}
+
+	if !flushPending(seq) {
+		s.removeSequence(i, "connection")
+		return token, false
+	}
+
+	return token, true
+}
+
+// trace records spans for the prompt evaluation and decoding phases of a
+// finished sequence
+func (seq *Sequence) trace(ctx context.Context) {
+	if seq.startGenerationTime.IsZero() {
+		return
+	}
+
+	_, span := tracing.StartAt(ctx, "processBatch prompt_eval", seq.startProcessingTime, tracing.Attr("tokens", seq.numPromptInputs))
+	span.EndAt(seq.startGenerationTime, nil)
+
+	_, span = tracing.StartAt(ctx, "processBatch decode", seq.startGenerationTime, tracing.Attr("tokens", seq.numDecoded))
+	span.End(nil)
 }
 
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "runner.completion")
+	defer span.End(nil)
+
 	var req llm.CompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
@@ -578,16 +770,26 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		Mirostat:       req.Options.Mirostat,
 		MirostatTau:    req.Options.MirostatTau,
 		MirostatEta:    req.Options.MirostatEta,
+		DRYMultiplier:  req.Options.DRYMultiplier,
+		DRYBase:        req.Options.DRYBase,
+		DRYAllowedLen:  req.Options.DRYAllowedLength,
+		DRYBreakers:    req.Options.DRYSequenceBreakers,
+		XTCProbability: req.Options.XTCProbability,
+		XTCThreshold:   req.Options.XTCThreshold,
+		LogitBias:      req.Options.LogitBias,
 		Seed:           uint32(req.Options.Seed),
 		Grammar:        req.Grammar,
 	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
 		numPredict:     req.Options.NumPredict,
+		numDraft:       req.Options.NumDraft,
 		stop:           req.Options.Stop,
 		numKeep:        req.Options.NumKeep,
 		samplingParams: &samplingParams,
 		embedding:      false,
+		logprobs:       req.Logprobs,
+		topLogprobs:    req.TopLogprobs,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
@@ -635,10 +837,11 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case resp, ok := <-seq.responses:
 			if ok {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
+					Content:  resp.content,
+					Logprobs: resp.logprobs,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
@@ -648,6 +851,8 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				flusher.Flush()
 			} else {
 				// Send the final response
+				seq.trace(ctx)
+
 				doneReason := "stop"
 				if seq.doneReason == "limit" {
 					doneReason = "length"
@@ -655,6 +860,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
 					Done:               true,
 					DoneReason:         doneReason,
+					StopSequence:       seq.stopSequence,
 					PromptEvalCount:    seq.numPromptInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numDecoded,
@@ -686,25 +892,77 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	embedding, err := s.embed(r.Context(), seq)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("aborting embeddings request due to client closing the connection")
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
+		Embedding: embedding,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) rerank(w http.ResponseWriter, r *http.Request) {
+	var req llm.RerankRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	seq, err := s.NewRerankSequence(req.Query, req.Document)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	score, err := s.embed(r.Context(), seq)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("aborting rerank request due to client closing the connection")
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(score) != 1 {
+		http.Error(w, "this model does not support reranking", http.StatusNotImplemented)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.RerankResponse{
+		Score: score[0],
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// embed runs seq, which must be an embedding sequence, and waits for its
+// embedding
+func (s *Server) embed(ctx context.Context, seq *Sequence) ([]float32, error) {
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting embeddings request due to client closing the connection")
-		} else {
+	if err := s.seqsSem.Acquire(ctx, 1); err != nil {
+		if !errors.Is(err, context.Canceled) {
 			slog.Error("Failed to acquire semaphore", "error", err)
 		}
-		return
+		return nil, err
 	}
 
 	s.mu.Lock()
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
+			var err error
 			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
 			if err != nil {
 				s.mu.Unlock()
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
+				s.seqsSem.Release(1)
+				return nil, fmt.Errorf("failed to load cache: %w", err)
 			}
 			s.seqs[i] = seq
 			s.cond.Signal()
@@ -715,14 +973,60 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	if !found {
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+		s.seqsSem.Release(1)
+		return nil, errors.New("could not find an available sequence")
+	}
+
+	return <-seq.embedding, nil
+}
+
+func (s *Server) saveCache(w http.ResponseWriter, r *http.Request) {
+	s.cacheSnapshot(w, r, (*InputCache).SaveSnapshot)
+}
+
+func (s *Server) restoreCache(w http.ResponseWriter, r *http.Request) {
+	s.cacheSnapshot(w, r, (*InputCache).RestoreSnapshot)
+}
+
+// cacheSnapshot handles saving or restoring the cache for a prompt with fn
+func (s *Server) cacheSnapshot(w http.ResponseWriter, r *http.Request, fn func(*InputCache, []input) (int, error)) {
+	var req llm.CacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
 		return
 	}
 
-	embedding := <-seq.embedding
+	w.Header().Set("Content-Type", "application/json")
+
+	s.ready.Wait()
 
-	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
-		Embedding: embedding,
+	inputs, err := s.inputs(req.Prompt, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to process inputs: %v", err), http.StatusInternalServerError)
+		return
+	} else if len(inputs) == 0 {
+		http.Error(w, "no input provided", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	n, err := fn(s.cache, inputs)
+	s.mu.Unlock()
+
+	switch {
+	case errors.Is(err, errSnapshotNotSupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case errors.Is(err, errNotCached), errors.Is(err, errNoSnapshot):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.CacheResponse{
+		Tokens: n,
 	}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
@@ -754,11 +1058,16 @@ func (s *Server) loadModel(
 	mpath string,
 	lpath multiLPath,
 	ppath string,
+	dpath string,
+	draftParams llama.ModelParams,
 	kvSize int,
 	kvCacheType string,
 	flashAttention bool,
 	threads int,
 	multiUserCache bool,
+	cacheDir string,
+	persistCache bool,
+	cacheSize int64,
 ) {
 	var err error
 	s.model, err = llama.LoadModelFromFile(mpath, params)
@@ -789,11 +1098,18 @@ func (s *Server) loadModel(
 		}
 	}
 
-	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache)
+	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache, cacheDir, persistCache, cacheSize)
 	if err != nil {
 		panic(err)
 	}
 
+	if dpath != "" {
+		s.draft, err = newDraftModel(dpath, draftParams, s.model, ctxParams, s.batchSize, s.parallel)
+		if err != nil {
+			slog.Warn("failed to load draft model, generating without it", "error", err)
+		}
+	}
+
 	s.status = llm.ServerStatusReady
 	s.ready.Done()
 }
@@ -802,6 +1118,8 @@ func Execute(args []string) error {
 	fs := flag.NewFlagSet("runner", flag.ExitOnError)
 	mpath := fs.String("model", "", "Path to model binary file")
 	ppath := fs.String("mmproj", "", "Path to projector binary file")
+	dpath := fs.String("draft-model", "", "Path to draft model binary file")
+	nGpuLayersDraft := fs.Int("draft-n-gpu-layers", 0, "Number of layers of the draft model to offload to GPU")
 	parallel := fs.Int("parallel", 1, "Number of sequences to handle simultaneously")
 	batchSize := fs.Int("batch-size", 512, "Batch size")
 	nGpuLayers := fs.Int("n-gpu-layers", 0, "Number of layers to offload to GPU")
@@ -816,6 +1134,9 @@ func Execute(args []string) error {
 	mlock := fs.Bool("mlock", false, "force system to keep model in RAM rather than swapping or compressing")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	cacheDir := fs.String("cache-dir", "", "Directory to save and restore snapshots of the KV cache")
+	persistCache := fs.Bool("persist-cache", false, "automatically save long shared prompt prefixes to the cache directory and restore them")
+	cacheSize := fs.Int64("cache-size", 0, "maximum bytes of automatically saved prompts in the cache directory, deleting the least recently used (default: unlimited)")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -845,6 +1166,15 @@ func Execute(args []string) error {
 	slog.SetDefault(slog.New(handler))
 	slog.Info("starting go runner")
 
+	if endpoint := envconfig.OTLPEndpoint(); endpoint != "" {
+		shutdown := tracing.Init(endpoint, "rose-runner")
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdown(ctx)
+		}()
+	}
+
 	llama.BackendInit()
 
 	server := &Server{
@@ -876,8 +1206,13 @@ func Execute(args []string) error {
 		},
 	}
 
+	draftParams := params
+	draftParams.NumGpuLayers = *nGpuLayersDraft
+	draftParams.TensorSplit = nil
+	draftParams.Progress = nil
+
 	server.ready.Add(1)
-	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache)
+	go server.loadModel(params, *mpath, lpaths, *ppath, *dpath, draftParams, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache, *cacheDir, *persistCache, *cacheSize)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -896,7 +1231,10 @@ func Execute(args []string) error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/embedding", server.embeddings)
+	mux.HandleFunc("/rerank", server.rerank)
 	mux.HandleFunc("/completion", server.completion)
+	mux.HandleFunc("/cache/save", server.saveCache)
+	mux.HandleFunc("/cache/restore", server.restoreCache)
 	mux.HandleFunc("/health", server.health)
 
 	httpServer := http.Server{
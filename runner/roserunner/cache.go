@@ -1,16 +1,26 @@
 package roserunner
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"log/slog"
 	"math"
+	"os"
+	"slices"
 	"time"
 
 	"github.com/qompassai/rose/kvcache"
 	"github.com/qompassai/rose/ml"
 	"github.com/qompassai/rose/model"
 	"github.com/qompassai/rose/model/input"
+	"github.com/qompassai/rose/runner/common"
+)
+
+var (
+	errSnapshotNotSupported = errors.New("saving the cache is not supported")
+	errNotCached            = errors.New("prompt is not in the cache")
+	errNoSnapshot           = errors.New("no saved cache for prompt")
 )
 
 type InputCache struct {
@@ -25,13 +35,25 @@ type InputCache struct {
 	// individual KV caches
 	slots []InputCacheSlot
 
-	// optimize cache eviction for multiple users
-	multiUserCache bool
+	// prefixes of the inputs in slots, built from them when first needed
+	// and then updated as they change
+	tree *prefixTree
+
+	// directory that snapshots of the cache are saved to and restored from
+	snapshotDir string
+
+	// automatically snapshot long prefixes shared between prompts and
+	// restore them for later prompts
+	autoSnapshot bool
+
+	// most bytes of snapshots kept in snapshotDir when saving them
+	// automatically, or 0 for no limit
+	maxSnapshots int64
 
 	cache kvcache.Cache
 }
 
-func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, multiUserCache bool) (*InputCache, error) {
+func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, snapshotDir string, autoSnapshot bool, maxSnapshots int64) (*InputCache, error) {
 	numCtx := kvSize / int32(numSlots)
 
 	if numCtx < 1 {
@@ -50,11 +72,14 @@ func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots
 	}
 
 	return &InputCache{
-		numCtx:         numCtx,
-		enabled:        cache != nil,
-		slots:          slots,
-		multiUserCache: multiUserCache,
-		cache:          cache,
+		numCtx:       numCtx,
+		enabled:      cache != nil,
+		slots:        slots,
+		tree:         newPrefixTree(slots),
+		snapshotDir:  snapshotDir,
+		autoSnapshot: autoSnapshot && snapshotDir != "",
+		maxSnapshots: maxSnapshots,
+		cache:        cache,
 	}, nil
 }
 
@@ -91,24 +116,28 @@ type InputCacheSlot struct {
 	lastUsed time.Time
 }
 
-func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []input.Input, error) {
+// LoadCacheSlot finds a slot for prompt and returns it with the inputs of
+// prompt that still need to be processed. Unless reuse is set, none of prompt
+// is taken from the cache, for sequences that need the outputs of all of
+// their inputs.
+func (c *InputCache) LoadCacheSlot(prompt []input.Input, reuse bool) (*InputCacheSlot, []input.Input, error) {
 	var slot *InputCacheSlot
 	var numPast int32
 	var err error
 
-	// In single-user scenarios, the longest cache slot works fine for getting good input
-	// cache hit rates and it keeps the footprint of the cache small, which improves throughput.
-	// For multiple users, the "best" cache slot produces better input cache hit rates
-	// at the cost of worse performance when we miss the input cache.
-	if !c.multiUserCache {
-		slot, numPast, err = c.findLongestCacheSlot(prompt)
+	if reuse {
+		slot, numPast, err = c.findCacheSlot(prompt)
 	} else {
-		slot, numPast, err = c.findBestCacheSlot(prompt)
+		slot, numPast, err = c.findCacheSlot(nil)
 	}
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if c.autoSnapshot && reuse {
+		numPast = c.autoRestore(slot, prompt, numPast)
+	}
+
 	slot.InUse = true
 	slot.lastUsed = time.Now()
 
@@ -132,79 +161,288 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	slog.Debug("loading cache slot", "id", slot.Id, "cache", len(slot.Inputs), "prompt", len(prompt),
 		"used", numPast, "remaining", int32(len(prompt))-numPast)
 
+	if c.autoSnapshot {
+		c.autoSave(slot, prompt[:numPast])
+	}
+
 	prompt = prompt[numPast:]
 	slot.Inputs = slot.Inputs[:numPast]
+	c.prefixes().insert(slot.Id, slot.Inputs, slot.lastUsed)
 
 	return slot, prompt, nil
 }
 
-func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot, int32, error) {
-	longest := int32(-1)
-	var longestSlot *InputCacheSlot
+// ReleaseCacheSlot marks slot as no longer in use, once the sequence using it
+// is done, so that its inputs can be shared with later prompts
+func (c *InputCache) ReleaseCacheSlot(slot *InputCacheSlot) {
+	slot.InUse = false
+	c.prefixes().insert(slot.Id, slot.Inputs, slot.lastUsed)
+}
+
+func (c *InputCache) prefixes() *prefixTree {
+	if c.tree == nil {
+		c.tree = newPrefixTree(c.slots)
+	}
+
+	return c.tree
+}
+
+// findCacheSlot returns a free slot for prompt and how much of prompt is in
+// it. The longest prefix of prompt in any slot, even one in use, is shared
+// with the slot, so sequences that start the same way, such as with a system
+// prompt, use the same entries in the cache instead of each processing and
+// storing them.
+//
+// A slot that can be reused without losing any inputs that aren't also in
+// another slot is preferred. Otherwise, the slot whose inputs were least
+// recently used is evicted.
+func (c *InputCache) findCacheSlot(prompt []input.Input) (*InputCacheSlot, int32, error) {
+	tree := c.prefixes()
+	node, longest := tree.match(prompt)
+
+	var slot *InputCacheSlot
+	var slotKeep, slotLost int32
+	var slotUsed time.Time
 
 	for i, s := range c.slots {
 		if s.InUse {
 			continue
 		}
 
-		count := countCommonPrefix(s.Inputs, prompt)
-		if count > longest {
-			longest = count
-			longestSlot = &c.slots[i]
+		keep := countCommonPrefix(s.Inputs, prompt)
+		lost, used := tree.evictable(s.Id, keep)
+
+		switch {
+		case slot == nil:
+		case (lost == 0) != (slotLost == 0):
+			if lost != 0 {
+				continue
+			}
+		case lost == 0:
+			if keep <= slotKeep {
+				continue
+			}
+		default:
+			if !used.Before(slotUsed) {
+				continue
+			}
 		}
+
+		slot = &c.slots[i]
+		slotKeep, slotLost, slotUsed = keep, lost, used
 	}
 
-	if longestSlot == nil {
+	if slot == nil {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
-	return longestSlot, longest, nil
+	if slotLost > 0 {
+		slog.Debug("evicting cache slot", "id", slot.Id, "inputs", len(slot.Inputs), "lost", slotLost,
+			"used", slotUsed)
+	}
+
+	// The tree has the inputs that slots in use started with, which they
+	// may have discarded since, such as by shifting, so only as much as the
+	// slot still has is shared
+	var src int
+	if longest > 0 {
+		src = node.slots[0]
+		longest = countCommonPrefix(c.slots[src].Inputs, prompt[:longest])
+	}
+
+	// Share the prefix from the first slot that has it, even if this slot
+	// has it too, so that copies that were processed at the same time by
+	// different slots are merged
+	if longest < slotKeep {
+		longest = slotKeep
+	} else if longest > 0 && src != slot.Id {
+		slog.Debug("sharing cache prefix", "src", src, "dst", slot.Id, "inputs", longest)
+		slot.Inputs = slices.Clone(prompt[:longest])
+		if c.cache != nil {
+			c.cache.CopyPrefix(src, slot.Id, longest)
+		}
+	}
+
+	return slot, longest, nil
 }
 
-func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, int32, error) {
-	oldest := time.Now()
-	var oldestSlot *InputCacheSlot
+// autoRestore restores the snapshot for the longest prefix of prompt into
+// slot if it has more of prompt than the slot does, returning how much of
+// prompt is now in the slot
+func (c *InputCache) autoRestore(slot *InputCacheSlot, prompt []input.Input, numPast int32) int32 {
+	if _, ok := c.cache.(kvcache.SnapshotCache); !ok {
+		return numPast
+	}
+
+	path, n := common.FindSnapshot(c.snapshotDir, snapshotTokens(prompt))
+	if int32(n) <= numPast {
+		return numPast
+	}
+
+	if err := c.restore(slot, path, prompt[:n]); err != nil {
+		slog.Warn("failed to restore cache", "path", path, "error", err)
+		return 0
+	}
+
+	return int32(n)
+}
+
+// autoSave saves inputs, which are the start of slot, if they're long
+// enough to be worth restoring and there isn't already a snapshot for part
+// of them
+func (c *InputCache) autoSave(slot *InputCacheSlot, inputs []input.Input) {
+	if _, ok := c.cache.(kvcache.SnapshotCache); !ok || len(inputs) < common.MinSnapshotTokens {
+		return
+	}
+
+	tokens := snapshotTokens(inputs)
+	if len(tokens) != len(inputs) {
+		return
+	}
+
+	if _, n := common.FindSnapshot(c.snapshotDir, tokens); n > 0 {
+		return
+	}
 
-	longest := int32(-1)
-	var longestSlot *InputCacheSlot
+	if err := c.save(slot, tokens); err != nil {
+		slog.Warn("failed to save cache", "error", err)
+		return
+	}
+
+	if c.maxSnapshots > 0 {
+		if err := common.PruneSnapshots(c.snapshotDir, c.maxSnapshots); err != nil {
+			slog.Warn("failed to prune saved caches", "error", err)
+		}
+	}
+}
+
+// SaveSnapshot saves the cache for prompt, which must already be in a cache
+// slot, returning the number of inputs saved
+func (c *InputCache) SaveSnapshot(prompt []input.Input) (int32, error) {
+	if _, ok := c.cache.(kvcache.SnapshotCache); !ok || c.snapshotDir == "" {
+		return 0, errSnapshotNotSupported
+	}
+
+	tokens := snapshotTokens(prompt)
+	if len(tokens) != len(prompt) {
+		return 0, errors.New("prompts with images cannot be saved")
+	}
 
 	for i, s := range c.slots {
-		count := countCommonPrefix(s.Inputs, prompt)
-		if count > longest {
-			longest = count
-			longestSlot = &c.slots[i]
+		if countCommonPrefix(s.Inputs, prompt) == int32(len(prompt)) {
+			if err := c.save(&c.slots[i], tokens); err != nil {
+				return 0, err
+			}
+
+			return int32(len(prompt)), nil
 		}
+	}
 
-		if s.lastUsed.Compare(oldest) < 0 && !s.InUse {
-			oldest = s.lastUsed
+	return 0, errNotCached
+}
+
+// RestoreSnapshot loads the snapshot for the longest prefix of prompt into
+// the least recently used slot, unless a slot already has as much of prompt.
+// It returns the number of inputs of prompt in the cache.
+func (c *InputCache) RestoreSnapshot(prompt []input.Input) (int32, error) {
+	if _, ok := c.cache.(kvcache.SnapshotCache); !ok || c.snapshotDir == "" {
+		return 0, errSnapshotNotSupported
+	}
+
+	path, n := common.FindSnapshot(c.snapshotDir, snapshotTokens(prompt))
+	if n == 0 {
+		return 0, errNoSnapshot
+	}
+
+	var longest int32
+	var oldestSlot *InputCacheSlot
+	for i, s := range c.slots {
+		longest = max(longest, countCommonPrefix(s.Inputs, prompt))
+
+		if !s.InUse && (oldestSlot == nil || s.lastUsed.Before(oldestSlot.lastUsed)) {
 			oldestSlot = &c.slots[i]
 		}
 	}
 
-	if longest == int32(len(longestSlot.Inputs)) && !longestSlot.InUse {
-		return longestSlot, longest, nil
+	if longest >= int32(n) {
+		return longest, nil
 	}
 
-	if oldestSlot.InUse {
-		return nil, 0, errors.New("no available cache slots")
+	if oldestSlot == nil {
+		return 0, errors.New("no available cache slots")
 	}
 
-	if len(oldestSlot.Inputs) != 0 {
-		slog.Debug("evicting cache slot", "id", oldestSlot.Id, "inputs", len(oldestSlot.Inputs),
-			"used", oldestSlot.lastUsed)
+	oldestSlot.lastUsed = time.Now()
+	if err := c.restore(oldestSlot, path, prompt[:n]); err != nil {
+		return 0, err
 	}
 
-	if longest > 0 && longestSlot != oldestSlot {
-		slog.Debug("forking cache slot", "src", longestSlot.Id, "dst", oldestSlot.Id, "inputs", longest, "total",
-			len(longestSlot.Inputs))
-		oldestSlot.Inputs = make([]input.Input, longest)
-		copy(oldestSlot.Inputs, longestSlot.Inputs[:longest])
-		if c.cache != nil {
-			c.cache.CopyPrefix(longestSlot.Id, oldestSlot.Id, longest)
+	return int32(n), nil
+}
+
+// save writes the cache of slot for tokens, which must be its first inputs,
+// to the snapshot directory
+func (c *InputCache) save(slot *InputCacheSlot, tokens []int32) error {
+	slog.Debug("saving cache slot", "id", slot.Id, "inputs", len(tokens))
+
+	return common.WriteSnapshot(c.snapshotDir, tokens, func(path string) error {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w := bufio.NewWriter(f)
+		if err := c.cache.(kvcache.SnapshotCache).Save(w, slot.Id, int32(len(tokens))); err != nil {
+			return err
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		return f.Close()
+	})
+}
+
+// restore replaces the contents of slot with the snapshot at path, which
+// holds inputs
+func (c *InputCache) restore(slot *InputCacheSlot, path string, inputs []input.Input) error {
+	slog.Debug("restoring cache slot", "id", slot.Id, "inputs", len(inputs), "path", path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := c.cache.(kvcache.SnapshotCache).Load(bufio.NewReader(f), slot.Id); err != nil {
+		// the slot may be partially overwritten
+		_ = c.cache.Remove(slot.Id, 0, math.MaxInt32)
+		slot.Inputs = slot.Inputs[:0]
+		c.prefixes().insert(slot.Id, slot.Inputs, slot.lastUsed)
+		return err
+	}
+
+	slot.Inputs = slices.Clone(inputs)
+	c.prefixes().insert(slot.Id, slot.Inputs, slot.lastUsed)
+	common.UseSnapshot(path)
+	return nil
+}
+
+// snapshotTokens returns the tokens at the start of inputs, up to the first
+// multimodal input, which is as much as can be matched to a snapshot
+func snapshotTokens(inputs []input.Input) []int32 {
+	var tokens []int32
+	for _, inp := range inputs {
+		if inp.Multimodal != nil || inp.MultimodalHash != 0 {
+			break
 		}
+
+		tokens = append(tokens, inp.Token)
 	}
 
-	return oldestSlot, longest, nil
+	return tokens
 }
 
 func countCommonPrefix(a []input.Input, b []input.Input) int32 {
@@ -270,6 +508,7 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int32) error {
 		slot.Inputs[i-discard] = slot.Inputs[i]
 	}
 	slot.Inputs = slot.Inputs[:inputLen-discard]
+	c.prefixes().insert(slot.Id, slot.Inputs, slot.lastUsed)
 
 	return nil
 }
@@ -80,11 +80,10 @@ func TestFindCacheSlot(t *testing.T) {
 	}
 
 	tests := []struct {
-		name    string
-		cache   InputCache
-		prompt  []input.Input
-		longest expected
-		best    expected
+		name     string
+		cache    InputCache
+		prompt   []input.Input
+		expected expected
 	}{
 		{
 			name: "Empty",
@@ -102,9 +101,8 @@ func TestFindCacheSlot(t *testing.T) {
 					lastUsed: time.Time{},
 				},
 			}},
-			prompt:  []input.Input{{Token: 1}},
-			longest: expected{result: 0, len: 0},
-			best:    expected{result: 0, len: 0},
+			prompt:   []input.Input{{Token: 1}},
+			expected: expected{result: 0, len: 0},
 		},
 		{
 			name: "Extend",
@@ -122,9 +120,8 @@ func TestFindCacheSlot(t *testing.T) {
 					lastUsed: time.Now().Add(-2 * time.Second),
 				},
 			}},
-			prompt:  []input.Input{{Token: 1}, {Token: 2}},
-			longest: expected{result: 1, len: 2},
-			best:    expected{result: 1, len: 2},
+			prompt:   []input.Input{{Token: 1}, {Token: 2}},
+			expected: expected{result: 1, len: 2},
 		},
 		{
 			name: "New",
@@ -142,9 +139,8 @@ func TestFindCacheSlot(t *testing.T) {
 					lastUsed: time.Time{},
 				},
 			}},
-			prompt:  []input.Input{{Token: 2}},
-			longest: expected{result: 0, len: 0},
-			best:    expected{result: 1, len: 0},
+			prompt:   []input.Input{{Token: 2}},
+			expected: expected{result: 1, len: 0},
 		},
 		{
 			name: "Fork",
@@ -164,12 +160,11 @@ func TestFindCacheSlot(t *testing.T) {
 					},
 				},
 			},
-			prompt:  []input.Input{{Token: 1}},
-			longest: expected{result: 0, len: 1},
-			best:    expected{result: 1, len: 1},
+			prompt:   []input.Input{{Token: 1}},
+			expected: expected{result: 1, len: 1},
 		},
 		{
-			name: "Evict",
+			name: "Reuse shared",
 			cache: InputCache{slots: []InputCacheSlot{
 				{
 					Id:       0,
@@ -184,9 +179,8 @@ func TestFindCacheSlot(t *testing.T) {
 					lastUsed: time.Now().Add(-2 * time.Second),
 				},
 			}},
-			prompt:  []input.Input{{Token: 2}, {Token: 3}},
-			longest: expected{result: 0, len: 0},
-			best:    expected{result: 1, len: 0},
+			prompt:   []input.Input{{Token: 2}, {Token: 3}},
+			expected: expected{result: 0, len: 0},
 		},
 		{
 			name: "In use",
@@ -204,32 +198,59 @@ func TestFindCacheSlot(t *testing.T) {
 					lastUsed: time.Now().Add(-2 * time.Second),
 				},
 			}},
-			prompt:  []input.Input{{Token: 1}, {Token: 2}},
-			longest: expected{result: 1, len: 1},
-			best:    expected{result: 1, len: 2},
+			prompt:   []input.Input{{Token: 1}, {Token: 2}},
+			expected: expected{result: 1, len: 2},
+		},
+		{
+			name: "Evict",
+			cache: InputCache{slots: []InputCacheSlot{
+				{
+					Id:       0,
+					Inputs:   []input.Input{{Token: 1}},
+					InUse:    false,
+					lastUsed: time.Now().Add(-time.Second),
+				},
+				{
+					Id:       1,
+					Inputs:   []input.Input{{Token: 2}},
+					InUse:    false,
+					lastUsed: time.Now().Add(-2 * time.Second),
+				},
+			}},
+			prompt:   []input.Input{{Token: 3}},
+			expected: expected{result: 1, len: 0},
+		},
+		{
+			name: "Merge",
+			cache: InputCache{slots: []InputCacheSlot{
+				{
+					Id:       0,
+					Inputs:   []input.Input{{Token: 1}, {Token: 2}},
+					InUse:    true,
+					lastUsed: time.Now().Add(-time.Second),
+				},
+				{
+					Id:       1,
+					Inputs:   []input.Input{{Token: 1}, {Token: 2}, {Token: 4}},
+					InUse:    false,
+					lastUsed: time.Now().Add(-2 * time.Second),
+				},
+			}},
+			prompt:   []input.Input{{Token: 1}, {Token: 2}, {Token: 3}},
+			expected: expected{result: 1, len: 2},
 		},
 	}
 
 	for _, tt := range tests {
-		t.Run("Longest-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt)
-			if err != nil {
-				t.Errorf("findLongestCacheSlot: err %v", err)
-			} else if result.Id != tt.longest.result || resultLen != tt.longest.len {
-				t.Errorf("findLongestCacheSlot: slot have %v, want %v len have %v, want %v",
-					result.Id, tt.longest.result, resultLen, tt.longest.len)
-			}
-		})
-	}
-
-	for _, tt := range tests {
-		t.Run("Best-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt)
+		t.Run(tt.name, func(t *testing.T) {
+			result, resultLen, err := tt.cache.findCacheSlot(tt.prompt)
 			if err != nil {
-				t.Errorf("findBestCacheSlot: err %v", err)
-			} else if result.Id != tt.best.result || resultLen != tt.best.len {
-				t.Errorf("findBestCacheSlot: slot have %v, want %v len have %v, want %v",
-					result.Id, tt.best.result, resultLen, tt.best.len)
+				t.Errorf("findCacheSlot: err %v", err)
+			} else if result.Id != tt.expected.result || resultLen != tt.expected.len {
+				t.Errorf("findCacheSlot: slot have %v, want %v len have %v, want %v",
+					result.Id, tt.expected.result, resultLen, tt.expected.len)
+			} else if countCommonPrefix(result.Inputs, tt.prompt) < resultLen {
+				t.Errorf("findCacheSlot: slot inputs %v don't start with %v inputs of the prompt", result.Inputs, resultLen)
 			}
 		})
 	}
@@ -303,14 +324,14 @@ func TestLoadCacheSlot(t *testing.T) {
 		name           string
 		cache          InputCache
 		prompt         []input.Input
+		noReuse        bool
 		wantErr        bool
 		expectedSlotId int
 		expectedPrompt int // expected length of remaining prompt
 	}{
 		{
-			name: "Basic cache hit - single user",
+			name: "Basic cache hit",
 			cache: InputCache{
-				multiUserCache: false,
 				slots: []InputCacheSlot{
 					{
 						Id:       0,
@@ -332,14 +353,13 @@ func TestLoadCacheSlot(t *testing.T) {
 			expectedPrompt: 1, // Only token 3 remains
 		},
 		{
-			name: "Basic cache hit - multi user",
+			name: "Shared prefix",
 			cache: InputCache{
-				multiUserCache: true,
 				slots: []InputCacheSlot{
 					{
 						Id:       0,
 						Inputs:   []input.Input{{Token: 1}, {Token: 2}},
-						InUse:    false,
+						InUse:    true,
 						lastUsed: time.Now().Add(-time.Second),
 					},
 					{
@@ -352,13 +372,12 @@ func TestLoadCacheSlot(t *testing.T) {
 			},
 			prompt:         []input.Input{{Token: 1}, {Token: 2}, {Token: 3}},
 			wantErr:        false,
-			expectedSlotId: 0,
+			expectedSlotId: 1,
 			expectedPrompt: 1, // Only token 3 remains
 		},
 		{
 			name: "Exact match - leave one input",
 			cache: InputCache{
-				multiUserCache: false,
 				slots: []InputCacheSlot{
 					{
 						Id:       0,
@@ -373,10 +392,27 @@ func TestLoadCacheSlot(t *testing.T) {
 			expectedSlotId: 0,
 			expectedPrompt: 1, // Should leave 1 token for sampling
 		},
+		{
+			name: "No reuse",
+			cache: InputCache{
+				slots: []InputCacheSlot{
+					{
+						Id:       0,
+						Inputs:   []input.Input{{Token: 1}, {Token: 2}},
+						InUse:    false,
+						lastUsed: time.Now().Add(-time.Second),
+					},
+				},
+			},
+			prompt:         []input.Input{{Token: 1}, {Token: 2}, {Token: 3}},
+			noReuse:        true,
+			wantErr:        false,
+			expectedSlotId: 0,
+			expectedPrompt: 3, // Every input is processed again
+		},
 		{
 			name: "No available slots",
 			cache: InputCache{
-				multiUserCache: false,
 				slots: []InputCacheSlot{
 					{
 						Id:       0,
@@ -395,7 +431,7 @@ func TestLoadCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			slot, remainingPrompt, err := tt.cache.LoadCacheSlot(tt.prompt)
+			slot, remainingPrompt, err := tt.cache.LoadCacheSlot(tt.prompt, !tt.noReuse)
 
 			// Check error state
 			if (err != nil) != tt.wantErr {
@@ -0,0 +1,134 @@
+package roserunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/qompassai/rose/kvcache"
+	"github.com/qompassai/rose/ml"
+	"github.com/qompassai/rose/model"
+	"github.com/qompassai/rose/model/input"
+	"github.com/qompassai/rose/runner/common"
+)
+
+// draftModel is a smaller model that proposes tokens for the model to verify
+// all at once, which is faster than generating them one at a time when the
+// model agrees with most of them
+type draftModel struct {
+	model     model.Model
+	cache     kvcache.Cache
+	batchSize int
+
+	// tokens stored in the draft model's KV cache for each cache slot,
+	// which it keeps in step with the model's
+	tokens [][]int32
+}
+
+func newDraftModel(ctx context.Context, path string, params ml.BackendParams, target model.TextProcessor, kvCacheType string, numCtx int32, parallel int, batchSize int) (*draftModel, error) {
+	m, err := model.New(ctx, path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tp, ok := m.(model.TextProcessor)
+	if !ok {
+		return nil, errors.New("draft model has no vocabulary")
+	}
+
+	vocab, draftVocab := target.Vocabulary().Values, tp.Vocabulary().Values
+	if err := common.CheckDraftVocab(
+		len(vocab), func(i int) string { return vocab[i] },
+		len(draftVocab), func(i int) string { return draftVocab[i] },
+	); err != nil {
+		return nil, err
+	}
+
+	cache := m.Config().Cache
+	if cache == nil {
+		return nil, errors.New("draft model does not support caching")
+	}
+	cache.Init(m.Backend(), kvCacheTypeFromStr(kvCacheType), parallel, int(numCtx), batchSize)
+
+	return &draftModel{
+		model:     m,
+		cache:     cache,
+		batchSize: batchSize,
+		tokens:    make([][]int32, parallel),
+	}, nil
+}
+
+// propose returns up to n tokens that the draft model predicts will follow
+// tokens in cache slot id, first catching up on any tokens it hasn't seen
+func (d *draftModel) propose(id int, tokens []int32, n int) ([]int32, error) {
+	numPast := common.CommonPrefix(d.tokens[id], tokens)
+	if numPast == len(tokens) {
+		// leave one token to get the logits for the first draft
+		numPast--
+	}
+
+	if err := d.cache.Remove(id, int32(numPast), math.MaxInt32); err != nil {
+		if err := d.cache.Remove(id, 0, math.MaxInt32); err != nil {
+			return nil, err
+		}
+		numPast = 0
+	}
+	d.tokens[id] = d.tokens[id][:numPast]
+
+	var logits []float32
+	for numPast < len(tokens) {
+		end := min(len(tokens), numPast+d.batchSize)
+
+		var err error
+		logits, err = d.forward(id, tokens[numPast:end])
+		if err != nil {
+			return nil, err
+		}
+
+		numPast = end
+	}
+
+	var drafts []int32
+	for {
+		token := int32(common.Argmax(logits))
+		if d.model.(model.TextProcessor).Is(token, model.SpecialEOG) {
+			break
+		}
+
+		drafts = append(drafts, token)
+		if len(drafts) >= n {
+			break
+		}
+
+		var err error
+		logits, err = d.forward(id, []int32{token})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return drafts, nil
+}
+
+// forward adds tokens to the draft model's cache for slot id, returning the
+// logits for the token after them
+func (d *draftModel) forward(id int, tokens []int32) ([]float32, error) {
+	ctx := d.model.Backend().NewContext()
+	defer ctx.Close()
+
+	var batch input.Batch
+	for i := range tokens {
+		batch.Positions = append(batch.Positions, int32(len(d.tokens[id])+i))
+		batch.Sequences = append(batch.Sequences, id)
+	}
+	batch.Outputs = []int32{int32(len(tokens) - 1)}
+
+	t, err := model.Forward(ctx, d.model, tokens, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode draft batch: %w", err)
+	}
+
+	d.tokens[id] = append(d.tokens[id], tokens...)
+	return t.Floats(), nil
+}
@@ -0,0 +1,35 @@
+package roserunner
+
+import (
+	"slices"
+
+	"github.com/qompassai/rose/model"
+)
+
+// pool combines the hidden states of a sequence, size values for each of
+// its inputs in order, into a single embedding. For reranking models these
+// are the scores of the classification head, and the embedding is the score
+// of the sequence.
+func pool(hidden []float32, size int, poolingType model.PoolingType) []float32 {
+	switch poolingType {
+	case model.PoolingTypeMean:
+		embedding := make([]float32, size)
+		for i := 0; i < len(hidden); i += size {
+			for j, v := range hidden[i : i+size] {
+				embedding[j] += v
+			}
+		}
+
+		n := float32(len(hidden) / size)
+		for j := range embedding {
+			embedding[j] /= n
+		}
+
+		return embedding
+	case model.PoolingTypeCLS, model.PoolingTypeRank:
+		return slices.Clone(hidden[:size])
+	default:
+		// the last input has seen all of the others in causal models
+		return slices.Clone(hidden[len(hidden)-size:])
+	}
+}
@@ -0,0 +1,33 @@
+package roserunner
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/qompassai/rose/model"
+)
+
+func TestPool(t *testing.T) {
+	hidden := []float32{
+		1, 2, 3,
+		3, 4, 5,
+		5, 0, 1,
+	}
+
+	cases := []struct {
+		poolingType model.PoolingType
+		want        []float32
+	}{
+		{model.PoolingTypeMean, []float32{3, 2, 3}},
+		{model.PoolingTypeCLS, []float32{1, 2, 3}},
+		{model.PoolingTypeRank, []float32{1, 2, 3}},
+		{model.PoolingTypeLast, []float32{5, 0, 1}},
+		{model.PoolingTypeNone, []float32{5, 0, 1}},
+	}
+
+	for _, tt := range cases {
+		if got := pool(hidden, 3, tt.poolingType); !slices.Equal(got, tt.want) {
+			t.Errorf("pool(%d) = %v, want %v", tt.poolingType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package roserunner
+
+import (
+	"slices"
+	"time"
+
+	"github.com/qompassai/rose/model/input"
+)
+
+// prefixTree is a radix tree of the inputs in the cache slots. Each node
+// holds a run of inputs that every slot below it starts with, so the longest
+// prefix of a prompt in any slot can be found in one pass and shared with
+// the slot that processes it, rather than each slot storing its own copy.
+//
+// The tree is kept with the cache and updated as slots change: when a slot
+// is loaded for a prompt, when it's released and when its inputs are moved
+// or replaced. While a slot is in use, the tree has the inputs that it
+// started with rather than those it has processed since.
+type prefixTree struct {
+	root prefixNode
+
+	// leaves are the nodes that the inputs of each slot end in
+	leaves map[int]*prefixNode
+}
+
+type prefixNode struct {
+	// inputs following those of the parent
+	inputs []input.Input
+
+	parent   *prefixNode
+	children []*prefixNode
+
+	// slots that have all of the inputs up to the end of this node, in
+	// order of Id
+	slots []int
+
+	// last time any of the slots used the inputs up to the end of this
+	// node, so the least recently used inputs are evicted first
+	lastUsed time.Time
+}
+
+func newPrefixTree(slots []InputCacheSlot) *prefixTree {
+	t := prefixTree{leaves: make(map[int]*prefixNode)}
+	for _, s := range slots {
+		t.insert(s.Id, s.Inputs, s.lastUsed)
+	}
+
+	return &t
+}
+
+// insert sets the inputs of a slot, replacing any it had before and
+// splitting nodes where they diverge from the inputs of other slots
+func (t *prefixTree) insert(slot int, inputs []input.Input, lastUsed time.Time) {
+	t.remove(slot)
+
+	node := &t.root
+	node.use(slot, lastUsed)
+
+	for len(inputs) > 0 {
+		child := node.child(inputs[0])
+		if child == nil {
+			// the slot's inputs change as it's used, so the tree keeps its
+			// own copy
+			child = &prefixNode{inputs: slices.Clone(inputs), parent: node}
+			node.children = append(node.children, child)
+		} else if n := countCommonPrefix(child.inputs, inputs); n < int32(len(child.inputs)) {
+			t.split(child, n)
+		}
+
+		inputs = inputs[len(child.inputs):]
+		node = child
+		node.use(slot, lastUsed)
+	}
+
+	t.leaves[slot] = node
+}
+
+// remove takes the inputs of a slot out of the tree, deleting nodes that no
+// other slot has and merging those that are no longer split
+func (t *prefixTree) remove(slot int) {
+	node, ok := t.leaves[slot]
+	if !ok {
+		return
+	}
+	delete(t.leaves, slot)
+
+	for ; node != nil; node = node.parent {
+		if i, ok := slices.BinarySearch(node.slots, slot); ok {
+			node.slots = slices.Delete(node.slots, i, i+1)
+		}
+
+		node.children = slices.DeleteFunc(node.children, func(child *prefixNode) bool {
+			return len(child.slots) == 0
+		})
+
+		if node != &t.root && len(node.children) == 1 && len(node.children[0].slots) == len(node.slots) {
+			t.merge(node)
+		}
+	}
+}
+
+// match returns the number of inputs at the start of prompt that are in the
+// tree and the node that the last of them is in. Every slot of the node has
+// at least that many inputs of prompt.
+func (t *prefixTree) match(prompt []input.Input) (*prefixNode, int32) {
+	node := &t.root
+	var length int32
+
+	for length < int32(len(prompt)) {
+		child := node.child(prompt[length])
+		if child == nil {
+			break
+		}
+
+		n := countCommonPrefix(child.inputs, prompt[length:])
+		node = child
+		length += n
+
+		if n < int32(len(child.inputs)) {
+			break
+		}
+	}
+
+	return node, length
+}
+
+// evictable returns how many inputs of slot would be lost by reusing it for
+// a prompt that it has the first keep inputs of, and when they were last
+// used. Inputs that another slot also has stay in the cache.
+func (t *prefixTree) evictable(slot int, keep int32) (int32, time.Time) {
+	var path []*prefixNode
+	for node := t.leaves[slot]; node != nil && node != &t.root; node = node.parent {
+		path = append(path, node)
+	}
+
+	var length, total int32
+	for _, node := range path {
+		total += int32(len(node.inputs))
+	}
+
+	for _, node := range slices.Backward(path) {
+		if len(node.slots) < 2 {
+			// this node and the ones below it are only in this slot
+			return total - max(length, keep), node.lastUsed
+		}
+
+		length += int32(len(node.inputs))
+	}
+
+	return 0, time.Time{}
+}
+
+func (n *prefixNode) child(inp input.Input) *prefixNode {
+	for _, child := range n.children {
+		if child.inputs[0].Token == inp.Token && child.inputs[0].MultimodalHash == inp.MultimodalHash {
+			return child
+		}
+	}
+
+	return nil
+}
+
+func (n *prefixNode) use(slot int, lastUsed time.Time) {
+	if i, ok := slices.BinarySearch(n.slots, slot); !ok {
+		n.slots = slices.Insert(n.slots, i, slot)
+	}
+
+	if lastUsed.After(n.lastUsed) {
+		n.lastUsed = lastUsed
+	}
+}
+
+// split moves the inputs of n after the first length into a new child
+func (t *prefixTree) split(n *prefixNode, length int32) {
+	child := &prefixNode{
+		inputs:   n.inputs[length:],
+		parent:   n,
+		children: n.children,
+		slots:    slices.Clone(n.slots),
+		lastUsed: n.lastUsed,
+	}
+
+	for _, grandchild := range child.children {
+		grandchild.parent = child
+	}
+
+	for _, slot := range n.slots {
+		if t.leaves[slot] == n {
+			t.leaves[slot] = child
+		}
+	}
+
+	n.inputs = n.inputs[:length]
+	n.children = []*prefixNode{child}
+}
+
+// merge moves the only child of n, which has the same slots, into n
+func (t *prefixTree) merge(n *prefixNode) {
+	child := n.children[0]
+
+	n.inputs = slices.Concat(n.inputs, child.inputs)
+	n.children = child.children
+	if child.lastUsed.After(n.lastUsed) {
+		n.lastUsed = child.lastUsed
+	}
+
+	for _, grandchild := range n.children {
+		grandchild.parent = n
+	}
+
+	for _, slot := range child.slots {
+		if t.leaves[slot] == child {
+			t.leaves[slot] = n
+		}
+	}
+}
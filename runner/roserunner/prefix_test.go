@@ -0,0 +1,147 @@
+package roserunner
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qompassai/rose/model/input"
+)
+
+func TestPrefixTree(t *testing.T) {
+	now := time.Now()
+	slots := []InputCacheSlot{
+		{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 3}}, lastUsed: now.Add(-3 * time.Second)},
+		{Id: 1, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 4}, {Token: 5}}, lastUsed: now.Add(-2 * time.Second)},
+		{Id: 2, Inputs: []input.Input{{Token: 1}, {Token: 2}}, lastUsed: now.Add(-time.Second)},
+		{Id: 3, Inputs: []input.Input{{Token: 6}, {MultimodalHash: 7}}, lastUsed: now},
+		{Id: 4, Inputs: []input.Input{}},
+	}
+
+	tree := newPrefixTree(slots)
+
+	matches := []struct {
+		name   string
+		prompt []input.Input
+		length int32
+		slots  []int
+	}{
+		{"shared", []input.Input{{Token: 1}, {Token: 2}, {Token: 9}}, 2, []int{0, 1, 2}},
+		{"within node", []input.Input{{Token: 1}}, 1, []int{0, 1, 2}},
+		{"branch", []input.Input{{Token: 1}, {Token: 2}, {Token: 4}}, 3, []int{1}},
+		{"whole slot", []input.Input{{Token: 1}, {Token: 2}, {Token: 3}, {Token: 4}}, 3, []int{0}},
+		{"multimodal", []input.Input{{Token: 6}, {MultimodalHash: 7}}, 2, []int{3}},
+		{"other image", []input.Input{{Token: 6}, {MultimodalHash: 8}}, 1, []int{3}},
+		{"none", []input.Input{{Token: 9}}, 0, []int{0, 1, 2, 3, 4}},
+	}
+
+	for _, tt := range matches {
+		t.Run(tt.name, func(t *testing.T) {
+			node, length := tree.match(tt.prompt)
+			if length != tt.length {
+				t.Errorf("match length have %v, want %v", length, tt.length)
+			}
+
+			if !slices.Equal(node.slots, tt.slots) {
+				t.Errorf("match slots have %v, want %v", node.slots, tt.slots)
+			}
+		})
+	}
+
+	evictions := []struct {
+		name string
+		slot int
+		keep int32
+		lost int32
+		used time.Time
+	}{
+		{"after shared", 0, 0, 1, slots[0].lastUsed},
+		{"kept", 1, 3, 1, slots[1].lastUsed},
+		{"all kept", 1, 4, 0, slots[1].lastUsed},
+		{"all shared", 2, 0, 0, time.Time{}},
+		{"all", 3, 0, 2, slots[3].lastUsed},
+		{"empty", 4, 0, 0, time.Time{}},
+	}
+
+	for _, tt := range evictions {
+		t.Run("evictable "+tt.name, func(t *testing.T) {
+			lost, used := tree.evictable(tt.slot, tt.keep)
+			if lost != tt.lost {
+				t.Errorf("evictable lost have %v, want %v", lost, tt.lost)
+			}
+
+			if lost > 0 && !used.Equal(tt.used) {
+				t.Errorf("evictable used have %v, want %v", used, tt.used)
+			}
+		})
+	}
+}
+
+func TestPrefixTreeUpdate(t *testing.T) {
+	now := time.Now()
+	slots := []InputCacheSlot{
+		{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 3}}, lastUsed: now.Add(-3 * time.Second)},
+		{Id: 1, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 4}, {Token: 5}}, lastUsed: now.Add(-2 * time.Second)},
+		{Id: 2, Inputs: []input.Input{{Token: 1}, {Token: 2}}, lastUsed: now.Add(-time.Second)},
+		{Id: 3, Inputs: []input.Input{{Token: 6}}, lastUsed: now},
+	}
+
+	tree := newPrefixTree(slots)
+
+	updates := []struct {
+		name   string
+		slot   int
+		inputs []input.Input
+	}{
+		{"replace", 1, []input.Input{{Token: 6}, {Token: 7}}},
+		{"shorten", 0, []input.Input{{Token: 1}}},
+		{"empty", 2, []input.Input{}},
+		{"extend", 3, []input.Input{{Token: 6}, {Token: 7}, {Token: 8}}},
+		{"split", 0, []input.Input{{Token: 6}, {Token: 9}}},
+	}
+
+	for _, tt := range updates {
+		t.Run(tt.name, func(t *testing.T) {
+			slots[tt.slot].Inputs = tt.inputs
+			tree.insert(tt.slot, tt.inputs, slots[tt.slot].lastUsed)
+
+			// the updated tree has the same nodes as one built from the slots
+			if have, want := dumpPrefixTree(&tree.root), dumpPrefixTree(&newPrefixTree(slots).root); have != want {
+				t.Errorf("tree have %s, want %s", have, want)
+			}
+
+			for _, s := range slots {
+				node, length := tree.match(s.Inputs)
+				if length != int32(len(s.Inputs)) || tree.leaves[s.Id] != node {
+					t.Errorf("slot %d leaf does not match its inputs", s.Id)
+				}
+			}
+		})
+	}
+}
+
+// dumpPrefixTree formats the nodes below n, with their children in order of
+// their first input
+func dumpPrefixTree(n *prefixNode) string {
+	var b strings.Builder
+	for _, inp := range n.inputs {
+		fmt.Fprintf(&b, "%d ", inp.Token)
+	}
+	fmt.Fprintf(&b, "%v", n.slots)
+
+	children := slices.Clone(n.children)
+	slices.SortFunc(children, func(a, b *prefixNode) int {
+		return int(a.inputs[0].Token - b.inputs[0].Token)
+	})
+
+	for _, child := range children {
+		if child.parent != n {
+			b.WriteString("!parent")
+		}
+		fmt.Fprintf(&b, "(%s)", dumpPrefixTree(child))
+	}
+
+	return b.String()
+}
@@ -9,12 +9,14 @@ import (
 	"hash/maphash"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,12 +26,14 @@ import (
 	"golang.org/x/sync/semaphore"
 
 	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/envconfig"
 	"github.com/qompassai/rose/llm"
 	"github.com/qompassai/rose/ml"
 	"github.com/qompassai/rose/model"
 	"github.com/qompassai/rose/model/input"
 	"github.com/qompassai/rose/runner/common"
 	"github.com/qompassai/rose/sample"
+	"github.com/qompassai/rose/tracing"
 
 	_ "github.com/qompassai/rose/model/models"
 )
@@ -55,11 +59,14 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log-probabilities of pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -67,12 +74,22 @@ type Sequence struct {
 	// number of tokens to predict
 	numPredict int
 
+	// number of tokens for the draft model to propose at a time
+	numDraft int
+
+	// tokens proposed by the draft model that were added to the
+	// batch after the last input
+	drafts []int32
+
 	// sampler with transforms to run on generated logits
 	sampler sample.Sampler
 
 	// channel to send back the embedding if embedding only
 	embedding chan []float32
 
+	// hidden states of the inputs processed so far, if embedding only
+	hidden []float32
+
 	// stop sequences
 	stop []string
 
@@ -82,8 +99,16 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// return the log-probability of each generated token along with
+	// topLogprobs alternatives
+	logprobs    bool
+	topLogprobs int
+
 	doneReason string
 
+	// the stop sequence that ended generation, if any
+	stopSequence string
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
@@ -93,10 +118,14 @@ type Sequence struct {
 
 type NewSequenceParams struct {
 	numPredict int
+	numDraft   int
 	stop       []string
 	numKeep    int32
 	sampler    sample.Sampler
 	embedding  bool
+
+	logprobs    bool
+	topLogprobs int
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -111,6 +140,25 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		return nil, errors.New("no input provided")
 	}
 
+	return s.newSequence(inputs, ctxs, startTime, params)
+}
+
+// NewRerankSequence returns a sequence whose embedding is the score a
+// reranking model gives document for how relevant it is to query
+func (s *Server) NewRerankSequence(query, document string) (*Sequence, error) {
+	s.ready.Wait()
+
+	startTime := time.Now()
+
+	inputs, err := s.rerankInputs(query, document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process inputs: %w", err)
+	}
+
+	return s.newSequence(inputs, nil, startTime, NewSequenceParams{embedding: true})
+}
+
+func (s *Server) newSequence(inputs []input.Input, ctxs *contextList, startTime time.Time, params NewSequenceParams) (*Sequence, error) {
 	if params.numKeep < 0 {
 		params.numKeep = int32(len(inputs))
 	}
@@ -130,20 +178,40 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		inputs = newInputs
 	}
 
+	// embedding models see the whole sequence at once
+	if params.embedding {
+		inputs[0].SameBatch = len(inputs) - 1
+	}
+
+	// the draft model only sees text
+	if slices.ContainsFunc(inputs, func(inp input.Input) bool { return inp.Multimodal != nil }) {
+		params.numDraft = 0
+	}
+
 	// TODO(jessegross): Ingest cached history for grammar
 
+	// the prompt counts towards the history for repetition penalties
+	for _, inp := range inputs {
+		if inp.Multimodal == nil {
+			params.sampler.Accept(inp.Token)
+		}
+	}
+
 	return &Sequence{
 		ctxs:                ctxs,
 		inputs:              inputs,
 		numPromptInputs:     len(inputs),
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
+		numDraft:            params.numDraft,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		sampler:             params.sampler,
 		embeddingOnly:       params.embedding,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
 	}, nil
@@ -229,6 +297,32 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, *
 	return inputs, &contexts, nil
 }
 
+// rerankInputs tokenizes a query and document into a single sequence for a
+// reranking model to score
+func (s *Server) rerankInputs(query, document string) ([]input.Input, error) {
+	tp := s.model.(model.TextProcessor)
+
+	q, err := tp.Encode(query, true)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := tp.Encode(document, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := common.RerankTokens(q, d, tp.Vocabulary().BOS)
+	segments := common.RerankSegments(q, d, tp.Vocabulary().BOS)
+
+	inputs := make([]input.Input, len(tokens))
+	for i, t := range tokens {
+		inputs[i] = input.Input{Token: t, Segment: segments[i]}
+	}
+
+	return inputs, nil
+}
+
 type Server struct {
 	// is the server ready to process requests?
 	// protects access to model and image
@@ -237,6 +331,9 @@ type Server struct {
 	// loaded model
 	model model.Model
 
+	// draft model proposing tokens for the model to verify, if any
+	draft *draftModel
+
 	// status for external health reporting - loading, ready to serve, etc.
 	status llm.ServerStatus
 
@@ -287,9 +384,17 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// response is a piece of generated text sent back to the client
+type response struct {
+	content  string
+	logprobs []api.Logprob
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -306,13 +411,59 @@ func flushPending(seq *Sequence) bool {
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
 	}
 }
 
+// decodeToken returns the text piece for a single token, used when
+// reporting alternative tokens in log-probabilities
+func (s *Server) decodeToken(token int) string {
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{int32(token)})
+	if err != nil {
+		return ""
+	}
+	return piece
+}
+
+// grammarVocab returns the text of each token that may be generated under a
+// grammar along with the tokens that end generation
+func grammarVocab(tp model.TextProcessor) ([]string, []int32) {
+	vocab := tp.Vocabulary()
+	pieces := make([]string, len(vocab.Values))
+	var eog []int32
+	for i := range vocab.Values {
+		id := int32(i)
+		if tp.Is(id, model.SpecialEOG) {
+			eog = append(eog, id)
+			continue
+		}
+
+		var typ uint32 = model.TOKEN_TYPE_NORMAL
+		if i < len(vocab.Types) {
+			typ = vocab.Types[i]
+		}
+
+		switch typ {
+		case model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_UNKNOWN, model.TOKEN_TYPE_UNUSED:
+			// never generated as text
+		case model.TOKEN_TYPE_BYTE:
+			var b byte
+			if _, err := fmt.Sscanf(vocab.Values[i], "<0x%02X>", &b); err == nil {
+				pieces[i] = string([]byte{b})
+			}
+		default:
+			if piece, err := tp.Decode([]int32{id}); err == nil {
+				pieces[i] = piece
+			}
+		}
+	}
+
+	return pieces, eog
+}
+
 func (s *Server) removeSequence(seqIndex int, reason string) {
 	seq := s.seqs[seqIndex]
 
@@ -320,7 +471,7 @@ func (s *Server) removeSequence(seqIndex int, reason string) {
 	seq.doneReason = reason
 	close(seq.responses)
 	close(seq.embedding)
-	seq.cache.InUse = false
+	s.cache.ReleaseCacheSlot(seq.cache)
 	s.seqs[seqIndex] = nil
 	s.seqsSem.Release(1)
 }
@@ -403,15 +554,35 @@ func (s *Server) processBatch() error {
 
 			batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
 			batch.Sequences = append(batch.Sequences, seq.cache.Id)
+			batch.Segments = append(batch.Segments, inp.Segment)
 
+			// embeddings are pooled from the hidden states of every input
 			seq.iBatch = len(batch.Outputs)
-			if j+1 == len(seq.inputs) {
+			if j+1 == len(seq.inputs) || seq.embeddingOnly {
 				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
 			}
 			seq.pendingInputs = append(seq.pendingInputs, inp)
 		}
 
 		seq.inputs = seq.inputs[len(seq.pendingInputs):]
+
+		if len(seq.inputs) == 0 && seq.numPredicted > 0 {
+			drafts, err := s.propose(seq, batchSize)
+			if err != nil {
+				return err
+			}
+
+			for _, token := range drafts {
+				batchInputs = append(batchInputs, token)
+				batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
+				batch.Sequences = append(batch.Sequences, seq.cache.Id)
+				batch.Segments = append(batch.Segments, 0)
+				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
+				seq.pendingInputs = append(seq.pendingInputs, input.Input{Token: token})
+				seq.iBatch = len(batch.Outputs) - 1
+			}
+			seq.drafts = drafts
+		}
 	}
 
 	if len(batchInputs) == 0 {
@@ -433,12 +604,23 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
-		// After calling Forward, pending inputs are now in the cache
+		// After calling Forward, pending inputs are now in the cache. Drafts
+		// are only kept once the model agrees with them.
 		if len(seq.pendingInputs) > 0 {
-			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
+			if seq.embeddingOnly {
+				// each pending input has an output, ending at iBatch
+				size := len(logits) / len(batch.Outputs)
+				start := seq.iBatch + 1 - len(seq.pendingInputs)
+				seq.hidden = append(seq.hidden, logits[start*size:(seq.iBatch+1)*size]...)
+			}
+
+			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs[:len(seq.pendingInputs)-len(seq.drafts)]...)
 			seq.pendingInputs = []input.Input{}
 		}
 
+		drafts := seq.drafts
+		seq.drafts = nil
+
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
 			if !s.cache.enabled {
@@ -454,83 +636,174 @@ func (s *Server) processBatch() error {
 
 		// if done processing the prompt, generate an embedding and return
 		if seq.embeddingOnly {
-			// TODO(jessegross): Embedding support
-			slog.Warn("generation of embedding outputs not yet supported")
+			size := len(logits) / len(batch.Outputs)
+			seq.embedding <- pool(seq.hidden, size, s.model.(model.EmbeddingModel).PoolingType())
 			s.removeSequence(i, "")
 			continue
 		}
 
-		// sample a token
+		// sample a token, then another for each draft the model agrees
+		// with, up to a token after the last draft
 		vocabSize := len(logits) / len(batch.Outputs)
+		for j := 0; ; j++ {
+			iBatch := seq.iBatch - len(drafts) + j
+			token, ok, err := s.sample(i, seq, logits[iBatch*vocabSize:(iBatch+1)*vocabSize])
+			if err != nil {
+				return err
+			}
 
-		token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
-		if err != nil {
-			return fmt.Errorf("failed to sample token: %w", err)
-		}
-
-		// if it's an end of sequence token, break
-		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
+			if !ok || j == len(drafts) || token != drafts[j] {
+				break
+			}
 
-			s.removeSequence(i, "stop")
-			continue
+			// the draft is already in the KV cache
+			seq.cache.Inputs = append(seq.cache.Inputs, input.Input{Token: token})
+			seq.inputs = nil
+			seq.numPredicted++
 		}
 
-		piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
-		if err != nil {
-			return err
+		// discard the drafts the model disagreed with
+		if len(drafts) > 0 && s.seqs[i] != nil {
+			if err := s.cache.cache.Remove(seq.cache.Id, int32(len(seq.cache.Inputs)), math.MaxInt32); err != nil {
+				// the model can't discard part of its cache, so evaluate
+				// the sequence again and stop drafting
+				slog.Warn("model does not support discarding drafts, disabling draft model", "error", err)
+				if err := s.cache.cache.Remove(seq.cache.Id, 0, math.MaxInt32); err != nil {
+					return err
+				}
+				seq.inputs = slices.Concat(seq.cache.Inputs, seq.inputs)
+				seq.cache.Inputs = []input.Input{}
+				s.draft = nil
+			}
 		}
+	}
 
-		seq.inputs = []input.Input{{Token: token}}
+	return nil
+}
 
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
+// propose returns tokens from the draft model to add to the batch after the
+// token the sequence generated last, as many as fit in the batch and the
+// context and are still left to predict
+func (s *Server) propose(seq *Sequence, batchSize int) ([]int32, error) {
+	if s.draft == nil || !s.cache.enabled || seq.numDraft <= 0 || seq.embeddingOnly {
+		return nil, nil
+	}
 
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+	n := min(seq.numDraft,
+		batchSize-len(seq.pendingInputs),
+		int(s.cache.numCtx)-len(seq.cache.Inputs)-len(seq.pendingInputs))
+	if seq.numPredict > 0 {
+		n = min(n, seq.numPredict-seq.numPredicted-1)
+	}
 
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
+	if n <= 0 {
+		return nil, nil
+	}
 
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
-			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+	tokens := make([]int32, 0, len(seq.cache.Inputs)+len(seq.pendingInputs))
+	for _, inp := range slices.Concat(seq.cache.Inputs, seq.pendingInputs) {
+		tokens = append(tokens, inp.Token)
+	}
 
-			s.removeSequence(i, "stop")
-			continue
-		}
+	return s.draft.propose(seq.cache.Id, tokens, n)
+}
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
-		}
+// sample samples a token for the sequence in s.seqs[i] from its logits and
+// sends it back, returning the token and whether the sequence is still
+// generating
+func (s *Server) sample(i int, seq *Sequence, seqLogits []float32) (int32, bool, error) {
+	token, err := seq.sampler.Sample(seqLogits)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to sample token: %w", err)
+	}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+	// if it's an end of sequence token, break
+	if s.model.(model.TextProcessor).Is(token, model.SpecialEOG) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
+
+		s.removeSequence(i, "stop")
+		return token, false, nil
+	}
+
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
+	if err != nil {
+		return 0, false, err
+	}
+
+	seq.inputs = []input.Input{{Token: token}}
+
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	if seq.logprobs {
+		seq.pendingLogprobs = append(seq.pendingLogprobs, common.Logprobs(seqLogits, int(token), seq.topLogprobs, s.decodeToken))
+	}
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		if len(seq.pendingLogprobs) > newLen {
+			seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
 		}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, "connection")
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		seq.stopSequence = stop
+		s.removeSequence(i, "stop")
+		return token, false, nil
 	}
 
-	return nil
+	if common.ContainsStopSuffix(sequence, seq.stop) {
+		return token, true, nil
+	}
+
+	if common.IncompleteUnicode(sequence) {
+		return token, true, nil
+	}
+
+	if !flushPending(seq) {
+		s.removeSequence(i, "connection")
+		return token, false, nil
+	}
+
+	return token, true, nil
+}
+
+// trace records spans for the prompt evaluation and decoding phases of a
+// finished sequence
+func (seq *Sequence) trace(ctx context.Context) {
+	if seq.startGenerationTime.IsZero() {
+		return
+	}
+
+	_, span := tracing.StartAt(ctx, "processBatch prompt_eval", seq.startProcessingTime, tracing.Attr("tokens", seq.numPromptInputs))
+	span.EndAt(seq.startGenerationTime, nil)
+
+	_, span = tracing.StartAt(ctx, "processBatch decode", seq.startGenerationTime, tracing.Attr("tokens", seq.numPredicted))
+	span.End(nil)
 }
 
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "runner.completion")
+	defer span.End(nil)
+
 	var req llm.CompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
@@ -557,26 +830,58 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	if req.Grammar != "" {
 		grammar, err = sample.NewGrammar(s.vocab, req.Grammar)
 		if err != nil {
-			http.Error(w, "failed to load model vocabulary required for format", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("failed to load grammar for format: %v", err), http.StatusBadRequest)
 			return
 		}
 	}
 
-	sampler := sample.NewSampler(
-		req.Options.Temperature,
-		req.Options.TopK,
-		req.Options.TopP,
-		req.Options.MinP,
-		req.Options.Seed,
-		grammar,
-	)
+	var dryBreakers []int32
+	if req.Options.DRYMultiplier > 0 {
+		dryBreakers = s.vocab.Containing(req.Options.DRYSequenceBreakers...)
+	}
+
+	var logitBias map[int32]float32
+	if len(req.Options.LogitBias) > 0 {
+		logitBias = make(map[int32]float32, len(req.Options.LogitBias))
+		for id, bias := range req.Options.LogitBias {
+			logitBias[int32(id)] = bias
+		}
+	}
+
+	sampler := sample.NewSampler(sample.Options{
+		Temperature:      req.Options.Temperature,
+		TopK:             req.Options.TopK,
+		TopP:             req.Options.TopP,
+		MinP:             req.Options.MinP,
+		TypicalP:         req.Options.TypicalP,
+		Seed:             req.Options.Seed,
+		RepeatLastN:      req.Options.RepeatLastN,
+		RepeatPenalty:    req.Options.RepeatPenalty,
+		PresencePenalty:  req.Options.PresencePenalty,
+		FrequencyPenalty: req.Options.FrequencyPenalty,
+		Mirostat:         req.Options.Mirostat,
+		MirostatTau:      req.Options.MirostatTau,
+		MirostatEta:      req.Options.MirostatEta,
+
+		DRYMultiplier:       req.Options.DRYMultiplier,
+		DRYBase:             req.Options.DRYBase,
+		DRYAllowedLength:    req.Options.DRYAllowedLength,
+		DRYSequenceBreakers: dryBreakers,
+		DRYLastN:            req.Options.NumCtx,
+		XTCProbability:      req.Options.XTCProbability,
+		XTCThreshold:        req.Options.XTCThreshold,
+		LogitBias:           logitBias,
+	}, grammar)
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
-		numPredict: req.Options.NumPredict,
-		stop:       req.Options.Stop,
-		numKeep:    int32(req.Options.NumKeep),
-		sampler:    sampler,
-		embedding:  false,
+		numPredict:  req.Options.NumPredict,
+		numDraft:    req.Options.NumDraft,
+		stop:        req.Options.Stop,
+		numKeep:     int32(req.Options.NumKeep),
+		sampler:     sampler,
+		embedding:   false,
+		logprobs:    req.Logprobs,
+		topLogprobs: req.TopLogprobs,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
@@ -597,7 +902,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
 			if err != nil {
 				s.mu.Unlock()
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
@@ -622,10 +927,11 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case resp, ok := <-seq.responses:
 			if ok {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
+					Content:  resp.content,
+					Logprobs: resp.logprobs,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
@@ -635,6 +941,8 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				flusher.Flush()
 			} else {
 				// Send the final response
+				seq.trace(ctx)
+
 				doneReason := "stop"
 				if seq.doneReason == "limit" {
 					doneReason = "length"
@@ -642,6 +950,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
 					Done:               true,
 					DoneReason:         doneReason,
+					StopSequence:       seq.stopSequence,
 					PromptEvalCount:    seq.numPromptInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numPredicted,
@@ -656,6 +965,181 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.model.(model.EmbeddingModel); !ok {
+		http.Error(w, "this model does not support embeddings", http.StatusNotImplemented)
+		return
+	}
+
+	var req llm.EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	slog.Debug("embedding request", "content", req.Content)
+
+	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{embedding: true})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	embedding, err := s.embed(r.Context(), seq)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("aborting embeddings request due to client closing the connection")
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
+		Embedding: embedding,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) rerank(w http.ResponseWriter, r *http.Request) {
+	if m, ok := s.model.(model.EmbeddingModel); !ok || m.PoolingType() != model.PoolingTypeRank {
+		http.Error(w, "this model does not support reranking", http.StatusNotImplemented)
+		return
+	}
+
+	var req llm.RerankRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	seq, err := s.NewRerankSequence(req.Query, req.Document)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	score, err := s.embed(r.Context(), seq)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("aborting rerank request due to client closing the connection")
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(score) == 0 {
+		http.Error(w, "failed to score document", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.RerankResponse{
+		Score: score[0],
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// embed runs seq, which must be an embedding sequence, and waits for its
+// embedding
+func (s *Server) embed(ctx context.Context, seq *Sequence) ([]float32, error) {
+	// Ensure there is a place to put the sequence, released when removed from s.seqs
+	if err := s.seqsSem.Acquire(ctx, 1); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	found := false
+	for i, sq := range s.seqs {
+		if sq == nil {
+			var err error
+			// inputs taken from the cache have no hidden states, so they
+			// can only be reused when the embedding is the last input's
+			reuse := s.model.(model.EmbeddingModel).PoolingType() == model.PoolingTypeLast
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, reuse)
+			if err != nil {
+				s.mu.Unlock()
+				s.seqsSem.Release(1)
+				return nil, fmt.Errorf("failed to load cache: %w", err)
+			}
+			s.seqs[i] = seq
+			s.cond.Signal()
+			found = true
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		s.seqsSem.Release(1)
+		return nil, errors.New("could not find an available sequence")
+	}
+
+	embedding, ok := <-seq.embedding
+	if !ok {
+		return nil, errors.New("sequence ended before its embedding was computed")
+	}
+
+	return embedding, nil
+}
+
+func (s *Server) saveCache(w http.ResponseWriter, r *http.Request) {
+	s.cacheSnapshot(w, r, (*InputCache).SaveSnapshot)
+}
+
+func (s *Server) restoreCache(w http.ResponseWriter, r *http.Request) {
+	s.cacheSnapshot(w, r, (*InputCache).RestoreSnapshot)
+}
+
+// cacheSnapshot handles saving or restoring the cache for a prompt with fn
+func (s *Server) cacheSnapshot(w http.ResponseWriter, r *http.Request, fn func(*InputCache, []input.Input) (int32, error)) {
+	var req llm.CacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	s.ready.Wait()
+
+	inputs, _, err := s.inputs(req.Prompt, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to process inputs: %v", err), http.StatusInternalServerError)
+		return
+	} else if len(inputs) == 0 {
+		http.Error(w, "no input provided", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	n, err := fn(s.cache, inputs)
+	s.mu.Unlock()
+
+	switch {
+	case errors.Is(err, errSnapshotNotSupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case errors.Is(err, errNotCached), errors.Is(err, errNoSnapshot):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.CacheResponse{
+		Tokens: int(n),
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
@@ -682,10 +1166,14 @@ func (s *Server) loadModel(
 	mpath string,
 	params ml.BackendParams,
 	lpath multiLPath,
+	dpath string,
+	draftParams ml.BackendParams,
 	parallel int,
 	kvCacheType string,
 	kvSize int,
-	multiUserCache bool,
+	cacheDir string,
+	persistCache bool,
+	cacheSize int64,
 ) {
 	var err error
 	s.model, err = model.New(ctx, mpath, params)
@@ -693,14 +1181,16 @@ func (s *Server) loadModel(
 		panic(err)
 	}
 
-	s.vocab = sample.NewVocab(mpath)
+	s.vocab = sample.NewVocab(func() ([]string, []int32) {
+		return grammarVocab(s.model.(model.TextProcessor))
+	})
 
 	// TODO(jessegross): LoRA loading
 	if lpath.String() != "" {
 		panic("loras are not yet implemented")
 	}
 
-	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, s.batchSize, multiUserCache)
+	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, s.batchSize, cacheDir, persistCache, cacheSize)
 	if err != nil {
 		panic(err)
 	}
@@ -710,6 +1200,13 @@ func (s *Server) loadModel(
 		slog.Warn("model does not support caching, disabling parallel processing")
 	}
 
+	if dpath != "" {
+		s.draft, err = newDraftModel(ctx, dpath, draftParams, s.model.(model.TextProcessor), kvCacheType, s.cache.numCtx, len(s.cache.slots), s.batchSize)
+		if err != nil {
+			slog.Warn("failed to load draft model, generating without it", "error", err)
+		}
+	}
+
 	s.parallel = parallel
 	s.seqs = make([]*Sequence, s.parallel)
 	s.seqsSem = semaphore.NewWeighted(int64(s.parallel))
@@ -721,6 +1218,8 @@ func (s *Server) loadModel(
 func Execute(args []string) error {
 	fs := flag.NewFlagSet("runner", flag.ExitOnError)
 	mpath := fs.String("model", "", "Path to model binary file")
+	dpath := fs.String("draft-model", "", "Path to draft model binary file")
+	numGPULayersDraft := fs.Int("draft-n-gpu-layers", 0, "Number of layers of the draft model to offload to GPU")
 	parallel := fs.Int("parallel", 1, "Number of sequences to handle simultaneously")
 	batchSize := fs.Int("batch-size", 512, "Batch size")
 	numGPULayers := fs.Int("n-gpu-layers", 0, "Number of layers to offload to GPU")
@@ -734,7 +1233,9 @@ func Execute(args []string) error {
 	_ = fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	_ = fs.Bool("mlock", false, "force system to keep model in RAM rather than swapping or compressing")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
-	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	cacheDir := fs.String("cache-dir", "", "Directory to save and restore snapshots of the KV cache")
+	persistCache := fs.Bool("persist-cache", false, "automatically save long shared prompt prefixes to the cache directory and restore them")
+	cacheSize := fs.Int64("cache-size", 0, "maximum bytes of automatically saved prompts in the cache directory, deleting the least recently used (default: unlimited)")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -764,6 +1265,15 @@ func Execute(args []string) error {
 	slog.SetDefault(slog.New(handler))
 	slog.Info("starting rose engine")
 
+	if endpoint := envconfig.OTLPEndpoint(); endpoint != "" {
+		shutdown := tracing.Init(endpoint, "rose-runner")
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdown(ctx)
+		}()
+	}
+
 	server := &Server{
 		batchSize: *batchSize,
 		status:    llm.ServerStatusLoadingModel,
@@ -794,11 +1304,16 @@ func Execute(args []string) error {
 		FlashAttention: *flashAttention,
 	}
 
+	draftParams := params
+	draftParams.NumGPULayers = *numGPULayersDraft
+	draftParams.TensorSplit = nil
+	draftParams.Progress = nil
+
 	server.ready.Add(1)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go server.loadModel(ctx, *mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
+	go server.loadModel(ctx, *mpath, params, lpaths, *dpath, draftParams, *parallel, *kvCacheType, *kvSize, *cacheDir, *persistCache, *cacheSize)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -813,12 +1328,11 @@ func Execute(args []string) error {
 	defer listener.Close()
 
 	mux := http.NewServeMux()
-	// TODO: support embeddings
-	mux.HandleFunc("POST /embedding", func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "this model does not support embeddings", http.StatusNotImplemented)
-	})
-
+	mux.HandleFunc("POST /embedding", server.embeddings)
+	mux.HandleFunc("POST /rerank", server.rerank)
 	mux.HandleFunc("POST /completion", server.completion)
+	mux.HandleFunc("POST /cache/save", server.saveCache)
+	mux.HandleFunc("POST /cache/restore", server.restoreCache)
 	mux.HandleFunc("GET /health", server.health)
 
 	httpServer := http.Server{
@@ -0,0 +1,594 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// elementType is the kind of a single grammar element. The encoding follows
+// llama.cpp so grammars written for it behave the same here: a rule is a
+// list of alternates separated by elementAlt and terminated by elementEnd,
+// and a character set is a elementChar or elementCharNot followed by any
+// number of elementCharAlt and elementCharRangeUpper modifiers.
+type elementType uint8
+
+const (
+	elementEnd            elementType = iota // end of rule definition
+	elementAlt                               // start of alternate definition for rule
+	elementRuleRef                           // non-terminal: reference to rule
+	elementChar                              // terminal: character (code point)
+	elementCharNot                           // inverse char(s) ([^a], [^a-b] [^abc])
+	elementCharRangeUpper                    // modifies a preceding char to be an inclusive range ([a-z])
+	elementCharAlt                           // modifies a preceding char to add an alternate char to match ([ab], [a-zA])
+	elementCharAny                           // any character (.)
+)
+
+type element struct {
+	typ   elementType
+	value uint32
+}
+
+// isEndOfSequence reports whether e ends an alternate
+func (e element) isEndOfSequence() bool {
+	return e.typ == elementEnd || e.typ == elementAlt
+}
+
+func (e element) isChar() bool {
+	switch e.typ {
+	case elementChar, elementCharNot, elementCharAny:
+		return true
+	default:
+		return false
+	}
+}
+
+// rules is a parsed grammar. All rules are stored in one flat list of
+// elements so a position in the grammar is a single index.
+type rules struct {
+	elements []element
+	// start of each rule in elements, indexed by rule id
+	starts []int32
+	root   int32
+}
+
+// parseGrammar parses a grammar in GBNF format
+// (https://github.com/ggml-org/llama.cpp/blob/master/grammars/README.md)
+func parseGrammar(src string) (*rules, error) {
+	p := gbnfParser{src: src, symbols: make(map[string]uint32)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	for name, id := range p.symbols {
+		if len(p.rules[id]) == 0 {
+			return nil, fmt.Errorf("grammar: undefined rule %q", name)
+		}
+	}
+
+	root, ok := p.symbols["root"]
+	if !ok {
+		return nil, errors.New("grammar: missing root rule")
+	}
+
+	r := rules{starts: make([]int32, len(p.rules)), root: int32(root)}
+	for i, rule := range p.rules {
+		r.starts[i] = int32(len(r.elements))
+		r.elements = append(r.elements, rule...)
+	}
+
+	if name, ok := r.leftRecursion(p.names()); ok {
+		return nil, fmt.Errorf("grammar: left recursion detected in rule %q", name)
+	}
+
+	return &r, nil
+}
+
+// leftRecursion finds a rule that can reference itself without consuming any
+// input, which the matcher would otherwise expand forever
+func (r *rules) leftRecursion(names []string) (string, bool) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	nullable := r.nullable()
+	state := make([]uint8, len(r.starts))
+
+	var recursive int
+	var visit func(int) bool
+	visit = func(id int) bool {
+		switch state[id] {
+		case visiting:
+			recursive = id
+			return true
+		case visited:
+			return false
+		}
+
+		state[id] = visiting
+		for pos := int(r.starts[id]); ; pos++ {
+			// walk each alternate up to its first element that can't be empty
+			for ; !r.elements[pos].isEndOfSequence(); pos++ {
+				e := r.elements[pos]
+				if e.typ != elementRuleRef {
+					break
+				}
+
+				if visit(int(e.value)) {
+					return true
+				}
+
+				if !nullable[e.value] {
+					break
+				}
+			}
+
+			for !r.elements[pos].isEndOfSequence() {
+				pos++
+			}
+
+			if r.elements[pos].typ == elementEnd {
+				break
+			}
+		}
+
+		state[id] = visited
+		return false
+	}
+
+	for id := range r.starts {
+		if visit(id) {
+			return names[recursive], true
+		}
+	}
+
+	return "", false
+}
+
+// nullable reports for each rule whether it can match the empty string
+func (r *rules) nullable() []bool {
+	nullable := make([]bool, len(r.starts))
+	for changed := true; changed; {
+		changed = false
+		for id, start := range r.starts {
+			if nullable[id] {
+				continue
+			}
+
+			pos := int(start)
+			for {
+				empty := true
+				for ; !r.elements[pos].isEndOfSequence(); pos++ {
+					e := r.elements[pos]
+					if empty && (e.typ != elementRuleRef || !nullable[e.value]) {
+						empty = false
+					}
+				}
+
+				if empty {
+					nullable[id] = true
+					changed = true
+					break
+				}
+
+				if r.elements[pos].typ == elementEnd {
+					break
+				}
+				pos++
+			}
+		}
+	}
+
+	return nullable
+}
+
+type gbnfParser struct {
+	src string
+	pos int
+
+	symbols map[string]uint32
+	rules   [][]element
+}
+
+func (p *gbnfParser) names() []string {
+	names := make([]string, len(p.rules))
+	for name, id := range p.symbols {
+		names[id] = name
+	}
+	return names
+}
+
+func (p *gbnfParser) errorf(format string, args ...any) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	return fmt.Errorf("grammar: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *gbnfParser) symbol(name string) uint32 {
+	if id, ok := p.symbols[name]; ok {
+		return id
+	}
+
+	id := uint32(len(p.rules))
+	p.symbols[name] = id
+	p.rules = append(p.rules, nil)
+	return id
+}
+
+// generatedSymbol returns a new rule id for a rule created while parsing
+// such as a group or repetition
+func (p *gbnfParser) generatedSymbol(base string) uint32 {
+	for i := len(p.symbols); ; i++ {
+		name := base + "_" + strconv.Itoa(i)
+		if _, ok := p.symbols[name]; !ok {
+			return p.symbol(name)
+		}
+	}
+}
+
+func (p *gbnfParser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *gbnfParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+// space skips whitespace and comments. Newlines are only skipped if
+// newlines is set since they otherwise end a rule.
+func (p *gbnfParser) space(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\r' && p.peek() != '\n' {
+				p.pos++
+			}
+		case newlines && (c == '\r' || c == '\n'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c == '-' || c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *gbnfParser) name() (string, error) {
+	start := p.pos
+	for !p.eof() && isWordChar(p.peek()) {
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", p.errorf("expecting name at %q", p.rest())
+	}
+
+	return p.src[start:p.pos], nil
+}
+
+func (p *gbnfParser) int() (int, error) {
+	start := p.pos
+	for !p.eof() && '0' <= p.peek() && p.peek() <= '9' {
+		p.pos++
+	}
+
+	if p.pos == start {
+		return 0, p.errorf("expecting integer at %q", p.rest())
+	}
+
+	return strconv.Atoi(p.src[start:p.pos])
+}
+
+func (p *gbnfParser) rest() string {
+	rest := p.src[p.pos:]
+	if len(rest) > 20 {
+		rest = rest[:20] + "..."
+	}
+	return rest
+}
+
+func (p *gbnfParser) parse() error {
+	p.space(true)
+	for !p.eof() {
+		if err := p.rule(); err != nil {
+			return err
+		}
+		p.space(true)
+	}
+
+	return nil
+}
+
+func (p *gbnfParser) rule() error {
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+
+	p.space(false)
+	if !strings.HasPrefix(p.src[p.pos:], "::=") {
+		return p.errorf("expecting ::= at %q", p.rest())
+	}
+	p.pos += 3
+	p.space(true)
+
+	id := p.symbol(name)
+	if len(p.rules[id]) > 0 {
+		return p.errorf("rule %q is defined more than once", name)
+	}
+
+	if err := p.alternates(name, id, false); err != nil {
+		return err
+	}
+
+	switch p.peek() {
+	case '\r':
+		p.pos++
+		if p.peek() == '\n' {
+			p.pos++
+		}
+	case '\n':
+		p.pos++
+	case 0:
+	default:
+		return p.errorf("expecting newline or end at %q", p.rest())
+	}
+
+	return nil
+}
+
+func (p *gbnfParser) alternates(name string, id uint32, nested bool) error {
+	var rule []element
+	if err := p.sequence(name, &rule, nested); err != nil {
+		return err
+	}
+
+	for p.peek() == '|' {
+		rule = append(rule, element{typ: elementAlt})
+		p.pos++
+		p.space(true)
+		if err := p.sequence(name, &rule, nested); err != nil {
+			return err
+		}
+	}
+
+	p.rules[id] = append(rule, element{typ: elementEnd})
+	return nil
+}
+
+func (p *gbnfParser) sequence(name string, out *[]element, nested bool) error {
+	// start of the last symbol, which any repetition operator applies to
+	last := len(*out)
+
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == '"':
+			p.pos++
+			last = len(*out)
+			for p.peek() != '"' {
+				if p.eof() {
+					return p.errorf("unexpected end of input in string")
+				}
+
+				r, err := p.char()
+				if err != nil {
+					return err
+				}
+				*out = append(*out, element{typ: elementChar, value: uint32(r)})
+			}
+			p.pos++
+			p.space(nested)
+		case c == '[':
+			p.pos++
+			last = len(*out)
+
+			typ := elementChar
+			if p.peek() == '^' {
+				p.pos++
+				typ = elementCharNot
+			}
+
+			for p.peek() != ']' {
+				if p.eof() {
+					return p.errorf("unexpected end of input in character class")
+				}
+
+				r, err := p.char()
+				if err != nil {
+					return err
+				}
+
+				if len(*out) > last {
+					typ = elementCharAlt
+				}
+				*out = append(*out, element{typ: typ, value: uint32(r)})
+
+				if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+					p.pos++
+					r, err := p.char()
+					if err != nil {
+						return err
+					}
+					*out = append(*out, element{typ: elementCharRangeUpper, value: uint32(r)})
+				}
+			}
+			p.pos++
+			p.space(nested)
+		case isWordChar(c):
+			ref, err := p.name()
+			if err != nil {
+				return err
+			}
+
+			last = len(*out)
+			*out = append(*out, element{typ: elementRuleRef, value: p.symbol(ref)})
+			p.space(nested)
+		case c == '(':
+			p.pos++
+			p.space(true)
+
+			// groups become their own rule
+			sub := p.generatedSymbol(name)
+			if err := p.alternates(name, sub, true); err != nil {
+				return err
+			}
+
+			last = len(*out)
+			*out = append(*out, element{typ: elementRuleRef, value: sub})
+			if p.peek() != ')' {
+				return p.errorf("expecting ')' at %q", p.rest())
+			}
+			p.pos++
+			p.space(nested)
+		case c == '.':
+			p.pos++
+			last = len(*out)
+			*out = append(*out, element{typ: elementCharAny})
+			p.space(nested)
+		case c == '*' || c == '+' || c == '?' || c == '{':
+			if last == len(*out) {
+				return p.errorf("expecting preceding item to %c at %q", c, p.rest())
+			}
+
+			p.pos++
+			minTimes, maxTimes := 0, -1
+			switch c {
+			case '+':
+				minTimes = 1
+			case '?':
+				maxTimes = 1
+			case '{':
+				p.space(false)
+
+				var err error
+				if minTimes, err = p.int(); err != nil {
+					return err
+				}
+				maxTimes = minTimes
+
+				p.space(false)
+				if p.peek() == ',' {
+					p.pos++
+					p.space(false)
+					maxTimes = -1
+					if '0' <= p.peek() && p.peek() <= '9' {
+						if maxTimes, err = p.int(); err != nil {
+							return err
+						}
+					}
+					p.space(false)
+				}
+
+				if p.peek() != '}' {
+					return p.errorf("expecting '}' at %q", p.rest())
+				}
+				p.pos++
+
+				if maxTimes >= 0 && maxTimes < minTimes {
+					return p.errorf("invalid repetition {%d,%d}", minTimes, maxTimes)
+				}
+			}
+
+			p.repeat(name, out, last, minTimes, maxTimes)
+			p.space(nested)
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// repeat rewrites the symbol at out[last:] to repeat between minTimes and
+// maxTimes, or an unlimited number of times if maxTimes is negative
+func (p *gbnfParser) repeat(name string, out *[]element, last, minTimes, maxTimes int) {
+	symbol := slices.Clone((*out)[last:])
+	*out = (*out)[:last]
+
+	for range minTimes {
+		*out = append(*out, symbol...)
+	}
+
+	if maxTimes < 0 {
+		// x* becomes rec ::= x rec |
+		rec := p.generatedSymbol(name)
+		rule := append(slices.Clone(symbol), element{typ: elementRuleRef, value: rec})
+		rule = append(rule, element{typ: elementAlt}, element{typ: elementEnd})
+		p.rules[rec] = rule
+		*out = append(*out, element{typ: elementRuleRef, value: rec})
+		return
+	}
+
+	// x{0,n} becomes opt ::= x opt' | where opt' is x{0,n-1}
+	var next []element
+	for range maxTimes - minTimes {
+		opt := p.generatedSymbol(name)
+		rule := append(slices.Clone(symbol), next...)
+		rule = append(rule, element{typ: elementAlt}, element{typ: elementEnd})
+		p.rules[opt] = rule
+		next = []element{{typ: elementRuleRef, value: opt}}
+	}
+
+	*out = append(*out, next...)
+}
+
+// char parses a single, possibly escaped, character in a string or
+// character class
+func (p *gbnfParser) char() (rune, error) {
+	if p.peek() != '\\' {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if r == utf8.RuneError && size <= 1 {
+			return 0, p.errorf("invalid UTF-8")
+		}
+		p.pos += size
+		return r, nil
+	}
+
+	p.pos++
+	c := p.peek()
+	p.pos++
+
+	var digits int
+	switch c {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case 'n':
+		return '\n', nil
+	case '\\', '"', '[', ']', '-', '^', '/':
+		return rune(c), nil
+	default:
+		p.pos--
+		return 0, p.errorf("unknown escape at %q", p.rest())
+	}
+
+	if p.pos+digits > len(p.src) {
+		return 0, p.errorf("expecting %d hex digits at %q", digits, p.rest())
+	}
+
+	v, err := strconv.ParseUint(p.src[p.pos:p.pos+digits], 16, 32)
+	if err != nil {
+		return 0, p.errorf("expecting %d hex digits at %q", digits, p.rest())
+	}
+	p.pos += digits
+
+	return rune(v), nil
+}
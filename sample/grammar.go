@@ -0,0 +1,501 @@
+package sample
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Vocab is the text of each token in a model's vocabulary, arranged in a
+// trie so tokens sharing a prefix are matched against a grammar together
+type Vocab struct {
+	once sync.Once
+	load func() ([]string, []int32)
+
+	pieces []string
+	eog    []int32
+	trie   *trieNode
+}
+
+// NewVocab returns a vocabulary that is built the first time a grammar needs
+// it. load returns the text of each token along with the tokens that end
+// generation. Tokens with empty text, such as control tokens, are never
+// allowed by a grammar.
+func NewVocab(load func() (pieces []string, eog []int32)) *Vocab {
+	return &Vocab{load: load}
+}
+
+func (v *Vocab) init() {
+	v.once.Do(func() {
+		v.pieces, v.eog = v.load()
+		v.trie = &trieNode{}
+		for id, piece := range v.pieces {
+			if piece != "" && !slices.Contains(v.eog, int32(id)) {
+				v.trie.insert(piece, int32(id))
+			}
+		}
+	})
+}
+
+// Containing returns the tokens whose text contains any of substrs
+func (v *Vocab) Containing(substrs ...string) []int32 {
+	v.init()
+
+	var ids []int32
+	for id, piece := range v.pieces {
+		if slices.ContainsFunc(substrs, func(s string) bool {
+			return s != "" && strings.Contains(piece, s)
+		}) {
+			ids = append(ids, int32(id))
+		}
+	}
+
+	return ids
+}
+
+type trieNode struct {
+	// sorted by key
+	children []trieChild
+	// tokens whose text ends at this node
+	tokens []int32
+}
+
+type trieChild struct {
+	key  byte
+	node *trieNode
+}
+
+func (n *trieNode) insert(s string, id int32) {
+	for i := range len(s) {
+		j, ok := slices.BinarySearchFunc(n.children, s[i], func(c trieChild, key byte) int {
+			return int(c.key) - int(key)
+		})
+
+		if !ok {
+			n.children = slices.Insert(n.children, j, trieChild{key: s[i], node: &trieNode{}})
+		}
+		n = n.children[j].node
+	}
+
+	n.tokens = append(n.tokens, id)
+}
+
+// stack is a position in the grammar along with the positions to return
+// to once it has been matched. Stacks are immutable and share their tails.
+// A nil stack has matched the grammar completely.
+type stack struct {
+	pos    int32
+	parent *stack
+}
+
+func (s *stack) equal(t *stack) bool {
+	for ; s != nil && t != nil; s, t = s.parent, t.parent {
+		if s == t {
+			return true
+		}
+
+		if s.pos != t.pos {
+			return false
+		}
+	}
+
+	return s == t
+}
+
+// grammarState is the set of positions the grammar may be in along with any
+// bytes of an incomplete UTF-8 character matched so far
+type grammarState struct {
+	stacks  []*stack
+	partial []byte
+}
+
+func (s grammarState) key() string {
+	b := append([]byte(nil), s.partial...)
+	b = append(b, 0xff)
+	for _, st := range s.stacks {
+		for ; st != nil; st = st.parent {
+			b = binary.LittleEndian.AppendUint32(b, uint32(st.pos))
+		}
+		b = append(b, 0xff, 0xff, 0xff, 0xff)
+	}
+	return string(b)
+}
+
+// grammarNode is an interned grammarState. Structured output tends to
+// revisit the same few states, such as inside a string, so transitions and
+// token masks are cached on the node as they are computed.
+type grammarNode struct {
+	state grammarState
+	next  [256]*grammarNode
+	mask  []uint64
+}
+
+// rejected is the transition for a byte that can't be matched
+var rejected = &grammarNode{}
+
+// maxGrammarNodes bounds the number of interned states kept per grammar
+const maxGrammarNodes = 4096
+
+// Grammar constrains sampling to tokens that match a GBNF grammar
+type Grammar struct {
+	vocab *Vocab
+	rules *rules
+	state *grammarNode
+
+	// interned states by grammarState.key
+	nodes map[string]*grammarNode
+}
+
+func NewGrammar(vocab *Vocab, grammar string) (*Grammar, error) {
+	r, err := parseGrammar(grammar)
+	if err != nil {
+		return nil, err
+	}
+
+	vocab.init()
+
+	g := &Grammar{
+		vocab: vocab,
+		rules: r,
+	}
+
+	g.reset(grammarState{stacks: g.expand(r.root, nil, nil)})
+	return g, nil
+}
+
+// reset drops all cached states and continues from state
+func (g *Grammar) reset(state grammarState) {
+	g.nodes = make(map[string]*grammarNode)
+	g.state = g.node(state)
+}
+
+func (g *Grammar) node(state grammarState) *grammarNode {
+	key := state.key()
+	if n, ok := g.nodes[key]; ok {
+		return n
+	}
+
+	n := &grammarNode{state: state}
+	g.nodes[key] = n
+	return n
+}
+
+// next returns the state after matching b from n, or rejected
+func (g *Grammar) next(n *grammarNode, b byte) *grammarNode {
+	if next := n.next[b]; next != nil {
+		return next
+	}
+
+	next := rejected
+	if state, ok := g.acceptByte(n.state, b); ok {
+		next = g.node(state)
+	}
+
+	n.next[b] = next
+	return next
+}
+
+// nextString returns the state after matching s from n, or rejected
+func (g *Grammar) nextString(n *grammarNode, s string) *grammarNode {
+	for i := 0; i < len(s) && n != rejected; i++ {
+		n = g.next(n, s[i])
+	}
+
+	return n
+}
+
+// advance expands rule references at the top of s until every resulting
+// stack has a character to match next, appending them to stacks
+func (g *Grammar) advance(s *stack, stacks []*stack) []*stack {
+	if s == nil || g.rules.elements[s.pos].isChar() {
+		if slices.ContainsFunc(stacks, s.equal) {
+			return stacks
+		}
+		return append(stacks, s)
+	}
+
+	e := g.rules.elements[s.pos]
+	if e.typ != elementRuleRef {
+		return stacks
+	}
+
+	// continue after the reference once the referenced rule is matched
+	parent := s.parent
+	if !g.rules.elements[s.pos+1].isEndOfSequence() {
+		parent = &stack{pos: s.pos + 1, parent: parent}
+	}
+
+	return g.expand(int32(e.value), parent, stacks)
+}
+
+// expand appends the stacks for each alternate of rule, continuing with
+// parent once the rule is matched
+func (g *Grammar) expand(rule int32, parent *stack, stacks []*stack) []*stack {
+	for pos := g.rules.starts[rule]; ; pos++ {
+		if g.rules.elements[pos].isEndOfSequence() {
+			stacks = g.advance(parent, stacks)
+		} else {
+			stacks = g.advance(&stack{pos: pos, parent: parent}, stacks)
+		}
+
+		for !g.rules.elements[pos].isEndOfSequence() {
+			pos++
+		}
+
+		if g.rules.elements[pos].typ == elementEnd {
+			break
+		}
+	}
+
+	return stacks
+}
+
+// matchChar reports whether r is in the character set at pos
+func (g *Grammar) matchChar(pos int32, r rune) bool {
+	return g.matchRange(pos, r, r, true)
+}
+
+// matchRange reports whether characters in [lo, hi] match the character
+// set at pos. If all is set every character must match, otherwise any one.
+func (g *Grammar) matchRange(pos int32, lo, hi rune, all bool) bool {
+	elements := g.rules.elements
+	if elements[pos].typ == elementCharAny {
+		return true
+	}
+
+	negate := elements[pos].typ == elementCharNot
+	var found bool
+	for {
+		first, last := rune(elements[pos].value), rune(elements[pos].value)
+		if elements[pos+1].typ == elementCharRangeUpper {
+			pos++
+			last = rune(elements[pos].value)
+		}
+
+		if negate != all {
+			// either every character must be in the set, or for a negated
+			// set some character matches unless an excluded range covers
+			// all of them
+			if first <= lo && hi <= last {
+				found = true
+				break
+			}
+		} else if first <= hi && lo <= last {
+			found = true
+			break
+		}
+
+		pos++
+		if elements[pos].typ != elementCharAlt {
+			break
+		}
+	}
+
+	return found != negate
+}
+
+// acceptRune returns the stacks that follow from matching r
+func (g *Grammar) acceptRune(stacks []*stack, r rune) []*stack {
+	var next []*stack
+	for _, s := range stacks {
+		if s == nil || !g.matchChar(s.pos, r) {
+			continue
+		}
+
+		pos := s.pos + 1
+		for g.rules.elements[pos].typ == elementCharAlt || g.rules.elements[pos].typ == elementCharRangeUpper {
+			pos++
+		}
+
+		parent := s.parent
+		if !g.rules.elements[pos].isEndOfSequence() {
+			parent = &stack{pos: pos, parent: parent}
+		}
+
+		next = g.advance(parent, next)
+	}
+
+	return next
+}
+
+// acceptByte returns the state after matching b, or false if no stack
+// could match it
+func (g *Grammar) acceptByte(state grammarState, b byte) (grammarState, bool) {
+	partial := append(state.partial[:len(state.partial):len(state.partial)], b)
+	if utf8.FullRune(partial) {
+		r, size := utf8.DecodeRune(partial)
+		if r == utf8.RuneError && size <= 1 {
+			return grammarState{}, false
+		}
+
+		stacks := g.acceptRune(state.stacks, r)
+		return grammarState{stacks: stacks}, len(stacks) > 0
+	}
+
+	// check the incomplete character could still be matched by some stack
+	lo, hi, ok := partialRange(partial)
+	if !ok {
+		return grammarState{}, false
+	}
+
+	for _, s := range state.stacks {
+		if s != nil && g.matchRange(s.pos, lo, hi, false) {
+			return grammarState{stacks: state.stacks, partial: partial}, true
+		}
+	}
+
+	return grammarState{}, false
+}
+
+// partialRange returns the range of characters whose UTF-8 encoding starts
+// with the incomplete sequence b
+func partialRange(b []byte) (lo, hi rune, ok bool) {
+	var n int
+	switch {
+	case b[0]&0xe0 == 0xc0:
+		n = 2
+	case b[0]&0xf0 == 0xe0:
+		n = 3
+	case b[0]&0xf8 == 0xf0:
+		n = 4
+	default:
+		return 0, 0, false
+	}
+
+	lob := append([]byte(nil), b...)
+	hib := append([]byte(nil), b...)
+	for len(lob) < n {
+		lob = append(lob, 0x80)
+		hib = append(hib, 0xbf)
+	}
+
+	lo, _ = utf8.DecodeRune(lob)
+	hi, _ = utf8.DecodeRune(hib)
+	if lo == utf8.RuneError || hi == utf8.RuneError {
+		// the prefix may still be valid with other continuation bytes,
+		// such as a surrogate boundary, so only reject obviously bad input
+		for _, c := range b[1:] {
+			if c&0xc0 != 0x80 {
+				return 0, 0, false
+			}
+		}
+		return 0x80, utf8.MaxRune, true
+	}
+
+	return lo, hi, true
+}
+
+func (g *Grammar) acceptString(state grammarState, s string) (grammarState, bool) {
+	for i := range len(s) {
+		var ok bool
+		if state, ok = g.acceptByte(state, s[i]); !ok {
+			return state, false
+		}
+	}
+
+	return state, true
+}
+
+// complete reports whether the grammar has been matched completely and
+// generation may end
+func (g *Grammar) complete(state grammarState) bool {
+	return len(state.partial) == 0 && slices.Contains(state.stacks, nil)
+}
+
+// allowed reports whether id may be sampled next
+func (g *Grammar) allowed(id int32) bool {
+	if id < 0 || int(id) >= len(g.vocab.pieces) {
+		return false
+	}
+
+	if slices.Contains(g.vocab.eog, id) {
+		return g.complete(g.state.state)
+	}
+
+	piece := g.vocab.pieces[id]
+	return piece != "" && g.nextString(g.state, piece) != rejected
+}
+
+// mask returns a bitset of the tokens that may be sampled next
+func (g *Grammar) mask() []uint64 {
+	if g.state.mask != nil {
+		return g.state.mask
+	}
+
+	m := make([]uint64, (len(g.vocab.pieces)+63)/64)
+	set := func(id int32) {
+		m[id/64] |= 1 << (id % 64)
+	}
+
+	var walk func(t *trieNode, n *grammarNode)
+	walk = func(t *trieNode, n *grammarNode) {
+		for _, c := range t.children {
+			next := g.next(n, c.key)
+			if next == rejected {
+				continue
+			}
+
+			// tokens may end partway through a character as long as
+			// the rest of it could still match
+			for _, id := range c.node.tokens {
+				set(id)
+			}
+
+			walk(c.node, next)
+		}
+	}
+	walk(g.vocab.trie, g.state)
+
+	if g.complete(g.state.state) {
+		for _, id := range g.vocab.eog {
+			if int(id) < len(g.vocab.pieces) {
+				set(id)
+			}
+		}
+	}
+
+	g.state.mask = m
+	return m
+}
+
+// Apply sets the logits of tokens that don't match the grammar to -Inf
+func (g *Grammar) Apply(tokens []token) {
+	// checking a handful of tokens directly is cheaper than
+	// building a mask for the entire vocabulary
+	if len(tokens) <= 16 {
+		for i := range tokens {
+			if !g.allowed(tokens[i].id) {
+				tokens[i].value = float32(math.Inf(-1))
+			}
+		}
+		return
+	}
+
+	m := g.mask()
+	for i := range tokens {
+		id := tokens[i].id
+		if id < 0 || int(id)/64 >= len(m) || m[id/64]&(1<<(id%64)) == 0 {
+			tokens[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+// Accept advances the grammar past token, which must have been allowed
+func (g *Grammar) Accept(token int32) {
+	if token < 0 || int(token) >= len(g.vocab.pieces) || slices.Contains(g.vocab.eog, token) {
+		return
+	}
+
+	n := g.nextString(g.state, g.vocab.pieces[token])
+	if n == rejected {
+		n = g.node(grammarState{})
+	}
+	g.state = n
+
+	if len(g.nodes) > maxGrammarNodes {
+		g.reset(g.state.state)
+	}
+}
@@ -0,0 +1,288 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const jsonGrammar = `
+root   ::= object
+value  ::= object | array | string | number | ("true" | "false" | "null") ws
+object ::=
+  "{" ws (
+            string ":" ws value
+    ("," ws string ":" ws value)*
+  )? "}" ws
+array  ::=
+  "[" ws (
+            value
+    ("," ws value)*
+  )? "]" ws
+string ::=
+  "\"" (
+    [^"\\\x7F\x00-\x1F] |
+    "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]) # escapes
+  )* "\"" ws
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+# Optional space: by convention, applied in this grammar after literal chars when allowed
+ws ::= ([ \t\n] ws)?
+`
+
+// byteVocab has a token for every byte followed by an end of generation token
+func byteVocab() *Vocab {
+	return NewVocab(func() ([]string, []int32) {
+		pieces := make([]string, 257)
+		for i := range 256 {
+			pieces[i] = string([]byte{byte(i)})
+		}
+		return pieces, []int32{256}
+	})
+}
+
+// matches reports whether the grammar accepts all of s
+func matches(t *testing.T, grammar, s string) bool {
+	t.Helper()
+
+	g, err := NewGrammar(byteVocab(), grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, ok := g.acceptString(g.state.state, s)
+	return ok && g.complete(state)
+}
+
+func TestParseGrammar(t *testing.T) {
+	cases := []struct {
+		name    string
+		grammar string
+		err     string
+	}{
+		{name: "json", grammar: jsonGrammar},
+		{name: "comments", grammar: "# comment\nroot ::= \"a\" # trailing\n"},
+		{name: "repetition", grammar: `root ::= [a-z]{2,4} "x"{3} "y"{1,} .?`},
+		{name: "missing root", grammar: `foo ::= "a"`, err: "grammar: missing root rule"},
+		{name: "undefined rule", grammar: `root ::= foo`, err: `grammar: undefined rule "foo"`},
+		{name: "left recursion", grammar: "root ::= expr\nexpr ::= expr \"+\" num | num\nnum ::= [0-9]+", err: `grammar: left recursion detected in rule "expr"`},
+		{name: "hidden left recursion", grammar: "root ::= a\na ::= b? a \"x\" | \"y\"\nb ::= \"z\"", err: "left recursion"},
+		{name: "unterminated string", grammar: `root ::= "abc`, err: "unexpected end of input in string"},
+		{name: "unknown escape", grammar: `root ::= "\q"`, err: "unknown escape"},
+		{name: "missing operator", grammar: `root "a"`, err: "expecting ::="},
+		{name: "duplicate rule", grammar: "root ::= \"a\"\nroot ::= \"b\"", err: "defined more than once"},
+		{name: "bad repetition", grammar: `root ::= "a"{3,1}`, err: "invalid repetition"},
+		{name: "dangling repetition", grammar: `root ::= *`, err: "expecting preceding item"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGrammar(tt.grammar)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("expected error %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("expected error %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestGrammarMatch(t *testing.T) {
+	cases := []struct {
+		grammar string
+		accept  []string
+		reject  []string
+	}{
+		{
+			grammar: `root ::= "yes" | "no"`,
+			accept:  []string{"yes", "no"},
+			reject:  []string{"", "y", "yess", "maybe"},
+		},
+		{
+			grammar: `root ::= [a-c]+ [^a-c]`,
+			accept:  []string{"ax", "abcabc1"},
+			reject:  []string{"a", "x", "abca"},
+		},
+		{
+			grammar: `root ::= "x"{2,3} "y"?`,
+			accept:  []string{"xx", "xxx", "xxy", "xxxy"},
+			reject:  []string{"x", "xxxx", "xxyy"},
+		},
+		{
+			grammar: `root ::= [0-9]{0,2} ("," [0-9])*`,
+			accept:  []string{"", "1", "12", "12,3,4", ",1"},
+			reject:  []string{"123", "1,"},
+		},
+		{
+			grammar: `root ::= "é" [α-ω]+ "☃" .`,
+			accept:  []string{"éαβ☃x", "éω☃😀"},
+			reject:  []string{"eαβ☃x", "é☃x", "éαβ☃"},
+		},
+		{
+			grammar: jsonGrammar,
+			accept:  []string{`{}`, `{"a": [1, 2.5e3, "x\né"], "b": {"c": null}}`, "{ \"nested\" : [[], {}, true] }\n"},
+			reject:  []string{`[]`, `{"a": }`, `{"a": 01}`, `{"a": "\x"}`, `{"a": 1,}`},
+		},
+	}
+
+	for _, tt := range cases {
+		for _, s := range tt.accept {
+			if !matches(t, tt.grammar, s) {
+				t.Errorf("%s: expected %q to match", tt.grammar, s)
+			}
+		}
+
+		for _, s := range tt.reject {
+			if matches(t, tt.grammar, s) {
+				t.Errorf("%s: expected %q not to match", tt.grammar, s)
+			}
+		}
+	}
+}
+
+func TestGrammarApply(t *testing.T) {
+	pieces := []string{"{", "}", "{}", "\"", "\"a\"", "a", ":", " ", "1", "true", "<|control|>", "", "\xc3", "\xa9", "é", "\xff"}
+	eos := int32(len(pieces))
+	vocab := NewVocab(func() ([]string, []int32) {
+		return append(slices.Clone(pieces), "</s>"), []int32{eos}
+	})
+
+	g, err := NewGrammar(vocab, `root ::= "{" "\"" [a-zé]* "\"" ":" " "? ("1" | "true") "}"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := func() []string {
+		// use more tokens than are checked individually so the mask is built
+		tokens := make([]token, 0, 64)
+		for len(tokens) < 64 {
+			for id := range eos + 1 {
+				tokens = append(tokens, token{id: id})
+			}
+		}
+		g.Apply(tokens)
+
+		var mask []string
+		for _, tok := range tokens[:eos+1] {
+			if !math.IsInf(float64(tok.value), -1) {
+				mask = append(mask, fmt.Sprintf("%q", append(pieces, "</s>")[tok.id]))
+			}
+		}
+
+		// the individual check must agree with the mask
+		for _, tok := range tokens[:eos+1] {
+			single := []token{{id: tok.id}}
+			g.Apply(single)
+			if math.IsInf(float64(single[0].value), -1) != math.IsInf(float64(tok.value), -1) {
+				t.Errorf("token %d: mask and individual check disagree", tok.id)
+			}
+		}
+
+		return mask
+	}
+
+	steps := []struct {
+		accept int32
+		want   []string
+	}{
+		{-1, []string{`"{"`}},
+		{0, []string{`"\""`, `"\"a\""`}},
+		{3, []string{`"\""`, `"a"`, `"true"`, `"\xc3"`, `"é"`}},
+		{12, []string{`"\xa9"`}},
+		{13, []string{`"\""`, `"a"`, `"true"`, `"\xc3"`, `"é"`}},
+		{3, []string{`":"`}},
+		{6, []string{`" "`, `"1"`, `"true"`}},
+		{9, []string{`"}"`}},
+		{1, []string{`"</s>"`}},
+	}
+
+	for i, step := range steps {
+		if step.accept >= 0 {
+			g.Accept(step.accept)
+		}
+
+		if got := allowed(); !slices.Equal(got, step.want) {
+			t.Errorf("step %d: expected %v, got %v", i, step.want, got)
+		}
+	}
+}
+
+func TestVocabContaining(t *testing.T) {
+	vocab := NewVocab(func() ([]string, []int32) {
+		return []string{"a", "b\n", ":", "c", "\n\n", ""}, nil
+	})
+
+	if got := vocab.Containing("\n", ":", ""); !slices.Equal(got, []int32{1, 2, 4}) {
+		t.Errorf("expected tokens 1, 2 and 4, got %v", got)
+	}
+}
+
+func TestSamplerGrammar(t *testing.T) {
+	pieces := []string{"no", "yes", "maybe", "</s>"}
+	vocab := NewVocab(func() ([]string, []int32) {
+		return pieces, []int32{3}
+	})
+
+	g, err := NewGrammar(vocab, `root ::= "yes" | "no"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sampler := NewSampler(Options{}, g)
+
+	// the most likely token is not allowed by the grammar
+	got, err := sampler.Sample([]float32{1, 2, 10, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("expected token 1, got %d", got)
+	}
+
+	got, err = sampler.Sample([]float32{1, 2, 10, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 3 {
+		t.Errorf("expected end of generation, got %d", got)
+	}
+}
+
+func BenchmarkGrammarMask(b *testing.B) {
+	// a vocabulary of random printable tokens, roughly the size of a
+	// large model's
+	r := rand.New(rand.NewPCG(1, 2))
+	pieces := make([]string, 128_000)
+	for i := range pieces {
+		var sb strings.Builder
+		for range 1 + r.IntN(8) {
+			sb.WriteByte(byte(0x20 + r.IntN(0x5f)))
+		}
+		pieces[i] = sb.String()
+	}
+	vocab := NewVocab(func() ([]string, []int32) { return pieces, nil })
+
+	for _, state := range []string{`{"key": "`, `{"key": [1, 2`, `{`} {
+		b.Run(state, func(b *testing.B) {
+			g, err := NewGrammar(vocab, jsonGrammar)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			start, ok := g.acceptString(g.state.state, state)
+			if !ok {
+				b.Fatal("state not accepted by grammar")
+			}
+
+			for b.Loop() {
+				g.reset(start)
+				g.mask()
+			}
+		})
+	}
+}
@@ -5,9 +5,6 @@ import (
 	"math"
 	"math/rand/v2"
 	"slices"
-	"sync"
-
-	"github.com/qompassai/rose/llama"
 )
 
 // token represents information about a single token during sampling
@@ -16,26 +13,153 @@ type token struct {
 	value float32 // The raw logit or probability from the model
 }
 
+// Options configures a Sampler
+type Options struct {
+	Temperature float32
+	TopK        int
+	TopP        float32
+	MinP        float32
+	// TypicalP limits tokens to the locally typical set; 0 or 1 disables it
+	TypicalP float32
+	// Seed makes sampling reproducible; -1 uses a random seed
+	Seed int
+
+	// RepeatLastN is the number of most recent tokens the penalties consider.
+	// 0 disables the penalties and -1 considers the whole history.
+	RepeatLastN int
+	// RepeatPenalty scales down the logits of tokens in the history
+	RepeatPenalty float32
+	// PresencePenalty is subtracted from the logits of tokens in the history
+	PresencePenalty float32
+	// FrequencyPenalty is subtracted from the logits of tokens in the history
+	// once for each time they appear
+	FrequencyPenalty float32
+
+	// Mirostat enables Mirostat sampling (1 or 2) in place of top-k, top-p,
+	// min-p and typical-p
+	Mirostat int
+	// MirostatTau is the target surprise
+	MirostatTau float32
+	// MirostatEta is the learning rate
+	MirostatEta float32
+
+	// DRYMultiplier scales the penalty for extending a repeated sequence;
+	// 0 disables it
+	DRYMultiplier float32
+	// DRYBase is raised to the length of the repeat beyond DRYAllowedLength
+	DRYBase float32
+	// DRYAllowedLength is the longest sequence that may repeat unpenalized
+	DRYAllowedLength int
+	// DRYSequenceBreakers are tokens that repeated sequences do not extend across
+	DRYSequenceBreakers []int32
+	// DRYLastN is the number of most recent tokens DRY considers; -1 considers
+	// the whole history
+	DRYLastN int
+
+	// XTCProbability is the chance of excluding the top choices for a token
+	XTCProbability float32
+	// XTCThreshold is the probability above which tokens are excluded
+	XTCThreshold float32
+
+	// LogitBias is added to the logits of tokens by id before sampling
+	LogitBias map[int32]float32
+}
+
 type Sampler struct {
 	rng         *rand.Rand
 	topK        int
 	topP        float32
 	minP        float32
+	typicalP    float32
 	temperature float32
 	grammar     *Grammar
+	mirostat    *mirostat
+
+	repeatLastN      int
+	repeatPenalty    float32
+	presencePenalty  float32
+	frequencyPenalty float32
+
+	dryMultiplier    float32
+	dryBase          float32
+	dryAllowedLength int
+	dryBreakers      map[int32]bool
+	dryLastN         int
+
+	xtcProbability float32
+	xtcThreshold   float32
+
+	logitBias map[int32]float32
+
+	// tokens seen so far, for penalties and DRY, and how many of them to
+	// keep: 0 keeps none and -1 keeps all of them
+	history    []int32
+	historyLen int
 }
 
-func (s *Sampler) Sample(logits []float32) (int32, error) {
-	if len(logits) == 0 {
-		return -1, errors.New("sample: no logits provided to sample")
+// Accept adds tokens to the history used for penalties and DRY, such as those
+// in the prompt. Sampled tokens are added automatically.
+func (s *Sampler) Accept(tokens ...int32) {
+	if s.historyLen == 0 {
+		return
+	}
+
+	s.history = append(s.history, tokens...)
+
+	// only keep what is looked at, trimming occasionally rather than
+	// on every token
+	if s.historyLen > 0 && len(s.history) > 2*s.historyLen {
+		s.history = slices.Delete(s.history, 0, len(s.history)-s.historyLen)
 	}
+}
+
+// lastN returns at most the n most recent tokens of the history, or all of
+// them if n is -1
+func (s *Sampler) lastN(n int) []int32 {
+	if n >= 0 && len(s.history) > n {
+		return s.history[len(s.history)-n:]
+	}
+	return s.history
+}
 
+// tokens returns the candidate tokens for logits with penalties applied
+func (s *Sampler) tokens(logits []float32) []token {
 	tokens := make([]token, len(logits))
 	for i := range logits {
 		tokens[i].id = int32(i)
 		tokens[i].value = logits[i]
 	}
 
+	if len(s.logitBias) > 0 {
+		logitBias(tokens, s.logitBias)
+	}
+
+	if s.repeatLastN != 0 && len(s.history) > 0 {
+		penalties(tokens, s.lastN(s.repeatLastN), s.repeatPenalty, s.presencePenalty, s.frequencyPenalty)
+	}
+
+	if s.dryLastN != 0 && len(s.history) > 0 {
+		dry(tokens, s.lastN(s.dryLastN), s.dryBreakers, s.dryMultiplier, s.dryBase, s.dryAllowedLength)
+	}
+
+	return tokens
+}
+
+// random returns a random number in [0, 1) from the sampler's seed if it has one
+func (s *Sampler) random() float32 {
+	if s.rng != nil {
+		return s.rng.Float32()
+	}
+	return rand.Float32()
+}
+
+func (s *Sampler) Sample(logits []float32) (int32, error) {
+	if len(logits) == 0 {
+		return -1, errors.New("sample: no logits provided to sample")
+	}
+
+	tokens := s.tokens(logits)
+
 	t, err := s.sample(tokens)
 	if err != nil {
 		return -1, err
@@ -48,16 +172,17 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Apply(top)
 		if !math.IsInf(float64(top[0].value), -1) {
 			s.grammar.Accept(top[0].id)
+			if s.mirostat != nil && s.temperature > 0 {
+				s.mirostat.update(t.value)
+			}
+			s.Accept(top[0].id)
 			return top[0].id, nil
 		}
 
 		// since .sample has side effects of modifying the tokens
 		// we need to reset them before applying the grammar and
 		// sampling again
-		for i := range logits {
-			tokens[i].id = int32(i)
-			tokens[i].value = logits[i]
-		}
+		tokens = s.tokens(logits)
 		s.grammar.Apply(tokens)
 		t, err = s.sample(tokens)
 		if err != nil {
@@ -66,6 +191,13 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Accept(t.id)
 	}
 
+	// update Mirostat only once the token is final, as the grammar may
+	// cause it to be sampled again
+	if s.mirostat != nil && s.temperature > 0 {
+		s.mirostat.update(t.value)
+	}
+
+	s.Accept(t.id)
 	return t.id, nil
 }
 
@@ -82,29 +214,39 @@ func greedy(tokens []token) token {
 }
 
 // sample returns the highest probability token from the tokens
-// given sampler parameters. It also has side effects of modifying the tokens
+// given sampler parameters, with its value set to the probability it
+// was sampled with. It also has side effects of modifying the tokens
 func (s *Sampler) sample(tokens []token) (token, error) {
 	if s.temperature == 0 {
 		return greedy(tokens), nil
 	}
 
-	// topK also sorts the tokens in descending order of logits
-	tokens = topK(tokens, s.topK)
+	if s.mirostat != nil {
+		n := len(tokens)
+		tokens = topK(tokens, 0)
+		temperature(tokens, s.temperature)
+		softmax(tokens)
+		tokens = s.mirostat.truncate(tokens, n)
+		softmax(tokens)
+	} else {
+		// topK also sorts the tokens in descending order of logits
+		tokens = topK(tokens, s.topK)
+		tokens = typicalP(tokens, s.typicalP)
 
-	// scale and normalize the tokens in place
-	temperature(tokens, s.temperature)
-	softmax(tokens)
+		// scale and normalize the tokens in place
+		temperature(tokens, s.temperature)
+		softmax(tokens)
 
-	tokens = topP(tokens, s.topP)
-	tokens = minP(tokens, s.minP)
+		tokens = topP(tokens, s.topP)
+		tokens = minP(tokens, s.minP)
 
-	var r float32
-	if s.rng != nil {
-		r = s.rng.Float32()
-	} else {
-		r = rand.Float32()
+		if s.xtcProbability > 0 && s.random() < s.xtcProbability {
+			tokens = xtc(tokens, s.xtcThreshold)
+		}
 	}
 
+	r := s.random()
+
 	// Calculate cumulative sum of probabilities
 	var sum float32
 	for i := range tokens {
@@ -123,18 +265,26 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	if math.IsNaN(float64(sum)) {
 		return token{}, errors.New("sample: logits sum to NaN, check model output")
 	}
-	return tokens[idx], nil
+
+	t := tokens[idx]
+	if idx > 0 {
+		t.value -= tokens[idx-1].value
+	}
+	t.value /= sum
+	return t, nil
 }
 
-func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, grammar *Grammar) Sampler {
+func NewSampler(opts Options, grammar *Grammar) Sampler {
 	var rng *rand.Rand
-	if seed != -1 {
+	if opts.Seed != -1 {
 		// PCG requires two parameters: sequence and stream
 		// Use original seed for sequence
-		sequence := uint64(seed)
+		sequence := uint64(opts.Seed)
 		// Use golden ratio hash to generate statistically independent seeds
 		rng = rand.New(rand.NewPCG(sequence, sequence^0x9E3779B9))
 	}
+
+	temperature, topP, minP := opts.Temperature, opts.TopP, opts.MinP
 	if temperature < 0.0 {
 		temperature = 0.0
 	}
@@ -153,73 +303,66 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		minP = 1.0
 	}
 
-	return Sampler{
-		rng:         rng,
-		topK:        topK,
-		topP:        topP,
-		minP:        minP,
-		temperature: temperature,
-		grammar:     grammar,
+	typicalP := opts.TypicalP
+	if typicalP <= 0.0 || typicalP >= 1.0 {
+		typicalP = 1.0
 	}
-}
-
-type Grammar struct {
-	vocab   *Vocab
-	grammar string
-	sampler *llama.Sampler
-}
 
-func NewGrammar(vocab *Vocab, grammar string) (*Grammar, error) {
-	v, err := vocab.Load()
-	if err != nil {
-		return nil, err
+	var m *mirostat
+	if opts.Mirostat == 1 || opts.Mirostat == 2 {
+		m = newMirostat(opts.Mirostat, opts.MirostatTau, opts.MirostatEta)
 	}
 
-	return &Grammar{
-		vocab:   vocab,
-		grammar: grammar,
-		sampler: llama.NewGrammarSampler(v, grammar),
-	}, nil
-}
-
-func (g *Grammar) Apply(tokens []token) {
-	tds := make([]llama.TokenData, len(tokens))
-	for i, token := range tokens {
-		tds[i].Id = token.id
-		tds[i].Logit = token.value
+	// a repeat penalty of 0 would divide by zero, treat it as disabled
+	repeatPenalty := opts.RepeatPenalty
+	if repeatPenalty <= 0 {
+		repeatPenalty = 1.0
 	}
 
-	g.sampler.Apply(tds)
-
-	for i := range tokens {
-		tokens[i].value = tds[i].Logit
+	repeatLastN := opts.RepeatLastN
+	if repeatLastN < -1 || (repeatPenalty == 1.0 && opts.PresencePenalty == 0 && opts.FrequencyPenalty == 0) {
+		repeatLastN = 0
 	}
-}
 
-func (g *Grammar) Accept(token int32) {
-	g.sampler.Accept(token)
-}
+	dryLastN := opts.DRYLastN
+	if dryLastN < -1 || opts.DRYMultiplier <= 0 || opts.DRYBase < 1 {
+		dryLastN = 0
+	}
 
-type Vocab struct {
-	once  sync.Once
-	vocab *llama.Vocab
-	err   error
-	path  string
-}
+	var dryBreakers map[int32]bool
+	if dryLastN != 0 {
+		dryBreakers = make(map[int32]bool, len(opts.DRYSequenceBreakers))
+		for _, id := range opts.DRYSequenceBreakers {
+			dryBreakers[id] = true
+		}
+	}
 
-func NewVocab(path string) *Vocab {
-	return &Vocab{path: path}
-}
+	historyLen := max(repeatLastN, dryLastN)
+	if repeatLastN == -1 || dryLastN == -1 {
+		historyLen = -1
+	}
 
-// Load returns the lazily-loaded vocabulary
-func (v *Vocab) Load() (*llama.Vocab, error) {
-	v.once.Do(func() {
-		vocab, err := llama.LoadVocabFromFile(v.path)
-		if err != nil {
-			v.err = err
-			return
-		}
-		v.vocab = vocab
-	})
-	return v.vocab, v.err
+	return Sampler{
+		rng:              rng,
+		topK:             opts.TopK,
+		topP:             topP,
+		minP:             minP,
+		typicalP:         typicalP,
+		temperature:      temperature,
+		grammar:          grammar,
+		mirostat:         m,
+		repeatLastN:      repeatLastN,
+		repeatPenalty:    repeatPenalty,
+		presencePenalty:  opts.PresencePenalty,
+		frequencyPenalty: opts.FrequencyPenalty,
+		dryMultiplier:    opts.DRYMultiplier,
+		dryBase:          opts.DRYBase,
+		dryAllowedLength: opts.DRYAllowedLength,
+		dryBreakers:      dryBreakers,
+		dryLastN:         dryLastN,
+		xtcProbability:   opts.XTCProbability,
+		xtcThreshold:     opts.XTCThreshold,
+		logitBias:        opts.LogitBias,
+		historyLen:       historyLen,
+	}
 }
@@ -3,12 +3,13 @@ package sample
 import (
 	"math"
 	"math/rand/v2"
+	"slices"
 	"testing"
 )
 
 func TestWeighted(t *testing.T) {
 	logits := []float32{-10, 3, -10, -10}
-	sampler := NewSampler(0, 0, 0, 0, 0, nil)
+	sampler := NewSampler(Options{}, nil)
 	got, err := sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -20,7 +21,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{-100, -10, 0, 10}
-	sampler = NewSampler(0, 0, 0, 0, 0, nil)
+	sampler = NewSampler(Options{}, nil)
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -34,7 +35,7 @@ func TestWeighted(t *testing.T) {
 	// Test very high p
 	logits = []float32{1.0, 0.9999999999999999, 0.5, 0.1}
 	// Use extremely small topP to filter out all tokens
-	sampler = NewSampler(1.0, 0, 1e-10, 0, 0, nil)
+	sampler = NewSampler(Options{Temperature: 1.0, TopP: 1e-10}, nil)
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -47,7 +48,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{float32(math.NaN()), float32(math.NaN()), float32(math.NaN())}
-	sampler = NewSampler(1, 0, 0.95, 0.05, 0, nil)
+	sampler = NewSampler(Options{Temperature: 1, TopP: 0.95, MinP: 0.05}, nil)
 	got, err = sampler.Sample(logits)
 	if err == nil {
 		t.Errorf("expected error, got %d", got)
@@ -55,10 +56,72 @@ func TestWeighted(t *testing.T) {
 	}
 }
 
+func TestSamplerPenalties(t *testing.T) {
+	logits := []float32{10, 9.5, 0, 0}
+
+	t.Run("disabled", func(t *testing.T) {
+		sampler := NewSampler(Options{RepeatLastN: 64, RepeatPenalty: 1.0}, nil)
+		sampler.Accept(0, 0, 0)
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 0 {
+			t.Errorf("expected token 0, got %d", got)
+		}
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		sampler := NewSampler(Options{RepeatLastN: 64, RepeatPenalty: 1.1}, nil)
+		sampler.Accept(0)
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Errorf("expected token 1, got %d", got)
+		}
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		sampler := NewSampler(Options{RepeatLastN: 64, FrequencyPenalty: 0.4}, nil)
+
+		var got []int32
+		for range 4 {
+			token, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, token)
+		}
+
+		want := []int32{0, 0, 1, 0}
+		if !slices.Equal(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("last n", func(t *testing.T) {
+		sampler := NewSampler(Options{RepeatLastN: 2, PresencePenalty: 1}, nil)
+		sampler.Accept(0, 2, 3, 2, 3)
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 0 {
+			t.Errorf("expected token 0 outside of the window to be unpenalized, got %d", got)
+		}
+
+		if len(sampler.history) > 2*2 {
+			t.Errorf("expected history to be trimmed, got %v", sampler.history)
+		}
+	})
+}
+
 func BenchmarkSample(b *testing.B) {
 	samplers := map[string]Sampler{
-		"Greedy":   NewSampler(0, 0, 0, 0, 0, nil), // Use NewSampler with temp=0 for greedy
-		"Weighted": NewSampler(0.5, 10, 0.9, 0.2, -1, nil),
+		"Greedy":   NewSampler(Options{}, nil), // Use NewSampler with temp=0 for greedy
+		"Weighted": NewSampler(Options{Temperature: 0.5, TopK: 10, TopP: 0.9, MinP: 0.2, Seed: -1}, nil),
 	}
 
 	// Generate random logits for benchmarking
@@ -78,3 +141,117 @@ func BenchmarkSample(b *testing.B) {
 		})
 	}
 }
+
+func TestSamplerMirostat(t *testing.T) {
+	logits := []float32{1, 0.9, 0.8, 0.7, 0.6, 0.5}
+
+	t.Run("v2", func(t *testing.T) {
+		// a target surprise of 0 only ever allows the most likely token
+		sampler := NewSampler(Options{Temperature: 1, Seed: 1, Mirostat: 2, MirostatTau: 0, MirostatEta: 0.1}, nil)
+		for range 10 {
+			got, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != 0 {
+				t.Fatalf("expected token 0, got %d", got)
+			}
+		}
+
+		if sampler.mirostat.mu != 0 {
+			t.Errorf("expected mu to stay at 0 when the surprise is 0, got %f", sampler.mirostat.mu)
+		}
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		sampler := NewSampler(Options{Temperature: 1, Seed: 1, Mirostat: 1, MirostatTau: 5, MirostatEta: 0.1}, nil)
+		for range 10 {
+			if _, err := sampler.Sample(logits); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the surprise of this distribution is well below the target so
+		// mu should grow
+		if sampler.mirostat.mu <= 10 {
+			t.Errorf("expected mu to increase from 10, got %f", sampler.mirostat.mu)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		sampler := NewSampler(Options{Temperature: 1, MirostatTau: 5}, nil)
+		if sampler.mirostat != nil {
+			t.Error("expected mirostat to be disabled")
+		}
+	})
+}
+
+func TestSamplerDRY(t *testing.T) {
+	logits := []float32{1, 1.5, 0, 0}
+
+	sampler := NewSampler(Options{DRYMultiplier: 1, DRYBase: 2, DRYAllowedLength: 2, DRYLastN: -1}, nil)
+	sampler.Accept(2, 3, 1, 2, 3)
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("expected token 0, got %d", got)
+	}
+
+	sampler = NewSampler(Options{DRYMultiplier: 1, DRYBase: 2, DRYAllowedLength: 2, DRYSequenceBreakers: []int32{3}, DRYLastN: -1}, nil)
+	sampler.Accept(2, 3, 1, 2, 3)
+	got, err = sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("expected token 1 after a breaker, got %d", got)
+	}
+
+	sampler = NewSampler(Options{DRYBase: 2, DRYAllowedLength: 2, DRYLastN: -1}, nil)
+	if sampler.historyLen != 0 {
+		t.Errorf("expected DRY to be disabled without a multiplier")
+	}
+}
+
+func TestSamplerXTC(t *testing.T) {
+	logits := []float32{3, 2.9, 2.8, -10}
+
+	sampler := NewSampler(Options{Temperature: 1, TopP: 1, Seed: 1, XTCProbability: 1, XTCThreshold: 0.1}, nil)
+	for range 10 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 2 {
+			t.Fatalf("expected the least likely top choice, got %d", got)
+		}
+	}
+}
+
+func TestSamplerLogitBias(t *testing.T) {
+	logits := []float32{10, 9, 0, 0}
+
+	// force a token that would not otherwise be chosen, as a classifier would
+	sampler := NewSampler(Options{LogitBias: map[int32]float32{2: 100}}, nil)
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("expected token 2, got %d", got)
+	}
+
+	// suppress the most likely token
+	sampler = NewSampler(Options{Temperature: 1, TopP: 1, LogitBias: map[int32]float32{0: float32(math.Inf(-1))}}, nil)
+	for range 10 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == 0 {
+			t.Fatal("expected token 0 to be suppressed")
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package sample
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// primitiveRules are the GBNF rules for JSON values shared by all schemas
+var primitiveRules = map[string]string{
+	"boolean":       `("true" | "false") space`,
+	"char":          `[^"\\\x7F\x00-\x1F] | [\\] (["\\/bfnrt] | "u" [0-9a-fA-F]{4})`,
+	"decimal-part":  `[0-9]{1,16}`,
+	"integral-part": `[0] | [1-9] [0-9]{0,15}`,
+	"number":        `("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space`,
+	"integer":       `("-"? integral-part) space`,
+	"null":          `"null" space`,
+	"string":        `"\"" char* "\"" space`,
+	"value":         `object | array | string | number | boolean | null`,
+	"object":        `"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`,
+	"array":         `"[" space ( value ("," space value)* )? "]" space`,
+	"space":         `| " " | "\n" [ \t]{0,20}`,
+}
+
+// primitiveDeps lists the rules each primitive rule references
+var primitiveDeps = map[string][]string{
+	"boolean":       {"space"},
+	"decimal-part":  nil,
+	"integral-part": nil,
+	"number":        {"integral-part", "decimal-part", "space"},
+	"integer":       {"integral-part", "space"},
+	"null":          {"space"},
+	"string":        {"char", "space"},
+	"value":         {"object", "array", "string", "number", "boolean", "null"},
+	"object":        {"string", "value", "space"},
+	"array":         {"value", "space"},
+}
+
+// formatRules are the GBNF rules for supported string formats
+var formatRules = map[string]string{
+	"date":      `[0-9]{4} "-" ( "0" [1-9] | "1" [0-2] ) "-" ( "0" [1-9] | [1-2] [0-9] | "3" [0-1] )`,
+	"time":      `([01] [0-9] | "2" [0-3]) ":" [0-5] [0-9] ":" [0-5] [0-9] ( "." [0-9]{3} )? ( "Z" | ( "+" | "-" ) ( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] )`,
+	"date-time": `date "T" time`,
+	"uuid":      `[0-9a-fA-F]{8} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{12}`,
+}
+
+// jsonSchema is the subset of JSON Schema that can be converted to a grammar
+type jsonSchema struct {
+	Type                 schemaType             `json:"type"`
+	Properties           schemaProperties       `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	PrefixItems          []*jsonSchema          `json:"prefixItems"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Format               string                 `json:"format"`
+	Enum                 []json.RawMessage      `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+}
+
+// schemaType is a single type name or a list of them
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = schemaType{s}
+		return nil
+	}
+
+	var ts []string
+	if err := json.Unmarshal(b, &ts); err != nil {
+		return fmt.Errorf("schema: invalid type %s", b)
+	}
+	*t = ts
+	return nil
+}
+
+type schemaProperty struct {
+	name   string
+	schema *jsonSchema
+}
+
+// schemaProperties keeps properties in the order they are written since
+// generated objects follow the same order
+type schemaProperties []schemaProperty
+
+func (p *schemaProperties) UnmarshalJSON(b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+
+	if t != json.Delim('{') {
+		return errors.New("schema: properties must be an object")
+	}
+
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		var s jsonSchema
+		if err := d.Decode(&s); err != nil {
+			return err
+		}
+
+		*p = append(*p, schemaProperty{name: t.(string), schema: &s})
+	}
+
+	return nil
+}
+
+// SchemaToGrammar converts a JSON schema to a GBNF grammar that only
+// matches JSON documents valid for the schema
+func SchemaToGrammar(schema []byte) ([]byte, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+
+	c := schemaConverter{root: &s, rules: make(map[string]string), refs: make(map[string]string)}
+	body, err := c.visit(&s, "root")
+	if err != nil {
+		return nil, err
+	}
+	c.rules["root"] = body
+
+	var sb strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(c.rules)) {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	return []byte(sb.String()), nil
+}
+
+type schemaConverter struct {
+	root  *jsonSchema
+	rules map[string]string
+	// rule names for resolved references
+	refs map[string]string
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// add adds a rule named after name and returns the name it was given, which
+// differs if a different rule already uses the name
+func (c *schemaConverter) add(name, body string) string {
+	name = invalidRuleChars.ReplaceAllString(name, "-")
+	available := func(name string) bool {
+		if _, ok := primitiveRules[name]; ok {
+			return false
+		}
+
+		if _, ok := formatRules[name]; ok {
+			return false
+		}
+
+		existing, ok := c.rules[name]
+		return name != "root" && (!ok || existing == body)
+	}
+
+	if !available(name) {
+		for i := 0; ; i++ {
+			if candidate := name + strconv.Itoa(i); available(candidate) {
+				name = candidate
+				break
+			}
+		}
+	}
+
+	c.rules[name] = body
+	return name
+}
+
+// primitive adds a primitive rule and the rules it depends on
+func (c *schemaConverter) primitive(name string) string {
+	if _, ok := c.rules[name]; ok {
+		return name
+	}
+
+	c.rules[name] = primitiveRules[name]
+	for _, dep := range primitiveDeps[name] {
+		c.primitive(dep)
+	}
+
+	return name
+}
+
+func (c *schemaConverter) format(name string) string {
+	if name == "date-time" {
+		c.format("date")
+		c.format("time")
+	}
+
+	c.rules[name] = formatRules[name]
+	return name
+}
+
+// literal returns a GBNF string literal matching the JSON encoding of v
+func literal(v any) (string, error) {
+	if raw, ok := v.(json.RawMessage); ok {
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return "", fmt.Errorf("schema: %w", err)
+		}
+	}
+
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", fmt.Errorf("schema: %w", err)
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range strings.TrimSuffix(b.String(), "\n") {
+		switch r {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String(), nil
+}
+
+// visit returns the body of a rule matching s. name is used to derive the
+// names of any rules added for nested schemas.
+func (c *schemaConverter) visit(s *jsonSchema, name string) (string, error) {
+	switch {
+	case s.Ref != "":
+		return c.ref(s.Ref)
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		var alts []string
+		for i, sub := range append(s.AnyOf, s.OneOf...) {
+			body, err := c.visit(sub, name+"-"+strconv.Itoa(i))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, c.add(name+"-"+strconv.Itoa(i), body))
+		}
+		return strings.Join(alts, " | "), nil
+	case s.Const != nil:
+		l, err := literal(s.Const)
+		if err != nil {
+			return "", err
+		}
+		return l + " " + c.primitive("space"), nil
+	case len(s.Enum) > 0:
+		var alts []string
+		for _, v := range s.Enum {
+			l, err := literal(v)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, l)
+		}
+		return "(" + strings.Join(alts, " | ") + ") " + c.primitive("space"), nil
+	case len(s.Type) > 1:
+		var alts []string
+		for _, t := range s.Type {
+			sub := *s
+			sub.Type = schemaType{t}
+			body, err := c.visit(&sub, name+"-"+t)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, c.add(name+"-"+t, body))
+		}
+		return strings.Join(alts, " | "), nil
+	}
+
+	var t string
+	if len(s.Type) == 1 {
+		t = s.Type[0]
+	} else if len(s.Properties) > 0 {
+		t = "object"
+	}
+
+	switch t {
+	case "object":
+		return c.object(s, name)
+	case "array":
+		return c.array(s, name)
+	case "string":
+		return c.string(s)
+	case "number", "integer", "boolean", "null":
+		return c.primitive(t), nil
+	case "":
+		return c.primitive("value"), nil
+	default:
+		return "", fmt.Errorf("schema: unsupported type %q", t)
+	}
+}
+
+func (c *schemaConverter) ref(ref string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+
+	var defs map[string]*jsonSchema
+	var key string
+	switch {
+	case strings.HasPrefix(ref, "#/$defs/"):
+		defs, key = c.root.Defs, strings.TrimPrefix(ref, "#/$defs/")
+	case strings.HasPrefix(ref, "#/definitions/"):
+		defs, key = c.root.Definitions, strings.TrimPrefix(ref, "#/definitions/")
+	default:
+		return "", fmt.Errorf("schema: unsupported reference %q", ref)
+	}
+
+	def, ok := defs[key]
+	if !ok {
+		return "", fmt.Errorf("schema: unresolved reference %q", ref)
+	}
+
+	// reserve the rule name first so recursive references resolve to it
+	name := c.add(key, "")
+	c.refs[ref] = name
+
+	body, err := c.visit(def, name)
+	if err != nil {
+		return "", err
+	}
+
+	c.rules[name] = body
+	return name, nil
+}
+
+func (c *schemaConverter) object(s *jsonSchema, name string) (string, error) {
+	var additional *jsonSchema
+	switch string(s.AdditionalProperties) {
+	case "", "false":
+	case "true":
+		additional = &jsonSchema{}
+	default:
+		additional = &jsonSchema{}
+		if err := json.Unmarshal(s.AdditionalProperties, additional); err != nil {
+			return "", fmt.Errorf("schema: %w", err)
+		}
+	}
+
+	if len(s.Properties) == 0 {
+		if additional == nil && s.AdditionalProperties != nil {
+			return `"{" ` + c.primitive("space") + ` "}" ` + c.primitive("space"), nil
+		}
+
+		if additional == nil || (additional.Type == nil && additional.Ref == "" && len(additional.AnyOf) == 0 && len(additional.OneOf) == 0) {
+			return c.primitive("object"), nil
+		}
+
+		value, err := c.visit(additional, name+"-value")
+		if err != nil {
+			return "", err
+		}
+		value = c.add(name+"-value", value)
+
+		kv := c.add(name+"-kv", c.primitive("string")+` ":" space `+value)
+		return `"{" space ( ` + kv + ` ( "," space ` + kv + ` )* )? "}" space`, nil
+	}
+
+	var required, optional []string
+	for _, p := range s.Properties {
+		value, err := c.visit(p.schema, name+"-"+p.name)
+		if err != nil {
+			return "", err
+		}
+		value = c.add(name+"-"+p.name, value)
+
+		l, err := literal(p.name)
+		if err != nil {
+			return "", err
+		}
+
+		kv := c.add(name+"-"+p.name+"-kv", l+` space ":" space `+value)
+		if slices.Contains(s.Required, p.name) {
+			required = append(required, kv)
+		} else {
+			optional = append(optional, kv)
+		}
+	}
+
+	parts := []string{`"{" space`}
+	if len(required) > 0 {
+		parts = append(parts, strings.Join(required, ` "," space `))
+
+		// optional properties follow the required ones in order
+		for _, kv := range optional {
+			parts = append(parts, `( "," space `+kv+` )?`)
+		}
+	} else {
+		// the first optional property present has no leading comma
+		var alts []string
+		for i, kv := range optional {
+			alt := []string{kv}
+			for _, next := range optional[i+1:] {
+				alt = append(alt, `( "," space `+next+` )?`)
+			}
+			alts = append(alts, strings.Join(alt, " "))
+		}
+		parts = append(parts, `( `+strings.Join(alts, " | ")+` )?`)
+	}
+
+	parts = append(parts, `"}" space`)
+	return strings.Join(parts, " "), nil
+}
+
+func (c *schemaConverter) array(s *jsonSchema, name string) (string, error) {
+	if len(s.PrefixItems) > 0 {
+		var items []string
+		for i, item := range s.PrefixItems {
+			body, err := c.visit(item, name+"-tuple-"+strconv.Itoa(i))
+			if err != nil {
+				return "", err
+			}
+			items = append(items, c.add(name+"-tuple-"+strconv.Itoa(i), body))
+		}
+
+		return `"[" space ` + strings.Join(items, ` "," space `) + ` "]" space`, nil
+	}
+
+	item := c.primitive("value")
+	if s.Items != nil {
+		body, err := c.visit(s.Items, name+"-item")
+		if err != nil {
+			return "", err
+		}
+		item = c.add(name+"-item", body)
+	}
+
+	minItems, maxItems := 0, -1
+	if s.MinItems != nil {
+		minItems = *s.MinItems
+	}
+	if s.MaxItems != nil {
+		maxItems = *s.MaxItems
+	}
+
+	if maxItems == 0 {
+		return `"[" space "]" space`, nil
+	}
+
+	list := item + ` ( "," space ` + item + ` )` + repetition(max(minItems-1, 0), maxItems-1)
+	if minItems == 0 {
+		list = `( ` + list + ` )?`
+	}
+
+	return `"[" space ` + list + ` "]" space`, nil
+}
+
+func (c *schemaConverter) string(s *jsonSchema) (string, error) {
+	if _, ok := formatRules[s.Format]; ok {
+		return `"\"" ` + c.format(s.Format) + ` "\"" ` + c.primitive("space"), nil
+	}
+
+	c.primitive("string")
+	if s.MinLength == nil && s.MaxLength == nil {
+		return "string", nil
+	}
+
+	minLength, maxLength := 0, -1
+	if s.MinLength != nil {
+		minLength = *s.MinLength
+	}
+	if s.MaxLength != nil {
+		maxLength = *s.MaxLength
+	}
+
+	return `"\"" char` + repetition(minLength, maxLength) + ` "\"" space`, nil
+}
+
+// repetition returns a GBNF repetition operator for between minTimes and
+// maxTimes, or unbounded if maxTimes is negative
+func repetition(minTimes, maxTimes int) string {
+	switch {
+	case maxTimes < 0 && minTimes == 0:
+		return "*"
+	case maxTimes < 0 && minTimes == 1:
+		return "+"
+	case maxTimes < 0:
+		return "{" + strconv.Itoa(minTimes) + ",}"
+	case minTimes == 0 && maxTimes == 1:
+		return "?"
+	case minTimes == maxTimes:
+		return "{" + strconv.Itoa(minTimes) + "}"
+	default:
+		return "{" + strconv.Itoa(minTimes) + "," + strconv.Itoa(maxTimes) + "}"
+	}
+}
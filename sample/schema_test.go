@@ -0,0 +1,171 @@
+package sample
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaToGrammar(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		accept []string
+		reject []string
+	}{
+		{
+			name:   "empty",
+			schema: `{}`,
+			accept: []string{`{"a": 1}`, `[1, "x"]`, `"x"`, `null`},
+			reject: []string{`{a: 1}`},
+		},
+		{
+			name: "object",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"age": {"type": "integer"},
+					"tags": {"type": "array", "items": {"type": "string"}}
+				},
+				"required": ["name", "age"]
+			}`,
+			accept: []string{
+				`{"name": "a", "age": 3}`,
+				`{"name":"a","age":-3,"tags":["x", "y"]}`,
+				`{"name": "a", "age": 3, "tags": []}`,
+			},
+			reject: []string{
+				`{"age": 3, "name": "a"}`,
+				`{"name": "a"}`,
+				`{"name": "a", "age": 3.5}`,
+				`{"name": "a", "age": 3, "other": 1}`,
+			},
+		},
+		{
+			name: "optional properties",
+			schema: `{
+				"type": "object",
+				"properties": {
+					"a": {"type": "boolean"},
+					"b": {"type": "null"},
+					"c": {"type": "number"}
+				}
+			}`,
+			accept: []string{`{}`, `{"a": true}`, `{"b": null, "c": 1.5}`, `{"a": false, "c": 0}`, `{"a": true, "b": null, "c": 2e3}`},
+			reject: []string{`{"c": 1, "a": true}`, `{, "a": true}`},
+		},
+		{
+			name:   "enum and const",
+			schema: `{"type": "object", "properties": {"color": {"enum": ["red", "green", 1]}, "kind": {"const": "fixed"}}, "required": ["color", "kind"]}`,
+			accept: []string{`{"color": "red", "kind": "fixed"}`, `{"color": 1, "kind": "fixed"}`},
+			reject: []string{`{"color": "blue", "kind": "fixed"}`, `{"color": "red", "kind": "other"}`},
+		},
+		{
+			name:   "array bounds",
+			schema: `{"type": "array", "items": {"type": "integer"}, "minItems": 1, "maxItems": 3}`,
+			accept: []string{`[1]`, `[1, 2, 3]`},
+			reject: []string{`[]`, `[1, 2, 3, 4]`, `["a"]`},
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 2, "maxLength": 3}`,
+			accept: []string{`"ab"`, `"abc"`},
+			reject: []string{`"a"`, `"abcd"`},
+		},
+		{
+			name:   "any of",
+			schema: `{"anyOf": [{"type": "string"}, {"type": "array", "items": {"type": "boolean"}}]}`,
+			accept: []string{`"x"`, `[true, false]`},
+			reject: []string{`1`, `[1]`},
+		},
+		{
+			name:   "type list",
+			schema: `{"type": ["integer", "null"]}`,
+			accept: []string{`1`, `null`},
+			reject: []string{`"1"`},
+		},
+		{
+			name: "references",
+			schema: `{
+				"$defs": {
+					"node": {
+						"type": "object",
+						"properties": {
+							"value": {"type": "integer"},
+							"children": {"type": "array", "items": {"$ref": "#/$defs/node"}}
+						},
+						"required": ["value"]
+					}
+				},
+				"$ref": "#/$defs/node"
+			}`,
+			accept: []string{`{"value": 1}`, `{"value": 1, "children": [{"value": 2, "children": []}]}`},
+			reject: []string{`{"children": []}`, `{"value": 1, "children": [{}]}`},
+		},
+		{
+			name:   "format",
+			schema: `{"type": "object", "properties": {"when": {"type": "string", "format": "date-time"}}, "required": ["when"]}`,
+			accept: []string{`{"when": "2024-01-31T12:30:00Z"}`, `{"when": "2024-12-01T23:59:59.123+02:00"}`},
+			reject: []string{`{"when": "yesterday"}`, `{"when": "2024-13-01T00:00:00Z"}`},
+		},
+		{
+			name:   "closed object",
+			schema: `{"type": "object", "additionalProperties": false}`,
+			accept: []string{`{}`},
+			reject: []string{`{"a": 1}`},
+		},
+		{
+			name:   "map",
+			schema: `{"type": "object", "additionalProperties": {"type": "integer"}}`,
+			accept: []string{`{}`, `{"a": 1, "b": 2}`},
+			reject: []string{`{"a": "x"}`},
+		},
+		{
+			name:   "escaped property names",
+			schema: `{"type": "object", "properties": {"say \"hi\"": {"type": "boolean"}, "a<b": {"type": "boolean"}}, "required": ["say \"hi\"", "a<b"]}`,
+			accept: []string{`{"say \"hi\"": true, "a<b": false}`},
+			reject: []string{`{"say "hi"": true, "a<b": false}`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := SchemaToGrammar([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range tt.accept {
+				if !matches(t, string(g), s) {
+					t.Errorf("expected %s to match grammar\n%s", s, g)
+				}
+			}
+
+			for _, s := range tt.reject {
+				if matches(t, string(g), s) {
+					t.Errorf("expected %s not to match grammar\n%s", s, g)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaToGrammarErrors(t *testing.T) {
+	cases := []struct {
+		schema string
+		err    string
+	}{
+		{`{"type": "object"`, "unexpected end of JSON input"},
+		{`{"type": "date"}`, `unsupported type "date"`},
+		{`{"$ref": "#/$defs/missing"}`, `unresolved reference "#/$defs/missing"`},
+		{`{"$ref": "https://example.com/schema"}`, "unsupported reference"},
+		{`{"type": 1}`, "invalid type"},
+	}
+
+	for _, tt := range cases {
+		_, err := SchemaToGrammar([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error %q, got %v", tt.schema, tt.err, err)
+		}
+	}
+}
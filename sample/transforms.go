@@ -1,6 +1,7 @@
 package sample
 
 import (
+	"cmp"
 	"container/heap"
 	"math"
 	"slices"
@@ -57,6 +58,79 @@ func softmax(ts []token) {
 	}
 }
 
+// logitBias adds a bias to the logits of tokens by id. Tokens must be
+// indexed by id, as they are before any other transform.
+func logitBias(ts []token, bias map[int32]float32) {
+	for id, b := range bias {
+		if id >= 0 && int(id) < len(ts) {
+			ts[id].value += b
+		}
+	}
+}
+
+// penalties discourages tokens that appear in history. Tokens must be
+// indexed by id, as they are before any other transform.
+func penalties(ts []token, history []int32, repeat, presence, frequency float32) {
+	counts := make(map[int32]int, len(history))
+	for _, id := range history {
+		if id >= 0 && int(id) < len(ts) {
+			counts[id]++
+		}
+	}
+
+	for id, count := range counts {
+		t := &ts[id]
+		if t.value > 0 {
+			t.value /= repeat
+		} else {
+			t.value *= repeat
+		}
+
+		t.value -= float32(count)*frequency + presence
+	}
+}
+
+// dry penalizes tokens that would extend a sequence that already appears in
+// history, by multiplier * base^(length - allowedLength) where length is the
+// length of the repeated sequence. Repeats do not extend across breakers and
+// breakers are never penalized. Tokens must be indexed by id
+func dry(ts []token, history []int32, breakers map[int32]bool, multiplier, base float32, allowedLength int) {
+	n := len(history)
+	if n < 2 || breakers[history[n-1]] {
+		return
+	}
+
+	// longer repeats than this would overflow the penalty
+	maxLength := allowedLength
+	if base > 1 {
+		maxLength += int(math.Log(math.MaxFloat32/float64(multiplier)) / math.Log(float64(base)))
+	}
+
+	lengths := make(map[int32]int)
+	for i := n - 2; i >= 0; i-- {
+		next := history[i+1]
+		if history[i] != history[n-1] || breakers[next] {
+			continue
+		}
+
+		// count how far the sequence ending at i matches the end of history
+		length := 0
+		for length <= i && length < maxLength && history[i-length] == history[n-1-length] && !breakers[history[i-length]] {
+			length++
+		}
+
+		if length >= allowedLength && length > lengths[next] {
+			lengths[next] = length
+		}
+	}
+
+	for id, length := range lengths {
+		if int(id) < len(ts) {
+			ts[id].value -= multiplier * float32(math.Pow(float64(base), float64(length-allowedLength)))
+		}
+	}
+}
+
 // topK limits the number of tokens considered to the k highest logits
 func topK(ts []token, k int) []token {
 	if k >= len(ts) || k <= 0 {
@@ -128,3 +202,136 @@ func minP(ts []token, p float32) []token {
 	}
 	return ts
 }
+
+// xtc removes all but the least likely of the tokens with a probability of at
+// least threshold, steering generation away from the most predictable choices.
+// It does nothing unless at least two tokens meet the threshold
+// requires ts to be sorted in descending order of probabilities
+func xtc(ts []token, threshold float32) []token {
+	i := 0
+	for i < len(ts) && ts[i].value >= threshold {
+		i++
+	}
+
+	if i < 2 {
+		return ts
+	}
+
+	return ts[i-1:]
+}
+
+// typicalP limits tokens to the locally typical set: those whose information
+// content is closest to the expected information content of the distribution,
+// up to a cumulative probability p. It works on logits and keeps the order of ts
+func typicalP(ts []token, p float32) []token {
+	if p >= 1.0 || len(ts) == 0 {
+		return ts
+	}
+
+	maxLogit := ts[0].value
+	for _, t := range ts {
+		maxLogit = max(maxLogit, t.value)
+	}
+
+	probs := make([]float64, len(ts))
+	var sum float64
+	for i, t := range ts {
+		probs[i] = math.Exp(float64(t.value - maxLogit))
+		sum += probs[i]
+	}
+
+	var entropy float64
+	for i := range probs {
+		probs[i] /= sum
+		if probs[i] > 0 {
+			entropy -= probs[i] * math.Log(probs[i])
+		}
+	}
+
+	// order by how far each token's surprise is from the entropy
+	shifted := make([]float64, len(ts))
+	indices := make([]int, len(ts))
+	for i := range ts {
+		shifted[i] = math.Abs(-math.Log(probs[i]) - entropy)
+		indices[i] = i
+	}
+	slices.SortStableFunc(indices, func(a, b int) int {
+		return cmp.Compare(shifted[a], shifted[b])
+	})
+
+	keep := make([]bool, len(ts))
+	var cum float64
+	for _, i := range indices {
+		keep[i] = true
+		cum += probs[i]
+		if cum > float64(p) {
+			break
+		}
+	}
+
+	n := 0
+	for i, t := range ts {
+		if keep[i] {
+			ts[n] = t
+			n++
+		}
+	}
+
+	return ts[:n]
+}
+
+// mirostat holds the state of Mirostat sampling, which adjusts truncation
+// after every token to keep the surprise of generated text close to tau
+type mirostat struct {
+	version int
+	tau     float32
+	eta     float32
+	// mu is the maximum surprise currently allowed, updated after each token
+	mu float32
+}
+
+// m is the number of tokens Mirostat v1 uses to estimate the distribution
+const mirostatM = 100
+
+func newMirostat(version int, tau, eta float32) *mirostat {
+	return &mirostat{version: version, tau: tau, eta: eta, mu: 2 * tau}
+}
+
+// truncate limits tokens to those allowed by the current target surprise.
+// It requires ts to be probabilities sorted in descending order and n to be
+// the size of the vocabulary
+func (m *mirostat) truncate(ts []token, n int) []token {
+	if m.version == 1 {
+		// estimate the Zipf exponent from the most probable tokens
+		var sumTiBi, sumTiSq float64
+		for i := 0; i < mirostatM-1 && i < len(ts)-1; i++ {
+			ti := math.Log(float64(i+2) / float64(i+1))
+			bi := math.Log(float64(ts[i].value) / float64(ts[i+1].value))
+			sumTiBi += ti * bi
+			sumTiSq += ti * ti
+		}
+		sHat := sumTiBi / sumTiSq
+
+		epsilonHat := sHat - 1
+		k := math.Pow(epsilonHat*math.Pow(2, float64(m.mu))/(1-math.Pow(float64(n), -epsilonHat)), 1/sHat)
+		// also catches NaN when there are too few tokens to estimate from
+		if !(k >= 1) {
+			k = 1
+		}
+		return ts[:int(min(k, float64(len(ts))))]
+	}
+
+	for i, t := range ts {
+		if -math.Log2(float64(t.value)) > float64(m.mu) {
+			return ts[:max(i, 1)]
+		}
+	}
+	return ts
+}
+
+// update moves mu towards the target surprise given the probability of the
+// token that was sampled
+func (m *mirostat) update(p float32) {
+	surprise := float32(-math.Log2(float64(p)))
+	m.mu -= m.eta * (surprise - m.tau)
+}
@@ -118,6 +118,154 @@ func TestSoftmax(t *testing.T) {
 	}
 }
 
+func TestLogitBias(t *testing.T) {
+	tokens := toTokens([]float32{1, 2, 3})
+	logitBias(tokens, map[int32]float32{0: 2.5, 2: -100, 7: 1, -1: 1})
+	compareLogits(t, "logitBias", []float32{3.5, 2, -97}, tokens)
+}
+
+func TestPenalties(t *testing.T) {
+	input := []float32{2.0, -1.0, 4.0, 0.5}
+	history := []int32{0, 1, 0, 7}
+
+	tokens := toTokens(input)
+	penalties(tokens, history, 2.0, 0, 0)
+	want := []float32{1.0, -2.0, 4.0, 0.5}
+	compareLogits(t, "penalties(repeat=2)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, history, 1.0, 0.5, 0)
+	want = []float32{1.5, -1.5, 4.0, 0.5}
+	compareLogits(t, "penalties(presence=0.5)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, history, 1.0, 0, 0.25)
+	want = []float32{1.5, -1.25, 4.0, 0.5}
+	compareLogits(t, "penalties(frequency=0.25)", want, tokens)
+
+	tokens = toTokens(input)
+	penalties(tokens, history, 2.0, 0.5, 0.25)
+	want = []float32{0.0, -2.75, 4.0, 0.5}
+	compareLogits(t, "penalties(all)", want, tokens)
+}
+
+func TestTypicalP(t *testing.T) {
+	logits := []float32{
+		float32(math.Log(0.5)),
+		float32(math.Log(0.3)),
+		float32(math.Log(0.1)),
+		float32(math.Log(0.1)),
+	}
+
+	got := typicalP(toTokens(logits), 1.0)
+	if len(got) != len(logits) {
+		t.Errorf("typicalP(1.0): should keep all tokens, got %d", len(got))
+	}
+
+	// the second token is closest to the entropy of the distribution so it
+	// is kept before the most likely one
+	got = typicalP(toTokens(logits), 0.2)
+	if len(got) != 1 || got[0].id != 1 {
+		t.Errorf("typicalP(0.2): expected token 1, got %v", got)
+	}
+
+	got = typicalP(toTokens(logits), 0.5)
+	if len(got) != 2 || got[0].id != 0 || got[1].id != 1 {
+		t.Errorf("typicalP(0.5): expected tokens 0 and 1 in order, got %v", got)
+	}
+}
+
+func TestMirostat(t *testing.T) {
+	probs := func() []token {
+		return toTokens([]float32{0.5, 0.25, 0.125, 0.125})
+	}
+
+	m := newMirostat(2, 1, 0.5)
+	if got := m.truncate(probs(), 4); len(got) != 2 {
+		t.Errorf("v2: expected tokens with surprise up to 2 bits, got %v", got)
+	}
+
+	m.update(0.25)
+	if m.mu != 1.5 {
+		t.Errorf("v2: expected mu 1.5, got %f", m.mu)
+	}
+	if got := m.truncate(probs(), 4); len(got) != 1 {
+		t.Errorf("v2: expected a single token, got %v", got)
+	}
+
+	m.mu = -1
+	if got := m.truncate(probs(), 4); len(got) != 1 {
+		t.Errorf("v2: should keep at least one token, got %v", got)
+	}
+
+	// a Zipf-like distribution over a larger vocabulary
+	zipf := func() []token {
+		ts := make([]token, 1000)
+		var sum float32
+		for i := range ts {
+			ts[i] = token{id: int32(i), value: 1 / float32(i+1)}
+			sum += ts[i].value
+		}
+		for i := range ts {
+			ts[i].value /= sum
+		}
+		return ts
+	}
+
+	m = newMirostat(1, 5, 0.1)
+	high := len(m.truncate(zipf(), 1000))
+	m.mu = 2
+	low := len(m.truncate(zipf(), 1000))
+	if low < 1 || low >= high {
+		t.Errorf("v1: expected fewer tokens with a lower target, got %d and %d", high, low)
+	}
+
+	if got := m.truncate([]token{{id: 0, value: 1}}, 1000); len(got) != 1 {
+		t.Errorf("v1: should keep a single token, got %v", got)
+	}
+}
+
+func TestDRY(t *testing.T) {
+	input := []float32{1, 1, 1, 1, 1}
+	history := []int32{1, 2, 3, 4, 1, 2, 3}
+
+	// 1 2 3 was followed by 4 before, so 4 would extend the repeat
+	tokens := toTokens(input)
+	dry(tokens, history, nil, 1, 2, 2)
+	compareLogits(t, "dry", []float32{1, 1, 1, 1, -1}, tokens)
+
+	tokens = toTokens(input)
+	dry(tokens, history, nil, 0.5, 2, 3)
+	compareLogits(t, "dry(allowed=3)", []float32{1, 1, 1, 1, 0.5}, tokens)
+
+	tokens = toTokens(input)
+	dry(tokens, history, nil, 1, 2, 4)
+	compareLogits(t, "dry(allowed=4)", input, tokens)
+
+	// repeats do not extend across breakers
+	tokens = toTokens(input)
+	dry(tokens, history, map[int32]bool{2: true}, 1, 2, 2)
+	compareLogits(t, "dry(breakers)", input, tokens)
+
+	// the longest repeat is used
+	tokens = toTokens(input)
+	dry(tokens, []int32{2, 3, 0, 1, 2, 3, 4, 1, 2, 3}, nil, 1, 2, 2)
+	compareLogits(t, "dry(longest)", []float32{0, 1, 1, 1, -1}, tokens)
+}
+
+func TestXTC(t *testing.T) {
+	input := []float32{0.4, 0.3, 0.2, 0.1}
+
+	got := xtc(toTokens(input), 0.2)
+	compareLogits(t, "xtc(0.2)", []float32{0.2, 0.1}, got)
+
+	got = xtc(toTokens(input), 0.35)
+	compareLogits(t, "xtc(0.35)", input, got)
+
+	got = xtc(toTokens(input), 0.05)
+	compareLogits(t, "xtc(0.05)", []float32{0.1}, got)
+}
+
 func TestTopK(t *testing.T) {
 	input := []float32{0.026986899, 0.043722924, 0.036774673, 0.27755088, 0.0046718004, 0.08582123, 0.20409796, 0.00412893, 0.15720603, 0.045046154, 0.0030491839, 0.01681367}
 	tokens := toTokens(input)
@@ -0,0 +1,1023 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
+	"github.com/qompassai/rose/format"
+	"github.com/qompassai/rose/openai"
+)
+
+// batchEndpoints are the endpoints requests in a batch can be sent to
+var batchEndpoints = []string{"/v1/chat/completions", "/v1/completions", "/v1/embeddings"}
+
+// maxBatchFileSize is the largest file that can be uploaded, including the
+// rest of the form it is uploaded with
+var maxBatchFileSize int64 = 200 * format.MegaByte
+
+// maxBatchErrors is the number of invalid lines reported when a batch fails
+// validation
+const maxBatchErrors = 100
+
+type batchPriorityKey struct{}
+
+// withBatchPriority marks requests made with ctx as part of a batch, which
+// the scheduler always queues at batch priority
+func withBatchPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchPriorityKey{}, true)
+}
+
+func isBatchRequest(ctx context.Context) bool {
+	batch, _ := ctx.Value(batchPriorityKey{}).(bool)
+	return batch
+}
+
+// batchRequest is a line of a batch's input file
+type batchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResult is a line of a batch's output or error file
+type batchResult struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *api.BatchError      `json:"error"`
+}
+
+type batchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// batch is a batch as it is stored, with the ID of the API key that
+// created it. Only that key can see the batch, and its requests are made
+// with it.
+type batch struct {
+	api.Batch
+	Owner string `json:"owner,omitempty"`
+
+	// Client is the rate limit identity of the client that created the
+	// batch, which its requests count against
+	Client string `json:"client,omitempty"`
+}
+
+// file is a file as it is stored, with the ID of the API key that created
+// it, or of the batch it is the output of
+type file struct {
+	api.File
+	Owner string `json:"owner,omitempty"`
+}
+
+// batchManager stores files and runs batches one at a time in the
+// background. Files and the progress of batches are kept under dir, so
+// batches continue where they left off when the server restarts. dir is
+// created when the first file is uploaded.
+type batchManager struct {
+	dir string
+
+	// handler serves the requests in batches
+	handler http.Handler
+
+	// parallel returns how many requests for a model are run at once,
+	// which is one if it is nil
+	parallel func(model string) int
+
+	mu      sync.Mutex
+	batches map[string]*batch
+	// pending are the IDs of batches waiting to run
+	pending []string
+	wake    chan struct{}
+	// cancel stops the batch that is running
+	cancel  context.CancelFunc
+	running string
+}
+
+func newBatchManager(dir string) (*batchManager, error) {
+	m := &batchManager{
+		dir:     dir,
+		batches: make(map[string]*batch),
+		wake:    make(chan struct{}, 1),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+
+		var b batch
+		if err := readJSON(filepath.Join(dir, e.Name()), &b); err != nil {
+			slog.Warn("skipping invalid batch", "file", e.Name(), "error", err)
+			continue
+		}
+
+		switch b.Status {
+		case "validating", "in_progress", "finalizing":
+			m.pending = append(m.pending, b.ID)
+		case "cancelling":
+			b.Status = "cancelled"
+			b.CancelledAt = time.Now().Unix()
+			if err := m.save(&b); err != nil {
+				return nil, err
+			}
+		}
+
+		m.batches[b.ID] = &b
+	}
+
+	// resume batches in the order they were created
+	slices.SortFunc(m.pending, func(a, b string) int {
+		return int(m.batches[a].CreatedAt - m.batches[b].CreatedAt)
+	})
+
+	return m, nil
+}
+
+func batchID(prefix string) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letters[rand.IntN(len(letters))]
+	}
+	return prefix + string(b)
+}
+
+func readJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON replaces the file at path with v, so it is never left partly
+// written
+func writeJSON(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *batchManager) filePath(id string) string {
+	return filepath.Join(m.dir, "files", filepath.Base(id))
+}
+
+// save writes a batch to disk. It must be called with mu held or before
+// the batch is shared.
+func (m *batchManager) save(b *batch) error {
+	return writeJSON(filepath.Join(m.dir, filepath.Base(b.ID)+".json"), b)
+}
+
+func (m *batchManager) file(id string) (*file, error) {
+	var f file
+	if err := readJSON(m.filePath(id)+".json", &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ownedFile returns a file if it belongs to the API key owner, and
+// fs.ErrNotExist if it does not exist or belongs to another key
+func (m *batchManager) ownedFile(id, owner string) (*api.File, error) {
+	f, err := m.file(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Owner != owner {
+		return nil, fs.ErrNotExist
+	}
+
+	return &f.File, nil
+}
+
+func (m *batchManager) createFile(name, purpose, owner string, r io.Reader) (*api.File, error) {
+	if err := os.MkdirAll(filepath.Join(m.dir, "files"), 0o755); err != nil {
+		return nil, err
+	}
+
+	f := file{
+		File: api.File{
+			ID:        batchID("file-"),
+			Object:    "file",
+			CreatedAt: time.Now().Unix(),
+			Filename:  name,
+			Purpose:   purpose,
+		},
+		Owner: owner,
+	}
+
+	if r != nil {
+		w, err := os.Create(m.filePath(f.ID))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		n, err := io.Copy(w, r)
+		if err != nil {
+			os.Remove(w.Name())
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		f.Bytes = n
+	}
+
+	if err := writeJSON(m.filePath(f.ID)+".json", f); err != nil {
+		return nil, err
+	}
+
+	return &f.File, nil
+}
+
+func (m *batchManager) deleteFile(id string) error {
+	if _, err := m.file(id); err != nil {
+		return err
+	}
+
+	if err := os.Remove(m.filePath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(m.filePath(id) + ".json")
+}
+
+// listFiles returns the files that belong to the API key owner, the most
+// recent first
+func (m *batchManager) listFiles(owner string) ([]api.File, error) {
+	files := []api.File{}
+	entries, err := os.ReadDir(filepath.Join(m.dir, "files"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		f, err := m.file(id)
+		if err != nil || f.Owner != owner {
+			continue
+		}
+		files = append(files, f.File)
+	}
+
+	slices.SortFunc(files, func(a, b api.File) int { return int(b.CreatedAt - a.CreatedAt) })
+	return files, nil
+}
+
+func (m *batchManager) create(req api.BatchRequest, owner, client string) (*api.Batch, error) {
+	b := &batch{
+		Batch: api.Batch{
+			ID:               batchID("batch_"),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileID:      req.InputFileID,
+			CompletionWindow: req.CompletionWindow,
+			Status:           "validating",
+			CreatedAt:        time.Now().Unix(),
+			Metadata:         req.Metadata,
+		},
+		Owner:  owner,
+		Client: client,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.save(b); err != nil {
+		return nil, err
+	}
+
+	m.batches[b.ID] = b
+	m.pending = append(m.pending, b.ID)
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	return m.get(b.ID), nil
+}
+
+// get returns a copy of a batch, or nil if it does not exist. It must be
+// called with mu held.
+func (m *batchManager) get(id string) *api.Batch {
+	b, ok := m.batches[id]
+	if !ok {
+		return nil
+	}
+
+	c := b.Batch
+	return &c
+}
+
+// lookup returns a copy of a batch if it belongs to the API key owner, or
+// nil if it does not exist or belongs to another key
+func (m *batchManager) lookup(id, owner string) *api.Batch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if b, ok := m.batches[id]; !ok || b.Owner != owner {
+		return nil
+	}
+
+	return m.get(id)
+}
+
+// list returns the batches that belong to the API key owner, the most
+// recent first
+func (m *batchManager) list(owner string) []api.Batch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	batches := make([]api.Batch, 0, len(m.batches))
+	for _, b := range m.batches {
+		if b.Owner == owner {
+			batches = append(batches, b.Batch)
+		}
+	}
+
+	slices.SortFunc(batches, func(a, b api.Batch) int { return int(b.CreatedAt - a.CreatedAt) })
+	return batches
+}
+
+// update changes a batch and saves it
+func (m *batchManager) update(id string, fn func(*api.Batch)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.batches[id]
+	fn(&b.Batch)
+	return m.save(b)
+}
+
+// cancelBatch cancels a batch that belongs to the API key owner
+func (m *batchManager) cancelBatch(id, owner string) (*api.Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.batches[id]
+	if !ok || b.Owner != owner {
+		return nil, os.ErrNotExist
+	}
+
+	switch b.Status {
+	case "validating", "in_progress", "finalizing":
+	default:
+		return nil, fmt.Errorf("cannot cancel a batch with status %q", b.Status)
+	}
+
+	now := time.Now().Unix()
+	if m.running == id {
+		// the batch stops the requests it is running
+		b.Status = "cancelling"
+		b.CancellingAt = now
+		m.cancel()
+	} else {
+		b.Status = "cancelled"
+		b.CancellingAt = now
+		b.CancelledAt = now
+		m.pending = slices.DeleteFunc(m.pending, func(p string) bool { return p == id })
+	}
+
+	if err := m.save(b); err != nil {
+		return nil, err
+	}
+
+	return m.get(id), nil
+}
+
+// run runs batches until ctx is done
+func (m *batchManager) run(ctx context.Context) {
+	for {
+		m.mu.Lock()
+		if len(m.pending) == 0 {
+			m.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+			}
+			continue
+		}
+
+		id := m.pending[0]
+		m.pending = m.pending[1:]
+		if status := m.batches[id].Status; status == "cancelled" || status == "failed" || status == "completed" {
+			m.mu.Unlock()
+			continue
+		}
+
+		batchCtx, cancel := context.WithCancel(ctx)
+		m.running = id
+		m.cancel = cancel
+		m.mu.Unlock()
+
+		err := m.runBatch(batchCtx, id)
+		cancel()
+
+		m.mu.Lock()
+		m.running = ""
+		m.cancel = nil
+		m.mu.Unlock()
+
+		switch {
+		case ctx.Err() != nil:
+			// the server is stopping, the batch continues when it restarts
+			return
+		case errors.Is(err, context.Canceled):
+			err = m.finish(id, "cancelled")
+		case err != nil:
+			slog.Error("batch failed", "batch", id, "error", err)
+			message := err.Error()
+			err = m.update(id, func(b *api.Batch) {
+				b.Status = "failed"
+				b.FailedAt = time.Now().Unix()
+				b.Errors = &api.BatchErrors{Object: "list", Data: []api.BatchError{{Code: "server_error", Message: message}}}
+			})
+		}
+
+		if err != nil {
+			slog.Error("failed to save batch", "batch", id, "error", err)
+		}
+	}
+}
+
+// validate reads the requests in a batch's input file
+func (m *batchManager) validate(b *api.Batch) ([]batchRequest, []api.BatchError, error) {
+	f, err := os.Open(m.filePath(b.InputFileID))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var requests []batchRequest
+	var errs []api.BatchError
+	seen := make(map[string]bool)
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		text, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, err
+		}
+
+		if text = bytes.TrimSpace(text); len(text) > 0 {
+			var req batchRequest
+			var message string
+			switch {
+			case json.Unmarshal(text, &req) != nil:
+				message = "line is not a valid JSON object"
+			case req.CustomID == "":
+				message = "custom_id is required"
+			case seen[req.CustomID]:
+				message = fmt.Sprintf("custom_id %q is not unique", req.CustomID)
+			case req.Method != http.MethodPost:
+				message = "method must be POST"
+			case req.URL != b.Endpoint:
+				message = fmt.Sprintf("url %q does not match the batch endpoint %q", req.URL, b.Endpoint)
+			case len(req.Body) == 0 || req.Body[0] != '{':
+				message = "body must be a JSON object"
+			}
+
+			if message != "" {
+				if len(errs) < maxBatchErrors {
+					errs = append(errs, api.BatchError{Code: "invalid_request", Message: message, Line: line})
+				}
+			} else {
+				seen[req.CustomID] = true
+				requests = append(requests, req)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	if len(requests) == 0 && len(errs) == 0 {
+		errs = append(errs, api.BatchError{Code: "empty_file", Message: "the input file has no requests"})
+	}
+
+	return requests, errs, nil
+}
+
+// results returns the custom IDs of the requests already in a batch's
+// output or error file, from an earlier run
+func (m *batchManager) results(id string) (map[string]bool, error) {
+	f, err := os.OpenFile(m.filePath(id), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	done := make(map[string]bool)
+	var n int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a line without a newline was cut off when the server stopped
+			if len(line) > 0 {
+				return done, f.Truncate(n)
+			}
+			return done, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		n += int64(len(line))
+
+		var result batchResult
+		if err := json.Unmarshal(line, &result); err == nil {
+			done[result.CustomID] = true
+		}
+	}
+}
+
+// openResults opens a batch's output or error file to append results to,
+// creating it for owner the first time the batch runs
+func (m *batchManager) openResults(id *string, name, owner string) (*os.File, error) {
+	if *id == "" {
+		f, err := m.createFile(name, "batch_output", owner, nil)
+		if err != nil {
+			return nil, err
+		}
+		*id = f.ID
+	}
+
+	return os.OpenFile(m.filePath(*id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+func (m *batchManager) runBatch(ctx context.Context, id string) error {
+	m.mu.Lock()
+	b := m.get(id)
+	owner, client := m.batches[id].Owner, m.batches[id].Client
+	m.mu.Unlock()
+
+	// requests are made with the key that created the batch, and count
+	// against the rate limits of its client
+	ctx = withRateLimitClient(auth.WithKeyID(ctx, owner), client)
+
+	requests, errs, err := m.validate(b)
+	if err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return m.update(id, func(b *api.Batch) {
+			b.Status = "failed"
+			b.FailedAt = time.Now().Unix()
+			b.Errors = &api.BatchErrors{Object: "list", Data: errs}
+		})
+	}
+
+	output, err := m.openResults(&b.OutputFileID, b.ID+"_output.jsonl", owner)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	failures, err := m.openResults(&b.ErrorFileID, b.ID+"_error.jsonl", owner)
+	if err != nil {
+		return err
+	}
+	defer failures.Close()
+
+	completed, err := m.results(b.OutputFileID)
+	if err != nil {
+		return err
+	}
+
+	failed, err := m.results(b.ErrorFileID)
+	if err != nil {
+		return err
+	}
+
+	if err := m.update(id, func(batch *api.Batch) {
+		batch.Status = "in_progress"
+		if batch.InProgressAt == 0 {
+			batch.InProgressAt = time.Now().Unix()
+		}
+		batch.OutputFileID = b.OutputFileID
+		batch.ErrorFileID = b.ErrorFileID
+		batch.RequestCounts = api.BatchRequestCounts{
+			Total:     len(requests),
+			Completed: len(completed),
+			Failed:    len(failed),
+		}
+	}); err != nil {
+		return err
+	}
+
+	// requests for each model run at once on the runner's parallel slots,
+	// and their results are written as they finish
+	g, gctx := errgroup.WithContext(ctx)
+	var mu sync.Mutex
+	limits := make(map[string]*semaphore.Weighted)
+	for _, req := range requests {
+		if completed[req.CustomID] || failed[req.CustomID] {
+			continue
+		}
+
+		// invalid bodies are reported by do
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(req.Body, &body)
+
+		limit, ok := limits[body.Model]
+		if !ok {
+			limit = semaphore.NewWeighted(int64(m.parallelRequests(body.Model)))
+			limits[body.Model] = limit
+		}
+
+		if err := limit.Acquire(gctx, 1); err != nil {
+			break
+		}
+
+		g.Go(func() error {
+			defer limit.Release(1)
+
+			result := m.do(gctx, req)
+			if gctx.Err() != nil {
+				return gctx.Err()
+			}
+
+			line, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+
+			ok := result.Response.StatusCode == http.StatusOK
+			w := output
+			if !ok {
+				w = failures
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+
+			return m.update(id, func(b *api.Batch) {
+				if ok {
+					b.RequestCounts.Completed++
+				} else {
+					b.RequestCounts.Failed++
+				}
+			})
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := m.update(id, func(b *api.Batch) {
+		b.Status = "finalizing"
+		b.FinalizingAt = time.Now().Unix()
+	}); err != nil {
+		return err
+	}
+
+	return m.finish(id, "completed")
+}
+
+func (m *batchManager) parallelRequests(model string) int {
+	if m.parallel == nil {
+		return 1
+	}
+
+	return max(m.parallel(model), 1)
+}
+
+// finish records the sizes of a batch's output and error files, deleting
+// them if they are empty, and sets its final status
+func (m *batchManager) finish(id, status string) error {
+	m.mu.Lock()
+	b := m.get(id)
+	m.mu.Unlock()
+
+	for _, fileID := range []*string{&b.OutputFileID, &b.ErrorFileID} {
+		if *fileID == "" {
+			continue
+		}
+
+		info, err := os.Stat(m.filePath(*fileID))
+		if err != nil {
+			return err
+		}
+
+		if info.Size() == 0 {
+			if err := m.deleteFile(*fileID); err != nil {
+				return err
+			}
+			*fileID = ""
+			continue
+		}
+
+		f, err := m.file(*fileID)
+		if err != nil {
+			return err
+		}
+
+		f.Bytes = info.Size()
+		if err := writeJSON(m.filePath(*fileID)+".json", f); err != nil {
+			return err
+		}
+	}
+
+	return m.update(id, func(batch *api.Batch) {
+		now := time.Now().Unix()
+		batch.Status = status
+		switch status {
+		case "completed":
+			batch.CompletedAt = now
+		case "cancelled":
+			batch.CancelledAt = now
+		}
+		batch.OutputFileID = b.OutputFileID
+		batch.ErrorFileID = b.ErrorFileID
+	})
+}
+
+// do sends a request from a batch to its endpoint, without streaming
+func (m *batchManager) do(ctx context.Context, req batchRequest) batchResult {
+	result := batchResult{
+		ID:       batchID("batch_req_"),
+		CustomID: req.CustomID,
+		Response: &batchResultResponse{RequestID: batchID("req_")},
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		result.Response.StatusCode = http.StatusBadRequest
+		result.Response.Body, _ = json.Marshal(openai.NewError(http.StatusBadRequest, "body must be a JSON object"))
+		return result
+	}
+
+	delete(body, "stream")
+	delete(body, "stream_options")
+	b, err := json.Marshal(body)
+	if err != nil {
+		result.Response.StatusCode = http.StatusInternalServerError
+		result.Response.Body, _ = json.Marshal(openai.NewError(http.StatusInternalServerError, err.Error()))
+		return result
+	}
+
+	ctx, cancel := context.WithCancel(withBatchPriority(ctx))
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://127.0.0.1"+req.URL, bytes.NewReader(b))
+	if err != nil {
+		result.Response.StatusCode = http.StatusInternalServerError
+		result.Response.Body, _ = json.Marshal(openai.NewError(http.StatusInternalServerError, err.Error()))
+		return result
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	w := &batchResponseWriter{header: make(http.Header), status: http.StatusOK}
+	m.handler.ServeHTTP(w, r)
+
+	result.Response.StatusCode = w.status
+	if id := w.header.Get(requestIDHeader); id != "" {
+		result.Response.RequestID = id
+	}
+	result.Response.Body = bytes.TrimSpace(w.body.Bytes())
+	if !json.Valid(result.Response.Body) {
+		result.Response.Body, _ = json.Marshal(openai.NewError(w.status, string(result.Response.Body)))
+	}
+
+	return result
+}
+
+// batchResponseWriter records the response to a request from a batch
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (s *Server) CreateFileHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchFileSize)
+	var maxBytes *http.MaxBytesError
+	if _, err := c.MultipartForm(); errors.As(err, &maxBytes) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, openai.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("file must be at most %s", format.HumanBytes(maxBatchFileSize))))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if purpose := c.PostForm("purpose"); purpose != "batch" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, fmt.Sprintf("purpose must be \"batch\", got %q", purpose)))
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, "file is required"))
+		return
+	}
+
+	r, err := fh.Open()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, openai.NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+	defer r.Close()
+
+	f, err := s.batches.createFile(fh.Filename, "batch", auth.KeyID(c.Request.Context()), r)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, openai.NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, f)
+}
+
+func (s *Server) ListFilesHandler(c *gin.Context) {
+	files, err := s.batches.listFiles(auth.KeyID(c.Request.Context()))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, openai.NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": files})
+}
+
+func (s *Server) fileNotFound(c *gin.Context, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, openai.NewError(http.StatusNotFound, fmt.Sprintf("file %q not found", c.Param("id"))))
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusInternalServerError, openai.NewError(http.StatusInternalServerError, err.Error()))
+}
+
+func (s *Server) GetFileHandler(c *gin.Context) {
+	f, err := s.batches.ownedFile(c.Param("id"), auth.KeyID(c.Request.Context()))
+	if err != nil {
+		s.fileNotFound(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, f)
+}
+
+func (s *Server) FileContentHandler(c *gin.Context) {
+	if _, err := s.batches.ownedFile(c.Param("id"), auth.KeyID(c.Request.Context())); err != nil {
+		s.fileNotFound(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "application/jsonl")
+	c.File(s.batches.filePath(c.Param("id")))
+}
+
+func (s *Server) DeleteFileHandler(c *gin.Context) {
+	if _, err := s.batches.ownedFile(c.Param("id"), auth.KeyID(c.Request.Context())); err != nil {
+		s.fileNotFound(c, err)
+		return
+	}
+
+	if err := s.batches.deleteFile(c.Param("id")); err != nil {
+		s.fileNotFound(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "object": "file", "deleted": true})
+}
+
+func (s *Server) CreateBatchHandler(c *gin.Context) {
+	var req api.BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if !slices.Contains(batchEndpoints, req.Endpoint) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, fmt.Sprintf("endpoint must be one of %s", strings.Join(batchEndpoints, ", "))))
+		return
+	}
+
+	if req.CompletionWindow == "" {
+		req.CompletionWindow = "24h"
+	} else if req.CompletionWindow != "24h" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, "completion_window must be \"24h\""))
+		return
+	}
+
+	owner := auth.KeyID(c.Request.Context())
+	f, err := s.batches.ownedFile(req.InputFileID, owner)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, openai.NewError(http.StatusNotFound, fmt.Sprintf("file %q not found", req.InputFileID)))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, openai.NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	if f.Purpose != "batch" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, openai.NewError(http.StatusBadRequest, fmt.Sprintf("file %q is not a batch input file", req.InputFileID)))
+		return
+	}
+
+	b, err := s.batches.create(req, owner, s.limits.identify(c))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, openai.NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+func (s *Server) ListBatchesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": s.batches.list(auth.KeyID(c.Request.Context())), "has_more": false})
+}
+
+func (s *Server) GetBatchHandler(c *gin.Context) {
+	b := s.batches.lookup(c.Param("id"), auth.KeyID(c.Request.Context()))
+	if b == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, openai.NewError(http.StatusNotFound, fmt.Sprintf("batch %q not found", c.Param("id"))))
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+func (s *Server) CancelBatchHandler(c *gin.Context) {
+	b, err := s.batches.cancelBatch(c.Param("id"), auth.KeyID(c.Request.Context()))
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, openai.NewError(http.StatusNotFound, fmt.Sprintf("batch %q not found", c.Param("id"))))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, openai.NewError(http.StatusConflict, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
@@ -0,0 +1,515 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
+)
+
+// echoHandler responds with the model of each request, or fails the request
+// if the model is "bad"
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !isBatchRequest(r.Context()) {
+		http.Error(w, "not a batch request", http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := req["stream"]; ok {
+		http.Error(w, "batch requests should not stream", http.StatusBadRequest)
+		return
+	}
+
+	if req["model"] == "bad" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"message": "model not found"}})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"model": req["model"]})
+})
+
+func newTestBatch(t *testing.T, m *batchManager, input string) *api.Batch {
+	t.Helper()
+
+	f, err := m.createFile("input.jsonl", "batch", "", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.create(api.BatchRequest{InputFileID: f.ID, Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func waitForBatch(t *testing.T, m *batchManager, id string) *api.Batch {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		b := m.get(id)
+		m.mu.Unlock()
+
+		switch b.Status {
+		case "completed", "failed", "cancelled":
+			return b
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("batch %s did not finish", id)
+	return nil
+}
+
+func readResults(t *testing.T, m *batchManager, id string) map[string]int {
+	t.Helper()
+
+	if id == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(m.filePath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var result batchResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatal(err)
+		}
+		results[result.CustomID] = result.Response.StatusCode
+	}
+
+	return results
+}
+
+func TestBatchRun(t *testing.T) {
+	cases := []struct {
+		name      string
+		input     string
+		status    string
+		counts    api.BatchRequestCounts
+		completed map[string]int
+		failed    map[string]int
+		errors    []api.BatchError
+	}{
+		{
+			name: "completed",
+			input: `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test","stream":true}}
+{"custom_id":"b","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+`,
+			status:    "completed",
+			counts:    api.BatchRequestCounts{Total: 2, Completed: 2},
+			completed: map[string]int{"a": 200, "b": 200},
+		},
+		{
+			name: "failed requests",
+			input: `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+{"custom_id":"b","method":"POST","url":"/v1/chat/completions","body":{"model":"bad"}}`,
+			status:    "completed",
+			counts:    api.BatchRequestCounts{Total: 2, Completed: 1, Failed: 1},
+			completed: map[string]int{"a": 200},
+			failed:    map[string]int{"b": 404},
+		},
+		{
+			name: "invalid lines",
+			input: `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+not json
+{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+{"custom_id":"c","method":"GET","url":"/v1/chat/completions","body":{"model":"test"}}
+{"custom_id":"d","method":"POST","url":"/v1/embeddings","body":{"model":"test"}}
+{"custom_id":"e","method":"POST","url":"/v1/chat/completions","body":"test"}`,
+			status: "failed",
+			errors: []api.BatchError{
+				{Code: "invalid_request", Message: "line is not a valid JSON object", Line: 2},
+				{Code: "invalid_request", Message: `custom_id "a" is not unique`, Line: 3},
+				{Code: "invalid_request", Message: "method must be POST", Line: 4},
+				{Code: "invalid_request", Message: `url "/v1/embeddings" does not match the batch endpoint "/v1/chat/completions"`, Line: 5},
+				{Code: "invalid_request", Message: "body must be a JSON object", Line: 6},
+			},
+		},
+		{
+			name:   "empty",
+			input:  "\n",
+			status: "failed",
+			errors: []api.BatchError{{Code: "empty_file", Message: "the input file has no requests"}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newBatchManager(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.handler = echoHandler
+
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			go m.run(ctx)
+
+			b := waitForBatch(t, m, newTestBatch(t, m, tt.input).ID)
+			if b.Status != tt.status {
+				t.Fatalf("expected status %q, got %q", tt.status, b.Status)
+			}
+
+			if diff := cmp.Diff(tt.counts, b.RequestCounts); diff != "" {
+				t.Errorf("request counts mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.completed, readResults(t, m, b.OutputFileID)); diff != "" {
+				t.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.failed, readResults(t, m, b.ErrorFileID)); diff != "" {
+				t.Errorf("errors mismatch (-want +got):\n%s", diff)
+			}
+
+			var errs []api.BatchError
+			if b.Errors != nil {
+				errs = b.Errors.Data
+			}
+
+			if diff := cmp.Diff(tt.errors, errs); diff != "" {
+				t.Errorf("batch errors mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBatchParallel(t *testing.T) {
+	m, err := newBatchManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.parallel = func(model string) int {
+		if model == "parallel" {
+			return 2
+		}
+		return 1
+	}
+
+	// requests wait until as many as the model runs at once have started,
+	// so the batch only finishes if they run in parallel
+	var mu sync.Mutex
+	running := make(map[string]int)
+	most := make(map[string]int)
+	started := map[string]chan struct{}{"parallel": make(chan struct{}), "serial": make(chan struct{})}
+	m.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		running[req.Model]++
+		most[req.Model] = max(most[req.Model], running[req.Model])
+		if running[req.Model] == m.parallelRequests(req.Model) {
+			select {
+			case <-started[req.Model]:
+			default:
+				close(started[req.Model])
+			}
+		}
+		mu.Unlock()
+
+		<-started[req.Model]
+
+		mu.Lock()
+		running[req.Model]--
+		mu.Unlock()
+
+		w.Write([]byte(`{}`))
+	})
+
+	var input strings.Builder
+	for i := range 6 {
+		model := "parallel"
+		if i%3 == 0 {
+			model = "serial"
+		}
+		fmt.Fprintf(&input, `{"custom_id":"%d","method":"POST","url":"/v1/chat/completions","body":{"model":%q}}`+"\n", i, model)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go m.run(ctx)
+
+	b := waitForBatch(t, m, newTestBatch(t, m, input.String()).ID)
+	if b.Status != "completed" {
+		t.Fatalf("expected status completed, got %q", b.Status)
+	}
+
+	if diff := cmp.Diff(api.BatchRequestCounts{Total: 6, Completed: 6}, b.RequestCounts); diff != "" {
+		t.Errorf("request counts mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string]int{"parallel": 2, "serial": 1}, most); diff != "" {
+		t.Errorf("most requests at once mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := len(readResults(t, m, b.OutputFileID)); got != 6 {
+		t.Errorf("expected 6 results, got %d", got)
+	}
+}
+
+func TestBatchResume(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newBatchManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBatch(t, m, `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+{"custom_id":"b","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+{"custom_id":"c","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}`)
+
+	// the server stopped after the first request, partway through writing
+	// the result of the second
+	output, err := m.createFile(b.ID+"_output.jsonl", "batch_output", "", strings.NewReader(`{"id":"1","custom_id":"a","response":{"status_code":200,"body":{}}}
+{"id":"2","custom_id":"b","resp`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.update(b.ID, func(b *api.Batch) {
+		b.Status = "in_progress"
+		b.OutputFileID = output.ID
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = newBatchManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests []string
+	m.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, string(body))
+		w.Write([]byte(`{}`))
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go m.run(ctx)
+
+	b = waitForBatch(t, m, b.ID)
+	if b.Status != "completed" {
+		t.Fatalf("expected status completed, got %q", b.Status)
+	}
+
+	if len(requests) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(requests))
+	}
+
+	if diff := cmp.Diff(api.BatchRequestCounts{Total: 3, Completed: 3}, b.RequestCounts); diff != "" {
+		t.Errorf("request counts mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string]int{"a": 200, "b": 200, "c": 200}, readResults(t, m, b.OutputFileID)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	m, err := newBatchManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	m.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	b := newTestBatch(t, m, `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}
+{"custom_id":"b","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}`)
+	pending := newTestBatch(t, m, `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}`)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go m.run(ctx)
+
+	<-started
+
+	cancelled, err := m.cancelBatch(pending.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cancelled.Status != "cancelled" {
+		t.Errorf("expected pending batch to be cancelled, got %q", cancelled.Status)
+	}
+
+	cancelled, err = m.cancelBatch(b.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cancelled.Status != "cancelling" {
+		t.Errorf("expected running batch to be cancelling, got %q", cancelled.Status)
+	}
+
+	b = waitForBatch(t, m, b.ID)
+	if b.Status != "cancelled" {
+		t.Fatalf("expected status cancelled, got %q", b.Status)
+	}
+
+	if b.OutputFileID != "" || b.ErrorFileID != "" {
+		t.Errorf("expected empty result files to be removed, got %q and %q", b.OutputFileID, b.ErrorFileID)
+	}
+
+	if _, err := m.cancelBatch(b.ID, ""); err == nil {
+		t.Error("expected an error cancelling a cancelled batch")
+	}
+}
+
+func TestBatchOwner(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "batches")
+	m, err := newBatchManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the batches directory to be created with the first file, got %v", err)
+	}
+
+	if files, err := m.listFiles("key-a"); err != nil || len(files) != 0 {
+		t.Fatalf("expected no files, got %v, %v", files, err)
+	}
+
+	f, err := m.createFile("input.jsonl", "batch", "key-a", strings.NewReader(`{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"test"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.ownedFile(f.ID, "key-b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected another key to not find the file, got %v", err)
+	}
+
+	if files, _ := m.listFiles("key-b"); len(files) != 0 {
+		t.Errorf("expected another key to list no files, got %v", files)
+	}
+
+	b, err := m.create(api.BatchRequest{InputFileID: f.ID, Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, "key-a", "key:key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.lookup(b.ID, "key-b") != nil {
+		t.Error("expected another key to not find the batch")
+	}
+
+	if batches := m.list("key-b"); len(batches) != 0 {
+		t.Errorf("expected another key to list no batches, got %v", batches)
+	}
+
+	if _, err := m.cancelBatch(b.ID, "key-b"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected another key to not cancel the batch, got %v", err)
+	}
+
+	var keys []string
+	m.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, auth.KeyID(r.Context()))
+		w.Write([]byte(`{}`))
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go m.run(ctx)
+
+	b = waitForBatch(t, m, b.ID)
+	if b.Status != "completed" {
+		t.Fatalf("expected status completed, got %q", b.Status)
+	}
+
+	if diff := cmp.Diff([]string{"key-a"}, keys); diff != "" {
+		t.Errorf("request keys mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := m.ownedFile(b.OutputFileID, "key-a"); err != nil {
+		t.Errorf("expected the output file to belong to the batch's key, got %v", err)
+	}
+}
+
+func TestCreateFileSize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m, err := newBatchManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{batches: m}
+
+	old := maxBatchFileSize
+	maxBatchFileSize = 1024
+	t.Cleanup(func() { maxBatchFileSize = old })
+
+	upload := func(size int) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		form := multipart.NewWriter(&b)
+		form.WriteField("purpose", "batch")
+		w, _ := form.CreateFormFile("file", "input.jsonl")
+		w.Write(bytes.Repeat([]byte("a"), size))
+		form.Close()
+
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/files", &b)
+		c.Request.Header.Set("Content-Type", form.FormDataContentType())
+		s.CreateFileHandler(c)
+		return rec
+	}
+
+	if rec := upload(512); rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := upload(2048); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if files, err := m.listFiles(""); err != nil || len(files) != 1 {
+		t.Errorf("expected only the smaller file to be stored, got %v, %v", files, err)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/llm"
+	"github.com/qompassai/rose/types/model"
+)
+
+// CacheSaveHandler processes a prompt and saves the model's cache for it to
+// disk, so that later prompts starting with it can skip processing it
+func (s *Server) CacheSaveHandler(c *gin.Context) {
+	s.cacheHandler(c, true)
+}
+
+// CacheRestoreHandler loads the longest saved cache for the start of a
+// prompt, such as to warm up a model after it's loaded
+func (s *Server) CacheRestoreHandler(c *gin.Context) {
+	s.cacheHandler(c, false)
+}
+
+func (s *Server) cacheHandler(c *gin.Context, save bool) {
+	checkpointStart := time.Now()
+	var req api.CacheRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Prompt == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt is required"})
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{CapabilityCompletion}, req.Options, "", req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	var tokens int
+	if save {
+		// process the prompt so it's in the cache, generating as little as
+		// possible
+		opts.NumPredict = 1
+
+		var metrics api.Metrics
+		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+			Prompt:  req.Prompt,
+			Options: opts,
+		}, func(cr llm.CompletionResponse) {
+			if cr.Done {
+				metrics.PromptEvalCount = cr.PromptEvalCount
+				metrics.PromptEvalDuration = cr.PromptEvalDuration
+				metrics.EvalCount = cr.EvalCount
+				metrics.EvalDuration = cr.EvalDuration
+			}
+		}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		observeTokens(c.Request.Context(), m.ShortName, metrics)
+
+		tokens, err = r.SaveCache(c.Request.Context(), req.Prompt)
+	} else {
+		tokens, err = r.RestoreCache(c.Request.Context(), req.Prompt)
+	}
+
+	var serr api.StatusError
+	if errors.As(err, &serr) {
+		c.JSON(serr.StatusCode, gin.H{"error": serr.ErrorMessage})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.CacheResponse{
+		Model:         req.Model,
+		Tokens:        tokens,
+		TotalDuration: time.Since(checkpointStart),
+		LoadDuration:  checkpointLoaded.Sub(checkpointStart),
+	})
+}
+
+// removeCache deletes the prompts saved for a deleted model once a blob they
+// were saved with has been deleted too. Blobs shared with other models are
+// kept, along with the prompts saved for them.
+func removeCache(m *Model) error {
+	dir := llm.CacheDir(m.ModelPath, m.AdapterPaths, m.ProjectorPaths)
+	if _, err := os.Stat(m.ModelPath); errors.Is(err, os.ErrNotExist) {
+		// prompts saved with any adapters or projectors
+		return os.RemoveAll(filepath.Dir(dir))
+	}
+
+	for _, p := range slices.Concat(m.AdapterPaths, m.ProjectorPaths) {
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			return os.RemoveAll(dir)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qompassai/rose/llm"
+)
+
+func TestRemoveCache(t *testing.T) {
+	t.Setenv("ROSE_MODELS", t.TempDir())
+
+	blob := func(name string) string {
+		t.Helper()
+		p, err := GetBlobsPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	base := &Model{ModelPath: blob("sha256:" + strings.Repeat("a", 64))}
+	adapted := &Model{ModelPath: base.ModelPath, AdapterPaths: []string{blob("sha256:" + strings.Repeat("b", 64))}}
+
+	cacheDir := func(m *Model) string {
+		return filepath.Join(llm.CacheDir(m.ModelPath, m.AdapterPaths, m.ProjectorPaths), "rose-f16")
+	}
+
+	saved := func(m *Model) bool {
+		_, err := os.Stat(cacheDir(m))
+		return err == nil
+	}
+
+	for _, m := range []*Model{base, adapted} {
+		if err := os.MkdirAll(cacheDir(m), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if llm.CacheDir(base.ModelPath, nil, nil) == llm.CacheDir(adapted.ModelPath, adapted.AdapterPaths, nil) {
+		t.Fatal("expected models with different adapters to have different cache directories")
+	}
+
+	// the blobs are still used by other models
+	if err := removeCache(adapted); err != nil {
+		t.Fatal(err)
+	}
+
+	if !saved(base) || !saved(adapted) {
+		t.Fatal("expected saved prompts to be kept while their blobs exist")
+	}
+
+	if err := os.Remove(adapted.AdapterPaths[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeCache(adapted); err != nil {
+		t.Fatal(err)
+	}
+
+	if !saved(base) || saved(adapted) {
+		t.Errorf("expected only the prompts saved with the deleted adapter to be removed")
+	}
+
+	if err := os.Remove(base.ModelPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeCache(base); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Dir(llm.CacheDir(base.ModelPath, nil, nil))); !os.IsNotExist(err) {
+		t.Errorf("expected the model's cache directory to be removed, got %v", err)
+	}
+}
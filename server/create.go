@@ -129,7 +129,7 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		}
 
 		if err := createModel(r, name, baseLayers, fn); err != nil {
-			if errors.Is(err, errBadTemplate) {
+			if errors.Is(err, errBadTemplate) || errors.Is(err, errBadDraft) {
 				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
 				return
 			}
@@ -326,6 +326,7 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 	}
 
 	var layers []Layer
+	var kv ggml.KV
 	for _, layer := range baseLayers {
 		if layer.GGML != nil {
 			quantType := strings.ToUpper(cmp.Or(r.Quantize, r.Quantize))
@@ -350,10 +351,20 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 			config.ModelType = cmp.Or(config.ModelType, format.HumanNumber(layer.GGML.KV().ParameterCount()))
 			config.FileType = cmp.Or(config.FileType, layer.GGML.KV().FileType().String())
 			config.ModelFamilies = append(config.ModelFamilies, layer.GGML.KV().Architecture())
+			if layer.MediaType == "application/vnd.rose.image.model" && kv == nil {
+				kv = layer.GGML.KV()
+			}
 		}
 		layers = append(layers, layer.Layer)
 	}
 
+	if r.Draft != "" {
+		layers, err = setDraft(layers, r.Draft, kv)
+		if err != nil {
+			return err
+		}
+	}
+
 	if r.Template != "" {
 		layers, err = setTemplate(layers, r.Template)
 		if err != nil {
@@ -116,6 +116,7 @@ func (p *blobDownloadPart) StopsAt() int64 {
 func (p *blobDownloadPart) Write(b []byte) (n int, err error) {
 	n = len(b)
 	p.blobDownload.Completed.Add(int64(n))
+	metricPullBytes.add(float64(n))
 	p.lastUpdatedMu.Lock()
 	p.lastUpdated = time.Now()
 	p.lastUpdatedMu.Unlock()
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/qompassai/rose/fs/ggml"
+	"github.com/qompassai/rose/llm"
+	"github.com/qompassai/rose/types/model"
+)
+
+// errBadDraft is returned when a draft model can't be used with the model
+// it's meant to propose tokens for
+var errBadDraft = errors.New("invalid draft model")
+
+// draftLayer returns a layer sharing the weights of the named draft model so
+// that it can propose tokens for a model with the key values kv
+func draftLayer(name string, kv ggml.KV) (Layer, error) {
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		return Layer{}, fmt.Errorf("%w: %q is not a valid model name", errBadDraft, name)
+	}
+
+	m, err := ParseNamedManifest(n)
+	if errors.Is(err, os.ErrNotExist) {
+		return Layer{}, fmt.Errorf("%w: %q not found, try pulling it first", errBadDraft, name)
+	} else if err != nil {
+		return Layer{}, err
+	}
+
+	for _, layer := range m.Layers {
+		if layer.MediaType != "application/vnd.rose.image.model" {
+			continue
+		}
+
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return Layer{}, err
+		}
+
+		f, err := llm.LoadModel(blob, 0)
+		if err != nil {
+			return Layer{}, err
+		}
+
+		if err := checkDraftVocab(kv, f.KV()); err != nil {
+			return Layer{}, fmt.Errorf("%w: %q %w", errBadDraft, name, err)
+		}
+
+		return NewLayerFromLayer(layer.Digest, "application/vnd.rose.image.draft", n.DisplayShortest())
+	}
+
+	return Layer{}, fmt.Errorf("%w: %q has no weights", errBadDraft, name)
+}
+
+// checkDraftVocab checks that a draft model tokenizes text the same way as
+// the model it proposes tokens for. The runner compares the vocabularies
+// token by token once both are loaded.
+func checkDraftVocab(target, draft ggml.KV) error {
+	for _, key := range []string{"tokenizer.ggml.model", "tokenizer.ggml.pre"} {
+		if target.String(key) != draft.String(key) {
+			return errors.New("uses a different tokenizer")
+		}
+	}
+
+	return nil
+}
+
+// setDraft replaces the draft model of a model, if any, with the named model
+func setDraft(layers []Layer, name string, kv ggml.KV) ([]Layer, error) {
+	layers = removeLayer(layers, "application/vnd.rose.image.draft")
+
+	layer, err := draftLayer(name, kv)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(layers, layer), nil
+}
+
+// loadDraft sets the draft model of m to the named model for a single
+// request
+func loadDraft(m *Model, name string) error {
+	f, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		return err
+	}
+
+	layer, err := draftLayer(name, f.KV())
+	if err != nil {
+		return err
+	}
+
+	m.Draft = layer.From
+	m.DraftPath, err = GetBlobsPath(layer.Digest)
+	return err
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/qompassai/rose/fs/ggml"
+)
+
+func TestCheckDraftVocab(t *testing.T) {
+	target := ggml.KV{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.pre": "llama-bpe"}
+
+	cases := []struct {
+		name    string
+		draft   ggml.KV
+		wantErr bool
+	}{
+		{"same", ggml.KV{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.pre": "llama-bpe"}, false},
+		{"different model", ggml.KV{"tokenizer.ggml.model": "llama", "tokenizer.ggml.pre": "llama-bpe"}, true},
+		{"different pre", ggml.KV{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.pre": "qwen2"}, true},
+		{"missing", ggml.KV{}, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDraftVocab(target, tt.draft)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
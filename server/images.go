@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
@@ -35,6 +36,8 @@ var (
 	errCapabilityCompletion = errors.New("completion")
 	errCapabilityTools      = errors.New("tools")
 	errCapabilityInsert     = errors.New("insert")
+	errCapabilityThinking   = errors.New("thinking")
+	errCapabilityRerank     = errors.New("rerank")
 )
 
 type Capability string
@@ -43,6 +46,8 @@ const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
 	CapabilityInsert     = Capability("insert")
+	CapabilityThinking   = Capability("thinking")
+	CapabilityRerank     = Capability("rerank")
 )
 
 type registryOptions struct {
@@ -62,6 +67,8 @@ type Model struct {
 	ParentModel    string
 	AdapterPaths   []string
 	ProjectorPaths []string
+	Draft          string
+	DraftPath      string
 	System         string
 	License        []string
 	Digest         string
@@ -78,22 +85,22 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 	for _, cap := range caps {
 		switch cap {
 		case CapabilityCompletion:
-			r, err := os.Open(m.ModelPath)
+			kv, err := m.kv()
 			if err != nil {
-				slog.Error("couldn't open model file", "error", err)
 				continue
 			}
-			defer r.Close()
 
-			// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
-			f, _, err := ggml.Decode(r, 0)
+			if _, ok := kv[fmt.Sprintf("%s.pooling_type", kv.Architecture())]; ok {
+				errs = append(errs, errCapabilityCompletion)
+			}
+		case CapabilityRerank:
+			kv, err := m.kv()
 			if err != nil {
-				slog.Error("couldn't decode ggml", "error", err)
 				continue
 			}
 
-			if _, ok := f.KV()[fmt.Sprintf("%s.pooling_type", f.KV().Architecture())]; ok {
-				errs = append(errs, errCapabilityCompletion)
+			if kv.Uint("pooling_type") != poolingTypeRank {
+				errs = append(errs, errCapabilityRerank)
 			}
 		case CapabilityTools:
 			if !slices.Contains(m.Template.Vars(), "tools") {
@@ -104,6 +111,10 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 			if !slices.Contains(vars, "suffix") {
 				errs = append(errs, errCapabilityInsert)
 			}
+		case CapabilityThinking:
+			if open, _ := m.thinkingTags(); open == "" {
+				errs = append(errs, errCapabilityThinking)
+			}
 		default:
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
@@ -117,6 +128,29 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 	return nil
 }
 
+// poolingTypeRank is the pooling type of reranking models, which score a
+// query and document with a classification head
+const poolingTypeRank = 4
+
+// kv returns the key values of the model's weights
+func (m *Model) kv() (ggml.KV, error) {
+	r, err := os.Open(m.ModelPath)
+	if err != nil {
+		slog.Error("couldn't open model file", "error", err)
+		return nil, err
+	}
+	defer r.Close()
+
+	// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
+	f, _, err := ggml.Decode(r, 0)
+	if err != nil {
+		slog.Error("couldn't decode ggml", "error", err)
+		return nil, err
+	}
+
+	return f.KV(), nil
+}
+
 func (m *Model) String() string {
 	var modelfile parser.Modelfile
 
@@ -139,6 +173,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.Draft != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "draft",
+			Args: m.Draft,
+		})
+	}
+
 	if m.Template != nil {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "template",
@@ -162,6 +203,14 @@ func (m *Model) String() string {
 					Args: fmt.Sprintf("%v", s),
 				})
 			}
+		case map[string]any:
+			// token biases, written back as <id>:<bias>
+			for _, id := range slices.Sorted(maps.Keys(v)) {
+				modelfile.Commands = append(modelfile.Commands, parser.Command{
+					Name: k,
+					Args: fmt.Sprintf("%s:%v", id, v[id]),
+				})
+			}
 		default:
 			modelfile.Commands = append(modelfile.Commands, parser.Command{
 				Name: k,
@@ -276,6 +325,9 @@ func GetModel(name string) (*Model, error) {
 			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.rose.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
+		case "application/vnd.rose.image.draft":
+			model.Draft = layer.From
+			model.DraftPath = filename
 		case "application/vnd.rose.image.prompt",
 			"application/vnd.rose.image.template":
 			bts, err := os.ReadFile(filename)
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/anthropic"
+	"github.com/qompassai/rose/auth"
+	"github.com/qompassai/rose/openai"
+)
+
+var (
+	errAPIKeyRequired = errors.New("missing api key, send one in the Authorization header as a bearer token")
+	errAPIKeyInvalid  = errors.New("invalid api key")
+)
+
+// apiKey returns the API key sent with a request, either as a bearer token
+// or in the x-api-key header used by Anthropic clients
+func apiKey(r *http.Request) string {
+	if scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(key)
+	}
+
+	return r.Header.Get("x-api-key")
+}
+
+// authorize checks that a request has an API key with scope when the
+// server requires keys, returning the request with the key's ID in its
+// context, or the status to respond with if it does not
+func (s *Server) authorize(r *http.Request, scope auth.Scope) (*http.Request, int, error) {
+	if s.keys == nil {
+		return r, http.StatusOK, nil
+	}
+
+	if isBatchRequest(r.Context()) {
+		// requests in a batch were authorized when the batch was created,
+		// and carry the ID of the key that created it
+		return r, http.StatusOK, nil
+	}
+
+	secret := apiKey(r)
+	if secret == "" {
+		return nil, http.StatusUnauthorized, errAPIKeyRequired
+	}
+
+	key, ok := s.keys.Verify(secret)
+	if !ok {
+		return nil, http.StatusUnauthorized, errAPIKeyInvalid
+	}
+
+	if !key.Allows(scope) {
+		return nil, http.StatusForbidden, fmt.Errorf("api key %s does not have the %s scope", key.ID, scope)
+	}
+
+	return r.WithContext(auth.WithKeyID(r.Context(), key.ID)), http.StatusOK, nil
+}
+
+// writeAuthError writes an authorization error
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rose"`)
+	}
+
+	writeError(w, r, status, err)
+}
+
+// writeError writes an error in the format of the API a request was made
+// to, for errors returned before a request reaches its handler
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	var body any = gin.H{"error": err.Error()}
+	switch {
+	case r.URL.Path == "/v1/messages":
+		body = anthropic.NewError(status, err.Error())
+	case strings.HasPrefix(r.URL.Path, "/v1/"):
+		body = openai.NewError(status, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// requireScope is middleware that requires an API key with scope when the
+// server requires keys
+func (s *Server) requireScope(scope auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, status, err := s.authorize(c.Request, scope)
+		if err != nil {
+			writeAuthError(c.Writer, c.Request, status, err)
+			c.Abort()
+			return
+		}
+
+		c.Request = r
+		c.Next()
+	}
+}
+
+// requireScopeHandler requires an API key with scope for paths served by h,
+// for routes that are handled before the router
+func (s *Server) requireScopeHandler(h http.Handler, scope auth.Scope, paths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range paths {
+			if r.URL.Path != path {
+				continue
+			}
+
+			authorized, status, err := s.authorize(r, scope)
+			if err != nil {
+				writeAuthError(w, r, status, err)
+				return
+			}
+			r = authorized
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
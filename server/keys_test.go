@@ -0,0 +1,164 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/auth"
+	"github.com/qompassai/rose/server/internal/client/rose"
+)
+
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ROSE_MODELS", t.TempDir())
+
+	keys, err := auth.LoadAPIKeys(filepath.Join(t.TempDir(), "api_keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inference, _, err := keys.Create("inference", []auth.Scope{auth.ScopeInference})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, _, err := keys.Create("read", []auth.Scope{auth.ScopeModelRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write, _, err := keys.Create("write", []auth.Scope{auth.ScopeModelWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, _, err := keys.Create("admin", []auth.Scope{auth.ScopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{keys: keys}
+	router, err := s.GenerateRoutes(&rose.Registry{HTTPClient: panicOnRoundTrip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		status int
+		body   string
+	}{
+		{
+			name:   "version is public",
+			method: http.MethodGet,
+			path:   "/api/version",
+			status: http.StatusOK,
+		},
+		{
+			name:   "missing key",
+			method: http.MethodGet,
+			path:   "/api/tags",
+			status: http.StatusUnauthorized,
+			body:   `{"error":"missing api key, send one in the Authorization header as a bearer token"}`,
+		},
+		{
+			name:   "invalid key",
+			method: http.MethodGet,
+			path:   "/api/tags",
+			header: http.Header{"Authorization": {"Bearer rose_invalid"}},
+			status: http.StatusUnauthorized,
+			body:   `{"error":"invalid api key"}`,
+		},
+		{
+			name:   "missing scope",
+			method: http.MethodGet,
+			path:   "/api/tags",
+			header: http.Header{"Authorization": {"Bearer " + inference}},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "read scope",
+			method: http.MethodGet,
+			path:   "/api/tags",
+			header: http.Header{"Authorization": {"Bearer " + read}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "admin scope",
+			method: http.MethodGet,
+			path:   "/api/tags",
+			header: http.Header{"Authorization": {"bearer " + admin}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "openai error",
+			method: http.MethodGet,
+			path:   "/v1/models",
+			status: http.StatusUnauthorized,
+			body:   `{"error":{"message":"missing api key, send one in the Authorization header as a bearer token","type":"api_error","param":null,"code":null}}`,
+		},
+		{
+			name:   "anthropic key header",
+			method: http.MethodGet,
+			path:   "/v1/models",
+			header: http.Header{"X-Api-Key": {read}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "inference scope",
+			method: http.MethodPost,
+			path:   "/api/cancel",
+			header: http.Header{"Authorization": {"Bearer " + inference}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "registry route without scope",
+			method: http.MethodDelete,
+			path:   "/api/delete",
+			header: http.Header{"Authorization": {"Bearer " + read}},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "registry route with scope",
+			method: http.MethodDelete,
+			path:   "/api/delete",
+			header: http.Header{"Authorization": {"Bearer " + write}},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header")
+			}
+
+			if tt.body != "" {
+				if got, _ := io.ReadAll(w.Body); strings.TrimSpace(string(got)) != tt.body {
+					t.Errorf("expected body %s, got %s", tt.body, got)
+				}
+			}
+		})
+	}
+}
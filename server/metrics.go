@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+)
+
+// metric is a Prometheus counter, gauge or histogram, with a series for
+// each combination of label values
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// counts are the number of observations in each bucket of a histogram,
+	// not including those in lower buckets
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(kind, name, help string, buckets []float64, labels []string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	if len(labels) == 0 {
+		// metrics without labels are reported before they are first set
+		m.get()
+	}
+
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, nil, labels)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric("gauge", name, help, nil, labels)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric("histogram", name, help, buckets, labels)
+}
+
+// get returns the series for label values, creating it if needed. It must
+// be called with mu held or before the metric is shared.
+func (m *metric) get(values ...string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", m.name, len(m.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add increases a counter or gauge
+func (m *metric) add(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values...).value += v
+}
+
+// set sets a gauge
+func (m *metric) set(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values...).value = v
+}
+
+// reset removes every series of a gauge, for gauges that are set each
+// time metrics are collected
+func (m *metric) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.series)
+}
+
+// observe adds an observation to a histogram
+func (m *metric) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.get(values...)
+	if i, _ := slices.BinarySearch(m.buckets, v); i < len(m.buckets) {
+		s.counts[i]++
+	}
+	s.value += v
+	s.count++
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label names and values, along with any extra pairs
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i := range names {
+		pairs = append(pairs, names[i]+`="`+labelValueReplacer.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelValueReplacer.Replace(extra[i+1])+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes a metric in the Prometheus text format
+func (m *metric) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(&b, "%s%s %s\n", m.name, formatLabels(m.labels, s.values), formatFloat(s.value))
+			continue
+		}
+
+		var count uint64
+		for i, le := range m.buckets {
+			count += s.counts[i]
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.values, "le", formatFloat(le)), count)
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.values), formatFloat(s.value))
+		fmt.Fprintf(&b, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.values), s.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var (
+	secondsBuckets         = []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+	tokensPerSecondBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+	metricQueueDepth            = newGauge("rose_scheduler_queue_depth", "Number of requests waiting for the scheduler.")
+	metricQueueWait             = newHistogram("rose_scheduler_wait_seconds", "Time requests waited for a runner, including loading its model.", secondsBuckets, "model")
+	metricRunnersLoaded         = newGauge("rose_runners_loaded", "Number of runners loaded.")
+	metricRunnerVRAM            = newGauge("rose_runner_vram_bytes", "Estimated VRAM used by a loaded runner.", "model")
+	metricModelLoad             = newHistogram("rose_model_load_duration_seconds", "Time taken to load a model.", secondsBuckets, "model")
+	metricRequests              = newCounter("rose_requests_total", "Number of generate, chat and embed requests.", "model", "endpoint")
+	metricRequestErrors         = newCounter("rose_request_errors_total", "Number of generate, chat and embed requests that failed.", "model", "endpoint")
+	metricPromptTokens          = newCounter("rose_prompt_tokens_total", "Number of prompt tokens evaluated.", "model")
+	metricEvalTokens            = newCounter("rose_eval_tokens_total", "Number of tokens generated.", "model")
+	metricPromptTokensPerSecond = newHistogram("rose_prompt_tokens_per_second", "Rate prompts were evaluated at.", tokensPerSecondBuckets, "model")
+	metricEvalTokensPerSecond   = newHistogram("rose_eval_tokens_per_second", "Rate tokens were generated at.", tokensPerSecondBuckets, "model")
+	metricPullBytes             = newCounter("rose_pull_bytes_total", "Number of bytes downloaded pulling models.")
+	metricPushBytes             = newCounter("rose_push_bytes_total", "Number of bytes uploaded pushing models.")
+
+	allMetrics = []*metric{
+		metricQueueDepth,
+		metricQueueWait,
+		metricRunnersLoaded,
+		metricRunnerVRAM,
+		metricModelLoad,
+		metricRequests,
+		metricRequestErrors,
+		metricPromptTokens,
+		metricEvalTokens,
+		metricPromptTokensPerSecond,
+		metricEvalTokensPerSecond,
+		metricPullBytes,
+		metricPushBytes,
+	}
+)
+
+type requestMetricsKey struct{}
+
+// requestMetrics are the labels of a request, filled in as it is handled
+type requestMetrics struct {
+	mu     sync.Mutex
+	model  string
+	err    bool
+	tokens int
+}
+
+func requestMetricsFromContext(ctx context.Context) *requestMetrics {
+	rm, _ := ctx.Value(requestMetricsKey{}).(*requestMetrics)
+	return rm
+}
+
+// setModel records the model a request is for
+func (rm *requestMetrics) setModel(model string) {
+	if rm == nil {
+		return
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.model = model
+}
+
+// setError records that a request failed after its response started
+func (rm *requestMetrics) setError() {
+	if rm == nil {
+		return
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.err = true
+}
+
+// addTokens records tokens evaluated or generated for a request
+func (rm *requestMetrics) addTokens(n int) {
+	if rm == nil {
+		return
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.tokens += n
+}
+
+// observeRequest is middleware that counts requests and their errors for
+// each model and endpoint
+func observeRequest(c *gin.Context) {
+	rm := &requestMetrics{}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestMetricsKey{}, rm))
+	c.Next()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	metricRequests.add(1, rm.model, c.FullPath())
+	if rm.err || c.Writer.Status() >= http.StatusBadRequest {
+		metricRequestErrors.add(1, rm.model, c.FullPath())
+	}
+}
+
+// observeTokens records the tokens evaluated and generated for a request
+func observeTokens(ctx context.Context, model string, m api.Metrics) {
+	requestMetricsFromContext(ctx).addTokens(m.PromptEvalCount + m.EvalCount)
+
+	metricPromptTokens.add(float64(m.PromptEvalCount), model)
+	metricEvalTokens.add(float64(m.EvalCount), model)
+
+	if m.PromptEvalCount > 0 && m.PromptEvalDuration > 0 {
+		metricPromptTokensPerSecond.observe(float64(m.PromptEvalCount)/m.PromptEvalDuration.Seconds(), model)
+	}
+
+	if m.EvalCount > 0 && m.EvalDuration > 0 {
+		metricEvalTokensPerSecond.observe(float64(m.EvalCount)/m.EvalDuration.Seconds(), model)
+	}
+}
+
+// observeSince records the seconds since start in a histogram
+func observeSince(m *metric, start time.Time, values ...string) {
+	m.observe(time.Since(start).Seconds(), values...)
+}
+
+func (s *Server) MetricsHandler(c *gin.Context) {
+	metricQueueDepth.set(float64(s.sched.queueDepth()))
+
+	s.sched.loadedMu.Lock()
+	metricRunnersLoaded.set(float64(len(s.sched.loaded)))
+	metricRunnerVRAM.reset()
+	for _, runner := range s.sched.loaded {
+		if runner.model != nil {
+			metricRunnerVRAM.set(float64(runner.estimatedVRAM), runner.model.ShortName)
+		}
+	}
+	s.sched.loadedMu.Unlock()
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	for _, m := range allMetrics {
+		if err := m.write(c.Writer); err != nil {
+			return
+		}
+	}
+}
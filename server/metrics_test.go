@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetricWrite(t *testing.T) {
+	cases := []struct {
+		name   string
+		metric func() *metric
+		want   string
+	}{
+		{
+			name: "counter",
+			metric: func() *metric {
+				m := newCounter("test_total", "A counter.")
+				m.add(1)
+				m.add(2)
+				return m
+			},
+			want: `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+`,
+		},
+		{
+			name: "gauge with labels",
+			metric: func() *metric {
+				m := newGauge("test_bytes", "A gauge.", "model")
+				m.set(10, "b")
+				m.set(20, `a"\`+"\n")
+				m.set(30, "b")
+				return m
+			},
+			want: `# HELP test_bytes A gauge.
+# TYPE test_bytes gauge
+test_bytes{model="a\"\\\n"} 20
+test_bytes{model="b"} 30
+`,
+		},
+		{
+			name: "histogram",
+			metric: func() *metric {
+				m := newHistogram("test_seconds", "A histogram.", []float64{0.5, 1, 5}, "model")
+				m.observe(0.1, "a")
+				m.observe(1, "a")
+				m.observe(2.5, "a")
+				m.observe(10, "a")
+				return m
+			},
+			want: `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{model="a",le="0.5"} 1
+test_seconds_bucket{model="a",le="1"} 2
+test_seconds_bucket{model="a",le="5"} 3
+test_seconds_bucket{model="a",le="+Inf"} 4
+test_seconds_sum{model="a"} 13.6
+test_seconds_count{model="a"} 4
+`,
+		},
+		{
+			name: "reset",
+			metric: func() *metric {
+				m := newGauge("test_runners", "A gauge.", "model")
+				m.set(1, "a")
+				m.reset()
+				m.set(2, "b")
+				return m
+			},
+			want: `# HELP test_runners A gauge.
+# TYPE test_runners gauge
+test_runners{model="b"} 2
+`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := tt.metric().write(&b); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, b.String()); diff != "" {
+				t.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestObserveRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.POST("/test/:status", observeRequest, func(c *gin.Context) {
+		rm := requestMetricsFromContext(c.Request.Context())
+		rm.setModel("test-observe")
+
+		switch c.Param("status") {
+		case "stream-error":
+			// errors while streaming are sent after a 200 status
+			streamResponse(c, func() chan any {
+				ch := make(chan any, 1)
+				ch <- gin.H{"error": "failed"}
+				close(ch)
+				return ch
+			}())
+		case "error":
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed"})
+		default:
+			c.Status(http.StatusOK)
+		}
+	})
+
+	for _, status := range []string{"ok", "ok", "error", "stream-error"} {
+		r.ServeHTTP(NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/"+status, nil))
+	}
+
+	get := func(m *metric) float64 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.get("test-observe", "/test/:status").value
+	}
+
+	if got := get(metricRequests); got != 4 {
+		t.Errorf("expected 4 requests, got %v", got)
+	}
+
+	if got := get(metricRequestErrors); got != 2 {
+		t.Errorf("expected 2 errors, got %v", got)
+	}
+}
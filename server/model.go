@@ -44,7 +44,13 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	}
 
 	for _, layer := range m.Layers {
-		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, name.DisplayShortest())
+		from := name.DisplayShortest()
+		if layer.MediaType == "application/vnd.rose.image.draft" {
+			// keep the name of the draft model rather than the model using it
+			from = layer.From
+		}
+
+		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, from)
 		if err != nil {
 			return nil, err
 		}
@@ -153,9 +159,9 @@ func parseObjects(s string) []map[string]any {
 	return objs
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
-// mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+// toolCallKeys returns the keys holding the function name and arguments of
+// tool calls rendered by the model's template
+func (m *Model) toolCallKeys() (name, arguments string, ok bool) {
 	// create a subtree from the node that ranges over .ToolCalls
 	tmpl := m.Template.Subtree(func(n parse.Node) bool {
 		if t, ok := n.(*parse.RangeNode); ok {
@@ -166,7 +172,7 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	})
 
 	if tmpl == nil {
-		return nil, false
+		return "", "", false
 	}
 
 	var b bytes.Buffer
@@ -182,16 +188,15 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 			},
 		},
 	}); err != nil {
-		return nil, false
+		return "", "", false
 	}
 
 	templateObjects := parseObjects(b.String())
 	if len(templateObjects) == 0 {
-		return nil, false
+		return "", "", false
 	}
 
 	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
 	for k, v := range templateObjects[0] {
 		switch v.(type) {
 		case string:
@@ -202,6 +207,111 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	}
 
 	if name == "" || arguments == "" {
+		return "", "", false
+	}
+
+	return name, arguments, true
+}
+
+// toolCallSchema returns a JSON schema matching calls to tools in the format
+// the model's template renders them. Unless parallel is set, it matches a
+// single call rather than an array of calls.
+func (m *Model) toolCallSchema(tools []api.Tool, parallel bool) (json.RawMessage, error) {
+	name, arguments, ok := m.toolCallKeys()
+	if !ok {
+		return nil, errors.New("model template does not support constrained tool calls")
+	}
+
+	nameKey, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+
+	argumentsKey, err := json.Marshal(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	calls := make([]json.RawMessage, 0, len(tools))
+	for _, tool := range tools {
+		properties := make(map[string]any, len(tool.Function.Parameters.Properties))
+		for k, p := range tool.Function.Parameters.Properties {
+			property := make(map[string]any)
+			if p.Type != "" {
+				property["type"] = p.Type
+			}
+			if len(p.Enum) > 0 {
+				property["enum"] = p.Enum
+			}
+			// nested schemas are passed through as they are, so that
+			// objects and arrays are constrained all the way down
+			if len(p.Items) > 0 {
+				property["items"] = p.Items
+			}
+			if len(p.Properties) > 0 {
+				property["properties"] = p.Properties
+			}
+			if len(p.Required) > 0 {
+				property["required"] = p.Required
+			}
+			if len(p.AnyOf) > 0 {
+				property["anyOf"] = p.AnyOf
+			}
+			properties[k] = property
+		}
+
+		parameters := map[string]any{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(tool.Function.Parameters.Required) > 0 {
+			parameters["required"] = tool.Function.Parameters.Required
+		}
+
+		function, err := json.Marshal(map[string]any{"const": tool.Function.Name})
+		if err != nil {
+			return nil, err
+		}
+
+		params, err := json.Marshal(parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		// built by hand so the name comes before the arguments, as
+		// models write them
+		calls = append(calls, json.RawMessage(fmt.Sprintf(
+			`{"type":"object","properties":{%s:%s,%s:%s},"required":[%s,%s]}`,
+			nameKey, function, argumentsKey, params, nameKey, argumentsKey,
+		)))
+	}
+
+	var call json.RawMessage
+	if len(calls) == 1 {
+		call = calls[0]
+	} else {
+		call, err = json.Marshal(map[string]any{"anyOf": calls})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !parallel {
+		return call, nil
+	}
+
+	return json.Marshal(map[string]any{
+		"type":     "array",
+		"items":    call,
+		"minItems": 1,
+	})
+}
+
+// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
+// mxyng: this only really works if the input contains tool calls in some JSON format
+func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+	name, arguments, ok := m.toolCallKeys()
+	if !ok {
 		return nil, false
 	}
 
@@ -13,6 +13,7 @@ import (
 	"github.com/qompassai/rose/llm"
 	"github.com/qompassai/rose/model/models/mllama"
 	"github.com/qompassai/rose/template"
+	"github.com/qompassai/rose/tracing"
 )
 
 type tokenizeFunc func(context.Context, string) ([]int, error)
@@ -21,10 +22,19 @@ var errTooManyImages = errors.New("vision model only supports a single image per
 
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
+// latest message and 2) system messages. think is passed to the template to turn thinking on or off when it is set
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, think *bool) (prompt string, images []llm.ImageData, err error) {
+	ctx, span := tracing.Start(ctx, "chatPrompt", tracing.Attr("messages", len(msgs)))
+	defer func() { span.End(err) }()
+
 	var system []api.Message
 
+	values := template.Values{Tools: tools}
+	if think != nil {
+		values.Think = *think
+		values.IsThinkSet = true
+	}
+
 	isMllama := checkMllamaModelFamily(m)
 
 	var imageNumTokens int
@@ -57,7 +67,8 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		}
 
 		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools}); err != nil {
+		values.Messages = append(system, msgs[i:]...)
+		if err := m.Template.Execute(&b, values); err != nil {
 			return "", nil, err
 		}
 
@@ -82,6 +93,7 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 	}
 
 	currMsgIdx := n
+	span.SetAttributes(tracing.Attr("messages.truncated", currMsgIdx))
 
 	for cnt, msg := range msgs[currMsgIdx:] {
 		prefix := ""
@@ -142,7 +154,8 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 
 	// truncate any messages that do not fit into the context window
 	var b bytes.Buffer
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[currMsgIdx:]...), Tools: tools}); err != nil {
+	values.Messages = append(system, msgs[currMsgIdx:]...)
+	if err := m.Template.Execute(&b, values); err != nil {
 		return "", nil, err
 	}
 
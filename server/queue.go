@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/qompassai/rose/envconfig"
+	"github.com/qompassai/rose/llm"
+)
+
+// priorityHeader sets the priority of a request, for clients that cannot
+// set the priority field, such as OpenAI clients
+const priorityHeader = "X-Rose-Priority"
+
+// priority is how soon a request is scheduled relative to others
+type priority int
+
+const (
+	priorityInteractive priority = iota
+	priorityBatch
+)
+
+// priorityWeights are the shares of the scheduler each priority gets. Each
+// client waiting with an interactive request is scheduled 8 times as often
+// as each client waiting with a batch request.
+var priorityWeights = [...]float64{
+	priorityInteractive: 8,
+	priorityBatch:       1,
+}
+
+func parsePriority(s string) (priority, error) {
+	switch s {
+	case "", "interactive":
+		return priorityInteractive, nil
+	case "batch":
+		return priorityBatch, nil
+	default:
+		return 0, fmt.Errorf("invalid priority %q, must be interactive or batch", s)
+	}
+}
+
+func (p priority) String() string {
+	if p == priorityBatch {
+		return "batch"
+	}
+	return "interactive"
+}
+
+type (
+	priorityKey struct{}
+	clientKey   struct{}
+)
+
+func withPriority(ctx context.Context, p priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFromContext returns the priority of a request. Requests from
+// batches are always batch priority.
+func priorityFromContext(ctx context.Context) priority {
+	if isBatchRequest(ctx) {
+		return priorityBatch
+	}
+
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+
+	return priorityInteractive
+}
+
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// prioritize is middleware that records the client making a request, and
+// the priority in its header if it has one
+func prioritize(c *gin.Context) {
+	ctx := context.WithValue(c.Request.Context(), clientKey{}, clientIdentity(c, envconfig.RateLimitHeader()))
+
+	if h := c.GetHeader(priorityHeader); h != "" {
+		p, err := parsePriority(h)
+		if err != nil {
+			writeError(c.Writer, c.Request, http.StatusBadRequest, err)
+			c.Abort()
+			return
+		}
+
+		ctx = withPriority(ctx, p)
+	}
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// setPriority sets the priority of a request from its priority field, which
+// takes precedence over its header
+func setPriority(c *gin.Context, s string) error {
+	if s == "" {
+		return nil
+	}
+
+	p, err := parsePriority(s)
+	if err != nil {
+		return err
+	}
+
+	c.Request = c.Request.WithContext(withPriority(c.Request.Context(), p))
+	return nil
+}
+
+// flowKey identifies the requests from a client at a priority, which are
+// scheduled in the order they arrive
+type flowKey struct {
+	priority priority
+	client   string
+}
+
+// queued is a request that can wait in a fairQueue
+type queued interface {
+	comparable
+	flowKey() flowKey
+}
+
+type queuedRequest[T queued] struct {
+	req T
+	// start is the virtual time the request's share of the scheduler
+	// starts at
+	start float64
+	seq   uint64
+}
+
+type flow[T queued] struct {
+	requests []queuedRequest[T]
+	// finish is the virtual time the flow's last request's share ends at
+	finish float64
+}
+
+// fairQueue holds requests waiting to be scheduled, and picks the next
+// one by weighted fair share using start-time fair queuing. Each request
+// uses a share of virtual time inversely proportional to the weight of its
+// priority, so clients with many requests waiting cannot hold up those
+// with few. The zero value is an empty queue.
+type fairQueue[T queued] struct {
+	mu    sync.Mutex
+	flows map[flowKey]*flow[T]
+	// now is the virtual time of the last request picked
+	now float64
+	seq uint64
+	n   int
+}
+
+func (q *fairQueue[T]) push(req T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.flows == nil {
+		q.flows = make(map[flowKey]*flow[T])
+	}
+
+	key := req.flowKey()
+	f, ok := q.flows[key]
+	if !ok {
+		// clients that were not waiting start from now, rather than
+		// having credit for the time they were idle
+		f = &flow[T]{finish: q.now}
+		q.flows[key] = f
+	}
+
+	start := max(q.now, f.finish)
+	f.finish = start + 1/priorityWeights[key.priority]
+
+	q.seq++
+	f.requests = append(f.requests, queuedRequest[T]{req: req, start: start, seq: q.seq})
+	q.n++
+}
+
+// pop returns the waiting request with the earliest start, preferring
+// higher priorities and then earlier requests, or the zero value if none
+// are waiting
+func (q *fairQueue[T]) pop() T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next flowKey
+	var best *queuedRequest[T]
+	for key, f := range q.flows {
+		r := &f.requests[0]
+		if best == nil ||
+			r.start < best.start ||
+			r.start == best.start && (key.priority < next.priority || key.priority == next.priority && r.seq < best.seq) {
+			next, best = key, r
+		}
+	}
+
+	if best == nil {
+		var zero T
+		return zero
+	}
+
+	req := best.req
+	q.now = best.start
+
+	f := q.flows[next]
+	f.requests = f.requests[1:]
+	if len(f.requests) == 0 {
+		delete(q.flows, next)
+	}
+	q.n--
+
+	return req
+}
+
+// remove takes a request out of the queue if it is waiting, e.g. because
+// its client stopped waiting for it
+func (q *fairQueue[T]) remove(req T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := req.flowKey()
+	f, ok := q.flows[key]
+	if !ok {
+		return
+	}
+
+	i := slices.IndexFunc(f.requests, func(r queuedRequest[T]) bool { return r.req == req })
+	if i < 0 {
+		return
+	}
+
+	f.requests = slices.Delete(f.requests, i, i+1)
+	if len(f.requests) == 0 {
+		delete(q.flows, key)
+	}
+	q.n--
+}
+
+// Len returns the number of requests waiting
+func (q *fairQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// slotRequest is a request waiting for one of a runner's slots
+type slotRequest struct {
+	priority priority
+	client   string
+	// ready is closed when the request gets a slot
+	ready chan struct{}
+}
+
+func (r *slotRequest) flowKey() flowKey {
+	return flowKey{r.priority, r.client}
+}
+
+// runnerSlots gives out the parallel slots of a loaded runner. Requests
+// waiting for a slot are picked by weighted fair share in the same way as
+// those waiting for the scheduler, so an interactive request overtakes
+// batch priority requests already waiting for the runner.
+type runnerSlots struct {
+	mu      sync.Mutex
+	free    int
+	waiting fairQueue[*slotRequest]
+}
+
+func newRunnerSlots(n int) *runnerSlots {
+	return &runnerSlots{free: max(n, 1)}
+}
+
+// acquire waits for a slot for the request made with ctx, and returns a
+// function that releases it
+func (s *runnerSlots) acquire(ctx context.Context) (func(), error) {
+	req := &slotRequest{
+		priority: priorityFromContext(ctx),
+		client:   clientFromContext(ctx),
+		ready:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.waiting.push(req)
+	s.grant()
+	s.mu.Unlock()
+
+	release := sync.OnceFunc(s.release)
+
+	// a free slot is taken even if ctx is done, as the request did not wait
+	select {
+	case <-req.ready:
+		return release, nil
+	default:
+	}
+
+	select {
+	case <-req.ready:
+		return release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-req.ready:
+			// the request got a slot as it stopped waiting
+			s.mu.Unlock()
+			s.release()
+		default:
+			s.waiting.remove(req)
+			s.mu.Unlock()
+		}
+
+		return nil, context.Cause(ctx)
+	}
+}
+
+func (s *runnerSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.free++
+	s.grant()
+}
+
+// grant gives free slots to waiting requests. s.mu must be held.
+func (s *runnerSlots) grant() {
+	for s.free > 0 {
+		req := s.waiting.pop()
+		if req == nil {
+			return
+		}
+
+		s.free--
+		close(req.ready)
+	}
+}
+
+// slotRunner is the runner of a request that holds one of its slots. It
+// limits the calls the request makes at once, such as to embed each of its
+// inputs, to the runner's parallel slots.
+type slotRunner struct {
+	llm.LlamaServer
+	calls *semaphore.Weighted
+}
+
+func newSlotRunner(runner *runnerRef) *slotRunner {
+	return &slotRunner{
+		LlamaServer: runner.llama,
+		calls:       semaphore.NewWeighted(int64(max(runner.numParallel, 1))),
+	}
+}
+
+func (r *slotRunner) Embedding(ctx context.Context, input string) ([]float32, error) {
+	if err := r.calls.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	defer r.calls.Release(1)
+
+	return r.LlamaServer.Embedding(ctx, input)
+}
+
+func (r *slotRunner) Rerank(ctx context.Context, query, document string) (float32, error) {
+	if err := r.calls.Acquire(ctx, 1); err != nil {
+		return 0, err
+	}
+	defer r.calls.Release(1)
+
+	return r.LlamaServer.Rerank(ctx, query, document)
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFairQueue(t *testing.T) {
+	newRequest := func(client string, p priority) *LlmRequest {
+		return &LlmRequest{client: client, priority: p}
+	}
+
+	order := func(q *fairQueue[*LlmRequest], n int) []string {
+		var got []string
+		for range n {
+			req := q.pop()
+			if req == nil {
+				break
+			}
+			got = append(got, req.client+"/"+req.priority.String())
+		}
+		return got
+	}
+
+	t.Run("clients take turns", func(t *testing.T) {
+		var q fairQueue[*LlmRequest]
+		for _, client := range []string{"a", "a", "a", "b", "b", "c"} {
+			q.push(newRequest(client, priorityInteractive))
+		}
+
+		want := []string{"a/interactive", "b/interactive", "c/interactive", "a/interactive", "b/interactive", "a/interactive"}
+		if diff := cmp.Diff(want, order(&q, 10)); diff != "" {
+			t.Errorf("order mismatch (-want +got):\n%s", diff)
+		}
+
+		if q.Len() != 0 {
+			t.Errorf("expected empty queue, got %d", q.Len())
+		}
+	})
+
+	t.Run("interactive ahead of batch", func(t *testing.T) {
+		var q fairQueue[*LlmRequest]
+		for range 20 {
+			q.push(newRequest("a", priorityBatch))
+		}
+
+		if diff := cmp.Diff([]string{"a/batch", "a/batch"}, order(&q, 2)); diff != "" {
+			t.Errorf("order mismatch (-want +got):\n%s", diff)
+		}
+
+		// a request arriving behind a flood of batch requests is next
+		q.push(newRequest("b", priorityInteractive))
+		if diff := cmp.Diff([]string{"b/interactive", "a/batch"}, order(&q, 2)); diff != "" {
+			t.Errorf("order mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("weighted share", func(t *testing.T) {
+		var q fairQueue[*LlmRequest]
+		for range 20 {
+			q.push(newRequest("a", priorityBatch))
+			q.push(newRequest("b", priorityInteractive))
+		}
+
+		// batch requests still make progress, at a lower share
+		counts := make(map[string]int)
+		for _, s := range order(&q, 18) {
+			counts[s]++
+		}
+
+		if diff := cmp.Diff(map[string]int{"a/batch": 2, "b/interactive": 16}, counts); diff != "" {
+			t.Errorf("share mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		var q fairQueue[*LlmRequest]
+		a, b := newRequest("a", priorityInteractive), newRequest("a", priorityInteractive)
+		q.push(a)
+		q.push(b)
+
+		q.remove(a)
+		q.remove(a)
+		if q.Len() != 1 {
+			t.Fatalf("expected 1 request, got %d", q.Len())
+		}
+
+		if req := q.pop(); req != b {
+			t.Errorf("expected remaining request, got %v", req)
+		}
+
+		q.remove(b)
+		if q.Len() != 0 {
+			t.Errorf("expected empty queue, got %d", q.Len())
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var q fairQueue[*LlmRequest]
+		if req := q.pop(); req != nil {
+			t.Errorf("expected no request, got %v", req)
+		}
+	})
+}
+
+func TestRunnerSlots(t *testing.T) {
+	requestContext := func(client string, p priority) context.Context {
+		return withPriority(context.WithValue(t.Context(), clientKey{}, client), p)
+	}
+
+	// acquire waits for a slot of a loaded runner in the background, and
+	// sends name once it has one, releasing it when ctx is done
+	acquire := func(ctx context.Context, runner *runnerRef, name string, got chan<- string) {
+		go func() {
+			release, err := runner.acquireSlot(ctx)
+			if err != nil {
+				got <- name + ": " + err.Error()
+				return
+			}
+			context.AfterFunc(ctx, release)
+			got <- name
+		}()
+	}
+
+	waiting := func(t *testing.T, runner *runnerRef, n int) {
+		t.Helper()
+		for range 100 {
+			runner.refMu.Lock()
+			slots := runner.slots
+			runner.refMu.Unlock()
+
+			if slots != nil && slots.waiting.Len() == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d requests waiting for a slot", n)
+	}
+
+	next := func(t *testing.T, got <-chan string) string {
+		t.Helper()
+		select {
+		case name := <-got:
+			return name
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a slot")
+			return ""
+		}
+	}
+
+	t.Run("interactive overtakes batch", func(t *testing.T) {
+		runner := &runnerRef{llama: &mockLlm{}, numParallel: 1}
+		got := make(chan string, 10)
+
+		running, stop := context.WithCancel(requestContext("a", priorityInteractive))
+		acquire(running, runner, "running", got)
+		if name := next(t, got); name != "running" {
+			t.Fatalf("expected running to have a slot, got %s", name)
+		}
+
+		for range 3 {
+			acquire(requestContext("b", priorityBatch), runner, "b/batch", got)
+		}
+		waiting(t, runner, 3)
+
+		acquire(requestContext("c", priorityInteractive), runner, "c/interactive", got)
+		waiting(t, runner, 4)
+
+		stop()
+		if name := next(t, got); name != "c/interactive" {
+			t.Errorf("expected c/interactive to have the next slot, got %s", name)
+		}
+	})
+
+	t.Run("batches share a busy runner", func(t *testing.T) {
+		runner := &runnerRef{llama: &mockLlm{}, numParallel: 1}
+		got := make(chan string, 10)
+
+		running, stop := context.WithCancel(requestContext("a", priorityInteractive))
+		acquire(running, runner, "running", got)
+		if name := next(t, got); name != "running" {
+			t.Fatalf("expected running to have a slot, got %s", name)
+		}
+
+		// requests from batches are batch priority, whatever they set
+		stops := make(map[string]context.CancelFunc)
+		for i, name := range []string{"a/interactive 1", "a/interactive 2", "a/interactive 3", "batch"} {
+			ctx := requestContext("a", priorityInteractive)
+			if name == "batch" {
+				ctx = withBatchPriority(requestContext("b", priorityInteractive))
+			}
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			stops[name] = cancel
+
+			acquire(ctx, runner, name, got)
+			waiting(t, runner, i+1)
+		}
+
+		// the batch gets its share of slots while interactive requests are
+		// waiting, rather than when the runner is idle
+		stop()
+		var order []string
+		for range 4 {
+			name := next(t, got)
+			order = append(order, name)
+			stops[name]()
+		}
+
+		if diff := cmp.Diff([]string{"a/interactive 1", "batch", "a/interactive 2", "a/interactive 3"}, order); diff != "" {
+			t.Errorf("slot order mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		runner := &runnerRef{llama: &mockLlm{}, numParallel: 1}
+		release, err := runner.acquireSlot(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		if _, err := runner.acquireSlot(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context canceled, got %v", err)
+		}
+
+		release()
+		if _, err := runner.acquireSlot(ctx); err != nil {
+			t.Errorf("expected a free slot after release, got %v", err)
+		}
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		runner := &runnerRef{llama: &mockLlm{}, numParallel: 1}
+		if _, err := runner.acquireSlot(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeoutCause(t.Context(), 10*time.Millisecond, errQueueTimeout)
+		defer cancel()
+		if _, err := runner.acquireSlot(ctx); !errors.Is(err, errQueueTimeout) {
+			t.Errorf("expected queue timeout, got %v", err)
+		}
+	})
+}
+
+func TestPrioritize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name   string
+		header string
+		body   string
+		status int
+		want   string
+	}{
+		{"default", "", `{}`, http.StatusOK, "interactive"},
+		{"header", "batch", `{}`, http.StatusOK, "batch"},
+		{"field", "", `{"priority":"batch"}`, http.StatusOK, "batch"},
+		{"field overrides header", "batch", `{"priority":"interactive"}`, http.StatusOK, "interactive"},
+		{"invalid header", "urgent", `{}`, http.StatusBadRequest, `{"error":"invalid priority \"urgent\", must be interactive or batch"}`},
+		{"invalid field", "", `{"priority":"urgent"}`, http.StatusBadRequest, `{"error":"invalid priority \"urgent\", must be interactive or batch"}`},
+	}
+
+	r := gin.New()
+	r.POST("/test", prioritize, func(c *gin.Context) {
+		var req struct {
+			Priority string `json:"priority"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := setPriority(c, req.Priority); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if client := clientFromContext(c.Request.Context()); client != "192.0.2.1" {
+			t.Errorf("expected client 192.0.2.1, got %q", client)
+		}
+
+		c.String(http.StatusOK, priorityFromContext(c.Request.Context()).String())
+	})
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set(priorityHeader, tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/auth"
+)
+
+// bucket is a token bucket that refills at a constant rate up to its
+// capacity. Its level can go below zero when more is spent than was
+// available, e.g. tokens counted after a request completes.
+type bucket struct {
+	capacity float64
+	// rate is how much the bucket refills each second
+	rate    float64
+	level   float64
+	updated time.Time
+}
+
+func newBucket(capacity float64, per time.Duration, now time.Time) bucket {
+	return bucket{
+		capacity: capacity,
+		rate:     capacity / per.Seconds(),
+		level:    capacity,
+		updated:  now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.updated) {
+		b.level = min(b.capacity, b.level+now.Sub(b.updated).Seconds()*b.rate)
+		b.updated = now
+	}
+}
+
+// wait returns how long until the bucket has at least n available
+func (b *bucket) wait(n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.level) / b.rate * float64(time.Second))
+}
+
+// reset returns how long until the bucket is full
+func (b *bucket) reset() time.Duration {
+	return b.wait(b.capacity)
+}
+
+// clientLimits are the buckets of a client. A nil bucket is unlimited.
+type clientLimits struct {
+	requests *bucket
+	tokens   *bucket
+}
+
+func (cl *clientLimits) refill(now time.Time) {
+	for _, b := range []*bucket{cl.requests, cl.tokens} {
+		if b != nil {
+			b.refill(now)
+		}
+	}
+}
+
+// full reports whether a client's buckets are full, which is the same as
+// a client that has not made any requests
+func (cl *clientLimits) full() bool {
+	for _, b := range []*bucket{cl.requests, cl.tokens} {
+		if b != nil && b.reset() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rateLimiter limits the requests per minute and tokens per day of each
+// client, identified by their API key, a request header or their IP address
+type rateLimiter struct {
+	requestsPerMinute uint
+	tokensPerDay      uint
+	header            string
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimits
+	lastPrune time.Time
+}
+
+// newRateLimiter returns a rate limiter, or nil if there are no limits
+func newRateLimiter(requestsPerMinute, tokensPerDay uint, header string) *rateLimiter {
+	if requestsPerMinute == 0 && tokensPerDay == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		requestsPerMinute: requestsPerMinute,
+		tokensPerDay:      tokensPerDay,
+		header:            header,
+		clients:           make(map[string]*clientLimits),
+	}
+}
+
+type rateLimitClientKey struct{}
+
+// withRateLimitClient counts requests made with ctx against the limits of
+// client, for requests made on its behalf such as those in batches
+func withRateLimitClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, rateLimitClientKey{}, client)
+}
+
+// clientIdentity returns the identity of the client making a request: the
+// API key it was made with, a header or its IP address. Headers are only
+// used when one is configured, as clients could set them to avoid their
+// limits. Servers behind a proxy should set an identity header.
+func clientIdentity(c *gin.Context, header string) string {
+	if client, ok := c.Request.Context().Value(rateLimitClientKey{}).(string); ok && client != "" {
+		return client
+	}
+
+	if id := auth.KeyID(c.Request.Context()); id != "" {
+		return "key:" + id
+	}
+
+	if header != "" {
+		if id := c.GetHeader(header); id != "" {
+			return id
+		}
+	}
+
+	return c.RemoteIP()
+}
+
+// identify returns the identity of the client making a request
+func (l *rateLimiter) identify(c *gin.Context) string {
+	var header string
+	if l != nil {
+		header = l.header
+	}
+
+	return clientIdentity(c, header)
+}
+
+// get returns the limits of a client, refilled to now. It must be called
+// with mu held.
+func (l *rateLimiter) get(client string, now time.Time) *clientLimits {
+	if now.Sub(l.lastPrune) > time.Minute {
+		// forget clients that have not made requests recently
+		for id, cl := range l.clients {
+			if cl.refill(now); cl.full() {
+				delete(l.clients, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	cl, ok := l.clients[client]
+	if !ok {
+		cl = &clientLimits{}
+		if l.requestsPerMinute > 0 {
+			b := newBucket(float64(l.requestsPerMinute), time.Minute, now)
+			cl.requests = &b
+		}
+
+		if l.tokensPerDay > 0 {
+			b := newBucket(float64(l.tokensPerDay), 24*time.Hour, now)
+			cl.tokens = &b
+		}
+
+		l.clients[client] = cl
+	}
+
+	cl.refill(now)
+	return cl
+}
+
+// rateLimitStatus is the state of a client's limits after a request
+type rateLimitStatus struct {
+	requests, tokens *bucket
+	// retryAfter is how long until the client can make another request,
+	// or zero if the request was allowed
+	retryAfter time.Duration
+}
+
+// allow reports whether a client can make a request, and takes a request
+// from its limit if it can. Requests are allowed while a client has any
+// tokens left, as they are only counted when a request completes.
+func (l *rateLimiter) allow(client string, now time.Time) rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cl := l.get(client, now)
+
+	var status rateLimitStatus
+	if cl.requests != nil {
+		status.retryAfter = max(status.retryAfter, cl.requests.wait(1))
+	}
+
+	if cl.tokens != nil && cl.tokens.level <= 0 {
+		// wait for at least one token
+		status.retryAfter = max(status.retryAfter, cl.tokens.wait(1))
+	}
+
+	if status.retryAfter == 0 && cl.requests != nil {
+		cl.requests.level--
+	}
+
+	// copy the buckets, as they change after the lock is released
+	if cl.requests != nil {
+		b := *cl.requests
+		status.requests = &b
+	}
+
+	if cl.tokens != nil {
+		b := *cl.tokens
+		status.tokens = &b
+	}
+
+	return status
+}
+
+// spend takes tokens from a client's limit
+func (l *rateLimiter) spend(client string, tokens int, now time.Time) {
+	if l.tokensPerDay == 0 || tokens == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.get(client, now).tokens.level -= float64(tokens)
+}
+
+// setHeaders sets the OpenAI rate limit headers for a client's limits
+func (s rateLimitStatus) setHeaders(h http.Header) {
+	for name, b := range map[string]*bucket{"requests": s.requests, "tokens": s.tokens} {
+		if b == nil {
+			continue
+		}
+
+		h.Set("x-ratelimit-limit-"+name, strconv.FormatFloat(b.capacity, 'f', 0, 64))
+		h.Set("x-ratelimit-remaining-"+name, strconv.FormatFloat(max(0, math.Floor(b.level)), 'f', 0, 64))
+		h.Set("x-ratelimit-reset-"+name, b.reset().Round(time.Millisecond).String())
+	}
+}
+
+// limit is middleware that rejects requests from clients over their
+// limits, and counts the tokens of requests that are allowed. Requests in
+// batches count against the limits of the client that created the batch,
+// and wait for them rather than failing.
+func (l *rateLimiter) limit(c *gin.Context) {
+	if l == nil {
+		c.Next()
+		return
+	}
+
+	client := clientIdentity(c, l.header)
+	status := l.allow(client, time.Now())
+	for isBatchRequest(c.Request.Context()) && status.retryAfter > 0 {
+		select {
+		case <-c.Request.Context().Done():
+			writeError(c.Writer, c.Request, http.StatusServiceUnavailable, c.Request.Context().Err())
+			c.Abort()
+			return
+		case <-time.After(status.retryAfter):
+		}
+
+		status = l.allow(client, time.Now())
+	}
+
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+		status.setHeaders(c.Writer.Header())
+	}
+
+	if status.retryAfter > 0 {
+		seconds := int(math.Ceil(status.retryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		writeError(c.Writer, c.Request, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded, retry in %ds", seconds))
+		c.Abort()
+		return
+	}
+
+	c.Next()
+
+	if rm := requestMetricsFromContext(c.Request.Context()); rm != nil {
+		rm.mu.Lock()
+		tokens := rm.tokens
+		rm.mu.Unlock()
+
+		l.spend(client, tokens, time.Now())
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Now()
+
+	t.Run("requests", func(t *testing.T) {
+		l := newRateLimiter(2, 0, "")
+		for range 2 {
+			if s := l.allow("a", now); s.retryAfter != 0 {
+				t.Fatalf("expected request to be allowed, retry after %s", s.retryAfter)
+			}
+		}
+
+		s := l.allow("a", now)
+		if s.retryAfter != 30*time.Second {
+			t.Errorf("expected to retry after 30s, got %s", s.retryAfter)
+		}
+
+		if s.tokens != nil {
+			t.Error("expected no token limit")
+		}
+
+		if s := l.allow("b", now); s.retryAfter != 0 {
+			t.Errorf("expected other clients to be allowed, retry after %s", s.retryAfter)
+		}
+
+		if s := l.allow("a", now.Add(30*time.Second)); s.retryAfter != 0 {
+			t.Errorf("expected request to be allowed after waiting, retry after %s", s.retryAfter)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		l := newRateLimiter(0, 86400, "")
+		if s := l.allow("a", now); s.retryAfter != 0 {
+			t.Fatalf("expected request to be allowed, retry after %s", s.retryAfter)
+		}
+
+		// requests are allowed until tokens run out, even if they use more
+		// than are left
+		l.spend("a", 86410, now)
+
+		s := l.allow("a", now)
+		if s.retryAfter != 11*time.Second {
+			t.Errorf("expected to retry after 11s, got %s", s.retryAfter)
+		}
+
+		if s.requests != nil {
+			t.Error("expected no request limit")
+		}
+
+		if s := l.allow("a", now.Add(11*time.Second)); s.retryAfter != 0 {
+			t.Errorf("expected request to be allowed after waiting, retry after %s", s.retryAfter)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		if l := newRateLimiter(0, 0, ""); l != nil {
+			t.Error("expected no rate limiter without limits")
+		}
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		l := newRateLimiter(60, 0, "")
+		l.allow("a", now)
+		l.allow("b", now.Add(2*time.Minute))
+
+		if _, ok := l.clients["a"]; ok {
+			t.Error("expected idle client to be forgotten")
+		}
+
+		if _, ok := l.clients["b"]; !ok {
+			t.Error("expected client to be remembered")
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	l := newRateLimiter(1, 100, "X-User")
+
+	r := gin.New()
+	handler := func(c *gin.Context) {
+		observeTokens(c.Request.Context(), "test-ratelimit", api.Metrics{PromptEvalCount: 10, EvalCount: 20})
+		c.Status(http.StatusOK)
+	}
+	r.POST("/api/chat", observeRequest, l.limit, handler)
+	r.POST("/v1/chat/completions", observeRequest, l.limit, handler)
+
+	do := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("/v1/chat/completions", "alice")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	for k, v := range map[string]string{
+		"x-ratelimit-limit-requests":     "1",
+		"x-ratelimit-remaining-requests": "0",
+		"x-ratelimit-reset-requests":     "1m0s",
+		"x-ratelimit-limit-tokens":       "100",
+		"x-ratelimit-remaining-tokens":   "100",
+	} {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("expected %s %q, got %q", k, v, got)
+		}
+	}
+
+	w = do("/v1/chat/completions", "alice")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After 60, got %q", got)
+	}
+
+	if got, want := w.Body.String(), `{"error":{"message":"rate limit exceeded, retry in 60s","type":"rate_limit_exceeded","param":null,"code":null}}`+"\n"; got != want {
+		t.Errorf("expected body %s, got %s", want, got)
+	}
+
+	// tokens of allowed requests are counted
+	l.mu.Lock()
+	if got := l.clients["alice"].tokens.level; got < 70 || got > 71 {
+		t.Errorf("expected 30 tokens to be spent, %v left", got)
+	}
+	l.mu.Unlock()
+
+	// other clients have their own limits, and native routes do not have
+	// OpenAI headers
+	w = do("/api/chat", "bob")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if got := w.Header().Get("x-ratelimit-limit-requests"); got != "" {
+		t.Errorf("expected no rate limit headers, got %q", got)
+	}
+
+	w = do("/api/chat", "bob")
+	if got := w.Body.String(); w.Code != http.StatusTooManyRequests || got != `{"error":"rate limit exceeded, retry in 60s"}`+"\n" {
+		t.Errorf("expected rate limit error, got %d %s", w.Code, got)
+	}
+}
+
+func TestRateLimitIdentity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	l := newRateLimiter(0, 100, "")
+
+	r := gin.New()
+	var ctx context.Context
+	r.POST("/api/chat", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(ctx)
+	}, observeRequest, l.limit, func(c *gin.Context) {
+		observeTokens(c.Request.Context(), "test-ratelimit", api.Metrics{PromptEvalCount: 10, EvalCount: 20})
+		c.Status(http.StatusOK)
+	})
+
+	do := func(c context.Context, user string) int {
+		ctx = c
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+		req.Header.Set("X-User", user)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	spent := func(client string) float64 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		cl, ok := l.clients[client]
+		if !ok {
+			return 0
+		}
+		return 100 - cl.tokens.level
+	}
+
+	// the identity header is ignored unless one is configured
+	if code := do(t.Context(), "alice"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	if _, ok := l.clients["alice"]; ok {
+		t.Error("expected the unconfigured header to be ignored")
+	}
+
+	// requests with an API key count against the key
+	if code := do(auth.WithKeyID(t.Context(), "key-a"), "alice"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	if got := spent("key:key-a"); got < 29 || got > 31 {
+		t.Errorf("expected 30 tokens to be spent by the key, got %v", got)
+	}
+
+	// requests in batches count against the client that created the batch
+	batch := withRateLimitClient(withBatchPriority(t.Context()), "key:key-a")
+	if code := do(batch, ""); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	if got := spent("key:key-a"); got < 59 || got > 61 {
+		t.Errorf("expected 60 tokens to be spent by the key, got %v", got)
+	}
+
+	// and wait for its limits rather than failing
+	l.mu.Lock()
+	l.clients["key:key-a"].tokens.level = -1000
+	l.mu.Unlock()
+
+	cancelled, cancel := context.WithCancel(batch)
+	cancel()
+	if code := do(cancelled, ""); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a batch request over its limits to wait until cancelled, got %d", code)
+	}
+}
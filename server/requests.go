@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
+	"github.com/qompassai/rose/openai"
+)
+
+// requestIDHeader is the response header with the ID of a request, which
+// can be used to cancel it
+const requestIDHeader = "X-Request-Id"
+
+// requestTracker keeps the requests that are in flight so they can be
+// cancelled by ID, rather than only when their connection is closed
+type requestTracker struct {
+	mu       sync.Mutex
+	requests map[string]trackedRequest
+}
+
+type trackedRequest struct {
+	// owner is the ID of the API key the request was made with
+	owner  string
+	cancel context.CancelFunc
+}
+
+func requestID() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letters[rand.IntN(len(letters))]
+	}
+	return string(b)
+}
+
+// track is middleware that assigns a request an ID and cancels its context
+// when the ID is cancelled
+func (t *requestTracker) track(c *gin.Context) {
+	id := requestID()
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	t.mu.Lock()
+	if t.requests == nil {
+		t.requests = make(map[string]trackedRequest)
+	}
+	t.requests[id] = trackedRequest{owner: auth.KeyID(ctx), cancel: cancel}
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.requests, id)
+		t.mu.Unlock()
+	}()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// cancel cancels a request made with the API key owner, returning false if
+// it is not in flight
+func (t *requestTracker) cancel(id, owner string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.requests[id]
+	if !ok || r.owner != owner {
+		return false
+	}
+
+	r.cancel()
+	delete(t.requests, id)
+	return true
+}
+
+func (s *Server) CancelHandler(c *gin.Context) {
+	var req api.CancelRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.ID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "id is required"})
+		return
+	}
+
+	if !s.requests.cancel(req.ID, auth.KeyID(c.Request.Context())) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("request %q not found", req.ID)})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// cancelCompletionHandler cancels an OpenAI compatible completion by its ID,
+// which is the request ID with a prefix for the kind of completion
+func (s *Server) cancelCompletionHandler(prefix, object string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !s.requests.cancel(strings.TrimPrefix(id, prefix), auth.KeyID(c.Request.Context())) {
+			c.AbortWithStatusJSON(http.StatusNotFound, openai.NewError(http.StatusNotFound, fmt.Sprintf("completion %q not found", id)))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": id, "object": object, "deleted": true})
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/auth"
+)
+
+func TestCancelRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   func(id string) string
+		status int
+	}{
+		{
+			name:   "cancel",
+			method: http.MethodPost,
+			path:   "/api/cancel",
+			body:   func(id string) string { return `{"id":"` + id + `"}` },
+			status: http.StatusOK,
+		},
+		{
+			name:   "delete chat completion",
+			method: http.MethodDelete,
+			path:   "/v1/chat/completions/chatcmpl-",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Server
+			r := gin.New()
+			r.POST("/api/cancel", s.CancelHandler)
+			r.DELETE("/v1/chat/completions/:id", s.cancelCompletionHandler("chatcmpl-", "chat.completion.deleted"))
+
+			started := make(chan string)
+			done := make(chan error)
+			r.POST("/api/generate", s.requests.track, func(c *gin.Context) {
+				started <- c.Writer.Header().Get(requestIDHeader)
+				<-c.Request.Context().Done()
+				done <- c.Request.Context().Err()
+			})
+
+			go r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/generate", nil))
+
+			id := <-started
+			if id == "" {
+				t.Fatal("expected a request ID")
+			}
+
+			path, body := tt.path, ""
+			if tt.body != nil {
+				body = tt.body(id)
+			} else {
+				path += id
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, path, strings.NewReader(body)))
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if err := <-done; err == nil {
+				t.Error("expected the request to be cancelled")
+			}
+
+			// the request is gone once it has been cancelled
+			w = httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, path, strings.NewReader(body)))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("expected status %d, got %d: %s", http.StatusNotFound, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCancelRequestErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		err    string
+	}{
+		{"missing body", "", http.StatusBadRequest, `{"error":"missing request body"}`},
+		{"missing id", `{}`, http.StatusBadRequest, `{"error":"id is required"}`},
+		{"unknown id", `{"id":"abc"}`, http.StatusNotFound, `{"error":"request \"abc\" not found"}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Server
+			r := gin.New()
+			r.POST("/api/cancel", s.CancelHandler)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/cancel", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+
+			if got := w.Body.String(); got != tt.err {
+				t.Errorf("expected error %s, got %s", tt.err, got)
+			}
+		})
+	}
+}
+
+func TestCancelRequestOwner(t *testing.T) {
+	var tracker requestTracker
+
+	started := make(chan string)
+	done := make(chan struct{})
+	r := gin.New()
+	r.POST("/api/generate", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(auth.WithKeyID(c.Request.Context(), "key-a"))
+	}, tracker.track, func(c *gin.Context) {
+		started <- c.Writer.Header().Get(requestIDHeader)
+		<-c.Request.Context().Done()
+		close(done)
+	})
+
+	go r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/generate", nil))
+	id := <-started
+
+	// requests can only be cancelled with the key they were made with
+	if tracker.cancel(id, "key-b") {
+		t.Error("expected another key to not cancel the request")
+	}
+
+	if tracker.cancel(id, "") {
+		t.Error("expected a request without a key to not cancel the request")
+	}
+
+	if !tracker.cancel(id, "key-a") {
+		t.Error("expected the request's key to cancel it")
+	}
+	<-done
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/types/model"
+)
+
+func (s *Server) RerankHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.RerankRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Query == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+
+	if req.TopN < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_n must not be negative"})
+		return
+	}
+
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer withTimeout(c, req.Timeout)()
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{CapabilityRerank}, req.Options, "", req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	if len(req.Documents) == 0 {
+		c.JSON(http.StatusOK, api.RerankResponse{Model: req.Model, Results: []api.RerankResult{}})
+		return
+	}
+
+	query, err := r.Tokenize(c.Request.Context(), req.Query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	count := len(query) * len(req.Documents)
+	for _, document := range req.Documents {
+		tokens, err := r.Tokenize(c.Request.Context(), document)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		count += len(tokens)
+	}
+
+	ctx, cancel := generateContext(c.Request.Context())
+	defer cancel()
+
+	var g errgroup.Group
+	scores := make([]float64, len(req.Documents))
+	for i, document := range req.Documents {
+		g.Go(func() error {
+			score, err := r.Rerank(ctx, req.Query, document)
+			if err != nil {
+				return err
+			}
+			scores[i] = sigmoid(score)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		if timedOut(ctx) {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": context.Cause(ctx).Error()})
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		return
+	}
+
+	observeTokens(c.Request.Context(), m.ShortName, api.Metrics{PromptEvalCount: count})
+
+	c.JSON(http.StatusOK, api.RerankResponse{
+		Model:           req.Model,
+		Results:         rankResults(scores, req.TopN),
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	})
+}
+
+// rankResults sorts documents from the highest score to the lowest, keeping
+// the first topN if it's set
+func rankResults(scores []float64, topN int) []api.RerankResult {
+	results := make([]api.RerankResult, len(scores))
+	for i, score := range scores {
+		results[i] = api.RerankResult{Index: i, RelevanceScore: score}
+	}
+
+	slices.SortStableFunc(results, func(a, b api.RerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+
+	if topN > 0 && topN < len(results) {
+		results = results[:topN]
+	}
+
+	return results
+}
+
+// sigmoid maps the score of a reranking model's classification head to a
+// relevance between 0 and 1
+func sigmoid(score float32) float64 {
+	return 1 / (1 + math.Exp(-float64(score)))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/qompassai/rose/api"
+)
+
+func TestRankResults(t *testing.T) {
+	scores := []float64{0.2, 0.9, 0.2, 0.5}
+
+	cases := []struct {
+		name string
+		topN int
+		want []api.RerankResult
+	}{
+		{
+			name: "all",
+			want: []api.RerankResult{
+				{Index: 1, RelevanceScore: 0.9},
+				{Index: 3, RelevanceScore: 0.5},
+				{Index: 0, RelevanceScore: 0.2},
+				{Index: 2, RelevanceScore: 0.2},
+			},
+		},
+		{
+			name: "top n",
+			topN: 2,
+			want: []api.RerankResult{
+				{Index: 1, RelevanceScore: 0.9},
+				{Index: 3, RelevanceScore: 0.5},
+			},
+		},
+		{
+			name: "top n more than documents",
+			topN: 10,
+			want: []api.RerankResult{
+				{Index: 1, RelevanceScore: 0.9},
+				{Index: 3, RelevanceScore: 0.5},
+				{Index: 0, RelevanceScore: 0.2},
+				{Index: 2, RelevanceScore: 0.2},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, rankResults(scores, tt.topN)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSigmoid(t *testing.T) {
+	if got := sigmoid(0); got != 0.5 {
+		t.Errorf("sigmoid(0) = %v, want 0.5", got)
+	}
+
+	if got := sigmoid(10); got <= 0.99 || got >= 1 {
+		t.Errorf("sigmoid(10) = %v, want close to 1", got)
+	}
+
+	if got := sigmoid(-10); got <= 0 || got >= 0.01 {
+		t.Errorf("sigmoid(-10) = %v, want close to 0", got)
+	}
+}
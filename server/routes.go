@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -27,16 +28,20 @@ import (
 	"github.com/gin-gonic/gin"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/qompassai/rose/anthropic"
 	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/auth"
 	"github.com/qompassai/rose/discover"
 	"github.com/qompassai/rose/envconfig"
 	"github.com/qompassai/rose/fs/ggml"
 	"github.com/qompassai/rose/llm"
 	"github.com/qompassai/rose/model/models/mllama"
 	"github.com/qompassai/rose/openai"
+	"github.com/qompassai/rose/runner/common"
 	"github.com/qompassai/rose/server/internal/client/rose"
 	"github.com/qompassai/rose/server/internal/registry"
 	"github.com/qompassai/rose/template"
+	"github.com/qompassai/rose/tracing"
 	"github.com/qompassai/rose/types/errtypes"
 	"github.com/qompassai/rose/types/model"
 	"github.com/qompassai/rose/version"
@@ -51,8 +56,19 @@ var useClient2 = experimentEnabled("client2")
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
-	sched *Scheduler
+	addr    net.Addr
+	sched   *Scheduler
+	batches *batchManager
+
+	// requests are the in-flight requests that can be cancelled
+	requests requestTracker
+
+	// keys are the API keys requests must use, or nil if keys are not
+	// required
+	keys *auth.APIKeys
+
+	// limits are the rate limits of clients, or nil if there are none
+	limits *rateLimiter
 }
 
 func init() {
@@ -87,7 +103,7 @@ func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options
 
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, draft string, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
 	if name == "" {
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
@@ -97,6 +113,8 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, err
 	}
 
+	requestMetricsFromContext(ctx).setModel(model.ShortName)
+
 	if err := model.CheckCapabilities(caps...); err != nil {
 		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
 	}
@@ -106,15 +124,77 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, err
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
+	if draft != "" {
+		if err := loadDraft(model, draft); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "Scheduler.GetRunner", tracing.Attr("model", model.ShortName))
+	req := s.sched.schedule(ctx, model, opts, keepAlive)
+
+	// the queue timeout covers waiting for the scheduler and then for one
+	// of the runner's slots, but not the scheduler loading the model, which
+	// is limited by ROSE_LOAD_TIMEOUT.
+	// Requests from batches can wait behind any number of interactive
+	// requests, so it does not apply to them.
+	queueTimeout := envconfig.QueueTimeout()
+	if isBatchRequest(ctx) {
+		queueTimeout = 0
+	}
+
+	timeout, stop := queueTimer(queueTimeout)
+	defer stop()
+	remaining := queueTimeout
+
+	dequeued := req.dequeued
 	var runner *runnerRef
-	select {
-	case runner = <-runnerCh:
-	case err = <-errCh:
+	for runner == nil {
+		select {
+		case runner = <-req.successCh:
+		case err = <-req.errCh:
+		case <-dequeued:
+			stop()
+			dequeued, timeout = nil, nil
+			remaining -= time.Since(start)
+		case <-timeout:
+			err = errQueueTimeout
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+		}
+
+		if err != nil {
+			// the request leaves the queue when ctx is done, as the
+			// handler returns
+			span.End(err)
+			return nil, nil, nil, err
+		}
+	}
+
+	if dequeued != nil {
+		remaining -= time.Since(start)
+	}
+
+	// requests for a loaded model wait for one of its slots, which are given
+	// out by priority and client in the same way as the scheduler's queue
+	slotCtx := ctx
+	if queueTimeout > 0 {
+		var cancel context.CancelFunc
+		slotCtx, cancel = context.WithTimeoutCause(ctx, max(remaining, 0), errQueueTimeout)
+		defer cancel()
+	}
+
+	release, err := runner.acquireSlot(slotCtx)
+	if err != nil {
+		span.End(err)
 		return nil, nil, nil, err
 	}
+	context.AfterFunc(ctx, release)
 
-	return runner.llama, model, &opts, nil
+	observeSince(metricQueueWait, start, model.ShortName)
+	span.End(nil)
+	return newSlotRunner(runner), model, &opts, nil
 }
 
 func (s *Server) GenerateHandler(c *gin.Context) {
@@ -176,12 +256,27 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := checkTopLogprobs(req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer withTimeout(c, req.Timeout)()
+
 	caps := []Capability{CapabilityCompletion}
 	if req.Suffix != "" {
 		caps = append(caps, CapabilityInsert)
 	}
+	if req.Think != nil && *req.Think && !req.Raw {
+		caps = append(caps, CapabilityThinking)
+	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.DraftModel, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
@@ -238,6 +333,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	}
 
 	prompt := req.Prompt
+	var thinkParser *thinkingParser
 	if !req.Raw {
 		tmpl := m.Template
 		if req.Template != "" {
@@ -249,6 +345,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		var values template.Values
+		if req.Think != nil {
+			values.Think = *req.Think
+			values.IsThinkSet = true
+		}
+
 		if req.Suffix != "" {
 			values.Prompt = prompt
 			values.Suffix = req.Suffix
@@ -292,27 +393,34 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		prompt = b.String()
+
+		// thinking is still parsed when it is turned off so that models
+		// that think anyway don't leak it into the response
+		if req.Suffix == "" {
+			thinkOpen, thinkClose := m.thinkingTags()
+			if req.Template != "" {
+				thinkOpen, thinkClose = thinkingTags(tmpl)
+			}
+			thinkParser = newThinkingParser(thinkOpen, thinkClose, prompt)
+		}
 	}
 
 	slog.Debug("generate request", "images", len(images), "prompt", prompt)
 
+	requestID := c.Writer.Header().Get(requestIDHeader)
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(cr llm.CompletionResponse) {
+		fn := func(cr llm.CompletionResponse) {
 			res := api.GenerateResponse{
 				Model:      req.Model,
 				CreatedAt:  time.Now().UTC(),
 				Response:   cr.Content,
 				Done:       cr.Done,
 				DoneReason: cr.DoneReason,
+				Logprobs:   cr.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
@@ -325,11 +433,25 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				ch <- gin.H{"error": err.Error()}
 			}
 
+			if thinkParser != nil {
+				res.Thinking, res.Response = thinkParser.Add(cr.Content)
+				if cr.Done {
+					thinking, content := thinkParser.Flush()
+					res.Thinking += thinking
+					res.Response += content
+				}
+
+				if req.Think != nil && !*req.Think {
+					res.Thinking = ""
+				}
+			}
+
 			if cr.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				observeTokens(c.Request.Context(), m.ShortName, res.Metrics)
 
-				if !req.Raw {
+				if !req.Raw && cr.DoneReason != doneReasonTimeout {
 					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
@@ -339,19 +461,43 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				}
 			}
 
+			// only the first response carries the request ID
+			res.RequestID, requestID = requestID, ""
 			ch <- res
-		}); err != nil {
+		}
+
+		ctx, cancel := generateContext(c.Request.Context())
+		defer cancel()
+
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      req.Format,
+			Options:     opts,
+			Logprobs:    req.Logprobs || req.TopLogprobs > 0,
+			TopLogprobs: req.TopLogprobs,
+		}, fn); err != nil {
+			if timedOut(ctx) {
+				// finish with the output so far
+				fn(llm.CompletionResponse{Done: true, DoneReason: doneReasonTimeout})
+				return
+			}
+
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
-		var sb strings.Builder
+		var sb, thinking strings.Builder
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(t.Response)
+				thinking.WriteString(t.Thinking)
+				logprobs = append(logprobs, t.Logprobs...)
+				t.RequestID = cmp.Or(r.RequestID, t.RequestID)
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -368,6 +514,8 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
+		r.Thinking = thinking.String()
+		r.Logprobs = logprobs
 		c.JSON(http.StatusOK, r)
 		return
 	}
@@ -416,13 +564,20 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		}
 	}
 
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer withTimeout(c, req.Timeout)()
+
 	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, "", req.KeepAlive)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -469,11 +624,14 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		input[i] = s
 	}
 
+	ctx, cancel := generateContext(c.Request.Context())
+	defer cancel()
+
 	var g errgroup.Group
 	embeddings := make([][]float32, len(input))
 	for i, text := range input {
 		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
+			embedding, err := r.Embedding(ctx, text)
 			if err != nil {
 				return err
 			}
@@ -483,10 +641,17 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	}
 
 	if err := g.Wait(); err != nil {
+		if timedOut(ctx) {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": context.Cause(ctx).Error()})
+			return
+		}
+
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
 		return
 	}
 
+	observeTokens(c.Request.Context(), m.ShortName, api.Metrics{PromptEvalCount: count})
+
 	resp := api.EmbedResponse{
 		Model:           req.Model,
 		Embeddings:      embeddings,
@@ -530,7 +695,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, req.KeepAlive)
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, "", req.KeepAlive)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -559,6 +724,92 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, "", req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// an empty request loads the model
+	if req.Content == "" {
+		c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: []int{}})
+		return
+	}
+
+	tokens, err := r.Tokenize(c.Request.Context(), req.Content)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens})
+}
+
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, "", req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// an empty request loads the model
+	if len(req.Tokens) == 0 {
+		c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model})
+		return
+	}
+
+	content, err := r.Detokenize(c.Request.Context(), req.Tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Content: content})
+}
+
 func (s *Server) PullHandler(c *gin.Context) {
 	var req api.PullRequest
 	err := c.ShouldBindJSON(&req)
@@ -726,6 +977,12 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		return
 	}
 
+	// the model's blobs are needed to find the prompts saved for it
+	saved, err := GetModel(n.String())
+	if err != nil {
+		slog.Warn("couldn't find saved prompts for model", "model", n.DisplayShortest(), "error", err)
+	}
+
 	if err := m.Remove(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -735,6 +992,12 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	if saved != nil {
+		if err := removeCache(saved); err != nil {
+			slog.Warn("couldn't remove saved prompts for model", "model", n.DisplayShortest(), "error", err)
+		}
+	}
 }
 
 func (s *Server) ShowHandler(c *gin.Context) {
@@ -829,6 +1092,10 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 			for _, nv := range val {
 				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
 			}
+		case map[string]any:
+			for _, id := range slices.Sorted(maps.Keys(val)) {
+				params = append(params, fmt.Sprintf("%-*s %s:%v", cs, k, id, val[id]))
+			}
 		default:
 			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
 		}
@@ -1140,6 +1407,12 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 }
 
 func (s *Server) GenerateRoutes(rc *rose.Registry) (http.Handler, error) {
+	batches, err := newBatchManager(filepath.Join(envconfig.Models(), "batches"))
+	if err != nil {
+		return nil, err
+	}
+	s.batches = batches
+
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowWildcard = true
 	corsConfig.AllowBrowserExtensions = true
@@ -1149,6 +1422,7 @@ func (s *Server) GenerateRoutes(rc *rose.Registry) (http.Handler, error) {
 		"User-Agent",
 		"Accept",
 		"X-Requested-With",
+		priorityHeader,
 
 		// OpenAI compatibility headers
 		"x-stainless-lang",
@@ -1163,7 +1437,13 @@ func (s *Server) GenerateRoutes(rc *rose.Registry) (http.Handler, error) {
 		"x-stainless-poll-helper",
 		"x-stainless-custom-poll-interval",
 		"x-stainless-timeout",
+
+		// Anthropic compatibility headers
+		"x-api-key",
+		"anthropic-version",
+		"anthropic-beta",
 	}
+	corsConfig.ExposeHeaders = []string{requestIDHeader}
 	corsConfig.AllowOrigins = envconfig.AllowedOrigins()
 
 	r := gin.Default()
@@ -1178,33 +1458,81 @@ func (s *Server) GenerateRoutes(rc *rose.Registry) (http.Handler, error) {
 	r.HEAD("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
 	r.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
 
+	// routes are grouped by the scope an API key needs to use them, when
+	// the server requires keys
+	admin := r.Group("", s.requireScope(auth.ScopeAdmin))
+	read := r.Group("", s.requireScope(auth.ScopeModelRead))
+	write := r.Group("", s.requireScope(auth.ScopeModelWrite))
+	infer := r.Group("", s.requireScope(auth.ScopeInference))
+
+	admin.GET("/metrics", s.MetricsHandler)
+
 	// Local model cache management (new implementation is at end of function)
-	r.POST("/api/pull", s.PullHandler)
-	r.POST("/api/push", s.PushHandler)
-	r.HEAD("/api/tags", s.ListHandler)
-	r.GET("/api/tags", s.ListHandler)
-	r.POST("/api/show", s.ShowHandler)
-	r.DELETE("/api/delete", s.DeleteHandler)
+	write.POST("/api/pull", s.PullHandler)
+	write.POST("/api/push", s.PushHandler)
+	read.HEAD("/api/tags", s.ListHandler)
+	read.GET("/api/tags", s.ListHandler)
+	read.POST("/api/show", s.ShowHandler)
+	write.DELETE("/api/delete", s.DeleteHandler)
 
 	// Create
-	r.POST("/api/create", s.CreateHandler)
-	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
-	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
-	r.POST("/api/copy", s.CopyHandler)
+	write.POST("/api/create", s.CreateHandler)
+	write.POST("/api/blobs/:digest", s.CreateBlobHandler)
+	write.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+	write.POST("/api/copy", s.CopyHandler)
 
 	// Inference
-	r.GET("/api/ps", s.PsHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	//
+	// requests that run a model are traced, counted in metrics, can be
+	// cancelled by ID, are rate limited and are scheduled fairly
+	inference := infer.Group("", traceRequest, s.requests.track, observeRequest, s.limits.limit, prioritize)
+	read.GET("/api/ps", s.PsHandler)
+	inference.POST("/api/generate", s.GenerateHandler)
+	inference.POST("/api/chat", s.ChatHandler)
+	inference.POST("/api/embed", s.EmbedHandler)
+	inference.POST("/api/embeddings", s.EmbeddingsHandler)
+	inference.POST("/api/rerank", s.RerankHandler)
+	inference.POST("/api/cache/save", s.CacheSaveHandler)
+	inference.POST("/api/cache/restore", s.CacheRestoreHandler)
+	infer.POST("/api/cancel", s.CancelHandler)
+	inference.POST("/api/tokenize", s.TokenizeHandler)
+	inference.POST("/api/detokenize", s.DetokenizeHandler)
 
 	// Inference (OpenAI compatibility)
-	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
-	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
-	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
-	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+	inference.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
+	infer.DELETE("/v1/chat/completions/:id", s.cancelCompletionHandler("chatcmpl-", "chat.completion.deleted"))
+	inference.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
+	infer.DELETE("/v1/completions/:id", s.cancelCompletionHandler("cmpl-", "text_completion.deleted"))
+	inference.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
+	inference.POST("/v1/rerank", openai.RerankMiddleware(), s.RerankHandler)
+	inference.POST("/v1/responses", openai.ResponsesMiddleware(openai.NewResponseStore()), s.ChatHandler)
+
+	// Batches (OpenAI compatibility)
+	infer.POST("/v1/files", s.CreateFileHandler)
+	infer.GET("/v1/files", s.ListFilesHandler)
+	infer.GET("/v1/files/:id", s.GetFileHandler)
+	infer.GET("/v1/files/:id/content", s.FileContentHandler)
+	infer.DELETE("/v1/files/:id", s.DeleteFileHandler)
+	infer.POST("/v1/batches", s.CreateBatchHandler)
+	infer.GET("/v1/batches", s.ListBatchesHandler)
+	infer.GET("/v1/batches/:id", s.GetBatchHandler)
+	infer.POST("/v1/batches/:id/cancel", s.CancelBatchHandler)
+	read.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
+	read.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+
+	// Inference (Anthropic compatibility)
+	inference.POST("/v1/messages", anthropic.MessagesMiddleware(), s.ChatHandler)
+
+	// requests in batches are served by the same routes
+	s.batches.handler = r
+	s.batches.parallel = func(name string) int {
+		m, err := GetModel(name)
+		if err != nil {
+			return 1
+		}
+
+		return s.sched.parallel(m.ModelPath)
+	}
 
 	if rc != nil {
 		// wrap old with new
@@ -1215,7 +1543,9 @@ func (s *Server) GenerateRoutes(rc *rose.Registry) (http.Handler, error) {
 
 			Prune: PruneLayers,
 		}
-		return rs, nil
+
+		// the registry client serves these routes before the router
+		return s.requireScopeHandler(rs, auth.ScopeModelWrite, "/api/delete", "/api/pull"), nil
 	}
 
 	return r, nil
@@ -1243,6 +1573,17 @@ func Serve(ln net.Listener) error {
 
 	slog.SetDefault(slog.New(handler))
 
+	if endpoint := envconfig.OTLPEndpoint(); endpoint != "" {
+		shutdown := tracing.Init(endpoint, "rose")
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				slog.Warn("failed to export remaining traces", "error", err)
+			}
+		}()
+	}
+
 	blobsDir, err := GetBlobsPath("")
 	if err != nil {
 		return err
@@ -1273,6 +1614,24 @@ func Serve(ln net.Listener) error {
 
 	s := &Server{addr: ln.Addr()}
 
+	if envconfig.Auth() {
+		path, err := auth.APIKeysPath()
+		if err != nil {
+			return err
+		}
+
+		s.keys, err = auth.LoadAPIKeys(path)
+		if err != nil {
+			return err
+		}
+
+		if keys, _ := s.keys.List(); len(keys) == 0 {
+			slog.Warn("api keys are required but none exist, create one with `rose keys create`")
+		}
+	}
+
+	s.limits = newRateLimiter(envconfig.RateLimitRPM(), envconfig.RateLimitTPD(), envconfig.RateLimitHeader())
+
 	var rc *rose.Registry
 	if useClient2 {
 		var err error
@@ -1319,6 +1678,7 @@ func Serve(ln net.Listener) error {
 	}()
 
 	s.sched.Run(schedCtx)
+	go s.batches.run(ctx)
 
 	// At startup we retrieve GPU information so we can get log messages before loading a model
 	// This will log warnings to the log in case we have problems with detected GPUs
@@ -1372,6 +1732,10 @@ func streamResponse(c *gin.Context, ch chan any) {
 			return false
 		}
 
+		if h, ok := val.(gin.H); ok && h["error"] != nil {
+			requestMetricsFromContext(c.Request.Context()).setError()
+		}
+
 		bts, err := json.Marshal(val)
 		if err != nil {
 			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
@@ -1468,23 +1832,46 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if err := checkTopLogprobs(req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tools, forced, err := chooseTools(req.Tools, req.ToolChoice)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer withTimeout(c, req.Timeout)()
+
+	parallel := req.ParallelToolCalls == nil || *req.ParallelToolCalls
+
 	caps := []Capability{CapabilityCompletion}
-	if len(req.Tools) > 0 {
+	if len(tools) > 0 {
 		caps = append(caps, CapabilityTools)
 	}
+	if req.Think != nil && *req.Think {
+		caps = append(caps, CapabilityThinking)
+	}
 
 	name := model.ParseName(req.Model)
 	if !name.IsValid() {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
 	}
-	name, err := getExistingName(name)
+	name, err = getExistingName(name)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.DraftModel, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
 		return
@@ -1493,6 +1880,16 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	// constrain the output to calls of the tools the model must choose from
+	format := req.Format
+	if len(forced) > 0 {
+		format, err = m.toolCallSchema(forced, parallel)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support tool_choice: %v", req.Model, err)})
+			return
+		}
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1511,7 +1908,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
 	}
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools)
+	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, tools, req.Think)
 	if err != nil {
 		slog.Error("chat prompt error", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1520,23 +1917,31 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 	slog.Debug("chat request", "images", len(images), "prompt", prompt)
 
+	// thinking is still parsed when it is turned off so that models that
+	// think anyway don't leak it into the response
+	thinkOpen, thinkClose := m.thinkingTags()
+	thinkParser := newThinkingParser(thinkOpen, thinkClose, prompt)
+
+	// stream tool calls as they are generated
+	var toolsParser *toolParser
+	if len(tools) > 0 && (req.Stream == nil || *req.Stream) {
+		toolsParser = newToolParser(m, req.ToolCallDeltas)
+	}
+
+	requestID := c.Writer.Header().Get(requestIDHeader)
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		var sb strings.Builder
-		var toolCallIndex int = 0
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(r llm.CompletionResponse) {
+		var logprobs []api.Logprob
+		fn := func(r llm.CompletionResponse) {
 			res := api.ChatResponse{
-				Model:      req.Model,
-				CreatedAt:  time.Now().UTC(),
-				Message:    api.Message{Role: "assistant", Content: r.Content},
-				Done:       r.Done,
-				DoneReason: r.DoneReason,
+				Model:        req.Model,
+				CreatedAt:    time.Now().UTC(),
+				Message:      api.Message{Role: "assistant", Content: r.Content},
+				Done:         r.Done,
+				DoneReason:   r.DoneReason,
+				StopSequence: r.StopSequence,
+				Logprobs:     r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
@@ -1548,51 +1953,94 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			if r.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				observeTokens(c.Request.Context(), m.ShortName, res.Metrics)
 			}
 
-			// TODO: tool call checking and filtering should be moved outside of this callback once streaming
-			// however this was a simple change for now without reworking streaming logic of this (and other)
-			// handlers
-			if req.Stream != nil && !*req.Stream || len(req.Tools) == 0 {
+			if thinkParser == nil && toolsParser == nil {
+				// only the first response carries the request ID
+				res.RequestID, requestID = requestID, ""
 				ch <- res
 				return
 			}
 
-			// Streaming tool calls:
-			// If tools are recognized, use a flag to track the sending of a tool downstream
-			// This ensures that content is cleared from the message on the last chunk sent
-			sb.WriteString(r.Content)
-			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-				res.Message.ToolCalls = toolCalls
-				for i := range toolCalls {
-					toolCalls[i].Function.Index = toolCallIndex
-					toolCallIndex++
+			// text held back by the parsers is sent with the next chunk
+			// they let through, along with its logprobs
+			content := r.Content
+			var thinking string
+			if thinkParser != nil {
+				thinking, content = thinkParser.Add(content)
+				if r.Done {
+					t, c := thinkParser.Flush()
+					thinking += t
+					content += c
+				}
+
+				if req.Think != nil && !*req.Think {
+					thinking = ""
 				}
-				res.Message.Content = ""
-				sb.Reset()
-				ch <- res
-				return
 			}
 
-			if r.Done {
-				// Send any remaining content if no tool calls were detected
-				if toolCallIndex == 0 {
-					res.Message.Content = sb.String()
+			var toolCalls []api.ToolCall
+			if toolsParser != nil {
+				content, toolCalls = toolsParser.Add(content)
+				if r.Done {
+					content += toolsParser.Flush()
 				}
-				ch <- res
+
+				if !parallel {
+					// drop any calls after the first
+					toolCalls = slices.DeleteFunc(toolCalls, func(tc api.ToolCall) bool {
+						return tc.Function.Index > 0
+					})
+				}
+			}
+
+			logprobs = append(logprobs, r.Logprobs...)
+			if content == "" && thinking == "" && len(toolCalls) == 0 && !r.Done {
+				return
 			}
-		}); err != nil {
+
+			res.Message.Content = content
+			res.Message.Thinking = thinking
+			res.Message.ToolCalls = toolCalls
+			res.Logprobs = logprobs
+			logprobs = nil
+			res.RequestID, requestID = requestID, ""
+			ch <- res
+		}
+
+		ctx, cancel := generateContext(c.Request.Context())
+		defer cancel()
+
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      format,
+			Options:     opts,
+			Logprobs:    req.Logprobs || req.TopLogprobs > 0,
+			TopLogprobs: req.TopLogprobs,
+		}, fn); err != nil {
+			if timedOut(ctx) {
+				// finish with the output so far
+				fn(llm.CompletionResponse{Done: true, DoneReason: doneReasonTimeout})
+				return
+			}
+
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
-		var sb strings.Builder
+		var sb, thinking strings.Builder
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sb.WriteString(t.Message.Content)
+				thinking.WriteString(t.Message.Thinking)
+				logprobs = append(logprobs, t.Logprobs...)
+				t.RequestID = cmp.Or(resp.RequestID, t.RequestID)
 				resp = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1609,9 +2057,14 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 
 		resp.Message.Content = sb.String()
+		resp.Message.Thinking = thinking.String()
+		resp.Logprobs = logprobs
 
-		if len(req.Tools) > 0 {
+		if len(tools) > 0 {
 			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
+				if !parallel {
+					toolCalls = toolCalls[:1]
+				}
 				resp.Message.ToolCalls = toolCalls
 				resp.Message.Content = ""
 			}
@@ -1624,10 +2077,51 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// chooseTools returns the tools to offer the model for a tool choice, along
+// with those it must call one of, if any
+func chooseTools(tools []api.Tool, choice *api.ToolChoice) (offered, forced []api.Tool, err error) {
+	if choice == nil {
+		return tools, nil, nil
+	}
+
+	switch choice.Mode {
+	case api.ToolChoiceNone:
+		return nil, nil, nil
+	case api.ToolChoiceRequired:
+		if len(tools) == 0 {
+			return nil, nil, errors.New("tool_choice \"required\" requires tools")
+		}
+		return tools, tools, nil
+	case api.ToolChoiceFunction:
+		i := slices.IndexFunc(tools, func(t api.Tool) bool {
+			return t.Function.Name == choice.Function
+		})
+		if i < 0 {
+			return nil, nil, fmt.Errorf("tool_choice function %q is not in tools", choice.Function)
+		}
+		return tools, tools[i : i+1], nil
+	default:
+		return tools, nil, nil
+	}
+}
+
+// checkTopLogprobs validates the number of alternative tokens requested
+// with each generated token
+func checkTopLogprobs(n int) error {
+	if n < 0 || n > common.MaxTopLogprobs {
+		return fmt.Errorf("top_logprobs must be between 0 and %d", common.MaxTopLogprobs)
+	}
+	return nil
+}
+
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
+	case errors.Is(err, errCapabilities), errors.Is(err, errRequired), errors.Is(err, errBadDraft):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errRequestTimeout), timedOut(c.Request.Context()):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": errRequestTimeout.Error()})
+	case errors.Is(err, errQueueTimeout):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
 	case errors.Is(err, ErrMaxQueue):
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -46,8 +47,17 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ api.Options, _ int) (llm.LlamaServer, error) {
+func (mockRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	var words []string
+	for _, t := range tokens {
+		words = append(words, fmt.Sprintf("t%d", t))
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ string, _ api.Options, _ int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -372,17 +382,25 @@ func TestGenerateChat(t *testing.T) {
 						Type       string   `json:"type"`
 						Required   []string `json:"required"`
 						Properties map[string]struct {
-							Type        string   `json:"type"`
-							Description string   `json:"description"`
-							Enum        []string `json:"enum,omitempty"`
+							Type        string          `json:"type"`
+							Description string          `json:"description"`
+							Enum        []string        `json:"enum,omitempty"`
+							Items       json.RawMessage `json:"items,omitempty"`
+							Properties  json.RawMessage `json:"properties,omitempty"`
+							Required    []string        `json:"required,omitempty"`
+							AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 						} `json:"properties"`
 					}{
 						Type:     "object",
 						Required: []string{"location"},
 						Properties: map[string]struct {
-							Type        string   `json:"type"`
-							Description string   `json:"description"`
-							Enum        []string `json:"enum,omitempty"`
+							Type        string          `json:"type"`
+							Description string          `json:"description"`
+							Enum        []string        `json:"enum,omitempty"`
+							Items       json.RawMessage `json:"items,omitempty"`
+							Properties  json.RawMessage `json:"properties,omitempty"`
+							Required    []string        `json:"required,omitempty"`
+							AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 						}{
 							"location": {
 								Type:        "string",
@@ -443,7 +461,9 @@ func TestGenerateChat(t *testing.T) {
 			t.Error("expected tool calls, got nil")
 		}
 
+		// streamed calls are sent whole unless deltas are requested
 		expectedToolCall := api.ToolCall{
+			ID: resp.Message.ToolCalls[0].ID,
 			Function: api.ToolCallFunction{
 				Name: "get_weather",
 				Arguments: api.ToolCallFunctionArguments{
@@ -469,17 +489,25 @@ func TestGenerateChat(t *testing.T) {
 						Type       string   `json:"type"`
 						Required   []string `json:"required"`
 						Properties map[string]struct {
-							Type        string   `json:"type"`
-							Description string   `json:"description"`
-							Enum        []string `json:"enum,omitempty"`
+							Type        string          `json:"type"`
+							Description string          `json:"description"`
+							Enum        []string        `json:"enum,omitempty"`
+							Items       json.RawMessage `json:"items,omitempty"`
+							Properties  json.RawMessage `json:"properties,omitempty"`
+							Required    []string        `json:"required,omitempty"`
+							AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 						} `json:"properties"`
 					}{
 						Type:     "object",
 						Required: []string{"location"},
 						Properties: map[string]struct {
-							Type        string   `json:"type"`
-							Description string   `json:"description"`
-							Enum        []string `json:"enum,omitempty"`
+							Type        string          `json:"type"`
+							Description string          `json:"description"`
+							Enum        []string        `json:"enum,omitempty"`
+							Items       json.RawMessage `json:"items,omitempty"`
+							Properties  json.RawMessage `json:"properties,omitempty"`
+							Required    []string        `json:"required,omitempty"`
+							AnyOf       json.RawMessage `json:"anyOf,omitempty"`
 						}{
 							"location": {
 								Type:        "string",
@@ -586,6 +614,343 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("messages with tools (streaming deltas)", func(t *testing.T) {
+		defer func() { mock.CompletionFn = nil }()
+
+		chat := func(t *testing.T, incremental bool, chunks ...string) (content string, deltas []api.ToolCall) {
+			t.Helper()
+
+			mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+				for _, chunk := range chunks {
+					fn(llm.CompletionResponse{Content: chunk})
+				}
+				fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+				return nil
+			}
+
+			streamed := true
+			no := false
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:             "test-system",
+				Messages:          []api.Message{{Role: "user", Content: "What's the weather in Seattle?"}},
+				Tools:             []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}},
+				ParallelToolCalls: &no,
+				ToolCallDeltas:    incremental,
+				Stream:            &streamed,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var sb strings.Builder
+			decoder := json.NewDecoder(w.Body)
+			for {
+				var resp api.ChatResponse
+				if err := decoder.Decode(&resp); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				sb.WriteString(resp.Message.Content)
+				deltas = append(deltas, resp.Message.ToolCalls...)
+			}
+
+			return sb.String(), deltas
+		}
+
+		content, deltas := chat(t, true, `{"name":"get_`, `weather","arguments":{"location":"Sea`, `ttle, WA"}}`, `{"name": "get_time", "arguments": {}}`)
+		if content != "" {
+			t.Errorf("expected no content, got %q", content)
+		}
+
+		// the call starts with its id and name, then its arguments follow as
+		// they are generated until it is complete; the second call is dropped
+		if len(deltas) != 2 {
+			t.Fatalf("expected 2 tool call deltas, got %+v", deltas)
+		}
+
+		if diff := cmp.Diff(deltas, []api.ToolCall{
+			{
+				ID:       deltas[0].ID,
+				Function: api.ToolCallFunction{Name: "get_weather", ArgumentsDelta: `{"location":"Sea`},
+			},
+			{
+				ID: deltas[0].ID,
+				Function: api.ToolCallFunction{
+					Name:           "get_weather",
+					Arguments:      api.ToolCallFunctionArguments{"location": "Seattle, WA"},
+					ArgumentsDelta: `ttle, WA"}`,
+				},
+			},
+		}); diff != "" {
+			t.Errorf("tool call deltas mismatch (-got +want):\n%s", diff)
+		}
+
+		if !strings.HasPrefix(deltas[0].ID, "call_") {
+			t.Errorf("unexpected tool call id %q", deltas[0].ID)
+		}
+
+		// the test template has no prefix, so calls are only recognized at
+		// the start of a response
+		content, deltas = chat(t, true, `Checking. {"name":"get_`, `weather","arguments":{}}`)
+		if content != `Checking. {"name":"get_weather","arguments":{}}` || len(deltas) != 0 {
+			t.Errorf("expected content without tool calls, got %q and %+v", content, deltas)
+		}
+
+		// by default, each call is sent once, when it is complete
+		content, deltas = chat(t, false, `{"name":"get_`, `weather","arguments":{"location":"Sea`, `ttle, WA"}}`)
+		if content != "" || len(deltas) != 1 {
+			t.Fatalf("expected one tool call, got %q and %+v", content, deltas)
+		}
+
+		if diff := cmp.Diff(deltas, []api.ToolCall{{
+			ID: deltas[0].ID,
+			Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"location": "Seattle, WA"},
+			},
+		}}); diff != "" {
+			t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("thinking", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: "test-think",
+			From:  "test",
+			Template: `
+{{- range .Messages }}{{ .Role }}: {{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}
+{{ end }}
+{{- if and .IsThinkSet (not .Think) }}/no_think{{ end }}`,
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:    "<think>\nThe user greets me.\n</think>\n\nHello!",
+			Done:       true,
+			DoneReason: "stop",
+		}
+
+		think := false
+		cases := []struct {
+			name     string
+			think    *bool
+			prompt   string
+			thinking string
+			content  string
+		}{
+			{"default", nil, "user: Hi\n", "The user greets me.", "Hello!"},
+			{"off", &think, "user: Hi\n/no_think", "", "Hello!"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test-think",
+					Messages: []api.Message{
+						{Role: "user", Content: "Hi"},
+					},
+					Think:  tt.think,
+					Stream: &stream,
+				})
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.prompt); diff != "" {
+					t.Errorf("prompt mismatch (-got +want):\n%s", diff)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Message.Thinking != tt.thinking || resp.Message.Content != tt.content {
+					t.Errorf("expected thinking %q and content %q, got %q and %q", tt.thinking, tt.content, resp.Message.Thinking, resp.Message.Content)
+				}
+			})
+		}
+
+		t.Run("unsupported", func(t *testing.T) {
+			think := true
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Hi"}},
+				Think:    &think,
+				Stream:   &stream,
+			})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), "does not support thinking") {
+				t.Errorf("expected a thinking error, got %s", w.Body.String())
+			}
+		})
+	})
+
+	t.Run("tool choice", func(t *testing.T) {
+		mock.CompletionFn = nil
+
+		var tools []api.Tool
+		if err := json.Unmarshal([]byte(`[
+			{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "required": ["location"], "properties": {"location": {"type": "string"}}}}},
+			{"type": "function", "function": {"name": "get_time", "parameters": {"type": "object", "properties": {}}}}
+		]`), &tools); err != nil {
+			t.Fatal(err)
+		}
+
+		chat := func(t *testing.T, content string, choice *api.ToolChoice, parallel *bool) api.ChatResponse {
+			t.Helper()
+
+			mock.CompletionResponse = llm.CompletionResponse{Content: content, Done: true, DoneReason: "stop"}
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:             "test-system",
+				Messages:          []api.Message{{Role: "user", Content: "What's the weather in Paris?"}},
+				Tools:             tools,
+				ToolChoice:        choice,
+				ParallelToolCalls: parallel,
+				Stream:            &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		calls := `[{"name": "get_weather", "arguments": {"location": "Paris"}}, {"name": "get_time", "arguments": {}}]`
+		no := false
+
+		t.Run("none", func(t *testing.T) {
+			resp := chat(t, calls, &api.ToolChoice{Mode: api.ToolChoiceNone}, nil)
+			if strings.Contains(mock.CompletionRequest.Prompt, "get_weather") {
+				t.Errorf("expected tools to be left out of the prompt, got %q", mock.CompletionRequest.Prompt)
+			}
+			if len(resp.Message.ToolCalls) != 0 || resp.Message.Content != calls {
+				t.Errorf("expected content without tool calls, got %+v", resp.Message)
+			}
+		})
+
+		t.Run("auto", func(t *testing.T) {
+			resp := chat(t, calls, &api.ToolChoice{Mode: api.ToolChoiceAuto}, nil)
+			if mock.CompletionRequest.Format != nil {
+				t.Errorf("expected no format, got %s", mock.CompletionRequest.Format)
+			}
+			if len(resp.Message.ToolCalls) != 2 {
+				t.Errorf("expected 2 tool calls, got %+v", resp.Message.ToolCalls)
+			}
+		})
+
+		t.Run("auto without parallel calls", func(t *testing.T) {
+			resp := chat(t, calls, nil, &no)
+			if len(resp.Message.ToolCalls) != 1 || resp.Message.ToolCalls[0].Function.Name != "get_weather" {
+				t.Errorf("expected only the first tool call, got %+v", resp.Message.ToolCalls)
+			}
+		})
+
+		t.Run("required", func(t *testing.T) {
+			resp := chat(t, calls, &api.ToolChoice{Mode: api.ToolChoiceRequired}, nil)
+			if len(resp.Message.ToolCalls) != 2 {
+				t.Errorf("expected 2 tool calls, got %+v", resp.Message.ToolCalls)
+			}
+
+			var schema struct {
+				Type  string `json:"type"`
+				Items struct {
+					AnyOf []struct {
+						Properties struct {
+							Name struct {
+								Const string `json:"const"`
+							} `json:"name"`
+						} `json:"properties"`
+					} `json:"anyOf"`
+				} `json:"items"`
+			}
+			if err := json.Unmarshal(mock.CompletionRequest.Format, &schema); err != nil {
+				t.Fatalf("expected a schema, got %q: %v", mock.CompletionRequest.Format, err)
+			}
+			if schema.Type != "array" || len(schema.Items.AnyOf) != 2 || schema.Items.AnyOf[1].Properties.Name.Const != "get_time" {
+				t.Errorf("unexpected schema %s", mock.CompletionRequest.Format)
+			}
+		})
+
+		t.Run("function", func(t *testing.T) {
+			resp := chat(t, `{"name": "get_time", "arguments": {}}`, &api.ToolChoice{Mode: api.ToolChoiceFunction, Function: "get_time"}, &no)
+			if len(resp.Message.ToolCalls) != 1 || resp.Message.ToolCalls[0].Function.Name != "get_time" {
+				t.Errorf("expected a call to get_time, got %+v", resp.Message.ToolCalls)
+			}
+
+			want := `{"type":"object","properties":{"name":{"const":"get_time"},"arguments":{"properties":{},"type":"object"}},"required":["name","arguments"]}`
+			if diff := cmp.Diff(string(mock.CompletionRequest.Format), want); diff != "" {
+				t.Errorf("schema mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("nested", func(t *testing.T) {
+			var nested []api.Tool
+			if err := json.Unmarshal([]byte(`[
+				{"type": "function", "function": {"name": "add_stops", "parameters": {"type": "object", "properties": {"stops": {"type": "array", "items": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}}}}}}
+			]`), &nested); err != nil {
+				t.Fatal(err)
+			}
+
+			mock.CompletionResponse = llm.CompletionResponse{Content: `{"name": "add_stops", "arguments": {"stops": [{"city": "Paris"}]}}`, Done: true, DoneReason: "stop"}
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:             "test-system",
+				Messages:          []api.Message{{Role: "user", Content: "Plan a trip"}},
+				Tools:             nested,
+				ToolChoice:        &api.ToolChoice{Mode: api.ToolChoiceRequired},
+				ParallelToolCalls: &no,
+				Stream:            &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			want := `{"type":"object","properties":{"name":{"const":"add_stops"},"arguments":{"properties":{"stops":{"items":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]},"type":"array"}},"type":"object"}},"required":["name","arguments"]}`
+			if diff := cmp.Diff(string(mock.CompletionRequest.Format), want); diff != "" {
+				t.Errorf("schema mismatch (-got +want):\n%s", diff)
+			}
+		})
+
+		t.Run("errors", func(t *testing.T) {
+			cases := []struct {
+				tools  []api.Tool
+				choice api.ToolChoice
+				err    string
+			}{
+				{tools, api.ToolChoice{Mode: api.ToolChoiceFunction, Function: "get_stock"}, `tool_choice function "get_stock" is not in tools`},
+				{nil, api.ToolChoice{Mode: api.ToolChoiceRequired}, `tool_choice "required" requires tools`},
+			}
+
+			for _, tt := range cases {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:      "test-system",
+					Messages:   []api.Message{{Role: "user", Content: "Hello"}},
+					Tools:      tt.tools,
+					ToolChoice: &tt.choice,
+					Stream:     &stream,
+				})
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("expected status 400, got %d", w.Code)
+				}
+				if diff := cmp.Diff(w.Body.String(), `{"error":"`+strings.ReplaceAll(tt.err, `"`, `\"`)+`"}`); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			}
+		})
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -959,4 +1324,83 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+	t.Run("logprobs", func(t *testing.T) {
+		logprobs := []api.Logprob{{TokenLogprob: api.TokenLogprob{Token: "Hi!", Logprob: -0.25}}}
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!", Logprobs: logprobs, Done: true, DoneReason: "stop"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			TopLogprobs: 5,
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Logprobs || mock.CompletionRequest.TopLogprobs != 5 {
+			t.Errorf("expected logprobs with 5 alternatives, got %v and %d", mock.CompletionRequest.Logprobs, mock.CompletionRequest.TopLogprobs)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(logprobs, resp.Logprobs); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi"})
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Timeout: &api.Duration{Duration: 50 * time.Millisecond},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the output so far is returned
+		if resp.Response != "Hi" || !resp.Done || resp.DoneReason != "timeout" {
+			t.Errorf("expected partial response ending with timeout, got %q %v %q", resp.Response, resp.Done, resp.DoneReason)
+		}
+	})
+
+	t.Run("top logprobs out of range", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			TopLogprobs: 21,
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"top_logprobs must be between 0 and 20"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
 }
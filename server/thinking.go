@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/template"
+)
+
+// thinkingTags returns the tags the template wraps an assistant's thinking
+// in, such as "<think>" and "</think>". They are empty if the template does
+// not render thinking.
+func thinkingTags(tmpl *template.Template) (open, close string) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, template.Values{
+		Messages: []api.Message{
+			{Role: "user", Content: "@@user@@"},
+			{Role: "assistant", Thinking: "@@thinking@@", Content: "@@content@@"},
+		},
+		Think:      true,
+		IsThinkSet: true,
+	}); err != nil {
+		return "", ""
+	}
+
+	before, after, ok := strings.Cut(b.String(), "@@thinking@@")
+	if !ok {
+		return "", ""
+	}
+
+	// the tags are the bracketed text or words on either side of the
+	// thinking
+	before = strings.TrimRightFunc(before, unicode.IsSpace)
+	switch {
+	case strings.HasSuffix(before, ">") && strings.Contains(before, "<"):
+		open = before[strings.LastIndex(before, "<"):]
+	case strings.HasSuffix(before, "]") && strings.Contains(before, "["):
+		open = before[strings.LastIndex(before, "["):]
+	default:
+		open = before[strings.LastIndexFunc(before, unicode.IsSpace)+1:]
+	}
+
+	after, _, _ = strings.Cut(after, "@@content@@")
+	after = strings.TrimLeftFunc(after, unicode.IsSpace)
+	switch {
+	case strings.HasPrefix(after, "<") && strings.Contains(after, ">"):
+		close = after[:strings.Index(after, ">")+1]
+	case strings.HasPrefix(after, "[") && strings.Contains(after, "]"):
+		close = after[:strings.Index(after, "]")+1]
+	default:
+		if fields := strings.Fields(after); len(fields) > 0 {
+			close = fields[0]
+		}
+	}
+
+	if open == "" || close == "" || strings.Contains(open, "@@") {
+		return "", ""
+	}
+
+	return open, close
+}
+
+// modelThinkingTags caches the thinking tags of models by digest so the
+// template is only rendered to find them once per model
+var modelThinkingTags sync.Map
+
+// thinkingTags returns the thinking tags of the model's template
+func (m *Model) thinkingTags() (open, close string) {
+	if m.Digest == "" {
+		return thinkingTags(m.Template)
+	}
+
+	if tags, ok := modelThinkingTags.Load(m.Digest); ok {
+		tags := tags.([2]string)
+		return tags[0], tags[1]
+	}
+
+	open, close = thinkingTags(m.Template)
+	modelThinkingTags.Store(m.Digest, [2]string{open, close})
+	return open, close
+}
+
+type thinkingState int
+
+const (
+	// thinkingStart is before the response shows whether it opens with
+	// thinking
+	thinkingStart thinkingState = iota
+	// thinkingOpened is just after the opening tag, where whitespace is
+	// dropped
+	thinkingOpened
+	thinkingIn
+	// thinkingClosed is just after the closing tag, where whitespace is
+	// dropped
+	thinkingClosed
+	thinkingDone
+)
+
+// thinkingParser separates a model's thinking from the rest of its response
+// as it is generated. Thinking is only recognized at the start of the
+// response.
+type thinkingParser struct {
+	open, close string
+
+	state thinkingState
+	// text that may be part of a tag
+	buf string
+}
+
+// newThinkingParser returns a parser for the thinking tags open and close,
+// or nil if there are none. If the prompt ends with the opening tag, the
+// response starts inside the thinking.
+func newThinkingParser(open, close, prompt string) *thinkingParser {
+	if open == "" {
+		return nil
+	}
+
+	p := &thinkingParser{open: open, close: close}
+	if strings.HasSuffix(strings.TrimRightFunc(prompt, unicode.IsSpace), open) {
+		p.state = thinkingOpened
+	}
+
+	return p
+}
+
+// Add parses the next piece of generated text and returns the thinking and
+// content in it.
+func (p *thinkingParser) Add(s string) (thinking, content string) {
+	p.buf += s
+	for {
+		switch p.state {
+		case thinkingStart:
+			trimmed := strings.TrimLeftFunc(p.buf, unicode.IsSpace)
+			if strings.HasPrefix(trimmed, p.open) {
+				p.buf = trimmed[len(p.open):]
+				p.state = thinkingOpened
+			} else if strings.HasPrefix(p.open, trimmed) {
+				return thinking, content
+			} else {
+				p.state = thinkingDone
+			}
+		case thinkingOpened, thinkingClosed:
+			p.buf = strings.TrimLeftFunc(p.buf, unicode.IsSpace)
+			if p.buf == "" {
+				return thinking, content
+			}
+
+			if p.state == thinkingOpened {
+				p.state = thinkingIn
+			} else {
+				p.state = thinkingDone
+			}
+		case thinkingIn:
+			if i := strings.Index(p.buf, p.close); i >= 0 {
+				thinking += strings.TrimRightFunc(p.buf[:i], unicode.IsSpace)
+				p.buf = p.buf[i+len(p.close):]
+				p.state = thinkingClosed
+				continue
+			}
+
+			// hold back the start of the closing tag and whitespace that
+			// may come before it
+			n := len(strings.TrimRightFunc(p.buf[:len(p.buf)-overlap(p.buf, p.close)], unicode.IsSpace))
+			thinking += p.buf[:n]
+			p.buf = p.buf[n:]
+			return thinking, content
+		case thinkingDone:
+			content += p.buf
+			p.buf = ""
+			return thinking, content
+		}
+	}
+}
+
+// Flush returns the text held back once generation is done.
+func (p *thinkingParser) Flush() (thinking, content string) {
+	s := p.buf
+	p.buf = ""
+	switch p.state {
+	case thinkingIn:
+		return strings.TrimRightFunc(s, unicode.IsSpace), ""
+	case thinkingStart, thinkingDone:
+		return "", s
+	}
+
+	return "", ""
+}
+
+// overlap returns the length of the longest suffix of s that is a prefix
+// of delim, such as the start of a tag that is still being generated
+func overlap(s, delim string) int {
+	for n := min(len(s), len(delim)-1); n > 0; n-- {
+		if strings.HasSuffix(s, delim[:n]) {
+			return n
+		}
+	}
+	return 0
+}
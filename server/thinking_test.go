@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/qompassai/rose/template"
+)
+
+func TestThinkingTags(t *testing.T) {
+	cases := []struct {
+		template    string
+		open, close string
+	}{
+		{
+			template: `{{ range .Messages }}<|{{ .Role }}|>{{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}{{ end }}`,
+			open:     "<think>",
+			close:    "</think>",
+		},
+		{
+			template: "{{ range .Messages }}{{ .Role }}:\n{{ if .Thinking }}[THINK]\n{{ .Thinking }}\n[/THINK]\n\n{{ end }}{{ .Content }}\n{{ end }}",
+			open:     "[THINK]",
+			close:    "[/THINK]",
+		},
+		{
+			template: `{{ range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}`,
+		},
+		{
+			template: `{{ .Prompt }}`,
+		},
+	}
+
+	for _, tt := range cases {
+		tmpl, err := template.Parse(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		open, close := thinkingTags(tmpl)
+		if open != tt.open || close != tt.close {
+			t.Errorf("%s: expected tags %q and %q, got %q and %q", tt.template, tt.open, tt.close, open, close)
+		}
+	}
+}
+
+func TestThinkingParser(t *testing.T) {
+	tmpl, err := template.Parse(`{{ range .Messages }}{{ .Role }}: {{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open, close := thinkingTags(tmpl)
+
+	cases := []struct {
+		name     string
+		prompt   string
+		output   string
+		thinking string
+		content  string
+	}{
+		{
+			name:     "thinking",
+			output:   "<think>\nI should greet them.\n</think>\n\nHello there!",
+			thinking: "I should greet them.",
+			content:  "Hello there!",
+		},
+		{
+			name:     "leading whitespace",
+			output:   "\n <think>Hmm, < and </thin are not tags. </think>Hi",
+			thinking: "Hmm, < and </thin are not tags.",
+			content:  "Hi",
+		},
+		{
+			name:    "no thinking",
+			output:  "Hello <think>there</think>",
+			content: "Hello <think>there</think>",
+		},
+		{
+			name:    "partial tag",
+			output:  " <thin",
+			content: " <thin",
+		},
+		{
+			name:     "unfinished",
+			output:   "<think>Let me see\n",
+			thinking: "Let me see",
+		},
+		{
+			name:     "opened in prompt",
+			prompt:   "user: Hi\nassistant: <think>\n",
+			output:   "Greeting.</think>Hello!",
+			thinking: "Greeting.",
+			content:  "Hello!",
+		},
+	}
+
+	for _, tt := range cases {
+		for _, size := range []int{1, 2, 5, len(tt.output)} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, size), func(t *testing.T) {
+				p := newThinkingParser(open, close, tt.prompt)
+				if p == nil {
+					t.Fatal("expected a parser")
+				}
+
+				var thinking, content string
+				for i := 0; i < len(tt.output); i += size {
+					th, c := p.Add(tt.output[i:min(i+size, len(tt.output))])
+					thinking += th
+					content += c
+				}
+
+				th, c := p.Flush()
+				thinking += th
+				content += c
+
+				if thinking != tt.thinking || content != tt.content {
+					t.Errorf("expected thinking %q and content %q, got %q and %q", tt.thinking, tt.content, thinking, content)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/envconfig"
+)
+
+var (
+	// errQueueTimeout is returned when a request waits in the queue for
+	// longer than ROSE_QUEUE_TIMEOUT
+	errQueueTimeout = errors.New("timed out waiting in the queue")
+	// errRequestTimeout is the cause of a request ending because its
+	// timeout passed
+	errRequestTimeout = errors.New("request timed out")
+	// errGenerateTimeout is the cause of generation ending because it ran
+	// for longer than ROSE_GENERATE_TIMEOUT
+	errGenerateTimeout = errors.New("generation timed out")
+)
+
+// doneReasonTimeout is the done reason of responses cut short by a timeout
+const doneReasonTimeout = "timeout"
+
+// withTimeout sets the deadline of a request from its timeout field, if it
+// has one. The returned function releases the deadline's resources and must
+// be called when the request is done.
+func withTimeout(c *gin.Context, timeout *api.Duration) context.CancelFunc {
+	if timeout == nil || timeout.Duration <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithTimeoutCause(c.Request.Context(), timeout.Duration, errRequestTimeout)
+	c.Request = c.Request.WithContext(ctx)
+	return cancel
+}
+
+// generateContext returns a context for generating a response, which ends
+// after ROSE_GENERATE_TIMEOUT if it is set. Ending the context stops the
+// request's sequence in the runner.
+func generateContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := envconfig.GenerateTimeout(); d > 0 {
+		return context.WithTimeoutCause(ctx, d, errGenerateTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// timedOut reports whether ctx ended because the request's timeout or the
+// generate timeout passed, rather than the client going away
+func timedOut(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return errors.Is(cause, errRequestTimeout) || errors.Is(cause, errGenerateTimeout)
+}
+
+// queueTimer returns a channel that receives when a request has waited in
+// the queue for d, or nil if d is not positive, and a function to stop the
+// timer
+func queueTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	if d <= 0 {
+		return nil, func() bool { return false }
+	}
+
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
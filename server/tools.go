@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/template"
+)
+
+// toolCallPrefix returns the text the model's template writes before tool
+// calls, such as "[TOOL_CALLS]" or "<tool_call>". It is empty if tool calls
+// start directly with JSON.
+func (m *Model) toolCallPrefix() string {
+	tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "@@name@@"}}}
+	render := func(msg api.Message) string {
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, template.Values{
+			Messages: []api.Message{{Role: "user", Content: "@@user@@"}, msg},
+			Tools:    tools,
+		}); err != nil {
+			return ""
+		}
+		return b.String()
+	}
+
+	// the assistant's turn starts where a response with content and one
+	// with tool calls first differ
+	content := render(api.Message{Role: "assistant", Content: "@@content@@"})
+	calls := render(api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{
+		Function: api.ToolCallFunction{
+			Name:      "@@name@@",
+			Arguments: api.ToolCallFunctionArguments{"@@argument@@": 1},
+		},
+	}}})
+
+	var start int
+	for start < len(content) && start < len(calls) && content[start] == calls[start] {
+		start++
+	}
+
+	end := strings.Index(calls[start:], `"@@name@@"`)
+	if end < 0 {
+		return ""
+	}
+
+	prefix := calls[start : start+end]
+	if i := strings.IndexByte(prefix, '{'); i >= 0 {
+		prefix = prefix[:i]
+	}
+
+	// opening brackets of an array of calls are parsed with the calls
+	prefix = strings.TrimRight(prefix, " \t\r\n[")
+	return strings.TrimSpace(prefix)
+}
+
+// toolParser separates tool calls from content as a response is generated,
+// so calls can be streamed while the model writes them. Calls are JSON
+// objects with the name and arguments keys of the model's template, either
+// following the template's tool call prefix or starting the response.
+type toolParser struct {
+	prefix    string
+	name      string
+	arguments string
+
+	// send calls as they are generated rather than once they are complete
+	incremental bool
+
+	// content that could be the start of the prefix
+	pending string
+	started bool
+	calling bool
+
+	// buf holds the text since tool calls started
+	buf      []byte
+	inString bool
+	escape   bool
+	strStart int
+	stack    []*toolFrame
+
+	calls []*toolFrame
+	// calls with changes that have not been returned yet
+	open []*toolFrame
+}
+
+// toolFrame is an object or array being parsed. Objects with the name key
+// are tool calls.
+type toolFrame struct {
+	object bool
+	start  int
+
+	key     string
+	inValue bool
+
+	// offsets of the arguments value in buf
+	argsStart, argsEnd int
+
+	call     bool
+	index    int
+	id       string
+	name     string
+	sent     bool
+	emitted  int
+	done     bool
+	complete map[string]any
+}
+
+func newToolParser(m *Model, incremental bool) *toolParser {
+	name, arguments, ok := m.toolCallKeys()
+	if !ok {
+		return nil
+	}
+
+	return &toolParser{
+		prefix:      m.toolCallPrefix(),
+		name:        name,
+		arguments:   arguments,
+		incremental: incremental,
+	}
+}
+
+// Add parses the next piece of generated text, returning the content to
+// show and the tool calls completed in it. When the parser is incremental,
+// it returns deltas instead: the first delta for a call carries its id and
+// name, later ones fragments of its arguments, and the one that completes
+// it the parsed arguments along with its id and name.
+func (p *toolParser) Add(s string) (string, []api.ToolCall) {
+	if p.calling {
+		p.parse(s)
+		return "", p.deltas()
+	}
+
+	s = p.pending + s
+	p.pending = ""
+
+	if !p.started {
+		trimmed := strings.TrimLeft(s, " \t\r\n")
+		if trimmed == "" {
+			p.pending = s
+			return "", nil
+		}
+
+		p.started = true
+		if trimmed[0] == '{' || trimmed[0] == '[' {
+			p.calling = true
+			p.parse(s)
+			return "", p.deltas()
+		}
+	}
+
+	if p.prefix == "" {
+		return s, nil
+	}
+
+	if i := strings.Index(s, p.prefix); i >= 0 {
+		p.calling = true
+		p.buf = append(p.buf, p.prefix...)
+		p.parse(s[i+len(p.prefix):])
+		return s[:i], p.deltas()
+	}
+
+	// hold back text that may be the start of the prefix
+	n := overlap(s, p.prefix)
+	p.pending = s[len(s)-n:]
+	return s[:len(s)-n], nil
+}
+
+// Flush returns any content held back once generation is done, including
+// text that looked like tool calls but turned out not to be.
+func (p *toolParser) Flush() string {
+	content := p.pending
+	p.pending = ""
+	if p.calling && len(p.calls) == 0 {
+		content += string(p.buf)
+		p.buf = nil
+	}
+	return content
+}
+
+func (p *toolParser) parse(s string) {
+	for i := range len(s) {
+		p.buf = append(p.buf, s[i])
+		p.step(len(p.buf) - 1)
+	}
+}
+
+func (p *toolParser) top() *toolFrame {
+	if len(p.stack) == 0 {
+		return nil
+	}
+	return p.stack[len(p.stack)-1]
+}
+
+func (p *toolParser) step(pos int) {
+	c := p.buf[pos]
+	top := p.top()
+
+	if p.inString {
+		switch {
+		case p.escape:
+			p.escape = false
+		case c == '\\':
+			p.escape = true
+		case c == '"':
+			p.inString = false
+			if top != nil && top.object {
+				var str string
+				if err := json.Unmarshal(p.buf[p.strStart:pos+1], &str); err != nil {
+					return
+				}
+
+				if !top.inValue {
+					top.key = str
+				} else if top.key == p.name && !p.inCall() {
+					p.startCall(top, str)
+				}
+			}
+		}
+		return
+	}
+
+	switch c {
+	case '"':
+		if top != nil {
+			p.inString = true
+			p.strStart = pos
+		}
+	case '{', '[':
+		if top != nil && top.object && top.inValue && top.key == p.arguments && top.argsStart < 0 {
+			top.argsStart = pos
+		}
+		p.stack = append(p.stack, &toolFrame{object: c == '{', start: pos, argsStart: -1, argsEnd: -1})
+	case '}', ']':
+		if top == nil {
+			return
+		}
+
+		p.stack = p.stack[:len(p.stack)-1]
+		if parent := p.top(); parent != nil && parent.argsStart == top.start {
+			parent.argsEnd = pos + 1
+		}
+
+		if top.call {
+			var obj map[string]any
+			if err := json.Unmarshal(p.buf[top.start:pos+1], &obj); err == nil {
+				top.complete, _ = obj[p.arguments].(map[string]any)
+			}
+			top.done = true
+		}
+	case ':':
+		if top != nil && top.object {
+			top.inValue = true
+		}
+	case ',':
+		if top != nil && top.object {
+			top.inValue = false
+			top.key = ""
+		}
+	}
+}
+
+// inCall reports whether parsing is inside a tool call, where objects are
+// arguments rather than calls
+func (p *toolParser) inCall() bool {
+	for _, f := range p.stack {
+		if f.call {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *toolParser) startCall(f *toolFrame, name string) {
+	f.call = true
+	f.name = name
+	f.index = len(p.calls)
+	f.id = toolCallID()
+	p.calls = append(p.calls, f)
+	p.open = append(p.open, f)
+}
+
+// deltas returns the changes to calls since it was last called, or only
+// the calls completed since then if the parser isn't incremental
+func (p *toolParser) deltas() []api.ToolCall {
+	var deltas []api.ToolCall
+	open := p.open[:0]
+	for _, f := range p.open {
+		tc := api.ToolCall{Function: api.ToolCallFunction{Index: f.index}}
+		if p.incremental && !f.sent {
+			tc.ID = f.id
+			tc.Function.Name = f.name
+			f.sent = true
+		}
+
+		if p.incremental && f.argsStart >= 0 {
+			end := len(p.buf)
+			if f.argsEnd >= 0 {
+				end = f.argsEnd
+			}
+
+			start := max(f.emitted, f.argsStart)
+			if end > start {
+				tc.Function.ArgumentsDelta = string(p.buf[start:end])
+				f.emitted = end
+			}
+		}
+
+		if f.done {
+			tc.ID = f.id
+			tc.Function.Name = f.name
+			tc.Function.Arguments = f.complete
+			if tc.Function.Arguments == nil {
+				tc.Function.Arguments = api.ToolCallFunctionArguments{}
+			}
+		} else {
+			open = append(open, f)
+		}
+
+		if tc.ID != "" || tc.Function.ArgumentsDelta != "" {
+			deltas = append(deltas, tc)
+		}
+	}
+
+	p.open = open
+	return deltas
+}
+
+func toolCallID() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = letters[rand.IntN(len(letters))]
+	}
+	return "call_" + string(b)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/qompassai/rose/api"
+	"github.com/qompassai/rose/template"
+)
+
+func TestToolCallPrefix(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+	cases := map[string]string{
+		"mistral":              "[TOOL_CALLS]",
+		"command-r-plus":       "Action: ```json",
+		"firefunction":         "functools",
+		"llama3-groq-tool-use": "<tool_call>",
+		"xlam":                 "",
+		"nemotron":             "<toolcall>",
+	}
+
+	for model, want := range cases {
+		t.Run(model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			if got := m.toolCallPrefix(); got != want {
+				t.Errorf("expected prefix %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestToolParser(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+	calls := []api.ToolCall{
+		{
+			Function: api.ToolCallFunction{
+				Index: 0,
+				Name:  "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "fahrenheit",
+					"location": "San Francisco, CA",
+				},
+			},
+		},
+		{
+			Function: api.ToolCallFunction{
+				Index: 1,
+				Name:  "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "celsius",
+					"location": "Toronto, Canada",
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		model   string
+		output  string
+		content string
+		calls   []api.ToolCall
+	}{
+		{
+			name:   "prefix",
+			model:  "mistral",
+			output: `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`,
+			calls:  calls,
+		},
+		{
+			name:    "content before prefix",
+			model:   "llama3-groq-tool-use",
+			output:  "Let me check.\n<tool_call>\n{\"name\": \"get_current_weather\", \"arguments\": {\"format\":\"fahrenheit\",\"location\":\"San Francisco, CA\"}}\n</tool_call>",
+			content: "Let me check.\n",
+			calls:   calls[:1],
+		},
+		{
+			name:   "nested calls",
+			model:  "xlam",
+			output: `{"tool_calls": [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]}`,
+			calls:  calls,
+		},
+		{
+			name:   "keys",
+			model:  "command-r-plus",
+			output: "Action: ```json\n[\n    {\n        \"tool_name\": \"get_current_weather\",\n        \"parameters\": {\n            \"format\": \"fahrenheit\",\n            \"location\": \"San Francisco, CA\"\n        }\n    }\n]\n```",
+			calls:  calls[:1],
+		},
+		{
+			name:    "content",
+			model:   "mistral",
+			output:  "The weather in San Francisco, CA is 70°F. Use [brackets] and {braces} freely.",
+			content: "The weather in San Francisco, CA is 70°F. Use [brackets] and {braces} freely.",
+		},
+		{
+			name:    "partial prefix",
+			model:   "nemotron",
+			output:  "Use <tool to call tools",
+			content: "Use <tool to call tools",
+		},
+		{
+			name:    "not a call",
+			model:   "xlam",
+			output:  `{"answer": 42}`,
+			content: `{"answer": 42}`,
+		},
+		{
+			name:   "name in arguments",
+			model:  "mistral",
+			output: `[TOOL_CALLS] [{"name": "greet", "arguments": {"name": "Ada", "options": {"loud": true}}}]`,
+			calls: []api.ToolCall{{
+				Function: api.ToolCallFunction{
+					Name:      "greet",
+					Arguments: api.ToolCallFunctionArguments{"name": "Ada", "options": map[string]any{"loud": true}},
+				},
+			}},
+		},
+	}
+
+	for _, tt := range cases {
+		tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", tt.model)).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &Model{Template: tmpl}
+
+		// feed the output in pieces of every size to check calls do not
+		// depend on where chunks are split
+		for _, size := range []int{1, 2, 3, 7, len(tt.output)} {
+			for _, incremental := range []bool{true, false} {
+				t.Run(fmt.Sprintf("%s/%d/incremental=%t", tt.name, size, incremental), func(t *testing.T) {
+					parser := newToolParser(m, incremental)
+					if parser == nil {
+						t.Fatal("expected a parser")
+					}
+
+					var content strings.Builder
+					var deltas []api.ToolCall
+					for i := 0; i < len(tt.output); i += size {
+						c, tcs := parser.Add(tt.output[i:min(i+size, len(tt.output))])
+						content.WriteString(c)
+						deltas = append(deltas, tcs...)
+					}
+					content.WriteString(parser.Flush())
+
+					if content.String() != tt.content {
+						t.Errorf("expected content %q, got %q", tt.content, content.String())
+					}
+
+					// rebuild the calls from the deltas
+					var got []api.ToolCall
+					arguments := make(map[int]string)
+					ids := make(map[int]string)
+					for _, d := range deltas {
+						i := d.Function.Index
+						arguments[i] += d.Function.ArgumentsDelta
+
+						if d.ID != "" {
+							if ids[i] != "" && ids[i] != d.ID {
+								t.Errorf("call %d: id changed from %s to %s", i, ids[i], d.ID)
+							}
+							ids[i] = d.ID
+						}
+
+						if d.Function.Arguments != nil {
+							got = append(got, api.ToolCall{Function: api.ToolCallFunction{
+								Index:     i,
+								Name:      d.Function.Name,
+								Arguments: d.Function.Arguments,
+							}})
+						}
+					}
+
+					if diff := cmp.Diff(got, tt.calls); diff != "" {
+						t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+					}
+
+					if len(deltas) > 0 && (deltas[0].Function.Name == "" || deltas[0].ID == "") {
+						t.Errorf("expected the first delta to have an id and name, got %+v", deltas[0])
+					}
+
+					if !incremental {
+						// calls are only sent once they are complete
+						for _, d := range deltas {
+							if d.Function.Arguments == nil || d.Function.ArgumentsDelta != "" {
+								t.Errorf("expected only complete calls, got %+v", d)
+							}
+						}
+					}
+
+					for i, call := range got {
+						if !strings.HasPrefix(ids[i], "call_") {
+							t.Errorf("call %d: unexpected id %q", i, ids[i])
+						}
+
+						if !incremental {
+							continue
+						}
+
+						// the streamed arguments are the JSON the model wrote
+						var args api.ToolCallFunctionArguments
+						if err := json.Unmarshal([]byte(arguments[i]), &args); err != nil {
+							t.Fatalf("call %d: invalid streamed arguments %q: %v", i, arguments[i], err)
+						}
+						if diff := cmp.Diff(args, call.Function.Arguments); diff != "" {
+							t.Errorf("call %d: streamed arguments mismatch (-got +want):\n%s", i, diff)
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qompassai/rose/tracing"
+)
+
+// traceRequest is middleware that starts a span for a request, continuing
+// the trace of the caller if it sent one
+func traceRequest(c *gin.Context) {
+	ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+	ctx, span := tracing.Start(ctx, c.Request.Method+" "+c.FullPath(),
+		tracing.Attr("http.request.method", c.Request.Method),
+		tracing.Attr("http.route", c.FullPath()),
+	)
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(
+		tracing.Attr("http.response.status_code", status),
+		tracing.Attr("rose.request_id", c.Writer.Header().Get(requestIDHeader)),
+	)
+
+	if rm := requestMetricsFromContext(c.Request.Context()); rm != nil {
+		rm.mu.Lock()
+		span.SetAttributes(tracing.Attr("model", rm.model))
+		rm.mu.Unlock()
+	}
+
+	var err error
+	if status >= http.StatusInternalServerError {
+		err = fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+	span.End(err)
+}
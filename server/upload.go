@@ -356,6 +356,7 @@ func (p *progressWriter) Write(b []byte) (n int, err error) {
 	n = len(b)
 	p.written += int64(n)
 	p.Completed.Add(int64(n))
+	metricPushBytes.add(float64(n))
 	return n, nil
 }
 
@@ -168,6 +168,11 @@ type Values struct {
 	Prompt string
 	Suffix string
 
+	// Think asks the model to reason before it answers, if IsThinkSet.
+	// Templates can use these to turn thinking on or off
+	Think      bool
+	IsThinkSet bool
+
 	// forceLegacy is a flag used to test compatibility with legacy templates
 	forceLegacy bool
 }
@@ -228,10 +233,12 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 		})
 	} else if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
 		return t.Template.Execute(w, map[string]any{
-			"System":   system,
-			"Messages": messages,
-			"Tools":    v.Tools,
-			"Response": "",
+			"System":     system,
+			"Messages":   messages,
+			"Tools":      v.Tools,
+			"Think":      v.Think,
+			"IsThinkSet": v.IsThinkSet,
+			"Response":   "",
 		})
 	}
 
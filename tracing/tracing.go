@@ -0,0 +1,191 @@
+// Package tracing records spans for the work done to serve a request and
+// exports them to an OpenTelemetry collector with OTLP over HTTP. Spans are
+// only recorded after [Init] is called, so tracing costs nothing when it is
+// off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// span kinds, as defined by OTLP
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+// Attribute is a key and a value describing a span. Values are strings,
+// integers, floats or bools.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Attr returns an attribute with a key and value
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// flagSampled is the trace flag set when the caller records the trace
+const flagSampled = 0x01
+
+// spanContext identifies a span, so other spans can be its children
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+	remote  bool
+}
+
+type spanContextKey struct{}
+
+// Span is an operation in a trace. A nil *Span is valid and does nothing,
+// which is what [Start] returns when tracing is off.
+type Span struct {
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []Attribute
+	err   error
+	ended bool
+}
+
+var current atomic.Pointer[exporter]
+
+// Enabled reports whether spans are being recorded
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// Start starts a span as a child of the span in ctx, if any, and returns a
+// context with the new span
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	return StartAt(ctx, name, time.Now(), attrs...)
+}
+
+// StartAt starts a span that began at a time in the past, for work whose
+// start was recorded before its span could be
+func StartAt(ctx context.Context, name string, start time.Time, attrs ...Attribute) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+
+	span := &Span{
+		name:  name,
+		kind:  kindInternal,
+		start: start,
+		attrs: attrs,
+	}
+
+	// spans of a new trace are always recorded, while those continuing a
+	// trace keep the flags the trace started with
+	flags := byte(flagSampled)
+	parent, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		flags = parent.flags
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+
+	if !ok || parent.remote {
+		// the span is where a request enters this process
+		span.kind = kindServer
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, spanContext{traceID: span.traceID, spanID: span.spanID, flags: flags}), span
+}
+
+// SetAttributes adds attributes to a span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// End ends a span, recording err as its status if it is not nil
+func (s *Span) End(err error) {
+	s.EndAt(time.Now(), err)
+}
+
+// EndAt ends a span at a time in the past
+func (s *Span) EndAt(end time.Time, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.end = end
+	s.err = err
+	s.ended = true
+	s.mu.Unlock()
+
+	if e := current.Load(); e != nil {
+		e.add(s)
+	}
+}
+
+// Inject adds the W3C traceparent header for the span in ctx to h, so a
+// request to another process continues the trace
+func Inject(ctx context.Context, h http.Header) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if !ok {
+		return
+	}
+
+	h.Set("traceparent", "00-"+hex.EncodeToString(sc.traceID[:])+"-"+hex.EncodeToString(sc.spanID[:])+"-"+hex.EncodeToString([]byte{sc.flags}))
+}
+
+// Extract returns a context continuing the trace in the W3C traceparent
+// header of h, if it has one
+func Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(h.Get("traceparent"), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+
+	var sc spanContext
+	if n, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || n != len(sc.traceID) {
+		return ctx
+	}
+
+	if n, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || n != len(sc.spanID) {
+		return ctx
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return ctx
+	}
+	sc.flags = flags[0]
+
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return ctx
+	}
+
+	sc.remote = true
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
@@ -0,0 +1,160 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartDisabled(t *testing.T) {
+	ctx, span := Start(t.Context(), "test")
+	if span != nil {
+		t.Fatal("expected no span when tracing is off")
+	}
+
+	// a nil span is safe to use
+	span.SetAttributes(Attr("key", "value"))
+	span.End(errors.New("failed"))
+
+	h := http.Header{}
+	Inject(ctx, h)
+	if got := h.Get("traceparent"); got != "" {
+		t.Errorf("expected no traceparent, got %q", got)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	sc := spanContext{flags: flagSampled}
+	copy(sc.traceID[:], []byte("0123456789abcdef"))
+	copy(sc.spanID[:], []byte("01234567"))
+	ctx := context.WithValue(t.Context(), spanContextKey{}, sc)
+
+	h := http.Header{}
+	Inject(ctx, h)
+
+	want := "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-01"
+	if got := h.Get("traceparent"); got != want {
+		t.Fatalf("expected traceparent %q, got %q", want, got)
+	}
+
+	got, ok := Extract(t.Context(), h).Value(spanContextKey{}).(spanContext)
+	if !ok {
+		t.Fatal("expected span context")
+	}
+
+	if got.traceID != sc.traceID || got.spanID != sc.spanID || got.flags != sc.flags || !got.remote {
+		t.Errorf("unexpected span context %+v", got)
+	}
+
+	// the flags of a trace the caller doesn't record are passed on unchanged
+	unsampled := http.Header{"Traceparent": {"00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-00"}}
+	h = http.Header{}
+	Inject(Extract(t.Context(), unsampled), h)
+	if got, want := h.Get("traceparent"), unsampled.Get("traceparent"); got != want {
+		t.Errorf("expected traceparent %q, got %q", want, got)
+	}
+
+	for _, v := range []string{
+		"",
+		"garbage",
+		"01-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-01",
+		"00-0123-" + hex.EncodeToString(sc.spanID[:]) + "-01",
+		"00-" + hex.EncodeToString(sc.traceID[:]) + "-zz-01",
+		"00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-1",
+		"00-00000000000000000000000000000000-" + hex.EncodeToString(sc.spanID[:]) + "-01",
+	} {
+		h := http.Header{"Traceparent": {v}}
+		if _, ok := Extract(t.Context(), h).Value(spanContextKey{}).(spanContext); ok {
+			t.Errorf("expected %q to be ignored", v)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	var mu sync.Mutex
+	var requests []otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	shutdown := Init(srv.URL, "test")
+
+	// continue a trace from another process
+	remote := http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}
+	ctx, parent := Start(Extract(t.Context(), remote), "parent", Attr("count", 3))
+	_, child := StartAt(ctx, "child", time.Now().Add(-time.Second))
+	child.End(errors.New("failed"))
+	parent.End(nil)
+
+	if err := shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if Enabled() {
+		t.Error("expected tracing to be off after shutdown")
+	}
+
+	var spans []otlpSpan
+	for _, req := range requests {
+		for _, rs := range req.ResourceSpans {
+			if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != "test" {
+				t.Errorf("unexpected service name %v", rs.Resource.Attributes)
+			}
+
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	c, p := spans[0], spans[1]
+	if p.Name != "parent" || c.Name != "child" {
+		t.Fatalf("unexpected spans %s, %s", c.Name, p.Name)
+	}
+
+	if p.TraceID != "0af7651916cd43dd8448eb211c80319c" || c.TraceID != p.TraceID {
+		t.Errorf("expected spans to continue the remote trace, got %s and %s", p.TraceID, c.TraceID)
+	}
+
+	if p.ParentSpanID != "b7ad6b7169203331" || c.ParentSpanID != p.SpanID {
+		t.Errorf("unexpected parents %s and %s", p.ParentSpanID, c.ParentSpanID)
+	}
+
+	if p.Kind != kindServer || c.Kind != kindInternal {
+		t.Errorf("unexpected kinds %d and %d", p.Kind, c.Kind)
+	}
+
+	if p.Status != nil {
+		t.Errorf("expected parent to succeed, got %+v", p.Status)
+	}
+
+	if c.Status == nil || c.Status.Code != 2 || c.Status.Message != "failed" {
+		t.Errorf("expected child to fail, got %+v", c.Status)
+	}
+
+	if v := p.Attributes[0].Value.IntValue; p.Attributes[0].Key != "count" || v == nil || *v != "3" {
+		t.Errorf("unexpected attributes %+v", p.Attributes)
+	}
+}